@@ -184,6 +184,18 @@ type Adapter interface {
 	FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.FileDef, error)
 	// FileGet fetches a record of a specific file
 	FileGet(fid string) (*t.FileDef, error)
+	// FileGetAll fetches records of the files with the given IDs. Missing files are skipped.
+	FileGetAll(fids []string) ([]t.FileDef, error)
+	// FileList returns records of completed uploads with IDs greater than 'after' ordered by ID.
+	// Use empty 'after' to start from the beginning.
+	FileList(after string, limit int) ([]t.FileDef, error)
+	// FileCountDownload increments the number of downloads of the file unless it has reached the download limit.
+	// Returns the number of downloads including this one, or 0 if the limit is reached or the file has no limit.
+	FileCountDownload(fid string) (int, error)
+	// FileMarkVariantsFailed records that generating the variants of the file failed permanently.
+	FileMarkVariantsFailed(fid string) error
+	// FileUsedBytesByPrefix returns the total size of completed uploads with locations starting with the prefix.
+	FileUsedBytesByPrefix(prefix string) (int64, error)
 	// FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
 	// unused records with UpdatedAt before olderThan.
 	// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
@@ -343,6 +343,8 @@ func initFileDefs(now time.Time, users []*types.User) []*types.FileDef {
 		User:     users[0].Id,
 		Location: "uploads/asdf.txt",
 		Size:     654321,
+		// Downloaded only twice.
+		DownloadLimit: 2,
 	})
 	files[0].SetUid(types.Uid(1001))
 	files[1].SetUid(types.Uid(1002))
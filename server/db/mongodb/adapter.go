@@ -8,6 +8,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"regexp"
 	"slices"
 	"sort"
 	"strconv"
@@ -39,7 +40,7 @@ type adapter struct {
 }
 
 const (
-	adpVersion  = 116
+	adpVersion  = 120
 	adapterName = "mongodb"
 
 	defaultHost     = "localhost:27017"
@@ -427,6 +428,11 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "fileuploads",
 			Field:      "usecount",
 		},
+		// Index on 'fileuploads.location' to sum sizes of files by location prefix.
+		{
+			Collection: "fileuploads",
+			Field:      "location",
+		},
 	}
 
 	var err error
@@ -564,6 +570,40 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 116 {
+		// Version 117: fileuploads.downloadlimit and fileuploads.downloads added. Missing values are zero.
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Version 118: fileuploads.variantsfailed added. Missing values are false.
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Version 119: fileuploads.originallocation added. Missing values are empty.
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Perform database upgrade from version 119 to version 120.
+
+		// Create secondary index on location to sum sizes of files by location prefix.
+		if _, err := a.db.Collection("fileuploads").Indexes().CreateOne(a.ctx, mdb.IndexModel{Keys: b.M{"location": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -2816,6 +2856,9 @@ func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
 // FileStartUpload initializes a file upload
 func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 	_, err := a.db.Collection("fileuploads").InsertOne(a.ctx, fd)
+	if isDuplicateErr(err) {
+		return t.ErrDuplicate
+	}
 	return err
 }
 
@@ -2832,6 +2875,8 @@ func (a *adapter) FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.
 				"size":      size,
 				"etag":      fd.ETag,
 				"location":  fd.Location,
+				// Set if the unprocessed original is kept.
+				"originallocation": fd.OriginalLocation,
 			}}); err != nil {
 
 			return nil, err
@@ -2866,6 +2911,99 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	return &fd, nil
 }
 
+// FileGetAll fetches records of the files with the given IDs. Missing files are skipped.
+func (a *adapter) FileGetAll(fids []string) ([]t.FileDef, error) {
+	if len(fids) == 0 {
+		return nil, nil
+	}
+	cur, err := a.db.Collection("fileuploads").Find(a.ctx, b.M{"_id": b.M{"$in": fids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var fds []t.FileDef
+	if err := cur.All(a.ctx, &fds); err != nil {
+		return nil, err
+	}
+	return fds, nil
+}
+
+// FileCountDownload increments the number of downloads of the file unless it has reached the download
+// limit. Returns the number of downloads including this one, or 0 if the limit is reached, the file has
+// no limit or is not found.
+func (a *adapter) FileCountDownload(fid string) (int, error) {
+	var fd t.FileDef
+	err := a.db.Collection("fileuploads").FindOneAndUpdate(a.ctx,
+		b.M{
+			"_id":           fid,
+			"downloadlimit": b.M{"$gt": 0},
+			"$expr":         b.M{"$lt": b.A{b.M{"$ifNull": b.A{"$downloads", 0}}, "$downloadlimit"}},
+		},
+		b.M{"$inc": b.M{"downloads": 1}},
+		mdbopts.FindOneAndUpdate().SetReturnDocument(mdbopts.After)).Decode(&fd)
+	if err == mdb.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fd.Downloads, nil
+}
+
+// FileMarkVariantsFailed records that generating the variants of the file failed permanently.
+func (a *adapter) FileMarkVariantsFailed(fid string) error {
+	_, err := a.db.Collection("fileuploads").UpdateOne(a.ctx,
+		b.M{"_id": fid},
+		b.M{"$set": b.M{"variantsfailed": true}})
+	return err
+}
+
+// FileUsedBytesByPrefix returns the total size of completed uploads with locations starting with the prefix.
+func (a *adapter) FileUsedBytesByPrefix(prefix string) (int64, error) {
+	pipeline := b.A{
+		b.M{"$match": b.M{"status": t.UploadCompleted, "location": b.M{"$regex": "^" + regexp.QuoteMeta(prefix)}}},
+		b.M{"$group": b.M{"_id": nil, "used": b.M{"$sum": "$size"}}},
+	}
+	cur, err := a.db.Collection("fileuploads").Aggregate(a.ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(a.ctx)
+
+	var res []struct {
+		Used int64 `bson:"used"`
+	}
+	if err := cur.All(a.ctx, &res); err != nil || len(res) == 0 {
+		return 0, err
+	}
+	return res[0].Used, nil
+}
+
+// FileList returns records of completed uploads with IDs greater than 'after' ordered by ID.
+func (a *adapter) FileList(after string, limit int) ([]t.FileDef, error) {
+	findOpts := mdbopts.Find().SetSort(b.D{{"_id", 1}})
+	if limit > 0 {
+		findOpts.SetLimit(int64(limit))
+	}
+	filter := b.M{"status": t.UploadCompleted}
+	if after != "" {
+		filter["_id"] = b.M{"$gt": after}
+	}
+
+	cur, err := a.db.Collection("fileuploads").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var fds []t.FileDef
+	if err := cur.All(a.ctx, &fds); err != nil {
+		return nil, err
+	}
+	return fds, nil
+}
+
 // FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
 // unused records with UpdatedAt before olderThan.
 // Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
@@ -878,6 +878,111 @@ func TestFileFinishUpload(t *testing.T) {
 	}
 }
 
+func TestFileList(t *testing.T) {
+	// Only the first file is completed by TestFileFinishUpload().
+	got, err := adp.FileList("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatal(mismatchErrorString("Files length", len(got), 1))
+	}
+	if got[0].Id != testData.Files[0].Id {
+		t.Error(mismatchErrorString("Id", got[0].Id, testData.Files[0].Id))
+	}
+	if got[0].Status != types.UploadCompleted {
+		t.Error(mismatchErrorString("Status", got[0].Status, types.UploadCompleted))
+	}
+
+	got, err = adp.FileList(testData.Files[0].Id, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Error(mismatchErrorString("Files after last", len(got), 0))
+	}
+}
+
+func TestFileGetAll(t *testing.T) {
+	// The last ID is not a known file.
+	got, err := adp.FileGetAll([]string{testData.Files[0].Id, testData.Files[1].Id, types.Uid(987654321).String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatal(mismatchErrorString("Files length", len(got), 2))
+	}
+	for _, fd := range got {
+		if fd.Id != testData.Files[0].Id && fd.Id != testData.Files[1].Id {
+			t.Error("Unexpected file", fd.Id)
+		}
+	}
+}
+
+func TestFileCountDownload(t *testing.T) {
+	for _, expected := range []int{1, 2, 0, 0} {
+		count, err := adp.FileCountDownload(testData.Files[1].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Error(mismatchErrorString("Downloads", count, expected))
+		}
+	}
+	// Files without a limit are not counted.
+	count, err := adp.FileCountDownload(testData.Files[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error(mismatchErrorString("Unlimited download", count, 0))
+	}
+}
+
+func TestFileMarkVariantsFailed(t *testing.T) {
+	err := adp.FileMarkVariantsFailed(testData.Files[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := adp.FileGet(testData.Files[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd == nil || !fd.VariantsFailed {
+		t.Error("Variants not marked as failed")
+	}
+}
+
+func TestFileOriginalLocation(t *testing.T) {
+	fd := *testData.Files[0]
+	fd.OriginalLocation = "originals/" + fd.Location
+	if _, err := adp.FileFinishUpload(&fd, true, fd.Size); err != nil {
+		t.Fatal(err)
+	}
+	got, err := adp.FileGet(fd.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.OriginalLocation != fd.OriginalLocation {
+		t.Error("Location of the original not recorded")
+	}
+}
+
+func TestFileUsedBytesByPrefix(t *testing.T) {
+	// Only the first file is completed by TestFileFinishUpload().
+	for prefix, expected := range map[string]int64{"uploads/": 22222, "uploads/asdf": 0, "other/": 0,
+		// Wildcards of LIKE patterns are matched literally.
+		"upload_/": 0, "upload%": 0} {
+		used, err := adp.FileUsedBytesByPrefix(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != expected {
+			t.Error(mismatchErrorString("Used bytes of "+prefix, used, expected))
+		}
+	}
+}
+
 // ================== Other tests =================================
 func TestDeviceGetAll(t *testing.T) {
 	uid0 := types.ParseUserId("usr" + testData.Users[0].Id)
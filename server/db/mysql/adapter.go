@@ -41,7 +41,7 @@ type adapter struct {
 }
 
 const (
-	adpVersion  = 116
+	adpVersion  = 120
 	adapterName = "mysql"
 
 	defaultDSN      = "root:@tcp(localhost:3306)/tinode?parseTime=true"
@@ -534,8 +534,13 @@ func (a *adapter) CreateDb(reset bool) error {
 			size      BIGINT NOT NULL,
 			etag      VARCHAR(128),
 			location  VARCHAR(2048) NOT NULL,
+			downloadlimit INT NOT NULL DEFAULT 0,
+			downloads     INT NOT NULL DEFAULT 0,
+			variantsfailed TINYINT NOT NULL DEFAULT 0,
+			originallocation VARCHAR(2048) NOT NULL DEFAULT '',
 			PRIMARY KEY(id),
-			INDEX fileuploads_status(status)
+			INDEX fileuploads_status(status),
+			INDEX fileuploads_location(location(255))
 		)`); err != nil {
 		return err
 	}
@@ -825,6 +830,59 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+
+		// Add limits of the number of downloads of files.
+		if _, err := a.db.Exec("ALTER TABLE fileuploads ADD downloadlimit INT NOT NULL DEFAULT 0 AFTER location, " +
+			"ADD downloads INT NOT NULL DEFAULT 0 AFTER downloadlimit"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Perform database upgrade from version 117 to version 118.
+
+		// Add the flag of files with permanently failed variants.
+		if _, err := a.db.Exec("ALTER TABLE fileuploads ADD variantsfailed TINYINT NOT NULL DEFAULT 0 AFTER downloads"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Perform database upgrade from version 118 to version 119.
+
+		// Add the location of the kept unprocessed originals of files.
+		if _, err := a.db.Exec("ALTER TABLE fileuploads ADD originallocation VARCHAR(2048) NOT NULL DEFAULT '' AFTER variantsfailed"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Perform database upgrade from version 119 to version 120.
+
+		// Index for sums of sizes of files by location prefix.
+		if _, err := a.db.Exec("ALTER TABLE fileuploads ADD INDEX fileuploads_location(location(255))"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -3348,10 +3406,13 @@ func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 		user = 0
 	}
 	_, err := a.db.ExecContext(ctx,
-		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,etag,location) "+
-			"VALUES(?,?,?,?,?,?,?,?,?)",
+		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,etag,location,downloadlimit) "+
+			"VALUES(?,?,?,?,?,?,?,?,?,?)",
 		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
-		fd.Status, fd.MimeType, fd.Size, fd.ETag, fd.Location)
+		fd.Status, fd.MimeType, fd.Size, fd.ETag, fd.Location, fd.DownloadLimit)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
 	return err
 }
 
@@ -3373,8 +3434,8 @@ func (a *adapter) FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.
 
 	now := t.TimeNow()
 	if success {
-		_, err = tx.ExecContext(ctx, "UPDATE fileuploads SET updatedat=?,status=?,size=?,etag=?,location=? WHERE id=?",
-			now, t.UploadCompleted, size, fd.ETag, fd.Location, store.DecodeUid(fd.Uid()))
+		_, err = tx.ExecContext(ctx, "UPDATE fileuploads SET updatedat=?,status=?,size=?,etag=?,location=?,originallocation=? WHERE id=?",
+			now, t.UploadCompleted, size, fd.ETag, fd.Location, fd.OriginalLocation, store.DecodeUid(fd.Uid()))
 		if err != nil {
 			return nil, err
 		}
@@ -3408,7 +3469,7 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 		defer cancel()
 	}
 	var fd t.FileDef
-	err := a.db.GetContext(ctx, &fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,IFNULL(etag,'') AS etag,location "+
+	err := a.db.GetContext(ctx, &fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,IFNULL(etag,'') AS etag,location,downloadlimit,downloads,variantsfailed,originallocation "+
 		"FROM fileuploads WHERE id=?", store.DecodeUid(id))
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -3423,6 +3484,145 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	return &fd, nil
 }
 
+// FileGetAll fetches records of the files with the given IDs. Missing files are skipped.
+func (a *adapter) FileGetAll(fids []string) ([]t.FileDef, error) {
+	if len(fids) == 0 {
+		return nil, nil
+	}
+	ids := make([]any, len(fids))
+	for i, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return nil, t.ErrMalformed
+		}
+		ids[i] = store.DecodeUid(id)
+	}
+
+	query, args, _ := sqlx.In("SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,IFNULL(etag,'') AS etag,location,downloadlimit,downloads,variantsfailed,originallocation "+
+		"FROM fileuploads WHERE id IN (?)", ids)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var fds []t.FileDef
+	if err := a.db.SelectContext(ctx, &fds, query, args...); err != nil {
+		return nil, err
+	}
+
+	for i := range fds {
+		fds[i].Id = common.EncodeUidString(fds[i].Id).String()
+		fds[i].User = common.EncodeUidString(fds[i].User).String()
+	}
+	return fds, nil
+}
+
+// FileCountDownload increments the number of downloads of the file unless it has reached the download
+// limit. Returns the number of downloads including this one, or 0 if the limit is reached, the file has
+// no limit or is not found.
+func (a *adapter) FileCountDownload(fid string) (int, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return 0, t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, "UPDATE fileuploads SET downloads=downloads+1 "+
+		"WHERE id=? AND downloadlimit>0 AND downloads<downloadlimit", store.DecodeUid(id))
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	if updated, _ := res.RowsAffected(); updated > 0 {
+		// The row stays locked until the transaction is committed.
+		if err = tx.GetContext(ctx, &count, "SELECT downloads FROM fileuploads WHERE id=?", store.DecodeUid(id)); err != nil {
+			return 0, err
+		}
+	}
+	return count, tx.Commit()
+}
+
+// FileMarkVariantsFailed records that generating the variants of the file failed permanently.
+func (a *adapter) FileMarkVariantsFailed(fid string) error {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx, "UPDATE fileuploads SET variantsfailed=1 WHERE id=?", store.DecodeUid(id))
+	return err
+}
+
+// FileUsedBytesByPrefix returns the total size of completed uploads with locations starting with the prefix.
+func (a *adapter) FileUsedBytesByPrefix(prefix string) (int64, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var used int64
+	err := a.db.GetContext(ctx, &used, "SELECT IFNULL(SUM(size),0) FROM fileuploads WHERE status=? AND location LIKE ? ESCAPE '!'",
+		t.UploadCompleted, likePrefix(prefix))
+	return used, err
+}
+
+// likePrefix returns the LIKE pattern of strings starting with the prefix, with '!' as the escape character.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+}
+
+// FileList returns records of completed uploads with IDs greater than 'after' ordered by ID.
+func (a *adapter) FileList(after string, limit int) ([]t.FileDef, error) {
+	query := "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,IFNULL(etag,'') AS etag,location,downloadlimit,downloads,variantsfailed,originallocation " +
+		"FROM fileuploads WHERE status=?"
+	args := []any{t.UploadCompleted}
+	if after != "" {
+		id := t.ParseUid(after)
+		if id.IsZero() {
+			return nil, t.ErrMalformed
+		}
+		query += " AND id>?"
+		args = append(args, store.DecodeUid(id))
+	}
+	query += " ORDER BY id"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var fds []t.FileDef
+	if err := a.db.SelectContext(ctx, &fds, query, args...); err != nil {
+		return nil, err
+	}
+
+	for i := range fds {
+		fds[i].Id = common.EncodeUidString(fds[i].Id).String()
+		fds[i].User = common.EncodeUidString(fds[i].User).String()
+	}
+
+	return fds, nil
+}
+
 // FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
 // unused records with UpdatedAt before olderThan.
 // Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
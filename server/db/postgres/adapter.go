@@ -47,7 +47,7 @@ type adapter struct {
 }
 
 const (
-	adpVersion  = 116
+	adpVersion  = 120
 	adapterName = "postgres"
 
 	defaultMaxResults = 1024
@@ -561,9 +561,14 @@ func (a *adapter) CreateDb(reset bool) error {
 			size      BIGINT NOT NULL,
 			etag      VARCHAR(128),
 			location  VARCHAR(2048) NOT NULL,
+			downloadlimit INT NOT NULL DEFAULT 0,
+			downloads     INT NOT NULL DEFAULT 0,
+			variantsfailed BOOLEAN NOT NULL DEFAULT FALSE,
+			originallocation VARCHAR(2048) NOT NULL DEFAULT '',
 			PRIMARY KEY(id)
 		);
-		CREATE INDEX fileuploads_status ON fileuploads(status);`); err != nil {
+		CREATE INDEX fileuploads_status ON fileuploads(status);
+		CREATE INDEX fileuploads_location ON fileuploads(location varchar_pattern_ops);`); err != nil {
 		return err
 	}
 
@@ -700,6 +705,59 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+
+		// Add limits of the number of downloads of files.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE fileuploads ADD downloadlimit INT NOT NULL DEFAULT 0, "+
+			"ADD downloads INT NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Perform database upgrade from version 117 to version 118.
+
+		// Add the flag of files with permanently failed variants.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE fileuploads ADD variantsfailed BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Perform database upgrade from version 118 to version 119.
+
+		// Add the location of the kept unprocessed originals of files.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE fileuploads ADD originallocation VARCHAR(2048) NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Perform database upgrade from version 119 to version 120.
+
+		// Index for sums of sizes of files by location prefix.
+		if _, err := a.db.Exec(ctx, "CREATE INDEX fileuploads_location ON fileuploads(location varchar_pattern_ops)"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -3314,10 +3372,13 @@ func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 		user = store.DecodeUid(t.ParseUid(fd.User))
 	}
 	_, err := a.db.Exec(ctx,
-		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,etag,location) "+
-			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)",
+		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,etag,location,downloadlimit) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)",
 		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
-		fd.Status, fd.MimeType, fd.Size, fd.ETag, fd.Location)
+		fd.Status, fd.MimeType, fd.Size, fd.ETag, fd.Location, fd.DownloadLimit)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
 	return err
 }
 
@@ -3339,8 +3400,8 @@ func (a *adapter) FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.
 
 	now := t.TimeNow()
 	if success {
-		_, err = tx.Exec(ctx, "UPDATE fileuploads SET updatedat=$1,status=$2,size=$3,etag=$4,location=$5 WHERE id=$6",
-			now, t.UploadCompleted, size, fd.ETag, fd.Location, store.DecodeUid(fd.Uid()))
+		_, err = tx.Exec(ctx, "UPDATE fileuploads SET updatedat=$1,status=$2,size=$3,etag=$4,location=$5,originallocation=$6 WHERE id=$7",
+			now, t.UploadCompleted, size, fd.ETag, fd.Location, fd.OriginalLocation, store.DecodeUid(fd.Uid()))
 		if err != nil {
 			return nil, err
 		}
@@ -3376,9 +3437,10 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	var fd t.FileDef
 	var ID int64
 	var userId int64
-	err := a.db.QueryRow(ctx, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,etag,location "+
+	err := a.db.QueryRow(ctx, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,etag,location,downloadlimit,downloads,variantsfailed,originallocation "+
 		"FROM fileuploads WHERE id=$1", store.DecodeUid(id)).Scan(&ID, &fd.CreatedAt, &fd.UpdatedAt, &userId, &fd.Status,
-		&fd.MimeType, &fd.Size, &fd.ETag, &fd.Location)
+		&fd.MimeType, &fd.Size, &fd.ETag, &fd.Location, &fd.DownloadLimit, &fd.Downloads, &fd.VariantsFailed,
+		&fd.OriginalLocation)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -3392,6 +3454,152 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	return &fd, nil
 }
 
+// FileGetAll fetches records of the files with the given IDs. Missing files are skipped.
+func (a *adapter) FileGetAll(fids []string) ([]t.FileDef, error) {
+	if len(fids) == 0 {
+		return nil, nil
+	}
+	ids := make([]any, len(fids))
+	for i, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return nil, t.ErrMalformed
+		}
+		ids[i] = store.DecodeUid(id)
+	}
+
+	query, args := expandQuery("SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,etag,location,downloadlimit,downloads,variantsfailed,originallocation "+
+		"FROM fileuploads WHERE id IN (?)", ids)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fds []t.FileDef
+	for rows.Next() {
+		var fd t.FileDef
+		var id int64
+		var userId int64
+		if err = rows.Scan(&id, &fd.CreatedAt, &fd.UpdatedAt, &userId, &fd.Status,
+			&fd.MimeType, &fd.Size, &fd.ETag, &fd.Location, &fd.DownloadLimit, &fd.Downloads, &fd.VariantsFailed,
+			&fd.OriginalLocation); err != nil {
+			return nil, err
+		}
+		fd.Id = store.EncodeUid(id).String()
+		fd.User = store.EncodeUid(userId).String()
+		fds = append(fds, fd)
+	}
+
+	return fds, rows.Err()
+}
+
+// FileCountDownload increments the number of downloads of the file unless it has reached the download
+// limit. Returns the number of downloads including this one, or 0 if the limit is reached, the file has
+// no limit or is not found.
+func (a *adapter) FileCountDownload(fid string) (int, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return 0, t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var count int
+	err := a.db.QueryRow(ctx, "UPDATE fileuploads SET downloads=downloads+1 "+
+		"WHERE id=$1 AND downloadlimit>0 AND downloads<downloadlimit RETURNING downloads", store.DecodeUid(id)).Scan(&count)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
+
+// FileMarkVariantsFailed records that generating the variants of the file failed permanently.
+func (a *adapter) FileMarkVariantsFailed(fid string) error {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "UPDATE fileuploads SET variantsfailed=TRUE WHERE id=$1", store.DecodeUid(id))
+	return err
+}
+
+// FileUsedBytesByPrefix returns the total size of completed uploads with locations starting with the prefix.
+func (a *adapter) FileUsedBytesByPrefix(prefix string) (int64, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var used int64
+	err := a.db.QueryRow(ctx, "SELECT COALESCE(SUM(size),0) FROM fileuploads WHERE status=$1 AND location LIKE $2 ESCAPE '!'",
+		t.UploadCompleted, likePrefix(prefix)).Scan(&used)
+	return used, err
+}
+
+// likePrefix returns the LIKE pattern of strings starting with the prefix, with '!' as the escape character.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+}
+
+// FileList returns records of completed uploads with IDs greater than 'after' ordered by ID.
+func (a *adapter) FileList(after string, limit int) ([]t.FileDef, error) {
+	query := "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,etag,location,downloadlimit,downloads,variantsfailed,originallocation " +
+		"FROM fileuploads WHERE status=$1"
+	args := []any{t.UploadCompleted}
+	if after != "" {
+		id := t.ParseUid(after)
+		if id.IsZero() {
+			return nil, t.ErrMalformed
+		}
+		args = append(args, store.DecodeUid(id))
+		query += " AND id>$" + strconv.Itoa(len(args))
+	}
+	query += " ORDER BY id"
+	if limit > 0 {
+		args = append(args, limit)
+		query += " LIMIT $" + strconv.Itoa(len(args))
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fds []t.FileDef
+	for rows.Next() {
+		var fd t.FileDef
+		var id int64
+		var userId int64
+		if err = rows.Scan(&id, &fd.CreatedAt, &fd.UpdatedAt, &userId, &fd.Status,
+			&fd.MimeType, &fd.Size, &fd.ETag, &fd.Location, &fd.DownloadLimit, &fd.Downloads, &fd.VariantsFailed,
+			&fd.OriginalLocation); err != nil {
+			return nil, err
+		}
+		fd.Id = store.EncodeUid(id).String()
+		fd.User = store.EncodeUid(userId).String()
+		fds = append(fds, fd)
+	}
+
+	return fds, rows.Err()
+}
+
 // FileDeleteUnused deletes file upload records.
 func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
 	ctx, cancel := a.getContextForTx()
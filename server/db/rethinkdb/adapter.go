@@ -7,10 +7,12 @@ import (
 	"encoding/json"
 	"errors"
 	"hash/fnv"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/db/common"
@@ -32,7 +34,7 @@ type adapter struct {
 }
 
 const (
-	adpVersion  = 116
+	adpVersion  = 120
 	adapterName = "rethinkdb"
 
 	defaultHost     = "localhost:28015"
@@ -390,6 +392,10 @@ func (a *adapter) CreateDb(reset bool) error {
 	if _, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreate("UseCount").RunWrite(a.conn); err != nil {
 		return err
 	}
+	// A secondary index on fileuploads.Location to sum sizes of files by location prefix.
+	if _, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreate("Location").RunWrite(a.conn); err != nil {
+		return err
+	}
 
 	// Record current DB version.
 	if _, err := rdb.DB(a.dbName).Table("kvmeta").Insert(
@@ -559,6 +565,40 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 116 {
+		// Version 117: fileuploads.DownloadLimit and fileuploads.Downloads added. Missing values are zero.
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Version 118: fileuploads.VariantsFailed added. Missing values are false.
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Version 119: fileuploads.OriginalLocation added. Missing values are empty.
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Perform database upgrade from version 119 to version 120.
+
+		// Create secondary index on fileuploads.Location to sum sizes of files by location prefix.
+		if _, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreate("Location").RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -2802,6 +2842,9 @@ func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.
 // FileStartUpload initializes a file upload
 func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 	_, err := rdb.DB(a.dbName).Table("fileuploads").Insert(fd).RunWrite(a.conn)
+	if rdb.IsConflictErr(err) {
+		return t.ErrDuplicate
+	}
 	return err
 }
 
@@ -2816,6 +2859,8 @@ func (a *adapter) FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.
 				"Size":      size,
 				"ETag":      fd.ETag,
 				"Location":  fd.Location,
+				// Set if the unprocessed original is kept.
+				"OriginalLocation": fd.OriginalLocation,
 			}).RunWrite(a.conn); err != nil {
 
 			return nil, err
@@ -2855,6 +2900,106 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 
 }
 
+// FileGetAll fetches records of the files with the given IDs. Missing files are skipped.
+func (a *adapter) FileGetAll(fids []string) ([]t.FileDef, error) {
+	if len(fids) == 0 {
+		return nil, nil
+	}
+	ids := make([]any, len(fids))
+	for i, fid := range fids {
+		ids[i] = fid
+	}
+	cursor, err := rdb.DB(a.dbName).Table("fileuploads").GetAll(ids...).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var fds []t.FileDef
+	if err = cursor.All(&fds); err != nil {
+		return nil, err
+	}
+
+	return fds, nil
+}
+
+// FileCountDownload increments the number of downloads of the file unless it has reached the download
+// limit. Returns the number of downloads including this one, or 0 if the limit is reached, the file has
+// no limit or is not found.
+func (a *adapter) FileCountDownload(fid string) (int, error) {
+	resp, err := rdb.DB(a.dbName).Table("fileuploads").Get(fid).
+		Update(func(row rdb.Term) any {
+			downloads := row.Field("Downloads").Default(0)
+			limit := row.Field("DownloadLimit").Default(0)
+			return rdb.Branch(limit.Gt(0).And(downloads.Lt(limit)),
+				map[string]any{"Downloads": downloads.Add(1)}, map[string]any{})
+		}, rdb.UpdateOpts{ReturnChanges: true}).
+		RunWrite(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Replaced == 0 || len(resp.Changes) == 0 {
+		return 0, nil
+	}
+	record, _ := resp.Changes[0].NewValue.(map[string]any)
+	count, _ := record["Downloads"].(float64)
+	return int(count), nil
+}
+
+// FileMarkVariantsFailed records that generating the variants of the file failed permanently.
+func (a *adapter) FileMarkVariantsFailed(fid string) error {
+	_, err := rdb.DB(a.dbName).Table("fileuploads").Get(fid).
+		Update(map[string]any{"VariantsFailed": true}).
+		RunWrite(a.conn)
+	return err
+}
+
+// FileUsedBytesByPrefix returns the total size of completed uploads with locations starting with the prefix.
+func (a *adapter) FileUsedBytesByPrefix(prefix string) (int64, error) {
+	// All strings starting with the prefix sort between the prefix and the prefix followed by the largest rune.
+	cursor, err := rdb.DB(a.dbName).Table("fileuploads").
+		Between(prefix, prefix+string(utf8.MaxRune), rdb.BetweenOpts{Index: "Location"}).
+		Filter(rdb.Row.Field("Status").Eq(t.UploadCompleted)).
+		Sum("Size").
+		Run(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var used int64
+	err = cursor.One(&used)
+	return used, err
+}
+
+// FileList returns records of completed uploads with IDs greater than 'after' ordered by ID.
+func (a *adapter) FileList(after string, limit int) ([]t.FileDef, error) {
+	var lower any = rdb.MinVal
+	if after != "" {
+		lower = after
+	}
+	q := rdb.DB(a.dbName).Table("fileuploads").
+		Between(lower, rdb.MaxVal, rdb.BetweenOpts{LeftBound: "open"}).
+		OrderBy(rdb.OrderByOpts{Index: "id"}).
+		Filter(map[string]any{"Status": t.UploadCompleted})
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	cursor, err := q.Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var fds []t.FileDef
+	if err = cursor.All(&fds); err != nil {
+		return nil, err
+	}
+
+	return fds, nil
+}
+
 // FileLinkAttachments connects given topic or message to the file record IDs from the list.
 func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error {
 	if len(fids) == 0 || (topic == "" && userId.IsZero() && msgId.IsZero()) {
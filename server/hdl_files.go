@@ -10,7 +10,10 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"io"
@@ -24,8 +27,10 @@ import (
 
 	"github.com/tinode/chat/pbx"
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 )
 
@@ -38,6 +43,7 @@ func largeFileServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 	now := types.TimeNow()
 	enc := json.NewEncoder(wrt)
 	mh := store.Store.GetMediaHandler()
+	addMediaSecurityHeaders(wrt.Header())
 	statsInc("FileDownloadsTotal", 1)
 
 	writeHttpResponse := func(msg *ServerComMessage, err error) {
@@ -101,9 +107,39 @@ func largeFileServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	ctx := media.NewContext(req.Context(), &media.RequestInfo{
+		Uid:        uid,
+		SessionId:  req.FormValue("sid"),
+		RemoteAddr: getRemoteAddr(req),
+		Header:     req.Header,
+	})
+
+	asAttachment, err := media.ParseAsAttachment(req.URL.Query().Get("asatt"))
+	if err != nil {
+		writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid asatt value"))
+		return
+	}
+
+	if issue, _ := strconv.ParseBool(req.FormValue("token")); issue && req.Method == http.MethodGet {
+		largeFileDownloadToken(ctx, mh, req, now, writeHttpResponse)
+		return
+	}
+
+	if ids := req.FormValue("presign"); ids != "" && req.Method == http.MethodGet {
+		largeFileBatchPresign(ctx, wrt, mh, strings.Split(ids, ","), now, writeHttpResponse)
+		return
+	}
+
+	if meta, _ := strconv.ParseBool(req.FormValue("meta")); meta && req.Method == http.MethodGet {
+		full, _ := strconv.ParseBool(req.FormValue("full"))
+		largeFileMetadata(ctx, mh, req, full, now, writeHttpResponse)
+		return
+	}
+
 	// Check if media handler redirects or adds headers.
-	headers, statusCode, err := mh.Headers(req.Method, req.URL, req.Header, true)
+	headers, statusCode, err := media.Headers(ctx, mh, req.Method, req.URL, req.Header, true)
 	if err != nil {
+		addRequestIDHeader(wrt.Header(), err)
 		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
 		return
 	}
@@ -145,8 +181,7 @@ func largeFileServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 	defer rsc.Close()
 
 	wrt.Header().Set("Content-Type", fd.MimeType)
-	asAttachment, _ := strconv.ParseBool(req.URL.Query().Get("asatt"))
-	// Force download for html files as a security measure.
+	// Force download for html files as a security measure, even if requested inline.
 	asAttachment = asAttachment ||
 		strings.Contains(fd.MimeType, "html") ||
 		strings.Contains(fd.MimeType, "xml") ||
@@ -171,6 +206,7 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 	now := types.TimeNow()
 	enc := json.NewEncoder(wrt)
 	mh := store.Store.GetMediaHandler()
+	addMediaSecurityHeaders(wrt.Header())
 	statsInc("FileUploadsTotal", 1)
 
 	writeHttpResponse := func(msg *ServerComMessage, err error) {
@@ -186,7 +222,7 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 
 	// Preflight request: process before any security checks.
 	if req.Method == http.MethodOptions {
-		headers, statusCode, err := mh.Headers(req.Method, req.URL, req.Header, true)
+		headers, statusCode, err := mh.Headers(req.Method, req.URL, req.Header, false)
 		if err != nil {
 			writeHttpResponse(decodeStoreError(err, "", now, nil), err)
 			return
@@ -239,10 +275,33 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	immutable, _ := strconv.ParseBool(req.FormValue("immutable"))
+	// Size of the file declared by the client, 0 if unknown.
+	var declaredSize int64
+	if size := req.FormValue("size"); size != "" {
+		if declaredSize, err = strconv.ParseInt(size, 10, 64); err != nil || declaredSize < 0 {
+			writeHttpResponse(ErrMalformed(msgID, "", now), errors.New("invalid size value"))
+			return
+		}
+	}
+	ctx := media.NewContext(req.Context(), &media.RequestInfo{
+		Uid:          uid,
+		SessionId:    req.FormValue("sid"),
+		RemoteAddr:   getRemoteAddr(req),
+		Topic:        req.FormValue("topic"),
+		Language:     req.FormValue("lang"),
+		CacheControl: req.FormValue("cache"),
+		TTL:          req.FormValue("ttl"),
+		MaxDownloads: req.FormValue("max_downloads"),
+		Immutable:    immutable,
+		Header:       req.Header,
+	})
+
 	// Check if uploads are handled elsewhere.
-	headers, statusCode, err := mh.Headers(req.Method, req.URL, req.Header, true)
+	headers, statusCode, err := media.Headers(ctx, mh, req.Method, req.URL, req.Header, false)
 	if err != nil {
 		logs.Info.Println("media upload: headers check failed", err)
+		addRequestIDHeader(wrt.Header(), err)
 		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
 		return
 	}
@@ -275,6 +334,12 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if req.FormValue("policy") != "" {
+		// The client wants to upload the file directly to storage.
+		largeFileFormPolicy(ctx, wrt, mh, req, uid, msgID, now, writeHttpResponse)
+		return
+	}
+
 	file, header, err := req.FormFile("file")
 	if err != nil {
 		logs.Info.Println("media upload: invalid multipart form", err)
@@ -286,6 +351,11 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if info := media.RequestInfoFromContext(ctx); info != nil {
+		// The name may tell the type of the file.
+		info.Filename = header.Filename
+	}
+
 	buff := make([]byte, 512)
 	if _, err = file.Read(buff); err != nil {
 		writeHttpResponse(ErrUnknown(msgID, "", now), err)
@@ -295,25 +365,18 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 	mimeType := http.DetectContentType(buff)
 	// If DetectContentType fails, see if client-provided content type can be used.
 	if mimeType == "application/octet-stream" {
-		if userContentType, params, err := mime.ParseMediaType(header.Header.Get("Content-Type")); err == nil {
-			// Make sure the content-type is legit.
-			for _, allowed := range allowedMimeTypes {
-				if strings.HasPrefix(userContentType, allowed) {
-					if userContentType = mime.FormatMediaType(userContentType, params); userContentType != "" {
-						mimeType = userContentType
-					}
-					break
-				}
-			}
+		if userContentType := allowedMimeType(header.Header.Get("Content-Type")); userContentType != "" {
+			mimeType = userContentType
 		}
 	}
 
 	fdef := &types.FileDef{
 		ObjHeader: types.ObjHeader{
-			Id: store.Store.GetUidString(),
+			Id: uploadFileId(uid, req.Header.Get("Idempotency-Key")),
 		},
 		User:     uid.String(),
 		MimeType: mimeType,
+		Size:     declaredSize,
 	}
 	fdef.InitTimes()
 
@@ -322,24 +385,31 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	url, size, err := mh.Upload(fdef, file)
+	res, err := media.UploadEx(ctx, mh, fdef, file)
 	if err != nil {
 		logs.Info.Println("media upload: failed", file, "key", fdef.Location, err)
-		store.Files.FinishUpload(fdef, false, 0)
-		writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
+		failUpload(fdef, err)
+		var throttled *media.ThrottledError
+		if errors.As(err, &throttled) {
+			wrt.Header().Set("Retry-After", throttled.RetryAfterSeconds())
+		}
+		addRequestIDHeader(wrt.Header(), err)
+		writeHttpResponse(decodeUploadError(err, msgID, now), err)
 		return
 	}
 
-	fdef, err = store.Files.FinishUpload(fdef, true, size)
+	fdef, err = store.Files.FinishUpload(fdef, true, res.Size)
 	if err != nil {
-		logs.Info.Println("media upload: failed to finalize", file, "key", fdef.Location, err)
-		// Best effort cleanup.
-		mh.Delete([]string{fdef.Location})
+		logs.Info.Println("media upload: failed to finalize", file, "key", res.Location, err)
+		if !res.Reused {
+			// Best effort cleanup.
+			mh.Delete([]string{res.Location})
+		}
 		writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
 		return
 	}
 
-	params := map[string]string{"url": url}
+	params := uploadParams(res)
 	if globals.mediaGcPeriod > 0 {
 		// How long this file is guaranteed to exist without being attached to a message or a topic.
 		params["expires"] = now.Add(globals.mediaGcPeriod).Format(types.TimeFormatRFC3339)
@@ -349,6 +419,201 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 	logs.Info.Println("media upload: ok", fdef.Id, fdef.Location)
 }
 
+// failUpload marks the file record of the failed upload failed, unless the record is of an earlier upload
+// of the file which the media handler kept.
+func failUpload(fdef *types.FileDef, err error) {
+	var existing *media.ExistingFileError
+	if !errors.As(err, &existing) {
+		store.Files.FinishUpload(fdef, false, 0)
+	}
+}
+
+// uploadFileId returns the ID of the new file. Uploads with an idempotency key get the ID derived from the key
+// and the user, so retries of the upload find the record of the earlier attempt on any node.
+func uploadFileId(uid types.Uid, idempotencyKey string) string {
+	if idempotencyKey == "" {
+		return store.Store.GetUidString()
+	}
+	sum := sha256.Sum256([]byte(uid.String() + "/" + idempotencyKey))
+	return types.Uid(binary.BigEndian.Uint64(sum[:]) | 1).String()
+}
+
+// uploadParams returns the params of the response to a successful upload: the URL of the file and, for
+// images, the dimensions, the placeholder and the URL of the thumbnail, if known.
+func uploadParams(res *media.UploadResult) map[string]any {
+	params := map[string]any{"url": res.URL}
+	if res.Width > 0 && res.Height > 0 {
+		params["width"] = res.Width
+		params["height"] = res.Height
+	}
+	if res.Placeholder != "" {
+		params["placeholder"] = res.Placeholder
+	}
+	if res.Thumbnail != "" {
+		params["thumbnail"] = res.Thumbnail
+	}
+	return params
+}
+
+// largeFileFormPolicy responds with a signed policy for uploading the file directly to storage
+// with an HTML form. The client declares the MIME type of the file in the "mime" form value.
+func largeFileFormPolicy(ctx context.Context, wrt http.ResponseWriter, mh media.Handler, req *http.Request, uid types.Uid,
+	msgID string, now time.Time, writeHttpResponse func(msg *ServerComMessage, err error)) {
+	fh, ok := mh.(media.FormUploadHandler)
+	if !ok {
+		writeHttpResponse(ErrNotImplemented(msgID, "", now, now), errors.New("media handler does not support form uploads"))
+		return
+	}
+
+	mimeType := allowedMimeType(req.FormValue("mime"))
+	if mimeType == "" {
+		writeHttpResponse(ErrMalformed(msgID, "", now), errors.New("missing or invalid mime type"))
+		return
+	}
+
+	fdef := &types.FileDef{
+		ObjHeader: types.ObjHeader{
+			Id: uploadFileId(uid, req.Header.Get("Idempotency-Key")),
+		},
+		User:     uid.String(),
+		MimeType: mimeType,
+	}
+	fdef.InitTimes()
+
+	policy, err := fh.FormUploadPolicy(ctx, fdef, globals.maxFileUploadSize)
+	if err != nil {
+		logs.Info.Println("media upload: failed to create form policy", fdef.Id, err)
+		var throttled *media.ThrottledError
+		if errors.As(err, &throttled) {
+			wrt.Header().Set("Retry-After", throttled.RetryAfterSeconds())
+		}
+		writeHttpResponse(decodeUploadError(err, msgID, now), err)
+		return
+	}
+
+	writeHttpResponse(NoErrParams(msgID, "", now, policy), nil)
+	logs.Info.Println("media upload: form policy issued", fdef.Id, fdef.Location)
+}
+
+// largeFileDownloadToken responds with a single-use token for downloading the requested file.
+func largeFileDownloadToken(ctx context.Context, mh media.Handler, req *http.Request, now time.Time,
+	writeHttpResponse func(msg *ServerComMessage, err error)) {
+	th, ok := mh.(media.DownloadTokenHandler)
+	if !ok {
+		writeHttpResponse(ErrNotImplemented("", "", now, now), errors.New("media handler does not support download tokens"))
+		return
+	}
+
+	token, err := th.DownloadToken(ctx, req.URL.Path)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+		return
+	}
+
+	writeHttpResponse(NoErrParams("", "", now, token), nil)
+	logs.Info.Println("media serve: download token issued", req.URL.Path)
+}
+
+// largeFileMetadata responds with the description of the file instead of the file itself.
+func largeFileMetadata(ctx context.Context, mh media.Handler, req *http.Request, full bool, now time.Time,
+	writeHttpResponse func(msg *ServerComMessage, err error)) {
+	mdh, ok := mh.(media.MetadataHandler)
+	if !ok {
+		writeHttpResponse(ErrNotImplemented("", "", now, now), errors.New("media handler does not support file metadata"))
+		return
+	}
+
+	meta, err := mdh.FileMetadata(ctx, req.URL.Path, full)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+		return
+	}
+
+	writeHttpResponse(NoErrParams("", "", now, meta), nil)
+	logs.Info.Println("media serve: metadata", req.URL.Path)
+}
+
+// largeFileBatchPresign responds with the download URLs of several files by file id.
+func largeFileBatchPresign(ctx context.Context, wrt http.ResponseWriter, mh media.Handler, fids []string, now time.Time,
+	writeHttpResponse func(msg *ServerComMessage, err error)) {
+	ph, ok := mh.(media.BatchPresignHandler)
+	if !ok {
+		writeHttpResponse(ErrNotImplemented("", "", now, now), errors.New("media handler does not support batch presigning"))
+		return
+	}
+
+	urls, err := ph.PresignURLs(ctx, fids)
+	if err != nil {
+		var throttled *media.ThrottledError
+		if errors.As(err, &throttled) {
+			wrt.Header().Set("Retry-After", throttled.RetryAfterSeconds())
+			writeHttpResponse(decodeStoreError(types.ErrUnavailable, "", now, nil), err)
+			return
+		}
+		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+		return
+	}
+
+	writeHttpResponse(NoErrParams("", "", now, map[string]any{"urls": urls}), nil)
+	logs.Info.Println("media serve: presigned", len(urls), "of", len(fids), "files")
+}
+
+// addRequestIDHeader reports the ID of the failed storage request to the client, if the media handler
+// exposes it.
+func addRequestIDHeader(header http.Header, err error) {
+	var reqErr *media.RequestError
+	if errors.As(err, &reqErr) {
+		header.Set("X-Amz-Request-Id", reqErr.RequestID)
+	}
+}
+
+// decodeUploadError is decodeStoreError which reports the applicable size limit of too large files,
+// exceeded quotas of tenants, dimensions of rejected images, failures to read the file from the client
+// and throttling by the storage.
+func decodeUploadError(err error, id string, ts time.Time) *ServerComMessage {
+	var existing *media.ExistingFileError
+	if errors.As(err, &existing) {
+		return decodeUploadError(existing.Err, id, ts)
+	}
+	var limitErr *media.SizeLimitError
+	if errors.As(err, &limitErr) {
+		return decodeStoreError(types.ErrTooLarge, id, ts, map[string]any{"limit": limitErr.Limit})
+	}
+	var quotaErr *media.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return decodeStoreError(types.ErrPolicy, id, ts, map[string]any{"tenant": quotaErr.Tenant, "quota": quotaErr.Quota})
+	}
+	var dimsErr *media.ImageDimensionsError
+	if errors.As(err, &dimsErr) {
+		return decodeStoreError(types.ErrPolicy, id, ts, map[string]any{"width": dimsErr.Width, "height": dimsErr.Height})
+	}
+	var readErr *media.SourceReadError
+	if errors.As(err, &readErr) {
+		return decodeStoreError(types.ErrMalformed, id, ts, map[string]any{"what": "source"})
+	}
+	var throttled *media.ThrottledError
+	if errors.As(err, &throttled) {
+		return decodeStoreError(types.ErrUnavailable, id, ts, nil)
+	}
+	return decodeStoreError(err, id, ts, nil)
+}
+
+// allowedMimeType validates the client-provided content type. Returns an empty string
+// if the type is invalid or not allowed.
+func allowedMimeType(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	// Make sure the content-type is legit.
+	for _, allowed := range allowedMimeTypes {
+		if strings.HasPrefix(mediaType, allowed) {
+			return mime.FormatMediaType(mediaType, params)
+		}
+	}
+	return ""
+}
+
 // LargeFileServe is the gRPC equivalent of largeFileServeHTTP.
 func (*grpcNodeServer) LargeFileServe(req *pbx.FileDownReq, stream pbx.Node_LargeFileServeServer) error {
 	now := types.TimeNow()
@@ -385,10 +650,16 @@ func (*grpcNodeServer) LargeFileServe(req *pbx.FileDownReq, stream pbx.Node_Larg
 		return nil
 	}
 
+	ctx := media.NewContext(stream.Context(), &media.RequestInfo{
+		Uid:        uid,
+		RemoteAddr: remoteAddr,
+		Header:     http.Header{},
+	})
+
 	// Check if media handler redirects or adds headers.
 	mh := store.Store.GetMediaHandler()
 	url, _ := url.Parse(req.Uri)
-	headers, statusCode, err := mh.Headers(http.MethodGet, url, http.Header{}, true)
+	headers, statusCode, err := media.Headers(ctx, mh, http.MethodGet, url, http.Header{}, true)
 	if err != nil {
 		writeResponse(decodeStoreError(err, "", now, nil), err)
 		return nil
@@ -489,8 +760,23 @@ func (*grpcNodeServer) LargeFileReceive(stream pbx.Node_LargeFileReceiveServer)
 		return nil
 	}
 
+	// Repeated uploads are identified by the same key as the HTTP header.
+	header := http.Header{}
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if key := md.Get("idempotency-key"); len(key) > 0 {
+			header.Set("Idempotency-Key", key[0])
+		}
+	}
+	ctx := media.NewContext(stream.Context(), &media.RequestInfo{
+		Uid:        uid,
+		RemoteAddr: remoteAddr,
+		Topic:      req.GetTopic(),
+		Filename:   req.Meta.GetName(),
+		Header:     header,
+	})
+
 	// Check if uploads are handled elsewhere.
-	headers, statusCode, err := mh.Headers(http.MethodPost, nil, http.Header{}, false)
+	headers, statusCode, err := media.Headers(ctx, mh, http.MethodPost, nil, http.Header{}, false)
 	if err != nil {
 		logs.Info.Println("media upload: headers check failed", err)
 		writeResponse(decodeStoreError(err, "", now, nil), nil)
@@ -519,10 +805,12 @@ func (*grpcNodeServer) LargeFileReceive(stream pbx.Node_LargeFileReceiveServer)
 
 	fdef := &types.FileDef{
 		ObjHeader: types.ObjHeader{
-			Id: store.Store.GetUidString(),
+			Id: uploadFileId(uid, header.Get("Idempotency-Key")),
 		},
 		User:     uid.String(),
 		MimeType: mimeType,
+		// Size of the file declared by the client, 0 if unknown.
+		Size: req.Meta.GetSize(),
 	}
 	fdef.InitTimes()
 
@@ -541,6 +829,9 @@ func (*grpcNodeServer) LargeFileReceive(stream pbx.Node_LargeFileReceiveServer)
 			} else {
 				if err == io.EOF {
 					err = nil
+				} else {
+					// Fail the upload instead of storing a truncated file.
+					writer.CloseWithError(err)
 				}
 				done <- err
 				break
@@ -548,15 +839,15 @@ func (*grpcNodeServer) LargeFileReceive(stream pbx.Node_LargeFileReceiveServer)
 		}
 	}()
 
-	url, size, err := mh.Upload(fdef, reader)
+	res, err := media.UploadEx(ctx, mh, fdef, reader)
 	if err == nil {
 		// No outbound IO error. Maybe we have an inbound one?
 		err = <-done
 	}
 	if err != nil {
 		logs.Info.Println("media upload: failed", req.Meta.Name, "key", fdef.Location, err)
-		store.Files.FinishUpload(fdef, false, 0)
-		writeResponse(decodeStoreError(err, msgID, now, nil), nil)
+		failUpload(fdef, err)
+		writeResponse(decodeUploadError(err, msgID, now), nil)
 		return nil
 	}
 
@@ -565,16 +856,45 @@ func (*grpcNodeServer) LargeFileReceive(stream pbx.Node_LargeFileReceiveServer)
 		Code: http.StatusOK,
 		Text: http.StatusText(http.StatusOK),
 		Meta: &pbx.FileMeta{
-			Name:     url,
+			Name:     res.URL,
 			MimeType: mimeType,
 			Etag:     fdef.ETag,
-			Size:     size,
+			Size:     res.Size,
 		},
 	})
 	logs.Info.Println("media upload: ok", fdef.Id, fdef.Location, err)
 	return err
 }
 
+// Default security headers of media responses: no MIME sniffing, no scripts in files rendered by the browser.
+var defaultMediaSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"Content-Security-Policy": "default-src 'none'; style-src 'unsafe-inline'; sandbox",
+}
+
+// parseMediaSecurityHeaders merges the configured security headers with the defaults.
+func parseMediaSecurityHeaders(conf map[string]string) http.Header {
+	headers := http.Header{}
+	for name, value := range defaultMediaSecurityHeaders {
+		headers.Set(name, value)
+	}
+	for name, value := range conf {
+		if value == "-" {
+			headers.Del(name)
+		} else {
+			headers.Set(name, value)
+		}
+	}
+	return headers
+}
+
+// addMediaSecurityHeaders adds the configured security headers to a media response.
+func addMediaSecurityHeaders(header http.Header) {
+	for name, values := range globals.mediaSecurityHeaders {
+		header[name] = values
+	}
+}
+
 // largeFileRunGarbageCollection runs every 'period' and deletes up to 'blockSize' unused files.
 // Returns channel which can be used to stop the process.
 func largeFileRunGarbageCollection(period time.Duration, blockSize int) chan<- bool {
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/auth/mock_auth"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const test_fileSecret = "<==auth-secret==>"
+
+// test_mediaHandler is a media handler which stores nothing and describes uploads by the given result.
+type test_mediaHandler struct {
+	result *media.UploadResult
+	// Error of uploads.
+	err     error
+	deleted []string
+	// Headers and status of serve requests.
+	serveHeader http.Header
+	serveStatus int
+	content     string
+	// Error of presigning URLs and form policies.
+	presignErr error
+}
+
+func (mh *test_mediaHandler) Init(jsconf string) error {
+	return nil
+}
+
+func (mh *test_mediaHandler) Headers(method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
+	if serve {
+		return mh.serveHeader, mh.serveStatus, nil
+	}
+	return nil, 0, nil
+}
+
+func (mh *test_mediaHandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	res, err := mh.UploadEx(context.Background(), fdef, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return res.URL, res.Size, nil
+}
+
+func (mh *test_mediaHandler) UploadEx(ctx context.Context, fdef *types.FileDef, file io.Reader) (*media.UploadResult, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if mh.err != nil {
+		return nil, mh.err
+	}
+	fdef.Location = "test/" + fdef.Id
+	res := *mh.result
+	res.Size = int64(len(data))
+	return &res, nil
+}
+
+func (mh *test_mediaHandler) PresignURLs(ctx context.Context, fids []string) (map[string]string, error) {
+	if mh.presignErr != nil {
+		return nil, mh.presignErr
+	}
+	return map[string]string{}, nil
+}
+
+func (mh *test_mediaHandler) FormUploadPolicy(ctx context.Context, fdef *types.FileDef, maxSize int64) (*media.FormUploadPolicy, error) {
+	if mh.presignErr != nil {
+		return nil, mh.presignErr
+	}
+	return &media.FormUploadPolicy{}, nil
+}
+
+func (mh *test_mediaHandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
+	fdef := &types.FileDef{MimeType: "image/png"}
+	fdef.InitTimes()
+	return fdef, test_readSeekCloser{strings.NewReader(mh.content)}, nil
+}
+
+func (mh *test_mediaHandler) Delete(locations []string) error {
+	mh.deleted = append(mh.deleted, locations...)
+	return nil
+}
+
+func (mh *test_mediaHandler) GetIdFromUrl(url string) types.Uid {
+	return media.GetIdFromUrl(url, "/v0/file/s/")
+}
+
+type test_readSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (test_readSeekCloser) Close() error {
+	return nil
+}
+
+// test_makeAPIKey sets the salt of API keys and returns a valid key.
+func test_makeAPIKey() string {
+	globals.apiKeySalt = []byte("test-salt")
+	data := make([]byte, apikeyLength)
+	data[0] = 1
+	hasher := hmac.New(md5.New, globals.apiKeySalt)
+	hasher.Write(data[:apikeyVersion+apikeyAppID+apikeySequence+apikeyWho])
+	copy(data[apikeyVersion+apikeyAppID+apikeySequence+apikeyWho:], hasher.Sum(nil))
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+// test_fileRequests mocks the store to authenticate requests of the user and to use the media handler.
+func test_fileRequests(t *testing.T, mh media.Handler, uid types.Uid) (*mock_store.MockPersistentStorageInterface,
+	*mock_store.MockFilePersistenceInterface) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	ff := mock_store.NewMockFilePersistenceInterface(ctrl)
+	aa := mock_auth.NewMockAuthHandler(ctrl)
+	savedStore, savedFiles := store.Store, store.Files
+	store.Store = ss
+	store.Files = ff
+	t.Cleanup(func() {
+		store.Store = savedStore
+		store.Files = savedFiles
+		globals.apiKeySalt = nil
+		globals.mediaSecurityHeaders = nil
+	})
+
+	ss.EXPECT().GetMediaHandler().Return(mh).AnyTimes()
+	ss.EXPECT().GetLogicalAuthHandler("basic").Return(aa).AnyTimes()
+	aa.EXPECT().Authenticate([]byte(test_fileSecret), gomock.Any()).Return(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth},
+		nil, nil).AnyTimes()
+	return ss, ff
+}
+
+// test_fileRequest returns the request with the API key and the credentials of the user.
+func test_fileRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("X-Tinode-APIKey", test_makeAPIKey())
+	req.Header.Set("X-Tinode-Auth", "basic "+base64.StdEncoding.EncodeToString([]byte(test_fileSecret)))
+	return req
+}
+
+// test_uploadRequest returns the request to upload the file.
+func test_uploadRequest(t *testing.T, content string) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	form.WriteField("id", "123")
+	form.Close()
+
+	req := test_fileRequest(http.MethodPost, "/v0/file/u/", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestLargeFileReceiveUploadResult(t *testing.T) {
+	uid := types.Uid(1)
+	mh := &test_mediaHandler{result: &media.UploadResult{
+		URL:         "/v0/file/s/abc.png",
+		Width:       640,
+		Height:      480,
+		Placeholder: "LKO2?U%2Tw=w",
+		Thumbnail:   "/v0/file/s/abc.png?thumb=1",
+	}}
+	ss, ff := test_fileRequests(t, mh, uid)
+	ss.EXPECT().GetUidString().Return("abc")
+	ff.EXPECT().FinishUpload(gomock.Any(), true, int64(len("\x89PNG-data"))).DoAndReturn(
+		func(fdef *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+			return fdef, nil
+		})
+
+	wrt := httptest.NewRecorder()
+	largeFileReceiveHTTP(wrt, test_uploadRequest(t, "\x89PNG-data"))
+
+	if wrt.Code != http.StatusOK {
+		t.Fatal("Upload failed:", wrt.Code, wrt.Body.String())
+	}
+	var resp struct {
+		Ctrl struct {
+			Id     string         `json:"id"`
+			Params map[string]any `json:"params"`
+		} `json:"ctrl"`
+	}
+	if err := json.Unmarshal(wrt.Body.Bytes(), &resp); err != nil {
+		t.Fatal("Invalid response:", err)
+	}
+	params := resp.Ctrl.Params
+	if resp.Ctrl.Id != "123" || params["url"] != mh.result.URL {
+		t.Error("Unexpected response", wrt.Body.String())
+	}
+	if params["width"] != float64(640) || params["height"] != float64(480) {
+		t.Error("Expected dimensions of the image, got", params["width"], params["height"])
+	}
+	if params["placeholder"] != mh.result.Placeholder || params["thumbnail"] != mh.result.Thumbnail {
+		t.Error("Expected placeholder and thumbnail, got", params["placeholder"], params["thumbnail"])
+	}
+}
+
+func TestUploadParams(t *testing.T) {
+	// Only the URL of files which are not images.
+	params := uploadParams(&media.UploadResult{URL: "/v0/file/s/abc", Size: 10})
+	if len(params) != 1 || params["url"] != "/v0/file/s/abc" {
+		t.Error("Expected only the URL, got", params)
+	}
+}
+
+func TestUploadFileId(t *testing.T) {
+	ss, _ := test_fileRequests(t, &test_mediaHandler{}, types.Uid(1))
+	ss.EXPECT().GetUidString().Return("abc")
+	if id := uploadFileId(types.Uid(1), ""); id != "abc" {
+		t.Error("Expected a new ID without an idempotency key, got", id)
+	}
+
+	// Retries with the same key get the same ID, other users don't.
+	id := uploadFileId(types.Uid(1), "key-1")
+	if types.ParseUid(id).IsZero() || uploadFileId(types.Uid(1), "key-1") != id {
+		t.Error("Expected the same valid ID of the retry, got", id)
+	}
+	if uploadFileId(types.Uid(2), "key-1") == id || uploadFileId(types.Uid(1), "key-2") == id {
+		t.Error("Expected IDs scoped to the user and the key")
+	}
+}
+
+func TestLargeFileReceiveKeepsExisting(t *testing.T) {
+	uid := types.Uid(1)
+
+	// The failed retry of an upload: the record of the earlier upload is not marked failed.
+	mh := &test_mediaHandler{err: &media.ExistingFileError{Err: types.ErrMalformed}}
+	ss, ff := test_fileRequests(t, mh, uid)
+	ss.EXPECT().GetUidString().Return("abc").Times(2)
+	wrt := httptest.NewRecorder()
+	largeFileReceiveHTTP(wrt, test_uploadRequest(t, "data"))
+	if wrt.Code != http.StatusBadRequest {
+		t.Error("Expected the error of the upload, got", wrt.Code, wrt.Body.String())
+	}
+
+	// The object stored by the earlier upload is not deleted if the record fails to update.
+	mh.err = nil
+	mh.result = &media.UploadResult{URL: "/v0/file/s/abc", Location: "test/abc", Reused: true}
+	ff.EXPECT().FinishUpload(gomock.Any(), true, gomock.Any()).Return(nil, types.ErrInternal)
+	wrt = httptest.NewRecorder()
+	largeFileReceiveHTTP(wrt, test_uploadRequest(t, "data"))
+	if wrt.Code != http.StatusInternalServerError || len(mh.deleted) != 0 {
+		t.Error("Expected the object kept, got", wrt.Code, mh.deleted)
+	}
+}
+
+func TestThrottledPresignRetryAfter(t *testing.T) {
+	uid := types.Uid(1)
+	mh := &test_mediaHandler{presignErr: &media.ThrottledError{RetryAfter: 3 * time.Second, Err: types.ErrUnavailable}}
+	ss, _ := test_fileRequests(t, mh, uid)
+	ss.EXPECT().GetUidString().Return("abc")
+
+	batch := httptest.NewRecorder()
+	largeFileServeHTTP(batch, test_fileRequest(http.MethodGet, "/v0/file/s/?presign=abc,def", nil))
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("policy", "1")
+	form.WriteField("mime", "image/png")
+	form.Close()
+	req := test_fileRequest(http.MethodPost, "/v0/file/u/", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	policy := httptest.NewRecorder()
+	largeFileReceiveHTTP(policy, req)
+
+	for name, wrt := range map[string]*httptest.ResponseRecorder{"batch": batch, "form policy": policy} {
+		if wrt.Code != http.StatusServiceUnavailable || wrt.Header().Get("Retry-After") != "3" {
+			t.Errorf("%s: expected 503 with Retry-After, got %d %q", name, wrt.Code, wrt.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestParseMediaSecurityHeaders(t *testing.T) {
+	headers := parseMediaSecurityHeaders(nil)
+	if len(headers) != len(defaultMediaSecurityHeaders) {
+		t.Error("Expected the default headers, got", headers)
+	}
+	for name, value := range defaultMediaSecurityHeaders {
+		if headers.Get(name) != value {
+			t.Errorf("Default %s: expected %q, got %q", name, value, headers.Get(name))
+		}
+	}
+
+	headers = parseMediaSecurityHeaders(map[string]string{
+		"content-security-policy": "default-src 'none'",
+		"X-Content-Type-Options":  "-",
+		"Referrer-Policy":         "no-referrer",
+	})
+	if headers.Get("Content-Security-Policy") != "default-src 'none'" {
+		t.Error("Default not overridden, got", headers.Get("Content-Security-Policy"))
+	}
+	if _, ok := headers["X-Content-Type-Options"]; ok {
+		t.Error("Header not removed by '-'")
+	}
+	if headers.Get("Referrer-Policy") != "no-referrer" {
+		t.Error("Added header missing")
+	}
+}
+
+func TestMediaSecurityHeadersOfResponses(t *testing.T) {
+	uid := types.Uid(1)
+	mh := &test_mediaHandler{content: "\x89PNG-data"}
+	test_fileRequests(t, mh, uid)
+	globals.mediaSecurityHeaders = parseMediaSecurityHeaders(map[string]string{"Referrer-Policy": "no-referrer"})
+
+	for _, tc := range []struct {
+		name   string
+		status int
+		header http.Header
+	}{
+		{"serve", 0, nil},
+		{"redirect", http.StatusTemporaryRedirect, http.Header{"Location": {"https://storage.example.com/abc"}}},
+	} {
+		mh.serveStatus, mh.serveHeader = tc.status, tc.header
+		wrt := httptest.NewRecorder()
+		largeFileServeHTTP(wrt, test_fileRequest(http.MethodGet, "/v0/file/s/abc.png", nil))
+
+		if expected := max(tc.status, http.StatusOK); wrt.Code != expected {
+			t.Errorf("%s: expected status %d, got %d %s", tc.name, expected, wrt.Code, wrt.Body.String())
+		}
+		for name := range globals.mediaSecurityHeaders {
+			if wrt.Header().Get(name) != globals.mediaSecurityHeaders.Get(name) {
+				t.Errorf("%s: expected %s %q, got %q", tc.name, name, globals.mediaSecurityHeaders.Get(name),
+					wrt.Header().Get(name))
+			}
+		}
+	}
+}
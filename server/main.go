@@ -56,6 +56,8 @@ import (
 	"google.golang.org/grpc"
 
 	// File upload handlers
+	"github.com/tinode/chat/server/media"
+	_ "github.com/tinode/chat/server/media/composite"
 	_ "github.com/tinode/chat/server/media/fs"
 	_ "github.com/tinode/chat/server/media/s3"
 )
@@ -186,6 +188,8 @@ var globals struct {
 	maxFileUploadSize int64
 	// Periodicity of a garbage collector for abandoned media uploads.
 	mediaGcPeriod time.Duration
+	// Security headers added to media responses.
+	mediaSecurityHeaders http.Header
 
 	// Prioritize X-Forwarded-For header as the source of IP address of the client.
 	useXForwardedFor bool
@@ -249,6 +253,9 @@ type mediaConfig struct {
 	GcBlockSize int `json:"gc_block_size"`
 	// Individual handler config params to pass to handlers unchanged.
 	Handlers map[string]json.RawMessage `json:"handlers"`
+	// Security headers to add to media responses, in addition to or replacing the defaults.
+	// The value "-" removes a default header.
+	SecurityHeaders map[string]string `json:"security_headers"`
 }
 
 // Contentx of the configuration file
@@ -362,6 +369,12 @@ func main() {
 		currentVersion, executable, buildstamp,
 		os.Getpid(), runtime.GOMAXPROCS(runtime.NumCPU()))
 
+	// Media handlers may report server version to external services.
+	media.ServerVersion = currentVersion
+	if parseVersion(buildstamp) > 0 {
+		media.ServerVersion = strings.TrimPrefix(buildstamp, "v")
+	}
+
 	*configfile = toAbsolutePath(curwd, *configfile)
 	logs.Info.Printf("Using config from '%s'", *configfile)
 
@@ -621,6 +634,7 @@ func main() {
 			config.Media = nil
 		} else {
 			globals.maxFileUploadSize = config.Media.MaxFileUploadSize
+			globals.mediaSecurityHeaders = parseMediaSecurityHeaders(config.Media.SecurityHeaders)
 			if config.Media.Handlers != nil {
 				var conf string
 				if params := config.Media.Handlers[config.Media.UseHandler]; params != nil {
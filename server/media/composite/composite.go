@@ -0,0 +1,354 @@
+// Package composite implements github.com/tinode/chat/server/media interface by chaining other media handlers.
+// New files are uploaded with the first (primary) handler while existing files are served and deleted by
+// the handler which stores them. It allows migrating from one storage to another gradually.
+package composite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const handlerName = "composite"
+
+type handlerConfig struct {
+	// Name of the registered media handler, e.g. "fs".
+	Name string `json:"name"`
+	// Configuration of the handler.
+	Config json.RawMessage `json:"config"`
+}
+
+type compositeConfig struct {
+	// Handlers in order of preference. The first one is the primary.
+	Handlers []handlerConfig `json:"handlers"`
+}
+
+type compositeHandler struct {
+	handlers []media.Handler
+}
+
+// Init initializes the chained handlers.
+func (ch *compositeHandler) Init(jsconf string) error {
+	var conf compositeConfig
+	if err := json.Unmarshal([]byte(jsconf), &conf); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if len(conf.Handlers) == 0 {
+		return errors.New("missing handlers")
+	}
+
+	handlers := make([]media.Handler, 0, len(conf.Handlers))
+	seen := make(map[string]bool, len(conf.Handlers))
+	for _, hc := range conf.Handlers {
+		if hc.Name == handlerName {
+			return errors.New("composite handler can't be chained")
+		}
+		if seen[hc.Name] {
+			return errors.New("handler '" + hc.Name + "' listed twice")
+		}
+		seen[hc.Name] = true
+
+		mh := store.GetRegisteredMediaHandler(hc.Name)
+		if mh == nil {
+			return errors.New("unknown handler '" + hc.Name + "'")
+		}
+		if err := mh.Init(string(hc.Config)); err != nil {
+			return errors.New("failed to init handler '" + hc.Name + "': " + err.Error())
+		}
+		handlers = append(handlers, mh)
+	}
+	ch.handlers = handlers
+	return nil
+}
+
+// Headers is used for cache management and serving CORS headers.
+func (ch *compositeHandler) Headers(method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
+	return ch.HeadersWithContext(context.Background(), method, url, headers, serve)
+}
+
+// HeadersWithContext passes upload requests to the primary handler and serve requests to the handlers
+// which may store the file until one finds it.
+func (ch *compositeHandler) HeadersWithContext(ctx context.Context, method string, url *url.URL, headers http.Header,
+	serve bool) (http.Header, int, error) {
+	if !serve || method == http.MethodOptions {
+		// CORS preflight requests of serve URLs don't refer to any particular file.
+		return media.Headers(ctx, ch.handlers[0], method, url, headers, serve)
+	}
+
+	candidates, err := ch.candidates(url.String())
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, mh := range candidates {
+		var header http.Header
+		var status int
+		header, status, err = media.Headers(ctx, mh, method, url, headers, serve)
+		if err != types.ErrNotFound {
+			return header, status, err
+		}
+	}
+	return nil, 0, err
+}
+
+// Upload processes request for file upload with the primary handler.
+func (ch *compositeHandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	return ch.handlers[0].Upload(fdef, file)
+}
+
+// UploadWithContext is Upload with request context.
+func (ch *compositeHandler) UploadWithContext(ctx context.Context, fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	return media.Upload(ctx, ch.handlers[0], fdef, file)
+}
+
+// UploadEx uploads the file with the primary handler and describes it.
+func (ch *compositeHandler) UploadEx(ctx context.Context, fdef *types.FileDef, file io.Reader) (*media.UploadResult, error) {
+	return media.UploadEx(ctx, ch.handlers[0], fdef, file)
+}
+
+// Download processes request for file download with the handlers which may store the file until one
+// finds it. The returned ReadSeekCloser must be closed after use.
+func (ch *compositeHandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
+	candidates, err := ch.candidates(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, mh := range candidates {
+		var fd *types.FileDef
+		var file media.ReadSeekCloser
+		fd, file, err = mh.Download(url)
+		if err != types.ErrNotFound {
+			return fd, file, err
+		}
+	}
+	return nil, nil, err
+}
+
+// Delete deletes files with the handlers which store them.
+func (ch *compositeHandler) Delete(locations []string) error {
+	byHandler := ch.byOwner(locations)
+
+	var firstErr error
+	for _, mh := range ch.handlers {
+		if locs := byHandler[mh]; len(locs) > 0 {
+			if err := mh.Delete(locs); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// DeleteWithProgress deletes files with the handlers which store them, reporting the totals of all handlers.
+// Handlers which don't report progress are counted once their Delete is done.
+func (ch *compositeHandler) DeleteWithProgress(ctx context.Context, locations []string,
+	progress media.DeleteProgress) error {
+	byHandler := ch.byOwner(locations)
+
+	// Totals of the handlers done so far.
+	var doneDeleted, doneFailed int
+	report := func(deleted, failed int) {
+		if progress != nil {
+			progress(doneDeleted+deleted, doneFailed+failed)
+		}
+	}
+	var firstErr error
+	for _, mh := range ch.handlers {
+		locs := byHandler[mh]
+		if len(locs) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var deleted, failed int
+		var err error
+		if ph, ok := mh.(media.ProgressDeleteHandler); ok {
+			err = ph.DeleteWithProgress(ctx, locs, func(d, f int) {
+				deleted, failed = d, f
+				report(deleted, failed)
+			})
+		} else if err = mh.Delete(locs); err == nil {
+			deleted = len(locs)
+			report(deleted, failed)
+		}
+		doneDeleted += deleted
+		doneFailed += failed
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// DownloadToken issues a download token with the handler which stores the file.
+func (ch *compositeHandler) DownloadToken(ctx context.Context, url string) (*media.DownloadToken, error) {
+	candidates, err := ch.candidates(url)
+	if err != nil {
+		return nil, err
+	}
+	err = types.ErrUnsupported
+	for _, mh := range candidates {
+		th, ok := mh.(media.DownloadTokenHandler)
+		if !ok {
+			continue
+		}
+		var token *media.DownloadToken
+		token, err = th.DownloadToken(ctx, url)
+		if err != types.ErrNotFound {
+			return token, err
+		}
+	}
+	return nil, err
+}
+
+// FileMetadata describes the file with the handler which stores it.
+func (ch *compositeHandler) FileMetadata(ctx context.Context, url string, full bool) (*media.FileMetadata, error) {
+	candidates, err := ch.candidates(url)
+	if err != nil {
+		return nil, err
+	}
+	err = types.ErrUnsupported
+	for _, mh := range candidates {
+		mdh, ok := mh.(media.MetadataHandler)
+		if !ok {
+			continue
+		}
+		var meta *media.FileMetadata
+		meta, err = mdh.FileMetadata(ctx, url, full)
+		if err != types.ErrNotFound {
+			return meta, err
+		}
+	}
+	return nil, err
+}
+
+// PresignURLs presigns the download URLs of the files with the handlers which store them. Files of handlers
+// which can't presign URLs are omitted.
+func (ch *compositeHandler) PresignURLs(ctx context.Context, fids []string) (map[string]string, error) {
+	supported := false
+	for _, mh := range ch.handlers {
+		if _, ok := mh.(media.BatchPresignHandler); ok {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, types.ErrUnsupported
+	}
+	for _, fid := range fids {
+		if types.ParseUid(fid).IsZero() {
+			return nil, types.ErrMalformed
+		}
+	}
+
+	fdefs, err := store.Files.GetAll(fids)
+	if err != nil {
+		return nil, err
+	}
+	byHandler := make(map[media.Handler][]string)
+	for i := range fdefs {
+		if owners := ch.owners(fdefs[i].Location); len(owners) > 0 {
+			byHandler[owners[0]] = append(byHandler[owners[0]], fdefs[i].Id)
+		}
+	}
+
+	urls := make(map[string]string, len(fdefs))
+	for _, mh := range ch.handlers {
+		ph, ok := mh.(media.BatchPresignHandler)
+		if !ok || len(byHandler[mh]) == 0 {
+			continue
+		}
+		signed, err := ph.PresignURLs(ctx, byHandler[mh])
+		if err == types.ErrUnsupported {
+			// Batch presigning is not enabled in the handler.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(urls, signed)
+	}
+	return urls, nil
+}
+
+// FormUploadPolicy creates the policy of a form upload with the primary handler.
+func (ch *compositeHandler) FormUploadPolicy(ctx context.Context, fdef *types.FileDef,
+	maxSize int64) (*media.FormUploadPolicy, error) {
+	fh, ok := ch.handlers[0].(media.FormUploadHandler)
+	if !ok {
+		return nil, types.ErrUnsupported
+	}
+	return fh.FormUploadPolicy(ctx, fdef, maxSize)
+}
+
+// GetIdFromUrl converts an attachment URL to a file UID with the first handler which recognizes it.
+func (ch *compositeHandler) GetIdFromUrl(url string) types.Uid {
+	for _, mh := range ch.handlers {
+		if fid := mh.GetIdFromUrl(url); !fid.IsZero() {
+			return fid
+		}
+	}
+	return types.ZeroUid
+}
+
+// candidates returns the handlers which may store the file with the given URL.
+func (ch *compositeHandler) candidates(url string) ([]media.Handler, error) {
+	fid := ch.GetIdFromUrl(url)
+	if fid.IsZero() {
+		return nil, types.ErrNotFound
+	}
+	fd, err := store.Files.Get(fid.String())
+	if err != nil {
+		return nil, err
+	}
+	if fd == nil {
+		return nil, types.ErrNotFound
+	}
+	candidates := ch.owners(fd.Location)
+	if len(candidates) == 0 {
+		return nil, types.ErrNotFound
+	}
+	return candidates, nil
+}
+
+// byOwner groups the locations by the handlers which store them.
+func (ch *compositeHandler) byOwner(locations []string) map[media.Handler][]string {
+	byHandler := make(map[media.Handler][]string)
+	for _, loc := range locations {
+		owners := ch.owners(loc)
+		if len(owners) == 0 {
+			logs.Warn.Println("composite: no handler for location", loc)
+			continue
+		}
+		byHandler[owners[0]] = append(byHandler[owners[0]], loc)
+	}
+	return byHandler
+}
+
+// owners returns the handlers which may store the file at the location in the order to try them:
+// the ones which claim the location followed by the ones which can't tell.
+func (ch *compositeHandler) owners(location string) []media.Handler {
+	var claimed, unknown []media.Handler
+	for _, mh := range ch.handlers {
+		if lo, ok := mh.(media.LocationOwner); !ok {
+			unknown = append(unknown, mh)
+		} else if lo.OwnsLocation(location) {
+			claimed = append(claimed, mh)
+		}
+	}
+	return append(claimed, unknown...)
+}
+
+func init() {
+	store.RegisterMediaHandler(handlerName, &compositeHandler{})
+}
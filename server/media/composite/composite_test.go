@@ -0,0 +1,324 @@
+package composite
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const testServeURL = "/v0/file/s/"
+
+// fakeHandler stores files by location in memory. fakeOwner also claims the locations with its prefix.
+type fakeHandler struct {
+	// Prefix of the locations of uploaded files.
+	prefix  string
+	files   map[string]string
+	deleted []string
+}
+
+type fakeOwner struct {
+	fakeHandler
+}
+
+func (fo *fakeOwner) OwnsLocation(location string) bool {
+	return strings.HasPrefix(location, fo.prefix)
+}
+
+func (fo *fakeOwner) DownloadToken(ctx context.Context, url string) (*media.DownloadToken, error) {
+	return &media.DownloadToken{Token: fo.prefix + "token"}, nil
+}
+
+func (fo *fakeOwner) FileMetadata(ctx context.Context, url string, full bool) (*media.FileMetadata, error) {
+	return &media.FileMetadata{Id: fo.GetIdFromUrl(url).String(), ETag: fo.prefix}, nil
+}
+
+func (fo *fakeOwner) PresignURLs(ctx context.Context, fids []string) (map[string]string, error) {
+	urls := make(map[string]string, len(fids))
+	for _, fid := range fids {
+		urls[fid] = "https://" + fo.prefix + fid
+	}
+	return urls, nil
+}
+
+func (fo *fakeOwner) DeleteWithProgress(ctx context.Context, locations []string, progress media.DeleteProgress) error {
+	for i, loc := range locations {
+		fo.deleted = append(fo.deleted, loc)
+		progress(i+1, 0)
+	}
+	return nil
+}
+
+func (fh *fakeHandler) Init(jsconf string) error {
+	fh.files = make(map[string]string)
+	fh.deleted = nil
+	return nil
+}
+
+func (fh *fakeHandler) Headers(method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
+	if !serve || method == http.MethodOptions {
+		return http.Header{"X-Handler": {fh.prefix}}, 0, nil
+	}
+	fd, err := store.Files.Get(fh.GetIdFromUrl(url.String()).String())
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := fh.files[fd.Location]; !ok {
+		return nil, 0, types.ErrNotFound
+	}
+	return http.Header{"X-Handler": {fh.prefix}}, http.StatusTemporaryRedirect, nil
+}
+
+func (fh *fakeHandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", 0, err
+	}
+	fdef.Location = fh.prefix + fdef.Id
+	fh.files[fdef.Location] = string(data)
+	return testServeURL + fdef.Id, int64(len(data)), nil
+}
+
+func (fh *fakeHandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
+	fd, err := store.Files.Get(fh.GetIdFromUrl(url).String())
+	if err != nil {
+		return nil, nil, err
+	}
+	data, ok := fh.files[fd.Location]
+	if !ok {
+		return nil, nil, types.ErrNotFound
+	}
+	return fd, nopCloser{strings.NewReader(data)}, nil
+}
+
+func (fh *fakeHandler) Delete(locations []string) error {
+	fh.deleted = append(fh.deleted, locations...)
+	return nil
+}
+
+func (fh *fakeHandler) GetIdFromUrl(url string) types.Uid {
+	return media.GetIdFromUrl(url, testServeURL)
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+var (
+	// Primary handler which can't tell its locations.
+	newStorage = &fakeHandler{prefix: "new/"}
+	// Handler of older files.
+	oldStorage = &fakeOwner{fakeHandler{prefix: "old/"}}
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	store.RegisterMediaHandler("test-new", newStorage)
+	store.RegisterMediaHandler("test-old", oldStorage)
+	os.Exit(m.Run())
+}
+
+func newTestHandler(t *testing.T) (*compositeHandler, *mock_store.MockFilePersistenceInterface) {
+	ctrl := gomock.NewController(t)
+	files := mock_store.NewMockFilePersistenceInterface(ctrl)
+	saved := store.Files
+	store.Files = files
+	t.Cleanup(func() { store.Files = saved })
+
+	ch := &compositeHandler{}
+	if err := ch.Init(`{"handlers": [{"name": "test-new", "config": {}}, {"name": "test-old", "config": {}}]}`); err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	return ch, files
+}
+
+func newTestFileDef(id uint64, location string) *types.FileDef {
+	fdef := &types.FileDef{ObjHeader: types.ObjHeader{Id: types.Uid(id).String()}, Location: location}
+	fdef.InitTimes()
+	return fdef
+}
+
+func TestInit(t *testing.T) {
+	for _, tc := range []struct {
+		conf string
+		err  string
+	}{
+		{`{"handlers": []}`, "missing handlers"},
+		{`{"handlers": [{"name": "composite"}]}`, "can't be chained"},
+		{`{"handlers": [{"name": "missing"}]}`, "unknown handler"},
+		{`{"handlers": [{"name": "test-new"}, {"name": "test-new"}]}`, "listed twice"},
+	} {
+		err := (&compositeHandler{}).Init(tc.conf)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Init(%s): expected error %q, got %v", tc.conf, tc.err, err)
+		}
+	}
+}
+
+func TestUploadToPrimary(t *testing.T) {
+	ch, _ := newTestHandler(t)
+
+	fdef := newTestFileDef(12345, "")
+	ref, size, err := ch.Upload(fdef, strings.NewReader("data"))
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if ref != testServeURL+fdef.Id || size != 4 || fdef.Location != "new/"+fdef.Id {
+		t.Error("unexpected upload result", ref, size, fdef.Location)
+	}
+	if len(oldStorage.files) != 0 {
+		t.Error("file uploaded to the secondary handler")
+	}
+
+	header, _, err := ch.Headers(http.MethodOptions, &url.URL{Path: "/v0/file/u/"}, http.Header{}, false)
+	if err != nil || header.Get("X-Handler") != "new/" {
+		t.Error("upload headers not from the primary handler", header, err)
+	}
+}
+
+func TestServeFallback(t *testing.T) {
+	ch, files := newTestHandler(t)
+
+	newFile := newTestFileDef(12345, "new/"+types.Uid(12345).String())
+	oldFile := newTestFileDef(23456, "old/"+types.Uid(23456).String())
+	newStorage.files[newFile.Location] = "new data"
+	oldStorage.files[oldFile.Location] = "old data"
+	files.EXPECT().Get(newFile.Id).Return(newFile, nil).AnyTimes()
+	files.EXPECT().Get(oldFile.Id).Return(oldFile, nil).AnyTimes()
+
+	for _, fdef := range []*types.FileDef{newFile, oldFile} {
+		serveURL := testServeURL + fdef.Id
+		header, status, err := ch.Headers(http.MethodGet, &url.URL{Path: serveURL}, http.Header{}, true)
+		if err != nil || status != http.StatusTemporaryRedirect || header.Get("X-Handler") != fdef.Location[:4] {
+			t.Error("unexpected headers of", fdef.Location, header, status, err)
+		}
+
+		_, file, err := ch.Download(serveURL)
+		if err != nil {
+			t.Fatal("Download failed:", err)
+		}
+		data, _ := io.ReadAll(file)
+		file.Close()
+		if string(data) != fdef.Location[:3]+" data" {
+			t.Error("downloaded wrong file", fdef.Location, string(data))
+		}
+	}
+
+	// The secondary handler disowns locations of the primary, so missing files are not found.
+	missing := newTestFileDef(34567, "new/missing")
+	files.EXPECT().Get(missing.Id).Return(missing, nil).AnyTimes()
+	if _, _, err := ch.Download(testServeURL + missing.Id); err != types.ErrNotFound {
+		t.Error("expected ErrNotFound, got", err)
+	}
+}
+
+func TestDeleteByOwner(t *testing.T) {
+	ch, _ := newTestHandler(t)
+
+	if err := ch.Delete([]string{"old/a", "new/b", "other/c", "old/d"}); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+	if !slices.Equal(oldStorage.deleted, []string{"old/a", "old/d"}) {
+		t.Error("unexpected deletions by the secondary handler", oldStorage.deleted)
+	}
+	if !slices.Equal(newStorage.deleted, []string{"new/b", "other/c"}) {
+		t.Error("unexpected deletions by the primary handler", newStorage.deleted)
+	}
+}
+
+func TestServePreflight(t *testing.T) {
+	// The file record is not looked up: any call to the mock store fails the test.
+	ch, _ := newTestHandler(t)
+
+	header, _, err := ch.Headers(http.MethodOptions, &url.URL{Path: testServeURL + types.Uid(12345).String()},
+		http.Header{}, true)
+	if err != nil || header.Get("X-Handler") != "new/" {
+		t.Error("preflight headers not from the primary handler", header, err)
+	}
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	ch, files := newTestHandler(t)
+
+	newFile := newTestFileDef(12345, "new/"+types.Uid(12345).String())
+	oldFile := newTestFileDef(23456, "old/"+types.Uid(23456).String())
+	files.EXPECT().Get(newFile.Id).Return(newFile, nil).AnyTimes()
+	files.EXPECT().Get(oldFile.Id).Return(oldFile, nil).AnyTimes()
+	ctx := context.Background()
+
+	token, err := ch.DownloadToken(ctx, testServeURL+oldFile.Id)
+	if err != nil || token.Token != "old/token" {
+		t.Error("download token not issued by the owner", token, err)
+	}
+	meta, err := ch.FileMetadata(ctx, testServeURL+oldFile.Id, true)
+	if err != nil || meta.Id != oldFile.Id || meta.ETag != "old/" {
+		t.Error("metadata not from the owner", meta, err)
+	}
+
+	// The primary handler supports none of the interfaces.
+	if _, err := ch.DownloadToken(ctx, testServeURL+newFile.Id); err != types.ErrUnsupported {
+		t.Error("expected ErrUnsupported of download token, got", err)
+	}
+	if _, err := ch.FileMetadata(ctx, testServeURL+newFile.Id, false); err != types.ErrUnsupported {
+		t.Error("expected ErrUnsupported of metadata, got", err)
+	}
+	if _, err := ch.FormUploadPolicy(ctx, newTestFileDef(34567, ""), 0); err != types.ErrUnsupported {
+		t.Error("expected ErrUnsupported of form upload, got", err)
+	}
+}
+
+func TestPresignURLs(t *testing.T) {
+	ch, files := newTestHandler(t)
+
+	newFile := newTestFileDef(12345, "new/"+types.Uid(12345).String())
+	oldFile := newTestFileDef(23456, "old/"+types.Uid(23456).String())
+	fids := []string{newFile.Id, oldFile.Id}
+	files.EXPECT().GetAll(fids).Return([]types.FileDef{*newFile, *oldFile}, nil)
+
+	urls, err := ch.PresignURLs(context.Background(), fids)
+	if err != nil {
+		t.Fatal("PresignURLs failed:", err)
+	}
+	// Files of the primary handler which can't presign are omitted.
+	if len(urls) != 1 || urls[oldFile.Id] != "https://old/"+oldFile.Id {
+		t.Error("unexpected presigned URLs", urls)
+	}
+
+	if _, err := ch.PresignURLs(context.Background(), []string{"invalid"}); err != types.ErrMalformed {
+		t.Error("expected ErrMalformed, got", err)
+	}
+}
+
+func TestDeleteWithProgress(t *testing.T) {
+	ch, _ := newTestHandler(t)
+
+	var reports [][2]int
+	err := ch.DeleteWithProgress(context.Background(), []string{"old/a", "new/b", "old/c"}, func(deleted, failed int) {
+		reports = append(reports, [2]int{deleted, failed})
+	})
+	if err != nil {
+		t.Fatal("DeleteWithProgress failed:", err)
+	}
+	// The primary handler is done first and reports once, the secondary reports per file.
+	if !slices.Equal(reports, [][2]int{{1, 0}, {2, 0}, {3, 0}}) {
+		t.Error("unexpected progress", reports)
+	}
+	if !slices.Equal(oldStorage.deleted, []string{"old/a", "old/c"}) || !slices.Equal(newStorage.deleted, []string{"new/b"}) {
+		t.Error("unexpected deletions", oldStorage.deleted, newStorage.deleted)
+	}
+}
@@ -9,11 +9,11 @@ import (
 	"errors"
 	"hash/fnv"
 	"io"
-	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/tinode/chat/server/logs"
@@ -35,12 +35,24 @@ type fileConfig struct {
 	ServeURL            string   `json:"serve_url"`
 	CorsOrigins         []string `json:"cors_origins"`
 	CacheControl        string   `json:"cache_control"`
+	// Extensions of serve URLs by MIME type, override the defaults.
+	Extensions map[string]string `json:"extensions"`
+	// Patterns of serve URLs of older versions, see media.ParseLegacyUrls.
+	LegacyServeURLs []string `json:"legacy_serve_urls"`
+	// Path the server is mounted under, like "/chat", prepended to relative serve URLs.
+	ServeURLBase string `json:"serve_url_base"`
 }
 
 type fshandler struct {
 	fileConfig
 	// corsOrigins parsed allowed origins.
 	corsOrigins []media.AllowedOrigin
+	// extensions parsed overrides of file extensions.
+	extensions map[string]string
+	// legacyURLs parsed patterns of legacy serve URLs.
+	legacyURLs []*regexp.Regexp
+	// serveURL with the base path, returned to clients.
+	serveURL string
 }
 
 func (fh *fshandler) Init(jsconf string) error {
@@ -57,6 +69,10 @@ func (fh *fshandler) Init(jsconf string) error {
 	if fh.ServeURL == "" {
 		fh.ServeURL = defaultServeURL
 	}
+	if fh.ServeURLBase, err = media.ParseServeURLBase(fh.ServeURLBase); err != nil {
+		return err
+	}
+	fh.serveURL = media.WithServeURLBase(fh.ServeURLBase, fh.ServeURL)
 
 	if fh.CacheControl == "" {
 		fh.CacheControl = defaultCacheControl
@@ -66,6 +82,14 @@ func (fh *fshandler) Init(jsconf string) error {
 	if err != nil {
 		return errors.New("failed to parse CORS allowed origins: " + err.Error())
 	}
+	fh.extensions, err = media.ParseExtensions(fh.Extensions)
+	if err != nil {
+		return errors.New("failed to parse extensions: " + err.Error())
+	}
+	fh.legacyURLs, err = media.ParseLegacyUrls(fh.LegacyServeURLs)
+	if err != nil {
+		return err
+	}
 	// Make sure the upload directory exists.
 	return os.MkdirAll(fh.FileUploadDirectory, 0777)
 }
@@ -123,7 +147,8 @@ func (fh *fshandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64,
 		return "", 0, err
 	}
 
-	if err = store.Files.StartUpload(fdef); err != nil {
+	// The record already exists if the file is re-uploaded, e.g. migrated from another handler.
+	if err = store.Files.StartUpload(fdef); err != nil && err != types.ErrDuplicate {
 		outfile.Close()
 		os.Remove(location)
 		logs.Warn.Println("failed to create file record", fdef.Id, err)
@@ -137,17 +162,13 @@ func (fh *fshandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64,
 		return "", 0, err
 	}
 
-	fname := fdef.Id
-	ext, _ := mime.ExtensionsByType(fdef.MimeType)
-	if len(ext) > 0 {
-		fname += ext[0]
-	}
+	fname := fdef.Id + media.FileExtension(fdef.MimeType, fh.extensions)
 
 	fdef.Location = location
 	// Use file path to create ETag. File paths are unique so will be the ETag.
 	fdef.ETag = etagFromPath(fdef.Location)
 
-	return fh.ServeURL + fname, size, nil
+	return fh.serveURL + fname, size, nil
 }
 
 // Download processes request for file download.
@@ -188,9 +209,14 @@ func (fh *fshandler) Delete(locations []string) error {
 	return nil
 }
 
+// OwnsLocation checks if the location is in the upload directory.
+func (fh *fshandler) OwnsLocation(location string) bool {
+	return location != "" && filepath.Dir(location) == filepath.Clean(fh.FileUploadDirectory)
+}
+
 // GetIdFromUrl converts an attahment URL to a file UID.
 func (fh *fshandler) GetIdFromUrl(url string) types.Uid {
-	return media.GetIdFromUrl(url, fh.ServeURL)
+	return media.GetIdFromUrl(media.TrimServeURLBase(url, fh.ServeURLBase), fh.ServeURL, fh.legacyURLs...)
 }
 
 // getFileRecord given file ID reads file record from the database.
@@ -2,19 +2,27 @@
 package media
 
 import (
+	"context"
 	"errors"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"slices"
 
 	"github.com/tinode/chat/server/store/types"
 )
 
+// ServerVersion is the version of the server, like "0.25.1". It's set by the server at startup
+// so the media handlers can report it to external services.
+var ServerVersion string
+
 // ReadSeekCloser must be implemented by the media being downloaded.
 type ReadSeekCloser interface {
 	io.Reader
@@ -45,6 +53,260 @@ type Handler interface {
 	GetIdFromUrl(url string) types.Uid
 }
 
+// FormUploadPolicy describes how a client can upload a file directly to storage with an HTML form.
+type FormUploadPolicy struct {
+	// URL to POST the multipart/form-data to.
+	URL string `json:"url"`
+	// Form fields which must precede the file field.
+	Fields map[string]string `json:"fields"`
+	// URL of the file to use in messages once uploaded.
+	Ref string `json:"ref"`
+	// Time when the policy expires.
+	Expires time.Time `json:"expires"`
+}
+
+// FormUploadHandler is an optional interface implemented by media handlers which support uploads
+// directly to storage with HTML forms.
+type FormUploadHandler interface {
+	// FormUploadPolicy creates a file record and a signed policy for uploading the file described by fdef.
+	// The size of the file is limited by maxSize, if greater than zero.
+	FormUploadPolicy(ctx context.Context, fdef *types.FileDef, maxSize int64) (*FormUploadPolicy, error)
+}
+
+// DownloadToken is a single-use token for downloading a file.
+type DownloadToken struct {
+	// The token to send with the download request.
+	Token string `json:"token"`
+	// Time when the token expires.
+	Expires time.Time `json:"expires"`
+}
+
+// DownloadTokenHandler is an optional interface implemented by media handlers which can require
+// single-use tokens for downloading files.
+type DownloadTokenHandler interface {
+	// DownloadToken issues a token for downloading the file with the given URL by the requester
+	// of the context.
+	DownloadToken(ctx context.Context, url string) (*DownloadToken, error)
+}
+
+// UploadResult describes the uploaded file.
+type UploadResult struct {
+	// URL to serve the file.
+	URL string
+	// Number of bytes stored.
+	Size int64
+	// ETag of the stored file, if known.
+	ETag string
+	// Location of the file in the storage, same as FileDef.Location.
+	Location string
+	// Content type of the stored file.
+	MimeType string
+	// Dimensions of images in pixels, 0 if unknown.
+	Width  int
+	Height int
+	// BlurHash of images, if computed.
+	Placeholder string
+	// URL to serve the thumbnail of images, if created.
+	Thumbnail string
+	// The file was stored by an earlier or concurrent upload of the same file. Its object must not be
+	// deleted if the file record fails to update.
+	Reused bool
+}
+
+// SizeLimitError is returned by media handlers when an uploaded file exceeds the size limit
+// applicable to it. It matches types.ErrTooLarge with errors.Is.
+type SizeLimitError struct {
+	// The limit in bytes.
+	Limit int64
+}
+
+func (e *SizeLimitError) Error() string {
+	return "file too large, limit " + strconv.FormatInt(e.Limit, 10) + " bytes"
+}
+
+func (e *SizeLimitError) Unwrap() error {
+	return types.ErrTooLarge
+}
+
+// QuotaExceededError is returned by media handlers when an upload would exceed the storage quota
+// of the tenant. It matches types.ErrPolicy with errors.Is.
+type QuotaExceededError struct {
+	// Name of the tenant.
+	Tenant string
+	// The quota in bytes.
+	Quota int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return "storage quota of tenant '" + e.Tenant + "' exceeded, quota " + strconv.FormatInt(e.Quota, 10) + " bytes"
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return types.ErrPolicy
+}
+
+// ImageDimensionsError is returned by media handlers when an uploaded image is larger or smaller
+// than allowed. It matches types.ErrPolicy with errors.Is.
+type ImageDimensionsError struct {
+	// Dimensions of the image in pixels.
+	Width, Height int
+}
+
+func (e *ImageDimensionsError) Error() string {
+	return "image dimensions " + strconv.Itoa(e.Width) + "x" + strconv.Itoa(e.Height) + " not allowed"
+}
+
+func (e *ImageDimensionsError) Unwrap() error {
+	return types.ErrPolicy
+}
+
+// SourceReadError is returned by media handlers when the file could not be read from the client
+// while uploading. The partial upload is discarded, so the client may retry.
+type SourceReadError struct {
+	Err error
+}
+
+func (e *SourceReadError) Error() string {
+	return "source read error: " + e.Err.Error()
+}
+
+func (e *SourceReadError) Unwrap() error {
+	return e.Err
+}
+
+// ExistingFileError is returned by media handlers when the upload of a file whose record already exists,
+// e.g. a retry with the same file ID, failed. The record and the object of the earlier upload are kept,
+// so the record must not be marked failed.
+type ExistingFileError struct {
+	Err error
+}
+
+func (e *ExistingFileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExistingFileError) Unwrap() error {
+	return e.Err
+}
+
+// ThrottledError is returned by media handlers when the storage refuses requests because of their rate.
+// It matches types.ErrUnavailable with errors.Is.
+type ThrottledError struct {
+	// How long the client should wait before retrying.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ThrottledError) Error() string {
+	return "storage throttled: " + e.Err.Error()
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return types.ErrUnavailable
+}
+
+// RetryAfterSeconds returns the value of the Retry-After header: the delay in whole seconds, at least 1.
+func (e *ThrottledError) RetryAfterSeconds() string {
+	return strconv.Itoa(max(int((e.RetryAfter+time.Second-1)/time.Second), 1))
+}
+
+// RequestError is returned by media handlers when a request to the storage failed, to report the ID the
+// storage assigned to the request. It matches the error of the request with errors.Is and errors.As.
+type RequestError struct {
+	// ID of the request, the value of the X-Amz-Request-Id header of responses.
+	RequestID string
+	// Extended ID of the request, x-amz-id-2 of S3.
+	HostID string
+	Err    error
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error() + ", request id " + e.RequestID
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// ExtendedUploadHandler is an optional interface implemented by media handlers which describe
+// uploaded files in detail.
+type ExtendedUploadHandler interface {
+	// UploadEx is Upload with request context which returns the description of the stored file.
+	UploadEx(ctx context.Context, fdef *types.FileDef, file io.Reader) (*UploadResult, error)
+}
+
+// FileMetadata is the description of a stored file.
+type FileMetadata struct {
+	Id        string    `json:"id"`
+	MimeType  string    `json:"mime,omitempty"`
+	Size      int64     `json:"size"`
+	ETag      string    `json:"etag,omitempty"`
+	CreatedAt time.Time `json:"created"`
+	// Time the stored object was last modified.
+	UpdatedAt time.Time `json:"modified"`
+	// BlurHash of the image to show while it's loading.
+	Placeholder string `json:"placeholder,omitempty"`
+	// URL of the thumbnail of the image.
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// Object metadata which is allowed to be exposed to clients.
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// MetadataHandler is an optional interface implemented by media handlers which can describe stored
+// files without serving them.
+type MetadataHandler interface {
+	// FileMetadata describes the file with the given URL. If full is true, the metadata of the stored
+	// object is included too.
+	FileMetadata(ctx context.Context, url string, full bool) (*FileMetadata, error)
+}
+
+// DeleteProgress is called after each batch of deleted files with the total numbers of
+// deleted and failed files so far.
+type DeleteProgress func(deleted, failed int)
+
+// ProgressDeleteHandler is an optional interface implemented by media handlers which
+// report progress of long deletions and can be cancelled.
+type ProgressDeleteHandler interface {
+	// DeleteWithProgress is Delete which calls progress, if not nil, after each batch.
+	// It stops at the next batch when ctx is cancelled.
+	DeleteWithProgress(ctx context.Context, locations []string, progress DeleteProgress) error
+}
+
+// ReconcileStats is the result of reconciling file records with the storage.
+type ReconcileStats struct {
+	// Number of checked records.
+	Checked int
+	// Number of records whose files are missing in the storage.
+	Missing int
+	// Number of deleted records of missing files, 0 in dry run.
+	Deleted int
+	// Number of records which could not be checked or deleted.
+	Failed int
+}
+
+// RecordReconciler is an optional interface implemented by media handlers which can find file records
+// whose files are missing in the storage, e.g. deleted out of band.
+type RecordReconciler interface {
+	// ReconcileRecords checks the files of all completed uploads and deletes the records of missing files
+	// unless dryRun is true. At most rate files are checked per second, 0 means no limit.
+	ReconcileRecords(ctx context.Context, dryRun bool, rate int) (*ReconcileStats, error)
+}
+
+// BatchPresignHandler is an optional interface implemented by media handlers which can sign download
+// URLs of several files at once, e.g. for prefetching the images of a gallery.
+type BatchPresignHandler interface {
+	// PresignURLs returns the download URLs of the files with the given ids by id. Files which are
+	// not found or can't be served by a presigned URL are omitted.
+	PresignURLs(ctx context.Context, fids []string) (map[string]string, error)
+}
+
+// LocationOwner is an optional interface implemented by media handlers which can tell if they store
+// files at the given locations, e.g. when several handlers are used together.
+type LocationOwner interface {
+	// OwnsLocation checks if the location, same as FileDef.Location, belongs to the handler.
+	OwnsLocation(location string) bool
+}
+
 type AllowedOrigin struct {
 	Origin      string
 	URL         url.URL
@@ -54,17 +316,188 @@ type AllowedOrigin struct {
 
 var fileNamePattern = regexp.MustCompile(`^[-_A-Za-z0-9]+`)
 
-// GetIdFromUrl is a helper method for extracting file ID from a URL.
-func GetIdFromUrl(url, serveUrl string) types.Uid {
-	dir, fname := path.Split(path.Clean(url))
+// Values of the "asatt" query parameter which request the file as an attachment or inline.
+var asAttachmentValues = map[string]bool{
+	"1": true, "t": true, "true": true, "y": true, "yes": true, "on": true, "attachment": true, "download": true,
+	"0": false, "f": false, "false": false, "n": false, "no": false, "off": false, "inline": false,
+}
+
+// ParseAsAttachment parses the value of the "asatt" query parameter, case-insensitive. Returns true
+// if the file is requested as an attachment and false if it's requested inline or the value is empty.
+// Other values are rejected with types.ErrMalformed.
+func ParseAsAttachment(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	asAttachment, ok := asAttachmentValues[strings.ToLower(value)]
+	if !ok {
+		return false, types.ErrMalformed
+	}
+	return asAttachment, nil
+}
+
+// ParseServeURLBase validates the path the server is mounted under, like "/chat", which is prepended to
+// relative serve URLs. Returns the path without the trailing slash, empty if the server is mounted at the root.
+func ParseServeURLBase(base string) (string, error) {
+	base = strings.TrimRight(base, "/")
+	if base == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(base, "/") || strings.HasPrefix(base, "//") || strings.ContainsAny(base, "?#") ||
+		path.Clean(base) != base {
+		return "", errors.New("invalid serve_url_base '" + base + "'")
+	}
+	return base, nil
+}
+
+// WithServeURLBase prepends the base path to the serve URL. Absolute serve URLs are returned as is.
+func WithServeURLBase(base, serveUrl string) string {
+	if base == "" || !strings.HasPrefix(serveUrl, "/") || strings.HasPrefix(serveUrl, "//") {
+		return serveUrl
+	}
+	return base + serveUrl
+}
+
+// TrimServeURLBase removes the base path from the URL of the file, so the URL can be resolved with
+// GetIdFromUrl whether it was returned with the base or received by the server with the base stripped.
+func TrimServeURLBase(url, base string) string {
+	if base != "" && strings.HasPrefix(url, base+"/") {
+		return url[len(base):]
+	}
+	return url
+}
+
+// GetIdFromUrl is a helper method for extracting file ID from a URL. URLs which don't match
+// the serve URL are matched against the legacy patterns, if any, see ParseLegacyUrls.
+// The query and fragment of serve URLs, like version tokens, are ignored.
+func GetIdFromUrl(url, serveUrl string, legacy ...*regexp.Regexp) types.Uid {
+	fpath := url
+	if i := strings.IndexAny(fpath, "?#"); i >= 0 {
+		fpath = fpath[:i]
+	}
+	dir, fname := path.Split(path.Clean(fpath))
 
 	if dir != "" && dir != serveUrl {
-		return types.ZeroUid
+		return getIdFromLegacyUrl(url, legacy)
 	}
 
 	return types.ParseUid(fileNamePattern.FindString(fname))
 }
 
+// Name of the group of legacy URL patterns which captures the file ID.
+const legacyIdGroup = "id"
+
+// ParseLegacyUrls compiles patterns of serve URLs used by older versions, so attachments
+// sent before migration can still be resolved. Each pattern is a regular expression which
+// must match the whole URL and capture the file ID with the named group "id", like
+// `/v0/media/(?P<id>[-_A-Za-z0-9]+)(\.\w+)?`.
+func ParseLegacyUrls(patterns []string) ([]*regexp.Regexp, error) {
+	var parsed []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, errors.New("invalid legacy URL pattern '" + pattern + "': " + err.Error())
+		}
+		if re.SubexpIndex(legacyIdGroup) < 0 {
+			return nil, errors.New("legacy URL pattern '" + pattern + "' has no group '" + legacyIdGroup + "'")
+		}
+		parsed = append(parsed, re)
+	}
+	return parsed, nil
+}
+
+// getIdFromLegacyUrl returns the file ID captured by the first matching legacy pattern.
+func getIdFromLegacyUrl(url string, legacy []*regexp.Regexp) types.Uid {
+	for _, re := range legacy {
+		if match := re.FindStringSubmatch(url); match != nil {
+			if fid := types.ParseUid(match[re.SubexpIndex(legacyIdGroup)]); !fid.IsZero() {
+				return fid
+			}
+		}
+	}
+	return types.ZeroUid
+}
+
+// Preferred extensions of common MIME types. The system MIME tables may list other
+// extensions first, like ".jpe" or ".jfif" for "image/jpeg".
+var preferredExtensions = map[string]string{
+	"image/jpeg":         ".jpg",
+	"image/png":          ".png",
+	"image/gif":          ".gif",
+	"image/webp":         ".webp",
+	"image/svg+xml":      ".svg",
+	"image/heic":         ".heic",
+	"image/bmp":          ".bmp",
+	"image/tiff":         ".tiff",
+	"video/mp4":          ".mp4",
+	"video/webm":         ".webm",
+	"video/mpeg":         ".mpeg",
+	"video/quicktime":    ".mov",
+	"audio/mpeg":         ".mp3",
+	"audio/mp4":          ".m4a",
+	"audio/aac":          ".aac",
+	"audio/ogg":          ".ogg",
+	"audio/wav":          ".wav",
+	"audio/webm":         ".weba",
+	"text/plain":         ".txt",
+	"text/html":          ".html",
+	"text/csv":           ".csv",
+	"application/pdf":    ".pdf",
+	"application/zip":    ".zip",
+	"application/gzip":   ".gz",
+	"application/json":   ".json",
+	"application/msword": ".doc",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": ".docx",
+	"application/vnd.ms-excel": ".xls",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.ms-powerpoint":                                             ".ppt",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+}
+
+var extensionPattern = regexp.MustCompile(`^(\.[A-Za-z0-9]+)+$`)
+
+// ParseExtensions validates configured extensions by MIME type which override the preferred ones.
+// An empty extension means no extension.
+func ParseExtensions(conf map[string]string) (map[string]string, error) {
+	if len(conf) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[string]string, len(conf))
+	for mimeType, ext := range conf {
+		mediaType, _, err := mime.ParseMediaType(mimeType)
+		if err != nil {
+			return nil, errors.New("invalid MIME type '" + mimeType + "'")
+		}
+		// Must start with a dot so the extension is not mistaken for a part of the file ID.
+		if ext != "" && !extensionPattern.MatchString(ext) {
+			return nil, errors.New("invalid extension '" + ext + "'")
+		}
+		parsed[mediaType] = ext
+	}
+	return parsed, nil
+}
+
+// FileExtension returns the extension with the leading dot to use in the URL of a file of the given
+// MIME type or an empty string. The overrides take precedence over the preferred extensions,
+// the extensions known to the mime package are the fallback.
+func FileExtension(mimeType string, overrides map[string]string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := overrides[mediaType]; ok {
+		return ext
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	if ext, _ := mime.ExtensionsByType(mediaType); len(ext) > 0 {
+		return ext[0]
+	}
+	return ""
+}
+
 // ParseCORSAllow pre-parses allowed origins from the configuration.
 func ParseCORSAllow(allowed []string) ([]AllowedOrigin, error) {
 	if len(allowed) == 0 {
@@ -200,7 +633,12 @@ func CORSHandler(method string, reqHeader http.Header, allowedOrigins []AllowedO
 			return respHeader, http.StatusNoContent
 		}
 
-		respHeader["Access-Control-Allow-Headers"] = []string{"*"}
+		// The "*" wildcard is not honored by browsers for requests with credentials, echo the requested headers.
+		if acHeaders := reqHeader.Get("Access-Control-Request-Headers"); acHeaders != "" {
+			respHeader["Access-Control-Allow-Headers"] = []string{acHeaders}
+		} else {
+			respHeader["Access-Control-Allow-Headers"] = []string{"*"}
+		}
 		respHeader["Access-Control-Allow-Credentials"] = []string{"true"}
 		respHeader["Access-Control-Allow-Methods"] = []string{strings.Join(allowMethods, ", ")}
 		respHeader["Access-Control-Max-Age"] = []string{"86400"}
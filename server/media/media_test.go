@@ -1,8 +1,21 @@
 package media
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
 )
 
 func TestMatchCORSOrigin(t *testing.T) {
@@ -219,3 +232,334 @@ func TestMatchCORSOrigin(t *testing.T) {
 func containsSubstring(str, substr string) bool {
 	return strings.Contains(strings.ToLower(str), strings.ToLower(substr))
 }
+
+func TestFileExtension(t *testing.T) {
+	overrides, err := ParseExtensions(map[string]string{"image/jpeg": ".jpeg", "Application/X-Custom": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		mimeType  string
+		overrides map[string]string
+		expected  string
+	}{
+		{"image/jpeg", nil, ".jpg"},
+		{"image/jpeg", overrides, ".jpeg"},
+		{"IMAGE/PNG", nil, ".png"},
+		{"text/plain; charset=utf-8", nil, ".txt"},
+		{"video/mp4", nil, ".mp4"},
+		{"application/pdf", nil, ".pdf"},
+		{"application/x-custom", overrides, ""},
+		{"application/x-unknown-type", nil, ""},
+		{"not a type", nil, ""},
+	} {
+		if got := FileExtension(tc.mimeType, tc.overrides); got != tc.expected {
+			t.Errorf("%s: expected extension '%s', got '%s'", tc.mimeType, tc.expected, got)
+		}
+	}
+
+	for _, ext := range []string{"jpg", ".", ".j/p", "..jpg", ".jpg."} {
+		if _, err := ParseExtensions(map[string]string{"image/jpeg": ext}); err == nil {
+			t.Errorf("Extension '%s' must be rejected", ext)
+		}
+	}
+}
+
+func TestGetIdFromUrl(t *testing.T) {
+	fid := types.Uid(12345)
+	for _, ext := range []string{"", ".jpg", ".jpe", ".jpeg", ".tar.gz", ".docx"} {
+		if got := GetIdFromUrl("/v0/file/s/"+fid.String()+ext, "/v0/file/s/"); got != fid {
+			t.Errorf("Extension '%s': expected %v, got %v", ext, fid, got)
+		}
+	}
+	for _, suffix := range []string{"?cv=AbC-12_x", ".jpg?cv=a/b", ".jpg#frag", "?ver=1&sig=a%2Fb"} {
+		if got := GetIdFromUrl("/v0/file/s/"+fid.String()+suffix, "/v0/file/s/"); got != fid {
+			t.Errorf("Suffix '%s': expected %v, got %v", suffix, fid, got)
+		}
+	}
+	if got := GetIdFromUrl("/other/"+fid.String()+".jpg", "/v0/file/s/"); !got.IsZero() {
+		t.Error("Wrong serve URL must not match", got)
+	}
+}
+
+func TestServeURLBase(t *testing.T) {
+	fid := types.Uid(12345)
+	for _, tc := range []struct {
+		base, serveURL, want string
+	}{
+		// Root mount.
+		{"", "/v0/file/s/", "/v0/file/s/"},
+		{"/", "/v0/file/s/", "/v0/file/s/"},
+		// Subpath mount.
+		{"/chat", "/v0/file/s/", "/chat/v0/file/s/"},
+		{"/chat/", "/v0/file/s/", "/chat/v0/file/s/"},
+		// Absolute serve URLs are unaffected.
+		{"/chat", "https://files.example.com/s/", "https://files.example.com/s/"},
+	} {
+		base, err := ParseServeURLBase(tc.base)
+		if err != nil {
+			t.Fatal("Base rejected:", tc.base, err)
+		}
+		url := WithServeURLBase(base, tc.serveURL)
+		if url != tc.want {
+			t.Errorf("Base '%s': expected %s, got %s", tc.base, tc.want, url)
+		}
+		if !strings.HasPrefix(url, "/") {
+			continue
+		}
+		// Resolved with and without the base.
+		for _, ref := range []string{url + fid.String() + ".jpg", tc.serveURL + fid.String() + ".jpg"} {
+			if got := GetIdFromUrl(TrimServeURLBase(ref, base), tc.serveURL); got != fid {
+				t.Errorf("Base '%s': expected %v from %s, got %v", tc.base, fid, ref, got)
+			}
+		}
+	}
+	for _, base := range []string{"chat", "//host/chat", "/chat?x=1", "/a/../b"} {
+		if _, err := ParseServeURLBase(base); err == nil {
+			t.Errorf("Invalid base '%s' accepted", base)
+		}
+	}
+}
+
+func TestParseAsAttachment(t *testing.T) {
+	for _, value := range []string{"1", "t", "true", "TRUE", "y", "yes", "On", "attachment", "download"} {
+		if asAttachment, err := ParseAsAttachment(value); err != nil || !asAttachment {
+			t.Errorf("'%s' must request attachment, got %v %v", value, asAttachment, err)
+		}
+	}
+	for _, value := range []string{"", "0", "f", "false", "n", "No", "off", "inline", "INLINE"} {
+		if asAttachment, err := ParseAsAttachment(value); err != nil || asAttachment {
+			t.Errorf("'%s' must request inline, got %v %v", value, asAttachment, err)
+		}
+	}
+	for _, value := range []string{"2", "maybe", "attach", " true", "yes please"} {
+		if _, err := ParseAsAttachment(value); err != types.ErrMalformed {
+			t.Errorf("'%s' must be rejected, got %v", value, err)
+		}
+	}
+}
+
+func TestGetIdFromLegacyUrl(t *testing.T) {
+	legacy, err := ParseLegacyUrls([]string{
+		// Older serve URL.
+		`/v0/media/(?P<id>[-_A-Za-z0-9]+)(\.\w+)?`,
+		// File name after the ID.
+		`/v0/file/s/(?P<id>[-_A-Za-z0-9]+)/[^/]+`,
+		// Absolute URL of the old server with the ID in the query.
+		`https://files\.example\.com/get\?id=(?P<id>[-_A-Za-z0-9]+)`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fid := types.Uid(12345)
+	for _, url := range []string{
+		"/v0/media/" + fid.String(),
+		"/v0/media/" + fid.String() + ".jpg",
+		"/v0/file/s/" + fid.String() + "/photo.jpg",
+		"https://files.example.com/get?id=" + fid.String(),
+		// The current format still takes precedence.
+		"/v0/file/s/" + fid.String() + ".jpg",
+	} {
+		if got := GetIdFromUrl(url, "/v0/file/s/", legacy...); got != fid {
+			t.Errorf("'%s': expected %v, got %v", url, fid, got)
+		}
+	}
+	for _, url := range []string{
+		"/other/" + fid.String() + ".jpg",
+		"/v0/media/" + fid.String() + "/extra",
+		"/prefix/v0/media/" + fid.String(),
+		"https://files.example.com/get?id=",
+	} {
+		if got := GetIdFromUrl(url, "/v0/file/s/", legacy...); !got.IsZero() {
+			t.Errorf("'%s' must not match, got %v", url, got)
+		}
+	}
+
+	for _, pattern := range []string{`/v0/media/([a-z]+)`, `/v0/media/(?P<id>`} {
+		if _, err := ParseLegacyUrls([]string{pattern}); err == nil {
+			t.Errorf("Pattern '%s' must be rejected", pattern)
+		}
+	}
+}
+
+func TestMemoryURLCache(t *testing.T) {
+	cache := &memoryURLCache{}
+	if err := cache.Init(`{"size": 2}`); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	cache.Set(ctx, "a", "https://a", time.Minute)
+	cache.Set(ctx, "expired", "https://expired", -time.Second)
+	if url, _ := cache.Get(ctx, "a"); url != "https://a" {
+		t.Error("Cached URL not returned", url)
+	}
+	if url, _ := cache.Get(ctx, "expired"); url != "" {
+		t.Error("Expired URL returned", url)
+	}
+	// Full: expired URLs are dropped first.
+	cache.Set(ctx, "expired", "https://expired", -time.Second)
+	cache.Set(ctx, "b", "https://b", time.Minute)
+	if url, _ := cache.Get(ctx, "a"); url != "https://a" {
+		t.Error("Valid URL dropped", url)
+	}
+	if len(cache.urls) > 2 {
+		t.Error("Cache exceeds its size", len(cache.urls))
+	}
+
+	if GetURLCache("memory") == nil || GetURLCache("none") != nil {
+		t.Error("Wrong registered caches")
+	}
+	if err := cache.Init(`{"size": -1}`); err == nil {
+		t.Error("Negative size accepted")
+	}
+}
+
+func TestThumbnailers(t *testing.T) {
+	if GetThumbnailer("builtin") == nil || GetThumbnailer("http") == nil || GetThumbnailer("none") != nil {
+		t.Error("Wrong registered thumbnailers")
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 100; y++ {
+			src.Set(x, y, color.RGBA{R: 200, B: 50, A: 255})
+		}
+	}
+	var pngData, jpegData bytes.Buffer
+	png.Encode(&pngData, src)
+	jpeg.Encode(&jpegData, src, nil)
+
+	ctx := context.Background()
+	builtin := imageThumbnailer{}
+	for _, tc := range []struct {
+		data     []byte
+		mimeType string
+	}{
+		{pngData.Bytes(), "image/png"},
+		{jpegData.Bytes(), "image/jpeg"},
+	} {
+		thumb, mimeType, err := builtin.Thumbnail(ctx, tc.mimeType, tc.data, 200)
+		if err != nil {
+			t.Fatal("Thumbnail failed:", err)
+		}
+		if mimeType != tc.mimeType {
+			t.Error("Wrong thumbnail type", mimeType, "expected", tc.mimeType)
+		}
+		img, _, err := image.Decode(bytes.NewReader(thumb))
+		if err != nil {
+			t.Fatal("Thumbnail not decoded:", err)
+		}
+		if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 50 {
+			t.Error("Wrong thumbnail dimensions", b)
+		}
+		if r, _, bl, _ := img.At(100, 25).RGBA(); r>>8 < 190 || bl>>8 > 60 {
+			t.Error("Wrong thumbnail color", r>>8, bl>>8)
+		}
+	}
+	if _, _, err := builtin.Thumbnail(ctx, "image/png", []byte("not an image"), 200); err == nil {
+		t.Error("Thumbnail of a non-image created")
+	}
+
+	var status int
+	var respType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.URL.Query().Get("size") != "200" ||
+			r.Header.Get("Content-Type") != "image/png" || !bytes.Equal(body, pngData.Bytes()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", respType)
+		w.WriteHeader(status)
+		io.WriteString(w, "thumbnail")
+	}))
+	defer srv.Close()
+
+	remote := &httpThumbnailer{}
+	if err := remote.Init(`{"url": "` + srv.URL + `/thumb"}`); err != nil {
+		t.Fatal(err)
+	}
+	status, respType = http.StatusOK, "image/webp"
+	thumb, mimeType, err := remote.Thumbnail(ctx, "image/png", pngData.Bytes(), 200)
+	if err != nil || string(thumb) != "thumbnail" || mimeType != "image/webp" {
+		t.Error("Unexpected remote thumbnail", string(thumb), mimeType, err)
+	}
+	for _, tc := range []struct {
+		status   int
+		respType string
+	}{
+		{http.StatusInternalServerError, "image/webp"},
+		{http.StatusOK, "text/html"},
+	} {
+		status, respType = tc.status, tc.respType
+		if _, _, err = remote.Thumbnail(ctx, "image/png", pngData.Bytes(), 200); err == nil {
+			t.Error("Failed response accepted", tc.status, tc.respType)
+		}
+	}
+	if err = remote.Init(`{"max_size": 4, "url": "` + srv.URL + `"}`); err != nil {
+		t.Fatal(err)
+	}
+	status, respType = http.StatusOK, "image/webp"
+	if _, _, err = remote.Thumbnail(ctx, "image/png", pngData.Bytes(), 200); err == nil {
+		t.Error("Too large thumbnail accepted")
+	}
+	if err = remote.Init(`{"url": "ftp://host/thumb"}`); err == nil {
+		t.Error("Invalid URL accepted")
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	type inner struct {
+		Name   string          `json:"name"`
+		Config json.RawMessage `json:"config"`
+	}
+	type embedded struct {
+		Debug bool `json:"debug"`
+	}
+	type config struct {
+		embedded
+		Mode    string           `json:"mode"`
+		Rate    float64          `json:"rate"`
+		Kinds   []string         `json:"kinds"`
+		Sizes   map[string]int64 `json:"sizes"`
+		Plugin  *inner           `json:"plugin"`
+		Ignored string           `json:"-"`
+		secret  string
+	}
+
+	data, err := ConfigSchema("Test", config{}, map[string][]string{"mode": {"a", "b"}, "kinds": {"x"},
+		"plugin.name": {"p"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Dialect    string                     `json:"$schema"`
+		Title      string                     `json:"title"`
+		Extra      bool                       `json:"additionalProperties"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err = json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema.Dialect == "" || schema.Title != "Test" || schema.Extra {
+		t.Error("Unexpected schema", string(data))
+	}
+	for name, expected := range map[string]string{
+		"debug":  `{"type":"boolean"}`,
+		"mode":   `{"enum":["a","b"],"type":"string"}`,
+		"rate":   `{"type":"number"}`,
+		"kinds":  `{"items":{"enum":["x"],"type":"string"},"type":"array"}`,
+		"sizes":  `{"additionalProperties":{"type":"integer"},"type":"object"}`,
+		"plugin": `{"additionalProperties":false,"properties":{"config":{},"name":{"enum":["p"],"type":"string"}},"type":"object"}`,
+	} {
+		var compact bytes.Buffer
+		json.Compact(&compact, schema.Properties[name])
+		if compact.String() != expected {
+			t.Error("Property", name, "expected", expected, "got", compact.String())
+		}
+	}
+	if len(schema.Properties) != 6 {
+		t.Error("Unexpected properties", string(data))
+	}
+}
@@ -0,0 +1,89 @@
+package media
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// RequestInfo describes the client request on behalf of which the media handler is called.
+type RequestInfo struct {
+	// ID of the authenticated user, zero if not authenticated.
+	Uid types.Uid
+	// ID of the client session, if the request is authenticated by the session.
+	SessionId string
+	// Address of the client.
+	RemoteAddr string
+	// Topic the file is uploaded to, if provided by the client.
+	Topic string
+	// Language of the uploaded content as a BCP 47 tag, if provided by the client.
+	Language string
+	// Cache-Control directives for the uploaded file, like "no-store" for ephemeral content,
+	// if provided by the client.
+	CacheControl string
+	// Lifetime of the uploaded file in seconds, if provided by the client.
+	TTL string
+	// Maximum number of downloads of the uploaded file, if provided by the client.
+	MaxDownloads string
+	// Store the uploaded file as immutable, if requested by the client.
+	Immutable bool
+	// Name of the uploaded file, if provided by the client.
+	Filename string
+	// Headers of the HTTP request, empty for gRPC.
+	Header http.Header
+}
+
+type requestInfoKey struct{}
+
+// NewContext returns a copy of the parent context which carries the request info.
+func NewContext(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns request info stored in the context or nil if missing.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// ContextHandler is an optional interface implemented by media handlers which use the context of
+// the client request. The methods are the same as the corresponding methods of Handler.
+type ContextHandler interface {
+	// HeadersWithContext is Headers with request context.
+	HeadersWithContext(ctx context.Context, method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error)
+
+	// UploadWithContext is Upload with request context.
+	UploadWithContext(ctx context.Context, fdef *types.FileDef, file io.Reader) (string, int64, error)
+}
+
+// Headers calls ContextHandler.HeadersWithContext if the handler implements it, Handler.Headers otherwise.
+func Headers(ctx context.Context, mh Handler, method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
+	if ch, ok := mh.(ContextHandler); ok {
+		return ch.HeadersWithContext(ctx, method, url, headers, serve)
+	}
+	return mh.Headers(method, url, headers, serve)
+}
+
+// Upload calls ContextHandler.UploadWithContext if the handler implements it, Handler.Upload otherwise.
+func Upload(ctx context.Context, mh Handler, fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	if ch, ok := mh.(ContextHandler); ok {
+		return ch.UploadWithContext(ctx, fdef, file)
+	}
+	return mh.Upload(fdef, file)
+}
+
+// UploadEx calls ExtendedUploadHandler.UploadEx if the handler implements it. Otherwise the file is
+// uploaded with Upload and described by the file record.
+func UploadEx(ctx context.Context, mh Handler, fdef *types.FileDef, file io.Reader) (*UploadResult, error) {
+	if eh, ok := mh.(ExtendedUploadHandler); ok {
+		return eh.UploadEx(ctx, fdef, file)
+	}
+	url, size, err := Upload(ctx, mh, fdef, file)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadResult{URL: url, Size: size, ETag: fdef.ETag, Location: fdef.Location, MimeType: fdef.MimeType}, nil
+}
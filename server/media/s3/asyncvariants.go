@@ -0,0 +1,228 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// With async_variants, uploads return as soon as the object is stored. Compressed variants, placeholders
+// and thumbnails are generated in background by reading the object back from S3. Until they are ready,
+// the object itself is served and the upload result has no placeholder or thumbnail. Jobs which fail to
+// read the object are retried with exponential backoff. Once out of retries, the file record is marked
+// so variants of the file are not looked up anymore.
+const (
+	// Default number of uploads processed concurrently.
+	defaultAsyncVariantsWorkers = 2
+	// Default maximum number of uploads waiting for their variants.
+	defaultAsyncVariantsQueue = 1024
+	// Time to generate and store all variants of an upload.
+	asyncVariantsTimeout = 2 * time.Minute
+	// Default delay before the first retry of a failed job in milliseconds.
+	defaultAsyncVariantsBackoff = 1000
+	// Maximum delay between retries of a failed job.
+	maxAsyncVariantsBackoff = 10 * time.Minute
+	// Time to cache the absence of a variant. Variants may still be generated, by this node
+	// after a restart or by another node, which does not know they are pending.
+	missingVariantCacheTTL = 30 * time.Second
+)
+
+// Outcomes of variant jobs, reported through expvar. The failure rate is failures/jobs.
+var (
+	variantJobs     = expvar.NewInt("S3VariantJobs")
+	variantRetries  = expvar.NewInt("S3VariantRetries")
+	variantFailures = expvar.NewInt("S3VariantFailures")
+)
+
+type asyncVariantsConfig struct {
+	// Number of uploads processed concurrently, 2 if 0.
+	Workers int `json:"workers"`
+	// Maximum number of uploads waiting for their variants, 1024 if 0. Uploads which don't fit
+	// get no variants.
+	QueueSize int `json:"queue_size"`
+	// Number of retries of a job which failed to read the object, 0 disables.
+	Retries int `json:"retries"`
+	// Delay before the first retry in milliseconds, doubled with every retry, 1000 if 0.
+	RetryBackoff int `json:"retry_backoff"`
+}
+
+// variantJob is an upload waiting for its variants.
+type variantJob struct {
+	fdef         types.FileDef
+	size         int64
+	lang         *string
+	cacheControl string
+	// Number of earlier failed attempts.
+	attempt int
+}
+
+// variantWorkers generates variants of uploads in background.
+type variantWorkers struct {
+	queue chan *variantJob
+
+	mu sync.Mutex
+	// Locations of objects with variants queued or being generated.
+	pending map[string]bool
+}
+
+// initAsyncVariants validates the configuration and starts the workers.
+func (ah *awshandler) initAsyncVariants() error {
+	conf := ah.conf.AsyncVariants
+	if conf == nil {
+		return nil
+	}
+	if conf.Workers < 0 || conf.QueueSize < 0 || conf.Retries < 0 || conf.RetryBackoff < 0 {
+		return errors.New("invalid async_variants")
+	}
+	if conf.Workers == 0 {
+		conf.Workers = defaultAsyncVariantsWorkers
+	}
+	if conf.QueueSize == 0 {
+		conf.QueueSize = defaultAsyncVariantsQueue
+	}
+	if conf.RetryBackoff == 0 {
+		conf.RetryBackoff = defaultAsyncVariantsBackoff
+	}
+	ah.variantWorkers = &variantWorkers{
+		queue:   make(chan *variantJob, conf.QueueSize),
+		pending: make(map[string]bool),
+	}
+	for range conf.Workers {
+		go ah.runVariantWorker()
+	}
+	return nil
+}
+
+// queueVariants queues generating the variants of the stored upload. It never blocks.
+func (ah *awshandler) queueVariants(fdef *types.FileDef, size int64, lang *string, cacheControl string) {
+	vw := ah.variantWorkers
+	if vw == nil || !ah.hasVariants() {
+		return
+	}
+	job := &variantJob{fdef: *fdef, size: size, lang: lang, cacheControl: cacheControl}
+	vw.mu.Lock()
+	vw.pending[fdef.Location] = true
+	vw.mu.Unlock()
+	select {
+	case vw.queue <- job:
+	default:
+		vw.done(fdef.Location)
+		logs.Warn.Println("s3: variants queue full, dropped", ah.redact.ref(fdef.Id))
+	}
+}
+
+// variantsMissing checks if the variants of the file are not generated yet on this node or failed
+// permanently. Lookups of variants are skipped then.
+func (ah *awshandler) variantsMissing(fdef *types.FileDef) bool {
+	if fdef.VariantsFailed {
+		return true
+	}
+	vw := ah.variantWorkers
+	if vw == nil {
+		return false
+	}
+	vw.mu.Lock()
+	defer vw.mu.Unlock()
+	return vw.pending[ah.objectLocation(fdef)]
+}
+
+// missingVariantTTL is the time to cache the absence of a variant, 0 for good. With async_variants,
+// a variant which is not found may be generated later.
+func (ah *awshandler) missingVariantTTL() time.Duration {
+	if ah.variantWorkers == nil {
+		return 0
+	}
+	return missingVariantCacheTTL
+}
+
+func (vw *variantWorkers) done(location string) {
+	vw.mu.Lock()
+	delete(vw.pending, location)
+	vw.mu.Unlock()
+}
+
+func (ah *awshandler) runVariantWorker() {
+	for job := range ah.variantWorkers.queue {
+		if job.attempt == 0 {
+			variantJobs.Add(1)
+		}
+		err := ah.generateVariants(job)
+		if err == nil || !ah.retryVariants(job, err) {
+			ah.variantWorkers.done(job.fdef.Location)
+		}
+	}
+}
+
+// retryVariants queues the failed job again after a backoff. If the object is gone or the job is
+// out of retries, the file record is marked as having no variants and false is returned.
+func (ah *awshandler) retryVariants(job *variantJob, err error) bool {
+	conf := ah.conf.AsyncVariants
+	if err == types.ErrNotFound || job.attempt >= conf.Retries {
+		variantFailures.Add(1)
+		logs.Warn.Println("s3: variants failed permanently", ah.redact.ref(job.fdef.Id), "attempts", job.attempt+1, err)
+		err = ah.storeBreaker.call(func() error { return store.Files.MarkVariantsFailed(job.fdef.Id) })
+		if err != nil {
+			logs.Warn.Println("s3: failed to mark variants as failed", ah.redact.ref(job.fdef.Id), err)
+		}
+		return false
+	}
+
+	backoff := time.Millisecond * time.Duration(conf.RetryBackoff)
+	for range job.attempt {
+		backoff = min(2*backoff, maxAsyncVariantsBackoff)
+	}
+	job.attempt++
+	variantRetries.Add(1)
+	logs.Info.Println("s3: retrying variants", ah.redact.ref(job.fdef.Id), "after", backoff, err)
+	time.AfterFunc(backoff, func() {
+		select {
+		case ah.variantWorkers.queue <- job:
+		default:
+			ah.variantWorkers.done(job.fdef.Location)
+			logs.Warn.Println("s3: variants queue full, dropped", ah.redact.ref(job.fdef.Id))
+		}
+	})
+	return true
+}
+
+// generateVariants reads the object back from S3 and stores its variants. Failures to read the object
+// are returned to be retried. Failures to store variants are logged but otherwise ignored: variants
+// are optional.
+func (ah *awshandler) generateVariants(job *variantJob) error {
+	fdef := &job.fdef
+	comps := ah.newCompressors(fdef, job.size)
+	lqip := ah.newPlaceholderBuffer(fdef, job.size)
+	thumb := ah.newThumbnailBuffer(fdef, job.size)
+	writers := variantWriters(comps, lqip, thumb)
+	if len(writers) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), asyncVariantsTimeout)
+	defer cancel()
+	fdef.Size = job.size
+	or, err := newObjectReader(ctx, ah, fdef)
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(writers...), or)
+		or.Close()
+	}
+	if err != nil {
+		logs.Warn.Println("s3: failed to read object for variants", ah.redact.ref(fdef.Id), err)
+		return err
+	}
+
+	ah.storeVariants(ctx, fdef, comps, job.lang, job.cacheControl)
+	// Nobody waits for the result anymore.
+	var res media.UploadResult
+	ah.storePlaceholder(ctx, fdef, lqip, &res)
+	ah.storeThumbnail(ctx, fdef, thumb, job.cacheControl, &res)
+	return nil
+}
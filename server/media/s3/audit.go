@@ -0,0 +1,131 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default number of audit records waiting to be written. Records are dropped when the queue is full.
+	defaultAuditQueueSize = 4096
+	auditTimeout          = 10 * time.Second
+)
+
+// Audit records which could not be written, reported through expvar.
+var (
+	auditDropped = expvar.NewInt("S3AuditDropped")
+	auditFailed  = expvar.NewInt("S3AuditFailed")
+)
+
+// auditRecord is an entry of the audit log of downloads.
+type auditRecord struct {
+	Id         string    `json:"id"`
+	User       string    `json:"user,omitempty"`
+	SessionId  string    `json:"session,omitempty"`
+	RemoteAddr string    `json:"ip,omitempty"`
+	Time       time.Time `json:"time"`
+	// The file was streamed through the server rather than redirected to S3.
+	Proxy bool `json:"proxy,omitempty"`
+}
+
+// auditLogger writes the audit log of downloads in background: records are appended to a file as
+// JSON lines or POSTed to a URL one by one.
+type auditLogger struct {
+	file   *os.File
+	url    string
+	client *http.Client
+	queue  chan []byte
+	redact *logRedactor
+}
+
+// newAuditLogger opens the sink and starts the logger. Returns nil if the sink is not configured.
+func newAuditLogger(sink string, queueSize int, redact *logRedactor) (*auditLogger, error) {
+	if sink == "" {
+		return nil, nil
+	}
+	if queueSize < 0 {
+		return nil, errors.New("invalid audit_queue_size")
+	}
+	if queueSize == 0 {
+		queueSize = defaultAuditQueueSize
+	}
+
+	al := &auditLogger{queue: make(chan []byte, queueSize), redact: redact}
+	if strings.HasPrefix(sink, "http://") || strings.HasPrefix(sink, "https://") {
+		al.url = sink
+		al.client = &http.Client{Timeout: auditTimeout}
+	} else {
+		file, err := os.OpenFile(sink, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, errors.New("failed to open audit_log: " + err.Error())
+		}
+		al.file = file
+	}
+	go al.run()
+	return al, nil
+}
+
+// log queues the record of the download of the file by the requester from the context. It never blocks.
+func (al *auditLogger) log(ctx context.Context, fdef *types.FileDef, proxy bool) {
+	if al == nil {
+		return
+	}
+
+	rec := auditRecord{Id: fdef.Id, Time: time.Now().UTC(), Proxy: proxy}
+	if info := media.RequestInfoFromContext(ctx); info != nil {
+		if !info.Uid.IsZero() {
+			rec.User = info.Uid.UserId()
+		}
+		rec.SessionId = info.SessionId
+		rec.RemoteAddr = info.RemoteAddr
+	}
+	line, err := json.Marshal(&rec)
+	if err != nil {
+		logs.Warn.Println("s3: failed to serialize audit record", al.redact.ref(fdef.Id), err)
+		return
+	}
+
+	select {
+	case al.queue <- append(line, '\n'):
+	default:
+		auditDropped.Add(1)
+		logs.Warn.Println("s3: audit queue full, dropped", al.redact.ref(fdef.Id))
+	}
+}
+
+func (al *auditLogger) run() {
+	for line := range al.queue {
+		if err := al.write(line); err != nil {
+			auditFailed.Add(1)
+			logs.Warn.Println("s3: failed to write audit record:", err)
+		}
+	}
+}
+
+func (al *auditLogger) write(line []byte) error {
+	if al.file != nil {
+		_, err := al.file.Write(line)
+		return err
+	}
+
+	resp, err := al.client.Post(al.url, "application/json; charset=utf-8", bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("audit sink responded with " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default maximum number of files presigned in one request.
+	defaultBatchPresignMaxFiles = 50
+	// Maximum number of requesters whose rate is tracked.
+	maxBatchRequesters = 10000
+)
+
+type batchPresignConfig struct {
+	// Maximum number of files presigned in one request, 50 if 0.
+	MaxFiles int `json:"max_files"`
+	// Maximum number of files presigned per minute per user, 0 means no limit.
+	Rate int `json:"rate"`
+}
+
+// initBatchPresign validates the configuration of batch presigning.
+func (ah *awshandler) initBatchPresign() error {
+	conf := ah.conf.BatchPresign
+	if conf == nil {
+		return nil
+	}
+	if ah.conf.DownloadTokenTTL > 0 {
+		return errors.New("batch_presign can't be used with download_token_ttl")
+	}
+	if ah.conf.Proxy == proxyAlways {
+		return errors.New("batch_presign can't be used when proxy is 'always'")
+	}
+	if conf.MaxFiles < 0 {
+		return errors.New("invalid batch_presign max_files")
+	}
+	if conf.MaxFiles == 0 {
+		conf.MaxFiles = defaultBatchPresignMaxFiles
+	}
+	if conf.Rate < 0 {
+		return errors.New("invalid batch_presign rate")
+	}
+	if conf.Rate > 0 {
+		ah.batchLimiter = newBatchLimiter(conf.Rate)
+	}
+	return nil
+}
+
+// PresignURLs returns the download URLs of the files by id. Files which are not found, not uploaded yet,
+// immutable or expired are omitted: they are served by the serve URL as usual.
+func (ah *awshandler) PresignURLs(ctx context.Context, fids []string) (map[string]string, error) {
+	conf := ah.conf.BatchPresign
+	if conf == nil {
+		return nil, types.ErrUnsupported
+	}
+
+	ids := make([]string, 0, len(fids))
+	seen := make(map[string]bool, len(fids))
+	for _, fid := range fids {
+		if types.ParseUid(fid).IsZero() {
+			return nil, types.ErrMalformed
+		}
+		if !seen[fid] {
+			seen[fid] = true
+			ids = append(ids, fid)
+		}
+	}
+	if len(ids) > conf.MaxFiles {
+		return nil, types.ErrTooLarge
+	}
+	if len(ids) == 0 {
+		return map[string]string{}, nil
+	}
+
+	if ah.batchLimiter != nil && !ah.batchLimiter.allow(batchRequester(ctx), len(ids)) {
+		return nil, types.ErrPolicy
+	}
+
+	var fdefs []types.FileDef
+	err := ah.storeBreaker.call(func() error {
+		var err error
+		fdefs, err = store.Files.GetAll(ids)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var headers http.Header
+	if info := media.RequestInfoFromContext(ctx); info != nil {
+		headers = info.Header
+	}
+	// All URLs are signed by the same client and credentials.
+	presign, bucket := ah.presignClient(headers)
+	network := ah.clientNetwork(ctx)
+	var pin func(*s3.PresignOptions)
+	if network != "" {
+		// The credentials must outlive the longest URL.
+		if pin, err = ah.pinPresign(ctx, network, time.Second*time.Duration(ah.conf.PresignTTL)); err != nil {
+			return nil, err
+		}
+	} else {
+		pin = func(*s3.PresignOptions) {}
+	}
+
+	urls := make(map[string]string, len(fdefs))
+	for i := range fdefs {
+		fdef, err := ah.completeFormUpload(ctx, &fdefs[i])
+		if err != nil || fdef.Status != types.UploadCompleted {
+			continue
+		}
+		// Immutable files are served by the version pinned by the token of the serve URL.
+		if ah.isImmutable(fdef) {
+			continue
+		}
+		// Downloads of files with a download limit are counted only when served one by one.
+		if fdef.DownloadLimit > 0 {
+			continue
+		}
+		// Presigned URLs of files which must not render inline are altered to attachments one by one.
+		if !ah.inlineAllowed(fdef.MimeType) {
+			continue
+		}
+		if ah.conf.MissingObjectStatus != 0 && ah.objectMissing(ctx, fdef) {
+			continue
+		}
+
+		// Presigned URLs of self-destructing files must not outlive the files.
+		ttl := time.Second * time.Duration(ah.conf.PresignTTL)
+		expires := ah.objectExpiry(ctx, fdef)
+		if !expires.IsZero() {
+			remaining := time.Until(expires).Truncate(time.Second)
+			if remaining < time.Second {
+				continue
+			}
+			ttl = min(ttl, remaining)
+		}
+
+		if ah.isPublic(ctx, fdef, expires) {
+			urls[fdef.Id] = ah.publicURL(fdef)
+		} else if ah.cdnCookieEligible(fdef, expires) {
+			urls[fdef.Id] = ah.cdnCookieURL(fdef)
+		} else {
+			url, err := ah.presignGet(ctx, fdef, presign, bucket, ah.objectLocation(fdef), nil,
+				ah.cacheControl(ctx, fdef), nil, nil, ttl, pin, network)
+			var throttled *media.ThrottledError
+			if errors.As(err, &throttled) {
+				// The rest of the batch would be rejected too.
+				return nil, err
+			}
+			if err != nil {
+				logs.Warn.Println("s3: failed to presign URL", ah.redact.ref(fdef.Id), err)
+				continue
+			}
+			urls[fdef.Id] = url
+		}
+		ah.audit.log(ctx, fdef, false)
+	}
+	return urls, nil
+}
+
+// batchRequester identifies the user the rate of batch presigning is limited for.
+func batchRequester(ctx context.Context) string {
+	info := media.RequestInfoFromContext(ctx)
+	if info == nil || info.Uid.IsZero() {
+		return ""
+	}
+	return info.Uid.String()
+}
+
+// batchBucket is the allowance of a requester.
+type batchBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// batchLimiter limits the number of files presigned per minute per requester.
+type batchLimiter struct {
+	rate float64
+
+	mu      sync.Mutex
+	buckets map[string]*batchBucket
+}
+
+func newBatchLimiter(perMinute int) *batchLimiter {
+	return &batchLimiter{rate: float64(perMinute), buckets: make(map[string]*batchBucket)}
+}
+
+// allow takes n files from the allowance of the requester. The allowance refills continuously up to
+// the rate.
+func (bl *batchLimiter) allow(requester string, n int) bool {
+	now := time.Now()
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bucket := bl.buckets[requester]
+	if bucket == nil {
+		if len(bl.buckets) >= maxBatchRequesters {
+			// Forget the requesters with full allowance, they are indistinguishable from new ones.
+			for key, b := range bl.buckets {
+				if b.tokens+now.Sub(b.last).Minutes()*bl.rate >= bl.rate {
+					delete(bl.buckets, key)
+				}
+			}
+		}
+		bucket = &batchBucket{tokens: bl.rate, last: now}
+		bl.buckets[requester] = bucket
+	} else {
+		bucket.tokens = min(bl.rate, bucket.tokens+now.Sub(bucket.last).Minutes()*bl.rate)
+		bucket.last = now
+	}
+	if bucket.tokens < float64(n) {
+		return false
+	}
+	bucket.tokens -= float64(n)
+	return true
+}
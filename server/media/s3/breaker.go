@@ -0,0 +1,107 @@
+package s3
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// circuitBreaker stops calling a failing dependency for a cooldown period after a number of
+// consecutive failures. Once the cooldown expires, a single probe call is let through: if it
+// succeeds, the breaker closes, otherwise it opens for another cooldown period.
+type circuitBreaker struct {
+	name string
+	// Number of consecutive failures which opens the breaker, 0 to disable the breaker.
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	// The breaker is open until this time.
+	openUntil time.Time
+	// A probe call is in progress.
+	probing bool
+}
+
+// call invokes fn unless the breaker is open. Returns types.ErrUnavailable when the breaker
+// is open, the error returned by fn otherwise.
+func (cb *circuitBreaker) call(fn func() error) error {
+	if cb == nil || cb.threshold <= 0 {
+		return fn()
+	}
+
+	probe, ok := cb.allow()
+	if !ok {
+		return types.ErrUnavailable
+	}
+
+	err := fn()
+	cb.record(isDependencyFailure(err), probe)
+	return err
+}
+
+// retryAfter returns the time remaining until the breaker will let a call through.
+func (cb *circuitBreaker) retryAfter() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if wait := time.Until(cb.openUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (cb *circuitBreaker) allow() (probe, ok bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.threshold {
+		// Closed.
+		return false, true
+	}
+	if cb.probing || time.Now().Before(cb.openUntil) {
+		// Open or a probe is already in progress.
+		return false, false
+	}
+	// Half-open: let one call through.
+	cb.probing = true
+	return true, true
+}
+
+func (cb *circuitBreaker) record(failed, probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if probe {
+		cb.probing = false
+	}
+
+	if !failed {
+		if cb.failures >= cb.threshold {
+			logs.Info.Println("s3: circuit breaker closed", cb.name)
+		}
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		if cb.failures == cb.threshold || probe {
+			logs.Warn.Println("s3: circuit breaker open", cb.name, "for", cb.cooldown)
+		}
+		cb.openUntil = time.Now().Add(cb.cooldown)
+	}
+}
+
+// isDependencyFailure checks if the error indicates a failure of the dependency rather than
+// a valid response like 'not found'.
+func isDependencyFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if storeErr, ok := err.(types.StoreError); ok {
+		return storeErr == types.ErrInternal || storeErr == types.ErrUnavailable
+	}
+	return true
+}
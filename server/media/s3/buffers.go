@@ -0,0 +1,86 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// bufferPool is a pool of upload buffers shared by all uploads.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	bp := &bufferPool{size: size}
+	bp.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return bp
+}
+
+func (bp *bufferPool) get() *[]byte {
+	return bp.pool.Get().(*[]byte)
+}
+
+func (bp *bufferPool) put(buf *[]byte) {
+	bp.pool.Put(buf)
+}
+
+// fits checks if the upload of the given size may fit into a buffer. Uploads of unknown size may fit too.
+func (bp *bufferPool) fits(size int64) bool {
+	return bp != nil && size <= int64(bp.size)
+}
+
+// uploadBuffered reads the upload into a pooled buffer. If the whole upload fits, it's sent with a single
+// PutObject, otherwise the buffered part is prepended to the rest of the stream and it's uploaded by the
+// uploader as usual.
+func (ah *awshandler) uploadBuffered(ctx context.Context, input *transfermanager.UploadObjectInput,
+	opts []func(*transfermanager.Options)) (*transfermanager.UploadObjectOutput, error) {
+	buf := ah.buffers.get()
+	defer ah.buffers.put(buf)
+
+	n, err := io.ReadFull(input.Body, *buf)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		// The whole upload is in the buffer.
+	case nil:
+		// The buffer is full, there may be more.
+		input.Body = io.MultiReader(bytes.NewReader((*buf)[:n]), input.Body)
+		return ah.uploadObject(ctx, input, opts)
+	default:
+		return nil, err
+	}
+	return ah.putObject(ctx, input, bytes.NewReader((*buf)[:n]), int64(n))
+}
+
+// putObject stores the object of the upload with a single PutObject.
+func (ah *awshandler) putObject(ctx context.Context, input *transfermanager.UploadObjectInput, body io.ReadSeeker,
+	size int64) (*transfermanager.UploadObjectOutput, error) {
+	result, err := ah.svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		Body:            body,
+		ContentLength:   aws.Int64(size),
+		ContentType:     input.ContentType,
+		ContentLanguage: input.ContentLanguage,
+		CacheControl:    input.CacheControl,
+		Metadata:        input.Metadata,
+		RequestPayer:    s3types.RequestPayer(input.RequestPayer),
+		// Set for immutable uploads.
+		ObjectLockMode:            s3types.ObjectLockMode(input.ObjectLockMode),
+		ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &transfermanager.UploadObjectOutput{ETag: result.ETag, VersionID: result.VersionId}, nil
+}
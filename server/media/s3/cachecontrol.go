@@ -0,0 +1,114 @@
+package s3
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Key of the object metadata with the Cache-Control requested for the file.
+const cacheControlMetaKey = "cache-control"
+
+// Cache-Control directives accepted for individual files. True if the directive takes
+// a number of seconds.
+var cacheDirectives = map[string]bool{
+	"no-cache":               false,
+	"no-store":               false,
+	"no-transform":           false,
+	"must-revalidate":        false,
+	"proxy-revalidate":       false,
+	"private":                false,
+	"public":                 false,
+	"immutable":              false,
+	"max-age":                true,
+	"s-maxage":               true,
+	"stale-while-revalidate": true,
+	"stale-if-error":         true,
+}
+
+// parseCacheControl validates the Cache-Control directives and returns them normalized.
+func parseCacheControl(value string) (string, error) {
+	var directives []string
+	for _, part := range strings.Split(value, ",") {
+		name, arg, hasArg := strings.Cut(strings.TrimSpace(part), "=")
+		name = strings.ToLower(name)
+		takesArg, ok := cacheDirectives[name]
+		if !ok || hasArg != takesArg {
+			return "", types.ErrMalformed
+		}
+		if hasArg {
+			secs, err := strconv.ParseUint(arg, 10, 32)
+			if err != nil {
+				return "", types.ErrMalformed
+			}
+			name += "=" + strconv.FormatUint(secs, 10)
+		}
+		directives = append(directives, name)
+	}
+	return strings.Join(directives, ", "), nil
+}
+
+// uploadCacheControl returns the Cache-Control requested for the upload in the request info, or
+// an empty string if not provided or not enabled. ErrMalformed if the directives are invalid.
+func (ah *awshandler) uploadCacheControl(ctx context.Context) (string, error) {
+	info := media.RequestInfoFromContext(ctx)
+	if !ah.conf.FileCacheControl || info == nil || info.CacheControl == "" {
+		return "", nil
+	}
+	return parseCacheControl(info.CacheControl)
+}
+
+// isVideo checks if the file is a video which is played with range requests.
+func isVideo(mimeType string) bool {
+	return strings.HasPrefix(strings.ToLower(mimeType), "video/")
+}
+
+// defaultCacheControl returns the Cache-Control to serve the file with if none is requested for the file.
+func (ah *awshandler) defaultCacheControl(fdef *types.FileDef) string {
+	if ah.conf.VideoCacheControl != "" && isVideo(fdef.MimeType) {
+		return ah.conf.VideoCacheControl
+	}
+	return ah.conf.CacheControl
+}
+
+// cacheControl returns the Cache-Control to serve the file with: requested for the file at
+// upload or the default.
+func (ah *awshandler) cacheControl(ctx context.Context, fdef *types.FileDef) string {
+	if !ah.conf.FileCacheControl {
+		return ah.defaultCacheControl(fdef)
+	}
+
+	key := ah.objectLocation(fdef)
+	value, ok := ah.cacheControls.get(key)
+	if !ok {
+		head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:       aws.String(ah.conf.BucketName),
+			RequestPayer: ah.requestPayer(),
+			Key:          aws.String(key),
+		})
+		if err != nil {
+			// The object may be missing or S3 is failing. Don't cache, use the default.
+			return ah.defaultCacheControl(fdef)
+		}
+		value = head.Metadata[cacheControlMetaKey]
+		ah.cacheMetadata(key, head.Metadata)
+	}
+	if value == "" {
+		return ah.defaultCacheControl(fdef)
+	}
+	return value
+}
+
+// responseCacheControl returns the Cache-Control override of presigned downloads of the file, or nil if
+// the Cache-Control stored with the object is served. Files with a download limit are never cached.
+func (ah *awshandler) responseCacheControl(fdef *types.FileDef, cacheControl string) *string {
+	if ah.conf.RespectObjectCacheControl && fdef.DownloadLimit == 0 {
+		return nil
+	}
+	return aws.String(cacheControl)
+}
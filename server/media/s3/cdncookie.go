@@ -0,0 +1,45 @@
+package s3
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// With cdn_cookie_url, downloads are redirected to the stable URL of the object at a CDN which authorizes
+// requests with signed cookies, like CloudFront with a trusted key group. The cookies are issued to clients
+// out of band, so nothing is signed by the server and the URL of a file is the same for all clients.
+
+// initCDNCookies validates the configuration of the cookie-authorized CDN.
+func (ah *awshandler) initCDNCookies() error {
+	if ah.conf.CDNCookieURL == "" {
+		return nil
+	}
+	base, err := url.Parse(ah.conf.CDNCookieURL)
+	if err != nil || (base.Scheme != "https" && base.Scheme != "http") || base.Host == "" || base.RawQuery != "" {
+		return errors.New("invalid cdn_cookie_url")
+	}
+	if ah.conf.PinPresignToIP {
+		// Nothing would be pinned.
+		return errors.New("pin_presign_to_ip can't be used with cdn_cookie_url")
+	}
+	if !strings.HasSuffix(ah.conf.CDNCookieURL, "/") {
+		ah.conf.CDNCookieURL += "/"
+	}
+	return nil
+}
+
+// cdnCookieEligible checks if the file may be served from the CDN. Immutable files are served by version,
+// self-destructing files must expire and downloads of files with a download limit must be counted,
+// so they are always presigned.
+func (ah *awshandler) cdnCookieEligible(fdef *types.FileDef, expires time.Time) bool {
+	return ah.conf.CDNCookieURL != "" && !ah.isImmutable(fdef) && expires.IsZero() && fdef.DownloadLimit == 0
+}
+
+// cdnCookieURL is the URL of the object at the CDN.
+func (ah *awshandler) cdnCookieURL(fdef *types.FileDef) string {
+	return ah.conf.CDNCookieURL + (&url.URL{Path: ah.objectLocation(fdef)}).EscapedPath()
+}
@@ -0,0 +1,108 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// When the clock of the host drifts, S3 rejects presigned URLs as not yet valid or expired. The skew of
+// the local clock is measured against the Date header of the responses to the bucket check in Init.
+// With correct_clock_skew, download URLs and POST policies are then presigned with the time of S3.
+// Requests of the handler itself are corrected by the SDK once S3 rejects them as skewed.
+const (
+	// Smaller skews are within the precision of the Date header and are ignored.
+	clockSkewThreshold = 2 * time.Second
+)
+
+// measureClockSkew records the skew of the local clock from the Date header of the response to
+// a request made at the given time.
+func (ah *awshandler) measureClockSkew(metadata middleware.Metadata, err error, sent time.Time) {
+	var resp *smithyhttp.Response
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		resp = respErr.Response
+	} else if err == nil {
+		resp, _ = awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response)
+	}
+	if resp == nil {
+		return
+	}
+	date, perr := http.ParseTime(resp.Header.Get("Date"))
+	if perr != nil {
+		return
+	}
+	// The date is truncated to seconds, the time of S3 is in the middle of the request.
+	local := sent.Add(time.Since(sent) / 2)
+	skew := date.Add(500 * time.Millisecond).Sub(local).Round(time.Second)
+	if skew.Abs() < clockSkewThreshold {
+		ah.clockSkew.Store(0)
+		return
+	}
+	// Positive if the local clock is ahead.
+	logs.Warn.Println("s3: local clock is off from S3 by", -skew)
+	if !ah.conf.CorrectClockSkew {
+		logs.Warn.Println("s3: presigned URLs may be rejected as not yet valid or expired, see correct_clock_skew")
+		return
+	}
+	ah.clockSkew.Store(int64(skew))
+}
+
+// skewedPresigner presigns URLs with the local time corrected by the measured skew.
+type skewedPresigner struct {
+	next s3.HTTPPresignerV4
+	ah   *awshandler
+}
+
+// PresignHTTP implements s3.HTTPPresignerV4.
+func (p skewedPresigner) PresignHTTP(ctx context.Context, credentials aws.Credentials, r *http.Request,
+	payloadHash string, service string, region string, signingTime time.Time,
+	optFns ...func(*v4.SignerOptions)) (string, http.Header, error) {
+	signingTime = signingTime.Add(time.Duration(p.ah.clockSkew.Load()))
+	return p.next.PresignHTTP(ctx, credentials, r, payloadHash, service, region, signingTime, optFns...)
+}
+
+// skewedPostPresigner presigns POST policies with the local time corrected by the measured skew.
+type skewedPostPresigner struct {
+	next s3.PresignPost
+	ah   *awshandler
+}
+
+// PresignPost implements s3.PresignPost.
+func (p skewedPostPresigner) PresignPost(credentials aws.Credentials, bucket string, key string,
+	region string, service string, signingTime time.Time, conditions []any, expirationTime time.Time,
+	optFns ...func(*v4.SignerOptions)) (map[string]string, error) {
+	skew := time.Duration(p.ah.clockSkew.Load())
+	return p.next.PresignPost(credentials, bucket, key, region, service, signingTime.Add(skew), conditions,
+		expirationTime.Add(skew), optFns...)
+}
+
+// postPresigner returns the presigner of POST policies, the given default unless the skew is corrected.
+func (ah *awshandler) postPresigner(presigner s3.PresignPost) s3.PresignPost {
+	if !ah.conf.CorrectClockSkew {
+		return presigner
+	}
+	return skewedPostPresigner{next: presigner, ah: ah}
+}
+
+// newV4Presigner returns the Signature Version 4 presigner the SDK uses by default.
+func newV4Presigner(svc *s3.Client) *v4.Signer {
+	opts := svc.Options()
+	return v4.NewSigner(func(so *v4.SignerOptions) {
+		so.Logger = opts.Logger
+		so.LogSigning = opts.ClientLogMode.IsSigning()
+		// Object keys are escaped by the S3 client already.
+		so.DisableURIPathEscaping = true
+	})
+}
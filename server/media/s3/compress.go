@@ -0,0 +1,291 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+
+	// Objects larger than this are not compressed by default.
+	defaultCompressMaxSize = 10 * 1024 * 1024
+	// Maximum number of entries in a cache of object lookups.
+	objectCacheSize = 10000
+)
+
+// Kinds of the compressed variants by encoding.
+var compressedKind = map[string]string{
+	encodingBrotli: "br",
+	encodingGzip:   "gz",
+}
+
+// MIME types worth compressing. Prefixes of the type.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+func isCompressible(mimeType string) bool {
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressor encodes the upload into memory. It stops silently when the input exceeds the limit.
+type compressor struct {
+	encoding string
+	buf      bytes.Buffer
+	enc      io.WriteCloser
+	limit    int64
+	count    int64
+	failed   bool
+}
+
+func newCompressor(encoding string, limit int64) *compressor {
+	c := &compressor{encoding: encoding, limit: limit}
+	switch encoding {
+	case encodingBrotli:
+		c.enc = brotli.NewWriterLevel(&c.buf, brotli.DefaultCompression)
+	case encodingGzip:
+		c.enc = gzip.NewWriter(&c.buf)
+	}
+	return c
+}
+
+// Write implements io.Writer. It never fails so it won't interrupt the upload.
+func (c *compressor) Write(p []byte) (int, error) {
+	if c.failed {
+		return len(p), nil
+	}
+	c.count += int64(len(p))
+	if c.count > c.limit {
+		// Too large, drop the variant and release the memory.
+		c.failed = true
+		c.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	if _, err := c.enc.Write(p); err != nil {
+		c.failed = true
+	}
+	return len(p), nil
+}
+
+// result returns the compressed bytes or nil if the variant is not worth storing.
+func (c *compressor) result() []byte {
+	if c.failed || c.enc.Close() != nil || int64(c.buf.Len()) >= c.count {
+		// Failed or compression did not reduce the size.
+		return nil
+	}
+	return c.buf.Bytes()
+}
+
+// initCompression validates the configured encodings.
+func (ah *awshandler) initCompression() error {
+	for _, enc := range ah.conf.Compress {
+		if _, ok := compressedKind[enc]; !ok {
+			return errors.New("unsupported compression encoding '" + enc + "'")
+		}
+	}
+	if ah.conf.CompressMaxSize < 0 {
+		return errors.New("invalid compress_max_size")
+	}
+	if ah.conf.CompressMaxSize == 0 {
+		ah.conf.CompressMaxSize = defaultCompressMaxSize
+	}
+	ah.variants = newObjectCache[bool]()
+	return nil
+}
+
+// newCompressors creates compressors for the upload or returns nil if the object should not be compressed.
+func (ah *awshandler) newCompressors(fdef *types.FileDef, size int64) []*compressor {
+	if len(ah.conf.Compress) == 0 || !isCompressible(fdef.MimeType) || size > ah.conf.CompressMaxSize {
+		return nil
+	}
+	var comps []*compressor
+	for _, enc := range ah.conf.Compress {
+		if ah.variantAllowed(compressedKind[enc]) {
+			comps = append(comps, newCompressor(enc, ah.conf.CompressMaxSize))
+		}
+	}
+	return comps
+}
+
+// storeVariants uploads compressed variants of the object. Failures are logged but otherwise ignored:
+// the clients get the uncompressed object.
+func (ah *awshandler) storeVariants(ctx context.Context, fdef *types.FileDef, comps []*compressor,
+	lang *string, cacheControl string) {
+	for _, c := range comps {
+		data := c.result()
+		if data == nil {
+			continue
+		}
+		key := ah.variantKey(fdef.Location, compressedKind[c.encoding])
+		_, err := ah.svc.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:          aws.String(ah.conf.BucketName),
+			RequestPayer:    ah.requestPayer(),
+			Key:             aws.String(key),
+			Body:            bytes.NewReader(data),
+			ContentLength:   aws.Int64(int64(len(data))),
+			ContentType:     aws.String(fdef.MimeType),
+			ContentEncoding: aws.String(c.encoding),
+			ContentLanguage: lang,
+			CacheControl:    aws.String(cacheControl),
+		})
+		if err != nil {
+			logs.Warn.Println("s3: failed to store compressed variant", ah.redact.ref(key), err)
+			continue
+		}
+		ah.variants.set(key, true)
+	}
+}
+
+// negotiateVariant picks the compressed variant of the object to serve given the Accept-Encoding
+// header of the request. Returns the key and encoding of the variant or empty strings for identity.
+func (ah *awshandler) negotiateVariant(ctx context.Context, fdef *types.FileDef, acceptEncoding string) (string, string) {
+	if len(ah.conf.Compress) == 0 || !isCompressible(fdef.MimeType) || ah.variantsMissing(fdef) {
+		return "", ""
+	}
+	accepted := parseAcceptEncoding(acceptEncoding)
+	// Preference: brotli, then gzip.
+	for _, enc := range []string{encodingBrotli, encodingGzip} {
+		if !accepted[enc] || !ah.compressionEnabled(enc) {
+			continue
+		}
+		key := ah.variantKey(ah.objectLocation(fdef), compressedKind[enc])
+		if ah.variantExists(ctx, key) {
+			return key, enc
+		}
+	}
+	return "", ""
+}
+
+func (ah *awshandler) compressionEnabled(encoding string) bool {
+	return slices.Contains(ah.conf.Compress, encoding) && ah.variantAllowed(compressedKind[encoding])
+}
+
+// variantExists checks if the variant is stored. Results are cached because the variant
+// may be missing, e.g. the object was uploaded before compression was enabled.
+func (ah *awshandler) variantExists(ctx context.Context, key string) bool {
+	if exists, ok := ah.variants.get(key); ok {
+		return exists
+	}
+	_, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(key),
+	})
+	if err != nil && !isAPIError(err, "NotFound", "NoSuchKey") {
+		// Don't cache transient errors.
+		return false
+	}
+	if err == nil {
+		ah.variants.set(key, true)
+	} else {
+		ah.variants.setExpiring(key, false, ah.missingVariantTTL())
+	}
+	return err == nil
+}
+
+// parseAcceptEncoding returns encodings accepted by the client, i.e. those with q > 0.
+func parseAcceptEncoding(header string) map[string]bool {
+	accepted := map[string]bool{}
+	// Value of the "*" wildcard, applies to encodings not listed explicitly.
+	var any *bool
+	for _, part := range strings.Split(header, ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if enc == "" {
+			continue
+		}
+		q := 1.0
+		if name, val, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+				q = parsed
+			}
+		}
+		ok := q > 0
+		if enc == "*" {
+			any = &ok
+			continue
+		}
+		accepted[enc] = ok
+	}
+	if any != nil {
+		for enc := range compressedKind {
+			if _, explicit := accepted[enc]; !explicit {
+				accepted[enc] = *any
+			}
+		}
+	}
+	return accepted
+}
+
+// objectCache remembers results of object lookups, like which compressed variants exist.
+type objectCache[V any] struct {
+	mu    sync.Mutex
+	known map[string]cachedLookup[V]
+}
+
+type cachedLookup[V any] struct {
+	val V
+	// Zero if the result does not expire.
+	expires time.Time
+}
+
+func newObjectCache[V any]() *objectCache[V] {
+	return &objectCache[V]{known: make(map[string]cachedLookup[V])}
+}
+
+func (oc *objectCache[V]) get(key string) (V, bool) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	entry, ok := oc.known[key]
+	if ok && !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(oc.known, key)
+		var zero V
+		return zero, false
+	}
+	return entry.val, ok
+}
+
+func (oc *objectCache[V]) set(key string, val V) {
+	oc.setExpiring(key, val, 0)
+}
+
+// setExpiring caches the result for the ttl, for good if the ttl is 0.
+func (oc *objectCache[V]) setExpiring(key string, val V, ttl time.Duration) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if len(oc.known) >= objectCacheSize {
+		// Crude but bounded: start over.
+		oc.known = make(map[string]cachedLookup[V])
+	}
+	entry := cachedLookup[V]{val: val}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	oc.known[key] = entry
+}
@@ -0,0 +1,138 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	// Default interval in seconds between re-reading credentials from files.
+	defaultCredentialsRefresh = 300
+	// Credentials are refreshed this long before they expire so presigning never uses stale keys.
+	credentialsExpiryWindow = 10 * time.Second
+	// Key of the object requested to check the presign credentials, normally missing.
+	presignCheckKey = "tinode-presign-check"
+)
+
+// fileCredentials provides credentials which are re-read from files periodically, so the
+// access key can be rotated by the secret manager without restarting the server.
+type fileCredentials struct {
+	keyIdFile  string
+	secretFile string
+	// Inline values used when the corresponding file is not configured.
+	keyId  string
+	secret string
+
+	refresh time.Duration
+	// Presigned URLs live this long. Used for logging only.
+	presignTTL time.Duration
+
+	mu sync.Mutex
+	// Access key ID of the current credentials.
+	current string
+	// Number of times the key has changed since the start.
+	generation int
+}
+
+// Retrieve implements aws.CredentialsProvider.
+func (fc *fileCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	keyId, secret := fc.keyId, fc.secret
+	var err error
+	if fc.keyIdFile != "" {
+		if keyId, err = readSecretFile(fc.keyIdFile); err != nil {
+			return aws.Credentials{}, err
+		}
+	}
+	if fc.secretFile != "" {
+		if secret, err = readSecretFile(fc.secretFile); err != nil {
+			return aws.Credentials{}, err
+		}
+	}
+	if keyId == "" || secret == "" {
+		return aws.Credentials{}, errors.New("s3: empty credentials")
+	}
+
+	fc.mu.Lock()
+	if fc.current != "" && fc.current != keyId {
+		fc.generation++
+		// Presigned URLs issued earlier are valid only as long as the old key remains active.
+		logs.Info.Printf("s3: access key rotated, generation %d; keep the old key active for at least %s",
+			fc.generation, fc.presignTTL)
+	}
+	fc.current = keyId
+	fc.mu.Unlock()
+
+	return aws.Credentials{
+		AccessKeyID:     keyId,
+		SecretAccessKey: secret,
+		Source:          "tinode-s3-files",
+		CanExpire:       true,
+		Expires:         time.Now().Add(fc.refresh),
+	}, nil
+}
+
+// rotatingCredentials is the caching provider of credentials which may be rotated.
+type rotatingCredentials struct {
+	*aws.CredentialsCache
+	files *fileCredentials
+}
+
+// generation returns the number of times the credentials have been rotated since the start. Expired
+// credentials are refreshed first, so the rotation is noticed before the credentials are used.
+func (rc *rotatingCredentials) generation(ctx context.Context) (int, error) {
+	if _, err := rc.Retrieve(ctx); err != nil {
+		return 0, err
+	}
+	rc.files.mu.Lock()
+	defer rc.files.mu.Unlock()
+	return rc.files.generation, nil
+}
+
+// newCredentialsProvider creates a caching provider of the credentials given inline or in files.
+func (ah *awshandler) newCredentialsProvider(keyIdFile, secretFile, keyId, secret string) *rotatingCredentials {
+	refresh := ah.conf.CredentialsRefresh
+	if refresh <= 0 {
+		refresh = defaultCredentialsRefresh
+	}
+	files := &fileCredentials{
+		keyIdFile:  keyIdFile,
+		secretFile: secretFile,
+		keyId:      keyId,
+		secret:     secret,
+		refresh:    time.Second * time.Duration(refresh),
+		presignTTL: time.Second * time.Duration(ah.conf.PresignTTL),
+	}
+	return &rotatingCredentials{
+		CredentialsCache: aws.NewCredentialsCache(files, func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = credentialsExpiryWindow
+		}),
+		files: files,
+	}
+}
+
+// hasPresignCredentials checks if downloads are presigned with separate credentials.
+func (ah *awshandler) hasPresignCredentials() bool {
+	return ah.conf.PresignAccessKeyId != "" || ah.conf.PresignSecretAccessKey != ""
+}
+
+// checkPresignCredentials makes sure S3 accepts the credentials for presigning downloads. The credentials
+// are expected to allow GetObject only, so a GET of a missing object is used: S3 responds with NoSuchKey
+// or AccessDenied to valid credentials.
+func checkPresignCredentials(ctx context.Context, svc *s3.Client, bucket string, payer s3types.RequestPayer) error {
+	_, err := svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(bucket),
+		RequestPayer: payer,
+		Key:          aws.String(presignCheckKey),
+	})
+	if err == nil || isAPIError(err, "NoSuchKey", "NoSuchBucket", "AccessDenied") {
+		return nil
+	}
+	return errors.New("invalid presign credentials: " + err.Error())
+}
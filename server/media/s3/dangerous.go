@@ -0,0 +1,76 @@
+package s3
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Content type of files downloaded under dangerous names, which no client renders.
+const safeContentType = "application/octet-stream"
+
+// Extensions of files which must not be rendered inline whatever their declared type: executables, scripts
+// and documents which browsers render with scripts.
+var defaultDangerousExtensions = []string{
+	".apk", ".app", ".bat", ".cmd", ".com", ".cpl", ".dll", ".dmg", ".exe", ".hta", ".htm", ".html", ".jar",
+	".js", ".jse", ".lnk", ".mht", ".mhtml", ".mjs", ".msi", ".pif", ".ps1", ".psm1", ".reg", ".scr", ".sh",
+	".shtml", ".svg", ".svgz", ".vbe", ".vbs", ".wsf", ".wsh", ".xht", ".xhtml", ".xml",
+}
+
+// initDangerousExtensions validates the configured extensions or uses the defaults.
+func (ah *awshandler) initDangerousExtensions() error {
+	exts := ah.conf.DangerousExtensions
+	if exts == nil {
+		exts = defaultDangerousExtensions
+	}
+	ah.dangerousExts = make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if len(ext) < 2 || strings.ContainsAny(ext[1:], "./\\ ") {
+			return errors.New("invalid dangerous_extensions '" + ext + "'")
+		}
+		ah.dangerousExts[ext] = true
+	}
+	return nil
+}
+
+// dangerousDownload checks if the file is requested under a name with a dangerous extension: the last
+// segment of the URL path or the "filename" query parameter. Browsers save downloads under these names.
+func (ah *awshandler) dangerousDownload(u *url.URL) bool {
+	if len(ah.dangerousExts) == 0 {
+		return false
+	}
+	for _, name := range []string{path.Base(u.Path), sanitizeFilename(u.Query().Get("filename"))} {
+		// Windows ignores trailing dots and spaces of file names.
+		name = strings.TrimRight(name, ". ")
+		if ah.dangerousExts[strings.ToLower(path.Ext(name))] {
+			return true
+		}
+	}
+	return false
+}
+
+// dangerousDownloadURL is dangerousDownload of the unparsed URL.
+func (ah *awshandler) dangerousDownloadURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && ah.dangerousDownload(u)
+}
+
+// forceAttachment returns the request URL and the file record altered to download the file as an attachment
+// of the safe content type. The record is a copy, it must not be saved.
+func forceAttachment(u *url.URL, fdef *types.FileDef) (*url.URL, *types.FileDef) {
+	return attachmentURL(u), safeFileDef(fdef)
+}
+
+// safeFileDef returns a copy of the file record with the safe content type.
+func safeFileDef(fdef *types.FileDef) *types.FileDef {
+	safe := *fdef
+	safe.MimeType = safeContentType
+	return &safe
+}
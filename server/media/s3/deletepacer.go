@@ -0,0 +1,79 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// deletePacer limits the rate of deleting objects and the number of concurrent DeleteObjects requests
+// of all deletions by the handler, so large cleanups don't get the bucket throttled for everyone.
+type deletePacer struct {
+	// Objects per second, 0 means no limit.
+	rate  int
+	slots chan struct{}
+
+	mu sync.Mutex
+	// Time when the next batch may start.
+	next time.Time
+}
+
+func newDeletePacer(rate, concurrency int) (*deletePacer, error) {
+	if rate < 0 {
+		return nil, errors.New("invalid delete_rate")
+	}
+	if concurrency < 0 {
+		return nil, errors.New("invalid delete_concurrency")
+	}
+	if concurrency == 0 {
+		concurrency = 1
+	}
+	return &deletePacer{rate: rate, slots: make(chan struct{}, concurrency)}, nil
+}
+
+// batchSize is the number of objects to delete with one request. Batches are limited to one second
+// of the rate to keep the pace even.
+func (dp *deletePacer) batchSize() int {
+	if dp.rate > 0 && dp.rate < maxDeleteBatch {
+		return dp.rate
+	}
+	return maxDeleteBatch
+}
+
+// acquire waits until a batch of n objects may be deleted. The returned function must be called
+// once the batch is done. Fails if the context is done.
+func (dp *deletePacer) acquire(ctx context.Context, n int) (func(), error) {
+	select {
+	case dp.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-dp.slots }
+	if err := ctx.Err(); err != nil {
+		release()
+		return nil, err
+	}
+
+	if dp.rate > 0 {
+		dp.mu.Lock()
+		start := time.Now()
+		if dp.next.After(start) {
+			start = dp.next
+		}
+		dp.next = start.Add(time.Duration(n) * time.Second / time.Duration(dp.rate))
+		dp.mu.Unlock()
+
+		if wait := time.Until(start); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return release, nil
+}
@@ -0,0 +1,101 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+
+	// Formats of images with checked dimensions.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// Images are rejected if their header does not fit into this many bytes. Headers of JPEG images
+// follow the metadata, all other formats keep the dimensions at the start.
+const imageHeaderMaxSize = 1024 * 1024
+
+// Content types of images with dimensions known from the header.
+var dimensionsTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+type imageLimitsConfig struct {
+	// Minimum width and height of images in pixels, no limit if 0.
+	MinWidth  int `json:"min_width"`
+	MinHeight int `json:"min_height"`
+	// Maximum width and height of images in pixels, no limit if 0.
+	MaxWidth  int `json:"max_width"`
+	MaxHeight int `json:"max_height"`
+	// Maximum number of pixels of images, no limit if 0.
+	MaxPixels int64 `json:"max_pixels"`
+}
+
+// initImageLimits validates the limits of dimensions of images.
+func (ah *awshandler) initImageLimits() error {
+	conf := ah.conf.ImageLimits
+	if conf == nil {
+		return nil
+	}
+	if conf.MinWidth < 0 || conf.MinHeight < 0 || conf.MaxWidth < 0 || conf.MaxHeight < 0 || conf.MaxPixels < 0 {
+		return errors.New("invalid image_limits")
+	}
+	if (conf.MaxWidth > 0 && conf.MinWidth > conf.MaxWidth) || (conf.MaxHeight > 0 && conf.MinHeight > conf.MaxHeight) ||
+		(conf.MaxPixels > 0 && int64(conf.MinWidth)*int64(conf.MinHeight) > conf.MaxPixels) {
+		return errors.New("invalid image_limits: minimum exceeds maximum")
+	}
+	return nil
+}
+
+// sourceErrReader remembers the error of the source stream.
+type sourceErrReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (sr *sourceErrReader) Read(p []byte) (int, error) {
+	n, err := sr.reader.Read(p)
+	if err != nil && err != io.EOF {
+		sr.err = err
+	}
+	return n, err
+}
+
+// checkImageDimensions reads the header of the uploaded image and rejects the image if its dimensions
+// are outside of the limits or the header can't be decoded. Only the header is decoded, the pixels are not.
+// Returns the stream to upload which starts with the header again.
+func (ah *awshandler) checkImageDimensions(fdef *types.FileDef, file io.Reader) (io.Reader, error) {
+	conf := ah.conf.ImageLimits
+	mediaType, _, _ := strings.Cut(fdef.MimeType, ";")
+	if conf == nil || !dimensionsTypes[strings.TrimSpace(mediaType)] {
+		return file, nil
+	}
+
+	var header bytes.Buffer
+	source := &sourceErrReader{reader: file}
+	cfg, _, err := image.DecodeConfig(io.TeeReader(io.LimitReader(source, imageHeaderMaxSize), &header))
+	file = io.MultiReader(&header, file)
+	if source.err != nil {
+		return file, &media.SourceReadError{Err: source.err}
+	}
+	if err != nil {
+		logs.Info.Println("s3: rejected image with invalid header", ah.redact.ref(fdef.Id), err)
+		return file, types.ErrMalformed
+	}
+
+	if cfg.Width < conf.MinWidth || cfg.Height < conf.MinHeight ||
+		(conf.MaxWidth > 0 && cfg.Width > conf.MaxWidth) || (conf.MaxHeight > 0 && cfg.Height > conf.MaxHeight) ||
+		(conf.MaxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > conf.MaxPixels) {
+		logs.Info.Println("s3: rejected image", ah.redact.ref(fdef.Id), cfg.Width, "x", cfg.Height)
+		return file, &media.ImageDimensionsError{Width: cfg.Width, Height: cfg.Height}
+	}
+	return file, nil
+}
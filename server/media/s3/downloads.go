@@ -0,0 +1,92 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Files may be uploaded with a limit of the number of downloads, like "view once" media. Downloads are
+// counted in the file record when the file is served, so redirects to limited files must not be cached
+// and their presigned URLs are short-lived.
+const (
+	// Cache-Control of files with a download limit.
+	limitedCacheControl = "private, no-store"
+	// Lifetime of presigned URLs of files with a download limit.
+	limitedPresignTTL = time.Minute
+)
+
+// uploadDownloadLimit returns the limit of downloads requested in the request info, or 0 if not requested
+// or not enabled. ErrMalformed if the limit is invalid.
+func (ah *awshandler) uploadDownloadLimit(ctx context.Context) (int, error) {
+	info := media.RequestInfoFromContext(ctx)
+	if !ah.conf.FileDownloadLimit || info == nil || info.MaxDownloads == "" {
+		return 0, nil
+	}
+	limit, err := strconv.ParseUint(info.MaxDownloads, 10, 31)
+	if err != nil || limit == 0 {
+		return 0, types.ErrMalformed
+	}
+	return int(limit), nil
+}
+
+// downloadsExhausted checks if the file reached its download limit according to the record.
+func downloadsExhausted(fdef *types.FileDef) bool {
+	return fdef.DownloadLimit > 0 && fdef.Downloads >= fdef.DownloadLimit
+}
+
+// countDownload counts the download of the file with a download limit in the store. Returns false if
+// the limit is already reached. The object is deleted after the last download if configured: once the URL
+// presigned for the download with the given lifetime expires.
+func (ah *awshandler) countDownload(fdef *types.FileDef, ttl time.Duration) (bool, error) {
+	var count int
+	err := ah.storeBreaker.call(func() error {
+		var err error
+		count, err = store.Files.CountDownload(fdef.Id)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if count == 0 {
+		// The object may still be there if the server was restarted after the last download.
+		ah.deleteExhausted(fdef, 0)
+		return false, nil
+	}
+	if count >= fdef.DownloadLimit {
+		ah.deleteExhausted(fdef, ttl)
+	}
+	return true, nil
+}
+
+// deleteExhausted deletes the object of the file which reached its download limit, with all its variants,
+// after the delay. The record is kept, so the file stays gone rather than missing.
+func (ah *awshandler) deleteExhausted(fdef *types.FileDef, delay time.Duration) {
+	if !ah.conf.DeleteExhausted {
+		return
+	}
+	location := ah.objectLocation(fdef)
+	time.AfterFunc(delay, func() {
+		if err := ah.Delete([]string{location}); err != nil {
+			logs.Warn.Println("s3: failed to delete exhausted file", ah.redact.ref(fdef.Id), err)
+		}
+	})
+}
+
+// goneResponse is the response to requests of files which are gone for good: expired or downloaded
+// as many times as allowed.
+func (ah *awshandler) goneResponse() (http.Header, int, error) {
+	status := ah.conf.MissingObjectStatus
+	if status == 0 {
+		status = http.StatusGone
+	}
+	return http.Header{
+		missingObjectHeader: {"1"},
+	}, status, nil
+}
@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Query parameter of the serve URL with the download token.
+	downloadTokenParam = "dt"
+	// Maximum number of outstanding download tokens.
+	maxDownloadTokens = 100000
+)
+
+// downloadToken is an issued download token.
+type downloadToken struct {
+	fid types.Uid
+	// User and session the token is issued to.
+	owner   string
+	expires time.Time
+}
+
+// downloadTokens is an in-memory store of single-use download tokens.
+type downloadTokens struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]downloadToken
+	// Time of the last removal of expired tokens.
+	swept time.Time
+}
+
+func newDownloadTokens(ttl time.Duration) *downloadTokens {
+	return &downloadTokens{ttl: ttl, tokens: make(map[string]downloadToken), swept: time.Now()}
+}
+
+// tokenOwner identifies the requester of the context the token is tied to.
+func tokenOwner(ctx context.Context) string {
+	info := media.RequestInfoFromContext(ctx)
+	if info == nil || info.Uid.IsZero() {
+		return ""
+	}
+	return info.Uid.String() + "/" + info.SessionId
+}
+
+// issue creates a token for downloading the file by the owner. ErrUnavailable if too many tokens
+// are outstanding.
+func (dt *downloadTokens) issue(fid types.Uid, owner string) (*media.DownloadToken, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now()
+	expires := now.Add(dt.ttl)
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	if now.Sub(dt.swept) > dt.ttl || len(dt.tokens) >= maxDownloadTokens {
+		for key, tok := range dt.tokens {
+			if now.After(tok.expires) {
+				delete(dt.tokens, key)
+			}
+		}
+		dt.swept = now
+	}
+	if len(dt.tokens) >= maxDownloadTokens {
+		return nil, types.ErrUnavailable
+	}
+	dt.tokens[token] = downloadToken{fid: fid, owner: owner, expires: expires}
+	return &media.DownloadToken{Token: token, Expires: expires}, nil
+}
+
+// consume checks that the token is issued for downloading the file by the owner and is not expired.
+// The token cannot be used again, even if it does not match.
+func (dt *downloadTokens) consume(token string, fid types.Uid, owner string) bool {
+	dt.mu.Lock()
+	tok, ok := dt.tokens[token]
+	delete(dt.tokens, token)
+	dt.mu.Unlock()
+
+	return ok && tok.fid == fid && tok.owner == owner && time.Now().Before(tok.expires)
+}
+
+// DownloadToken implements media.DownloadTokenHandler.
+func (ah *awshandler) DownloadToken(ctx context.Context, url string) (*media.DownloadToken, error) {
+	if ah.downloadTokens == nil {
+		return nil, types.ErrUnsupported
+	}
+	owner := tokenOwner(ctx)
+	if owner == "" {
+		return nil, types.ErrPermissionDenied
+	}
+	fid := ah.GetIdFromUrl(url)
+	if fid.IsZero() {
+		return nil, types.ErrNotFound
+	}
+	return ah.downloadTokens.issue(fid, owner)
+}
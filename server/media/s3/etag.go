@@ -0,0 +1,108 @@
+package s3
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Header of the response which tells that the object of the file record is missing.
+const missingObjectHeader = "X-Tinode-Object-Missing"
+
+// objectMissing checks if the object of the file record is missing in the bucket. Errors other
+// than a missing object are ignored.
+func (ah *awshandler) objectMissing(ctx context.Context, fdef *types.FileDef) bool {
+	_, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(ah.objectLocation(fdef)),
+	})
+	return err != nil && isAPIError(err, "NotFound", "NoSuchKey")
+}
+
+// verifyETag compares the ETag of the object with the file record for a sample of requests. If the object
+// was replaced out of band, the record is repaired. Returns the record to serve the file with.
+func (ah *awshandler) verifyETag(ctx context.Context, fdef *types.FileDef) *types.FileDef {
+	if ah.conf.ETagCheckRate <= 0 || rand.Float64() >= ah.conf.ETagCheckRate {
+		return fdef
+	}
+	return ah.verifyObject(ctx, fdef, false)
+}
+
+// verifyHead checks if the metadata of the proxied HEAD request should be verified against the object.
+func (ah *awshandler) verifyHead(u *url.URL) bool {
+	if ah.conf.HeadMetadata != headMetadataVerify {
+		return false
+	}
+	if verify, _ := strconv.ParseBool(u.Query().Get(headVerifyParam)); verify {
+		return true
+	}
+	return rand.Float64() < ah.conf.HeadVerifyRate
+}
+
+// verifyObject compares the ETag and, if withSize is true, the size of the object with the file record
+// and repairs the record if they differ. The content type is always served from the record, a different
+// type of the object is only logged. Returns the record to serve the file with.
+func (ah *awshandler) verifyObject(ctx context.Context, fdef *types.FileDef, withSize bool) *types.FileDef {
+	if ah.isImmutable(fdef) {
+		// Immutable files are served by version, a newer version must not replace the record.
+		return fdef
+	}
+
+	key := ah.objectLocation(fdef)
+	head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(key),
+	})
+	if err != nil {
+		if isAPIError(err, "NotFound", "NoSuchKey") {
+			logs.Warn.Println("s3: object of file record is missing", ah.redact.ref(fdef.Id), ah.redact.ref(key))
+		}
+		return fdef
+	}
+
+	// Objects uploaded by older versions were stored without the content type, S3 reports the default.
+	if contentType := aws.ToString(head.ContentType); contentType != "" && contentType != fdef.MimeType &&
+		contentType != "application/octet-stream" {
+		logs.Warn.Println("s3: content type of object differs from file record", ah.redact.ref(fdef.Id), contentType, fdef.MimeType)
+	}
+	live := strings.Trim(aws.ToString(head.ETag), `"`)
+	if ah.conf.ETagSource == etagSourceContentHash {
+		// The ETag of the record is not an ETag of S3, only the size can be compared.
+		live = ""
+	}
+	size := fdef.Size
+	if head.ContentLength != nil {
+		size = *head.ContentLength
+	}
+	if (live == "" || live == fdef.ETag) && (!withSize || size == fdef.Size) {
+		return fdef
+	}
+
+	logs.Warn.Println("s3: object changed out of band, repairing file record", ah.redact.ref(fdef.Id), "ETag", fdef.ETag, "->", live,
+		"size", fdef.Size, "->", size)
+	repaired := *fdef
+	if live != "" {
+		repaired.ETag = live
+	}
+	err = ah.storeBreaker.call(func() error {
+		_, err := store.Files.FinishUpload(&repaired, true, size)
+		return err
+	})
+	if err != nil {
+		// Serve with the live ETag and size anyway, the record is checked again later.
+		logs.Warn.Println("s3: failed to repair file record", ah.redact.ref(fdef.Id), err)
+		repaired.Size = size
+	}
+	ah.cacheMetadata(key, head.Metadata)
+	return &repaired
+}
@@ -0,0 +1,71 @@
+package s3
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Key of the object metadata with the time the file expires, in Unix seconds.
+const expiresMetaKey = "expires-at"
+
+// uploadExpiry returns the time the upload expires given the lifetime requested in the request info,
+// or zero time if not requested or not enabled. ErrMalformed if the lifetime is invalid.
+func (ah *awshandler) uploadExpiry(ctx context.Context) (time.Time, error) {
+	info := media.RequestInfoFromContext(ctx)
+	if !ah.conf.FileExpiry || info == nil || info.TTL == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseUint(info.TTL, 10, 32)
+	if err != nil || secs == 0 {
+		return time.Time{}, types.ErrMalformed
+	}
+	return time.Now().Add(time.Second * time.Duration(secs)).Truncate(time.Second), nil
+}
+
+// metadataExpiry returns the expiration time stored in the object metadata, zero if none.
+func metadataExpiry(meta map[string]string) time.Time {
+	secs, err := strconv.ParseInt(meta[expiresMetaKey], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// objectExpiry returns the time the file expires, zero if it does not.
+func (ah *awshandler) objectExpiry(ctx context.Context, fdef *types.FileDef) time.Time {
+	if !ah.conf.FileExpiry {
+		return time.Time{}
+	}
+
+	key := ah.objectLocation(fdef)
+	if expires, ok := ah.expiries.get(key); ok {
+		return expires
+	}
+	head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(key),
+	})
+	if err != nil {
+		// The object may be missing or S3 is failing. Don't cache.
+		return time.Time{}
+	}
+	ah.cacheMetadata(key, head.Metadata)
+	return metadataExpiry(head.Metadata)
+}
+
+// cacheMetadata remembers the attributes of the file stored in the object metadata.
+func (ah *awshandler) cacheMetadata(key string, meta map[string]string) {
+	if ah.conf.FileCacheControl {
+		ah.cacheControls.set(key, meta[cacheControlMetaKey])
+	}
+	if ah.conf.FileExpiry {
+		ah.expiries.set(key, metadataExpiry(meta))
+	}
+}
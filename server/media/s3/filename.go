@@ -0,0 +1,76 @@
+package s3
+
+import (
+	"mime"
+	"strings"
+	"unicode"
+)
+
+// File names come from clients and may contain anything. They are sanitized the same way wherever they
+// are used, and sent in Content-Disposition both as an ASCII fallback and, if that loses anything, in
+// full as the RFC 5987 "filename*" parameter, which all current browsers prefer.
+
+// sanitizeFilename removes path separators, control characters and bidirectional overrides, which
+// disguise extensions, from the client-provided file name.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' || r == '\\' || isBidiControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(name, ""))
+	name = strings.TrimSpace(name)
+	if len(name) > maxFilenameLength {
+		name = strings.ToValidUTF8(name[:maxFilenameLength], "")
+	}
+	return name
+}
+
+// isBidiControl checks if the rune changes the direction of the text.
+func isBidiControl(r rune) bool {
+	return r == '\u200e' || r == '\u200f' || r == '\u061c' || (r >= '\u202a' && r <= '\u202e') ||
+		(r >= '\u2066' && r <= '\u2069')
+}
+
+// contentDisposition returns the Content-Disposition of the given type with the sanitized file name.
+func contentDisposition(disposition, name string) string {
+	name = sanitizeFilename(name)
+	if name == "" {
+		return disposition
+	}
+	fallback := asciiFilename(name)
+	// FormatMediaType quotes the fallback as needed.
+	header := mime.FormatMediaType(disposition, map[string]string{"filename": fallback})
+	if fallback != name {
+		header += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	return header
+}
+
+// asciiFilename replaces characters of the name which are not printable ASCII, quotes, backslashes and
+// percent signs, which some browsers decode, with underscores.
+func asciiFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '%' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// encodeRFC5987 percent-encodes the UTF-8 bytes of the value except attr-char of RFC 5987.
+func encodeRFC5987(value string) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteByte('%')
+			sb.WriteByte(hex[c>>4])
+			sb.WriteByte(hex[c&0xf])
+		}
+	}
+	return sb.String()
+}
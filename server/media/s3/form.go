@@ -0,0 +1,133 @@
+package s3
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// FormUploadPolicy implements media.FormUploadHandler: it creates a file record and a signed POST policy
+// which lets the client upload the file with an HTML form directly to the bucket.
+// The upload is completed when the file is accessed for the first time, see completeFormUpload.
+func (ah *awshandler) FormUploadPolicy(ctx context.Context, fdef *types.FileDef, maxSize int64) (*media.FormUploadPolicy, error) {
+	if ah.conf.RequesterPays {
+		// Browsers cannot send the requester pays header with the form.
+		return nil, types.ErrUnsupported
+	}
+	if ah.conf.SignatureVersion == signatureV2 {
+		// POST policies are signed with Signature Version 4 only.
+		return nil, types.ErrUnsupported
+	}
+	if ah.conf.MaxFileSize > 0 && (maxSize <= 0 || ah.conf.MaxFileSize < maxSize) {
+		maxSize = ah.conf.MaxFileSize
+	}
+
+	tenant := ah.uploadTenant(ctx)
+	// The size is not known yet: uploads are rejected only once the quota is used up.
+	if err := ah.checkTenantQuota(tenant, 0); err != nil {
+		return nil, err
+	}
+
+	// The location is known in advance. It also marks the record as a form upload.
+	fdef.Location = tenant.keyPrefix() + ah.uploadObjectKey(ctx, fdef.Uid())
+	if err := ah.checkKeyLength(fdef.Location); err != nil {
+		return nil, err
+	}
+
+	conditions := []any{
+		map[string]string{"key": fdef.Location},
+		map[string]string{"Content-Type": fdef.MimeType},
+		map[string]string{"Cache-Control": ah.conf.CacheControl},
+	}
+	if maxSize > 0 {
+		conditions = append(conditions, []any{"content-length-range", 1, maxSize})
+	}
+
+	ttl := time.Second * time.Duration(ah.conf.PresignTTL)
+	release, err := ah.presignLimit.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	presigned, err := ah.presign.PresignPostObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(ah.conf.BucketName),
+		Key:    aws.String(fdef.Location),
+	}, func(opts *s3.PresignPostOptions) {
+		opts.Expires = ttl
+		opts.Conditions = conditions
+		opts.PostPresigner = ah.postPresigner(opts.PostPresigner)
+	})
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	if fdef.DownloadLimit, err = ah.uploadDownloadLimit(ctx); err != nil {
+		return nil, err
+	}
+	// Retries get the form again, the object is not uploaded by the server.
+	if err = ah.startUpload(ctx, fdef); err == types.ErrDuplicate {
+		_, err = ah.existingRecord(ctx, fdef)
+	}
+	if err != nil {
+		logs.Warn.Println("failed to create file record", ah.redact.ref(fdef.Id), err)
+		return nil, err
+	}
+
+	// Fields are not added to the policy by the SDK.
+	presigned.Values["Content-Type"] = fdef.MimeType
+	presigned.Values["Cache-Control"] = ah.conf.CacheControl
+
+	return &media.FormUploadPolicy{
+		URL:     presigned.URL,
+		Fields:  presigned.Values,
+		Ref:     ah.serveURL + fdef.Id + media.FileExtension(fdef.MimeType, ah.extensions),
+		Expires: time.Now().Add(ttl).UTC().Round(time.Second),
+	}, nil
+}
+
+// completeFormUpload marks the record of a form upload as completed if the object exists in the bucket.
+// Records of regular uploads in progress have no location and are not affected.
+func (ah *awshandler) completeFormUpload(ctx context.Context, fdef *types.FileDef) (*types.FileDef, error) {
+	if fdef.Status != types.UploadStarted || fdef.Location == "" {
+		return fdef, nil
+	}
+
+	head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(fdef.Location),
+	})
+	if err != nil {
+		if isAPIError(err, "NotFound", "NoSuchKey") {
+			// Not uploaded yet.
+			return nil, types.ErrNotFound
+		}
+		return nil, err
+	}
+
+	if head.ETag != nil {
+		fdef.ETag = strings.Trim(*head.ETag, "\"")
+	}
+	var size int64
+	if head.ContentLength != nil {
+		size = *head.ContentLength
+	}
+	var completed *types.FileDef
+	err = ah.storeBreaker.call(func() error {
+		var err error
+		completed, err = store.Files.FinishUpload(fdef, true, size)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logs.Info.Println("s3: form upload completed", ah.redact.ref(fdef.Id), size)
+	return completed, nil
+}
@@ -0,0 +1,191 @@
+package s3
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net/url"
+	"sync"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Tiny objects which are downloaded all the time, like custom emoji or reaction images, are cheaper to
+// serve from memory than to presign and redirect to on every request. With hot_cache, objects no larger
+// than max_object_size are served by the server itself from an LRU cache of at most max_size bytes,
+// which is filled from S3 on miss. Entries are dropped when their objects are deleted through this node.
+// Entries are keyed by the ETag too, so replaced content is not served once the file record is updated.
+const (
+	// Default total size of cached objects.
+	defaultHotCacheSize = 64 << 20
+	// Default maximum size of a cached object.
+	defaultHotCacheObjectSize = 64 << 10
+)
+
+// Lookups in the hot cache, reported through expvar.
+var (
+	hotCacheHits   = expvar.NewInt("S3HotCacheHits")
+	hotCacheMisses = expvar.NewInt("S3HotCacheMisses")
+)
+
+type hotCacheConfig struct {
+	// Total size of cached objects in bytes, 64MB if 0.
+	MaxSize int64 `json:"max_size"`
+	// Larger objects are always redirected to, 64KB if 0.
+	MaxObjectSize int64 `json:"max_object_size"`
+}
+
+// hotCache is an LRU cache of contents of small objects bounded by their total size.
+type hotCache struct {
+	maxSize       int64
+	maxObjectSize int64
+
+	mu   sync.Mutex
+	size int64
+	// Entries, most recently used first.
+	lru *list.List
+	// Elements of lru by object key.
+	entries map[string]*list.Element
+}
+
+// hotEntry is the content of one object.
+type hotEntry struct {
+	key  string
+	etag string
+	data []byte
+}
+
+// initHotCache validates the configuration and creates the cache.
+func (ah *awshandler) initHotCache() error {
+	conf := ah.conf.HotCache
+	if conf == nil {
+		return nil
+	}
+	if conf.MaxSize < 0 || conf.MaxObjectSize < 0 {
+		return errors.New("invalid hot_cache")
+	}
+	if conf.MaxSize == 0 {
+		conf.MaxSize = defaultHotCacheSize
+	}
+	if conf.MaxObjectSize == 0 {
+		conf.MaxObjectSize = min(defaultHotCacheObjectSize, conf.MaxSize)
+	}
+	if conf.MaxObjectSize > conf.MaxSize {
+		return errors.New("hot_cache max_object_size must not exceed max_size")
+	}
+	ah.hotCache = &hotCache{
+		maxSize:       conf.MaxSize,
+		maxObjectSize: conf.MaxObjectSize,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+	return nil
+}
+
+// get returns the content of the object with the given key and ETag.
+func (hc *hotCache) get(key, etag string) ([]byte, bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	elem, ok := hc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*hotEntry)
+	if entry.etag != etag {
+		// The object was replaced.
+		hc.removeElement(elem)
+		return nil, false
+	}
+	hc.lru.MoveToFront(elem)
+	return entry.data, true
+}
+
+// set adds the content of the object, evicting the least recently used objects to make room.
+func (hc *hotCache) set(key, etag string, data []byte) {
+	if int64(len(data)) > hc.maxObjectSize {
+		return
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if elem, ok := hc.entries[key]; ok {
+		hc.removeElement(elem)
+	}
+	for hc.size+int64(len(data)) > hc.maxSize {
+		hc.removeElement(hc.lru.Back())
+	}
+	hc.entries[key] = hc.lru.PushFront(&hotEntry{key: key, etag: etag, data: data})
+	hc.size += int64(len(data))
+}
+
+// remove drops the objects with the given keys.
+func (hc *hotCache) remove(keys []string) {
+	if hc == nil {
+		return
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := hc.entries[key]; ok {
+			hc.removeElement(elem)
+		}
+	}
+}
+
+func (hc *hotCache) removeElement(elem *list.Element) {
+	entry := hc.lru.Remove(elem).(*hotEntry)
+	delete(hc.entries, entry.key)
+	hc.size -= int64(len(entry.data))
+}
+
+// hotCacheable checks if the file is served from the hot cache rather than redirected to. Responses
+// which must be altered, like downloads as attachments, are redirected.
+func (ah *awshandler) hotCacheable(fdef *types.FileDef, u *url.URL) bool {
+	return ah.hotCache != nil && fdef.Size > 0 && fdef.Size <= ah.hotCache.maxObjectSize &&
+		responseDisposition(u.Query()) == nil
+}
+
+// hotObject returns the reader of the content of a small object from the hot cache, reading the object
+// from S3 on miss. Returns nil if the object is too large to be cached.
+func (ah *awshandler) hotObject(ctx context.Context, fdef *types.FileDef) (media.ReadSeekCloser, error) {
+	if ah.hotCache == nil || fdef.Size <= 0 || fdef.Size > ah.hotCache.maxObjectSize {
+		return nil, nil
+	}
+	key, etag := ah.objectLocation(fdef), ah.objectETag(fdef)
+	if data, ok := ah.hotCache.get(key, etag); ok {
+		hotCacheHits.Add(1)
+		return bytesReadCloser{bytes.NewReader(data)}, nil
+	}
+	hotCacheMisses.Add(1)
+
+	reader, err := newObjectReader(ctx, ah, fdef)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// The reader stops at the size of the record.
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != fdef.Size {
+		logs.Warn.Println("s3: size mismatch of cached object", ah.redact.ref(key), len(data), fdef.Size)
+		return nil, types.ErrInternal
+	}
+	ah.hotCache.set(key, etag, data)
+	return bytesReadCloser{bytes.NewReader(data)}, nil
+}
+
+// bytesReadCloser is a media.ReadSeekCloser of content in memory.
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+// Close implements io.Closer.
+func (bytesReadCloser) Close() error {
+	return nil
+}
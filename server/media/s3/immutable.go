@@ -0,0 +1,205 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	tmtypes "github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Immutable uploads are stored under a separate prefix with S3 Object Lock so they cannot be
+// overwritten or deleted until the retention expires. The prefix of FileDef.Location marks the
+// file as immutable. Serve URLs of such files carry a long-lived token signed by the server
+// which pins the version of the object.
+const (
+	defaultImmutablePrefix = "immutable/"
+
+	// Query parameters of the serve URL of immutable files.
+	immutableVersionParam   = "ver"
+	immutableExpiresParam   = "exp"
+	immutableSignatureParam = "sig"
+)
+
+type immutableConfig struct {
+	// Prefix of keys of immutable objects. Must not be changed once files are stored.
+	Prefix string `json:"prefix"`
+	// Object Lock mode: "COMPLIANCE" (default) or "GOVERNANCE".
+	Mode string `json:"mode"`
+	// Retention period of immutable objects in days.
+	RetentionDays int `json:"retention_days"`
+	// Key for signing serve URLs with HMAC-SHA256.
+	TokenSecret string `json:"token_secret"`
+	// Lifetime of serve URLs in seconds, the retention period if 0.
+	TokenTTL int64 `json:"token_ttl"`
+}
+
+// initImmutable validates the configuration of immutable uploads.
+func (ah *awshandler) initImmutable() error {
+	conf := ah.conf.Immutable
+	if conf == nil {
+		return nil
+	}
+	if conf.Prefix == "" {
+		conf.Prefix = defaultImmutablePrefix
+	}
+	if !strings.HasSuffix(conf.Prefix, "/") || strings.HasPrefix(conf.Prefix, "/") {
+		return errors.New("immutable prefix must end with '/' and must not start with '/'")
+	}
+	if strings.HasPrefix(conf.Prefix, ah.conf.VariantPrefix) || strings.HasPrefix(ah.conf.VariantPrefix, conf.Prefix) {
+		return errors.New("immutable prefix must not overlap variant_prefix")
+	}
+	switch strings.ToUpper(conf.Mode) {
+	case "":
+		conf.Mode = string(s3types.ObjectLockModeCompliance)
+	case string(s3types.ObjectLockModeCompliance), string(s3types.ObjectLockModeGovernance):
+		conf.Mode = strings.ToUpper(conf.Mode)
+	default:
+		return errors.New("invalid immutable mode '" + conf.Mode + "'")
+	}
+	if conf.RetentionDays <= 0 {
+		return errors.New("immutable retention_days must be positive")
+	}
+	if conf.TokenSecret == "" {
+		return errors.New("missing immutable token_secret")
+	}
+	if conf.TokenTTL < 0 {
+		return errors.New("invalid immutable token_ttl")
+	}
+	if conf.TokenTTL == 0 {
+		conf.TokenTTL = int64(conf.RetentionDays) * 24 * 3600
+	}
+	return nil
+}
+
+// checkObjectLock makes sure the existing bucket can store immutable objects.
+func (ah *awshandler) checkObjectLock(ctx context.Context) error {
+	if ah.conf.Immutable == nil {
+		return nil
+	}
+	out, err := ah.svc.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(ah.conf.BucketName),
+	})
+	if err != nil {
+		return errors.New("failed to read object lock configuration: " + err.Error())
+	}
+	if out.ObjectLockConfiguration == nil ||
+		out.ObjectLockConfiguration.ObjectLockEnabled != s3types.ObjectLockEnabledEnabled {
+		return errors.New("object lock must be enabled on the bucket for immutable uploads")
+	}
+	return nil
+}
+
+// immutableUpload checks if the upload is requested as immutable. ErrUnsupported if requested
+// but not configured.
+func (ah *awshandler) immutableUpload(ctx context.Context) (bool, error) {
+	info := media.RequestInfoFromContext(ctx)
+	if info == nil || !info.Immutable {
+		return false, nil
+	}
+	if ah.conf.Immutable == nil {
+		return false, types.ErrUnsupported
+	}
+	return true, nil
+}
+
+// isImmutable checks if the file is stored as immutable.
+func (ah *awshandler) isImmutable(fdef *types.FileDef) bool {
+	return ah.conf.Immutable != nil && strings.HasPrefix(fdef.Location, ah.conf.Immutable.Prefix)
+}
+
+// lockObject sets the Object Lock of a new immutable object.
+func (ah *awshandler) lockObject(input *transfermanager.UploadObjectInput) {
+	input.ObjectLockMode = tmtypes.ObjectLockMode(ah.conf.Immutable.Mode)
+	input.ObjectLockRetainUntilDate = aws.Time(time.Now().UTC().AddDate(0, 0, ah.conf.Immutable.RetentionDays))
+}
+
+// immutableToken returns the query of the serve URL of the given version of the file.
+func (ah *awshandler) immutableToken(fid, version string) url.Values {
+	exp := strconv.FormatInt(time.Now().Unix()+ah.conf.Immutable.TokenTTL, 10)
+	return url.Values{
+		immutableVersionParam:   {version},
+		immutableExpiresParam:   {exp},
+		immutableSignatureParam: {ah.immutableSignature(fid, version, exp)},
+	}
+}
+
+func (ah *awshandler) immutableSignature(fid, version, exp string) string {
+	mac := hmac.New(sha256.New, []byte(ah.conf.Immutable.TokenSecret))
+	mac.Write([]byte(fid + "\n" + version + "\n" + exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkImmutableToken validates the token of the serve URL of the immutable file. Returns the version
+// of the object to serve.
+func (ah *awshandler) checkImmutableToken(fdef *types.FileDef, query url.Values) (string, error) {
+	version := query.Get(immutableVersionParam)
+	exp := query.Get(immutableExpiresParam)
+	sig := query.Get(immutableSignatureParam)
+	if version == "" || exp == "" || sig == "" {
+		return "", types.ErrPermissionDenied
+	}
+	if !hmac.Equal([]byte(sig), []byte(ah.immutableSignature(fdef.Id, version, exp))) {
+		return "", types.ErrPermissionDenied
+	}
+	if expires, err := strconv.ParseInt(exp, 10, 64); err != nil || expires < time.Now().Unix() {
+		return "", types.ErrPermissionDenied
+	}
+	return version, nil
+}
+
+// retainedObjects removes immutable objects from the list of keys to delete unless their retention
+// has expired. Returns the keys to delete, versions of expired immutable objects to delete by key,
+// and the number of refused keys.
+func (ah *awshandler) retainedObjects(ctx context.Context, keys []string) ([]string, map[string]string, int) {
+	if ah.conf.Immutable == nil {
+		return keys, nil, 0
+	}
+
+	var allowed []string
+	versions := map[string]string{}
+	refused := 0
+	now := time.Now()
+	for _, key := range keys {
+		if !strings.HasPrefix(key, ah.conf.Immutable.Prefix) {
+			allowed = append(allowed, key)
+			continue
+		}
+		head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:       aws.String(ah.conf.BucketName),
+			RequestPayer: ah.requestPayer(),
+			Key:          aws.String(key),
+		})
+		if err != nil && !isAPIError(err, "NotFound", "NoSuchKey") {
+			logs.Warn.Println("s3: failed to check retention, not deleted", ah.redact.ref(key), err)
+			refused++
+			continue
+		}
+		if err == nil {
+			if until := aws.ToTime(head.ObjectLockRetainUntilDate); until.After(now) {
+				logs.Warn.Println("s3: immutable object is retained until", until, "not deleted", ah.redact.ref(key))
+				refused++
+				continue
+			}
+			// Delete the version itself, otherwise S3 only adds a delete marker.
+			if head.VersionId != nil {
+				versions[key] = *head.VersionId
+			}
+		}
+		allowed = append(allowed, key)
+	}
+	return allowed, versions, refused
+}
@@ -0,0 +1,203 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Header which identifies repeated submissions of the same upload.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// Values of the "duplicate_upload" config option.
+	duplicateUploadOverwrite = "overwrite"
+	duplicateUploadExisting  = "existing"
+)
+
+// inflightUploads coalesces concurrent identical uploads on this node: the duplicate waits
+// for the first upload to complete and reuses its result instead of uploading the object again.
+type inflightUploads struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+// inflightCall is the result of the upload shared with the duplicates.
+type inflightCall struct {
+	done   chan struct{}
+	fdef   types.FileDef
+	result *media.UploadResult
+	err    error
+}
+
+// completedUpload is the result of the upload with an idempotency key remembered for the retries.
+type completedUpload struct {
+	fdef    types.FileDef
+	result  *media.UploadResult
+	expires time.Time
+}
+
+// idempotencyKey returns the client-provided idempotency key of the upload scoped to the user, or an
+// empty string if the client provided none.
+func idempotencyKey(ctx context.Context, fdef *types.FileDef) string {
+	if info := media.RequestInfoFromContext(ctx); info != nil && info.Header != nil {
+		if key := info.Header.Get(idempotencyKeyHeader); key != "" {
+			return fdef.User + "/" + key
+		}
+	}
+	return ""
+}
+
+// uploadKey identifies the upload: by the user and the client-provided idempotency key, if present,
+// by file ID otherwise.
+func uploadKey(ctx context.Context, fdef *types.FileDef) string {
+	if key := idempotencyKey(ctx, fdef); key != "" {
+		return key
+	}
+	return fdef.Id
+}
+
+// completedResult returns the remembered result of the completed upload with the idempotency key.
+func (ah *awshandler) completedResult(key string) (*completedUpload, bool) {
+	if ah.completed == nil || key == "" {
+		return nil, false
+	}
+	done, ok := ah.completed.get(key)
+	if !ok || time.Now().After(done.expires) {
+		return nil, false
+	}
+	return &done, true
+}
+
+// rememberResult keeps the result of the successful upload with the idempotency key for the retries.
+func (ah *awshandler) rememberResult(key string, fdef *types.FileDef, result *media.UploadResult) {
+	if ah.completed == nil || key == "" {
+		return
+	}
+	ah.completed.set(key, completedUpload{
+		fdef:    *fdef,
+		result:  result,
+		expires: time.Now().Add(time.Second * time.Duration(ah.conf.IdempotencyTTL)),
+	})
+}
+
+// start registers the upload. Returns the call and true if the caller must perform the upload,
+// or the call of the upload in progress and false if the caller is a duplicate.
+func (iu *inflightUploads) start(key string) (*inflightCall, bool) {
+	iu.mu.Lock()
+	defer iu.mu.Unlock()
+
+	if call, ok := iu.calls[key]; ok {
+		return call, false
+	}
+	if iu.calls == nil {
+		iu.calls = make(map[string]*inflightCall)
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	iu.calls[key] = call
+	return call, true
+}
+
+// finish publishes the result of the upload to the duplicates and removes the call.
+func (iu *inflightUploads) finish(key string, call *inflightCall, fdef *types.FileDef, result *media.UploadResult, err error) {
+	iu.mu.Lock()
+	delete(iu.calls, key)
+	iu.mu.Unlock()
+
+	call.fdef, call.result, call.err = *fdef, result, err
+	close(call.done)
+}
+
+// wait drains the duplicate stream, then waits for the upload in progress and copies the result to fdef.
+func (call *inflightCall) wait(ctx context.Context, fdef *types.FileDef, file io.Reader, limit int64) (*media.UploadResult, error) {
+	drain(file, limit)
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	// The duplicate becomes the same file. No new file record is created.
+	*fdef = call.fdef
+	return reusedResult(call.result), nil
+}
+
+// reusedResult returns a copy of the result of another upload marked as reused: the object belongs
+// to that upload.
+func reusedResult(result *media.UploadResult) *media.UploadResult {
+	reused := *result
+	reused.Reused = true
+	return &reused
+}
+
+// drain reads the stream of the duplicate upload so the sender is not blocked. The stream can't be read
+// once the request is handled.
+func drain(file io.Reader, limit int64) {
+	io.Copy(io.Discard, &readerCounter{reader: file, limit: limit})
+}
+
+// existingRecord returns the existing record of the retried upload. The file ID of the retries is derived
+// from the idempotency key and the user, so the record of another user is a collision and is never
+// overwritten: ErrPermissionDenied.
+func (ah *awshandler) existingRecord(ctx context.Context, fdef *types.FileDef) (*types.FileDef, error) {
+	existing, err := ah.getFileRecord(ctx, fdef.Uid())
+	if err != nil {
+		return nil, err
+	}
+	if existing.User != fdef.User {
+		logs.Warn.Println("s3: file record of another user", ah.redact.ref(fdef.Id))
+		return nil, types.ErrPermissionDenied
+	}
+	return existing, nil
+}
+
+// existingUpload returns the result of the earlier upload of the file if the record of the file exists,
+// e.g. the client retried the upload with the same idempotency key on another node, and with
+// duplicate_upload "existing" if its object is stored. The retried stream is drained. Returns nil
+// without an error if the file should be uploaded again.
+func (ah *awshandler) existingUpload(ctx context.Context, fdef *types.FileDef, file io.Reader) (*media.UploadResult, error) {
+	existing, err := ah.existingRecord(ctx, fdef)
+	if err != nil {
+		return nil, err
+	}
+	if ah.conf.DuplicateUpload != duplicateUploadExisting || existing.Location == "" {
+		return nil, nil
+	}
+	head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(existing.Location),
+	})
+	if err != nil {
+		if isAPIError(err, "NotFound", "NoSuchKey") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	url, err := ah.uploadURL(existing, ah.isImmutable(existing), head.VersionId)
+	if err != nil {
+		return nil, err
+	}
+	logs.Info.Println("s3: retried upload, returning the stored object", ah.redact.ref(fdef.Id))
+	drain(file, ah.conf.MaxFileSize)
+	*fdef = *existing
+	return &media.UploadResult{
+		URL:      url,
+		Size:     aws.ToInt64(head.ContentLength),
+		ETag:     existing.ETag,
+		Location: existing.Location,
+		MimeType: existing.MimeType,
+		Reused:   true,
+	}, nil
+}
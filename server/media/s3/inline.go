@@ -0,0 +1,61 @@
+package s3
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Files may render inline in the browser, unless they are downloaded as attachments. Which types render
+// is restricted either by the allowlist inline_types, e.g. only media and PDF in locked-down deployments,
+// or by the denylist force_download_types.
+
+// initInlineTypes validates the MIME type patterns of inline_types and force_download_types.
+func (ah *awshandler) initInlineTypes() error {
+	if ah.conf.InlineTypes != nil && ah.conf.ForceDownloadTypes != nil {
+		return errors.New("inline_types can't be used with force_download_types")
+	}
+	for name, patterns := range map[string][]string{
+		"inline_types":         ah.conf.InlineTypes,
+		"force_download_types": ah.conf.ForceDownloadTypes,
+	} {
+		for i, pattern := range patterns {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if _, err := path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+				return errors.New("invalid " + name + " pattern '" + pattern + "'")
+			}
+			patterns[i] = pattern
+		}
+	}
+	return nil
+}
+
+// matchesType checks if the media type of the MIME type matches any of the patterns.
+func matchesType(patterns []string, mimeType string) bool {
+	mediaType, _, _ := strings.Cut(mimeType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// inlineAllowed checks if files of the MIME type may render inline.
+func (ah *awshandler) inlineAllowed(mimeType string) bool {
+	if ah.conf.InlineTypes != nil {
+		return matchesType(ah.conf.InlineTypes, mimeType)
+	}
+	return !matchesType(ah.conf.ForceDownloadTypes, mimeType)
+}
+
+// attachmentURL returns the request URL altered to download the file as an attachment.
+func attachmentURL(u *url.URL) *url.URL {
+	query := u.Query()
+	query.Set("asatt", "1")
+	forced := *u
+	forced.RawQuery = query.Encode()
+	return &forced
+}
@@ -0,0 +1,48 @@
+package s3
+
+import (
+	"encoding/hex"
+	"expvar"
+	"strings"
+	"sync"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// Proxied downloads are optionally verified while they are streamed: the MD5 of the whole object is
+// compared with the ETag of the file record, which S3 sets to the MD5 of the content of objects uploaded
+// in one part without SSE-KMS or SSE-C encryption. Other objects and partial downloads are not verified.
+// Corruption can't be undone once the content is sent, so it's logged and counted as "S3CorruptDownloads".
+var (
+	corruptDownloads        expvar.Int
+	publishCorruptDownloads sync.Once
+)
+
+// initIntegrity publishes the counter of corrupt downloads if downloads are verified.
+func (ah *awshandler) initIntegrity() {
+	if !ah.conf.VerifyProxiedDownloads {
+		return
+	}
+	publishCorruptDownloads.Do(func() {
+		expvar.Publish("S3CorruptDownloads", &corruptDownloads)
+	})
+}
+
+// isContentMD5 checks if the ETag is the MD5 of the object, i.e. not of a multipart upload.
+func isContentMD5(etag string) bool {
+	if len(etag) != 2*16 {
+		return false
+	}
+	_, err := hex.DecodeString(etag)
+	return err == nil
+}
+
+// verifyDigest compares the MD5 of the object read to the end with its ETag.
+func (or *objectReader) verifyDigest() {
+	sum := hex.EncodeToString(or.digest.Sum(nil))
+	or.digest = nil
+	if !strings.EqualFold(sum, or.etag) {
+		corruptDownloads.Add(1)
+		logs.Warn.Println("s3: content of object does not match its ETag", or.redact.ref(or.key), or.etag, "->", sum)
+	}
+}
@@ -0,0 +1,174 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Presigned URLs can't carry policy conditions. Pinned URLs are presigned with temporary credentials of
+// a role assumed with a session policy which allows reading objects only from the network of the client.
+const (
+	// Default lengths of the network prefixes of the pinned addresses.
+	defaultPinIPv4Prefix = 32
+	defaultPinIPv6Prefix = 64
+
+	// Shortest session STS accepts. By default credentials outlive the presigned URLs by this many seconds.
+	minPinSessionTTL = 900
+
+	pinSessionName = "tinode-presign"
+)
+
+// ipPinner issues temporary credentials limited to a network.
+type ipPinner struct {
+	sts        *sts.Client
+	roleARN    string
+	ipv4Prefix int
+	ipv6Prefix int
+	sessionTTL time.Duration
+	// Credentials by network.
+	credentials *objectCache[aws.Credentials]
+}
+
+// initIPPinning validates the configuration of pinned presigned URLs.
+func (ah *awshandler) initIPPinning(cfg aws.Config) error {
+	if !ah.conf.PinPresignToIP {
+		return nil
+	}
+	if ah.conf.PinPresignRoleARN == "" {
+		return errors.New("pin_presign_to_ip requires pin_presign_role_arn")
+	}
+	pinner := &ipPinner{
+		roleARN:     ah.conf.PinPresignRoleARN,
+		ipv4Prefix:  ah.conf.PinPresignIPv4Prefix,
+		ipv6Prefix:  ah.conf.PinPresignIPv6Prefix,
+		credentials: newObjectCache[aws.Credentials](),
+	}
+	if pinner.ipv4Prefix == 0 {
+		pinner.ipv4Prefix = defaultPinIPv4Prefix
+	}
+	if pinner.ipv6Prefix == 0 {
+		pinner.ipv6Prefix = defaultPinIPv6Prefix
+	}
+	if pinner.ipv4Prefix < 0 || pinner.ipv4Prefix > 32 {
+		return errors.New("invalid pin_presign_ipv4_prefix")
+	}
+	if pinner.ipv6Prefix < 0 || pinner.ipv6Prefix > 128 {
+		return errors.New("invalid pin_presign_ipv6_prefix")
+	}
+	sessionTTL := ah.conf.PinPresignSessionTTL
+	if sessionTTL == 0 {
+		sessionTTL = ah.conf.PresignTTL + minPinSessionTTL
+	}
+	// The credentials must outlive the URLs signed with them.
+	if sessionTTL < minPinSessionTTL || sessionTTL <= ah.conf.PresignTTL {
+		return errors.New("pin_presign_session_ttl must be at least 900 and longer than presign_ttl")
+	}
+	pinner.sessionTTL = time.Second * time.Duration(sessionTTL)
+
+	var opts []func(*sts.Options)
+	if ah.conf.STSEndpoint != "" {
+		endpoint := ah.endpointURL(ah.conf.STSEndpoint)
+		opts = append(opts, func(o *sts.Options) {
+			o.BaseEndpoint = aws.String(endpoint)
+		})
+	}
+	pinner.sts = sts.NewFromConfig(cfg, opts...)
+	ah.pinner = pinner
+	return nil
+}
+
+// clientNetwork returns the network of the client the URLs are pinned to, or an empty string if they are
+// not pinned or the address of the client is unknown, like of gRPC clients.
+func (ah *awshandler) clientNetwork(ctx context.Context) string {
+	info := media.RequestInfoFromContext(ctx)
+	if ah.pinner == nil || info == nil {
+		return ""
+	}
+	host := info.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := ah.pinner.ipv4Prefix
+	if addr.Is6() {
+		bits = ah.pinner.ipv6Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+// pinPresign returns the option of the presign request which signs the URL with the credentials limited
+// to the network. The credentials are reused while they outlive the URL by ttl.
+func (ah *awshandler) pinPresign(ctx context.Context, network string, ttl time.Duration) (func(*s3.PresignOptions), error) {
+	creds, ok := ah.pinner.credentials.get(network)
+	if !ok || time.Until(creds.Expires) <= ttl {
+		var err error
+		if creds, err = ah.pinner.assumeRole(ctx, network); err != nil {
+			logs.Warn.Println("s3: failed to get credentials pinned to", network, err)
+			return nil, types.ErrUnavailable
+		}
+		ah.pinner.credentials.set(network, creds)
+	}
+	provider := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return creds, nil
+	})
+	return func(opts *s3.PresignOptions) {
+		opts.ClientOptions = append(opts.ClientOptions, func(o *s3.Options) {
+			o.Credentials = provider
+		})
+	}, nil
+}
+
+// assumeRole gets temporary credentials which can read objects only from the network.
+func (ip *ipPinner) assumeRole(ctx context.Context, network string) (aws.Credentials, error) {
+	policy, err := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Effect":    "Allow",
+			"Action":    "s3:GetObject",
+			"Resource":  "*",
+			"Condition": map[string]any{"IpAddress": map[string]string{"aws:SourceIp": network}},
+		}},
+	})
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	out, err := ip.sts.AssumeRole(ctx, &sts.AssumeRoleInput{
+		RoleArn:         aws.String(ip.roleARN),
+		RoleSessionName: aws.String(pinSessionName),
+		Policy:          aws.String(string(policy)),
+		DurationSeconds: aws.Int32(int32(ip.sessionTTL / time.Second)),
+	})
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if out.Credentials == nil {
+		return aws.Credentials{}, errors.New("no credentials returned")
+	}
+	return aws.Credentials{
+		AccessKeyID:     aws.ToString(out.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(out.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(out.Credentials.SessionToken),
+		Source:          "AssumeRole",
+		CanExpire:       true,
+		Expires:         aws.ToTime(out.Credentials.Expiration),
+	}, nil
+}
@@ -0,0 +1,72 @@
+package s3
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// S3 keys are up to 1024 bytes long, some S3-compatible servers allow fewer. Keys are made of the prefixes
+// of immutable objects and of tenants, the topic in the by_topic layout and the encoded file ID. Keys of
+// variants add variant_prefix and the kind, keys of originals add their prefix. The longest key which the
+// prefixes allow is checked against max_key_length in Init, so the configuration fails at startup. Topics
+// are known only at upload, so keys with topics are checked then, and such uploads fail before anything
+// is stored.
+const defaultMaxKeyLength = 1024
+
+// initMaxKeyLength validates the limit of key length against the longest key of the configured prefixes.
+func (ah *awshandler) initMaxKeyLength() error {
+	if ah.conf.MaxKeyLength < 0 {
+		return errors.New("invalid max_key_length")
+	}
+	if ah.conf.MaxKeyLength == 0 {
+		ah.conf.MaxKeyLength = defaultMaxKeyLength
+	}
+
+	longest := 0
+	for i := range ah.conf.Tenants {
+		longest = max(longest, len(ah.conf.Tenants[i].keyPrefix()))
+	}
+	if ah.conf.Immutable != nil {
+		longest += len(ah.conf.Immutable.Prefix)
+	}
+	// Encoded IDs are no longer than the encoding of the largest one.
+	longest += len(ah.objectKey(types.Uid(math.MaxUint64)))
+	if n := ah.storedKeyLength(longest); n > ah.conf.MaxKeyLength {
+		return errors.New("object keys may be " + strconv.Itoa(n) + " bytes long, longer than max_key_length " +
+			strconv.Itoa(ah.conf.MaxKeyLength) + ", shorten the prefixes")
+	}
+	return nil
+}
+
+// storedKeyLength returns the length of the longest key stored for the object with the key of the given
+// length, including keys of its variants and original.
+func (ah *awshandler) storedKeyLength(length int) int {
+	longest := length
+	if ah.conf.Originals != nil {
+		longest = len(ah.conf.Originals.Prefix) + length
+	}
+	if !ah.hasVariants() {
+		return longest
+	}
+	kind := 0
+	for _, k := range []string{placeholderKind, thumbnailKind, compressedKind[encodingBrotli], compressedKind[encodingGzip]} {
+		if ah.variantAllowed(k) {
+			kind = max(kind, len(k))
+		}
+	}
+	return max(longest, len(ah.conf.VariantPrefix)+length+len("/")+kind)
+}
+
+// checkKeyLength rejects the key of a new object if it or the keys of its variants or original are too long.
+func (ah *awshandler) checkKeyLength(key string) error {
+	if n := ah.storedKeyLength(len(key)); n > ah.conf.MaxKeyLength {
+		logs.Warn.Println("s3: object key", ah.redact.ref(key), "would be", n, "bytes long, more than max_key_length",
+			ah.conf.MaxKeyLength)
+		return errors.New("object key exceeds max_key_length " + strconv.Itoa(ah.conf.MaxKeyLength))
+	}
+	return nil
+}
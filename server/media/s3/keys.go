@@ -0,0 +1,193 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Layouts of object keys.
+const (
+	// Keys are encoded file IDs.
+	keyLayoutFlat = "flat"
+	// Keys of files uploaded to a topic are topics/<topic>/<encoded file ID>.
+	keyLayoutByTopic = "by_topic"
+
+	topicKeyPrefix = "topics/"
+)
+
+// Encodings of file IDs into object keys. Both are lowercase and thus safe for
+// case-insensitive backends.
+const (
+	// Lowercase base32, the same as the file names of the fs handler.
+	keyEncodingBase32 = "base32"
+	// Lowercase hex.
+	keyEncodingHex = "hex"
+	// Lowercase hex of HMAC-SHA256 of the file ID keyed with the salt of the deployment, truncated
+	// to 128 bits. Keys are opaque: deployments with different salts use different keys for the same ID,
+	// and keys of sequential IDs are unrelated, so keys don't reveal the order or time of uploads.
+	keyEncodingHMAC = "hmac"
+
+	// Shortest salt of hmac keys.
+	minKeySaltLength = 16
+
+	// Topic names longer than this are not used in keys.
+	maxTopicKeyLength = 64
+)
+
+type keyCodec struct {
+	encode func(types.Uid) string
+	// Nil if keys are opaque.
+	decode func(string) types.Uid
+}
+
+// hmacKeyCodec returns the codec of opaque keys derived with the salt.
+func hmacKeyCodec(salt string) keyCodec {
+	return keyCodec{
+		encode: func(uid types.Uid) string {
+			data, _ := uid.MarshalBinary()
+			mac := hmac.New(sha256.New, []byte(salt))
+			mac.Write(data)
+			return hex.EncodeToString(mac.Sum(nil)[:16])
+		},
+	}
+}
+
+var keyCodecs = map[string]keyCodec{
+	keyEncodingBase32: {
+		encode: types.Uid.String32,
+		decode: func(key string) types.Uid {
+			return types.ParseUid32(strings.ToUpper(key))
+		},
+	},
+	keyEncodingHex: {
+		encode: func(uid types.Uid) string {
+			data, _ := uid.MarshalBinary()
+			return hex.EncodeToString(data)
+		},
+		decode: func(key string) types.Uid {
+			var uid types.Uid
+			if data, err := hex.DecodeString(key); err == nil {
+				uid.UnmarshalBinary(data)
+			}
+			return uid
+		},
+	},
+}
+
+// initKeyEncoding validates the key encoding and warns if the bucket contains objects stored
+// with a different encoding.
+func (ah *awshandler) initKeyEncoding() error {
+	if ah.conf.KeyEncoding == "" {
+		ah.conf.KeyEncoding = keyEncodingBase32
+	}
+	if ah.conf.KeyEncoding == keyEncodingHMAC {
+		if len(ah.conf.KeySalt) < minKeySaltLength {
+			return errors.New("key_encoding 'hmac' requires key_salt of at least 16 characters")
+		}
+		ah.keyCodec = hmacKeyCodec(ah.conf.KeySalt)
+		return nil
+	}
+	codec, ok := keyCodecs[ah.conf.KeyEncoding]
+	if !ok {
+		return errors.New("unknown key_encoding '" + ah.conf.KeyEncoding + "'")
+	}
+
+	// Make sure the encoding is reversible, i.e. different IDs cannot map to the same key.
+	for _, uid := range []types.Uid{1, 0x0123456789abcdef, 0xfedcba9876543210, 0xffffffffffffffff} {
+		if codec.decode(codec.encode(uid)) != uid {
+			return errors.New("key_encoding '" + ah.conf.KeyEncoding + "' is not reversible")
+		}
+	}
+	ah.keyCodec = codec
+	return nil
+}
+
+// checkKeyEncoding logs a warning if existing objects use a different key encoding. Objects
+// remain accessible because their keys are stored in FileDef.Location, but the handler cannot
+// derive their keys from file IDs.
+func (ah *awshandler) checkKeyEncoding(ctx context.Context) {
+	if ah.keyCodec.decode == nil {
+		// Opaque keys can't be matched to file IDs.
+		return
+	}
+	out, err := ah.svc.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		MaxKeys:      aws.Int32(1),
+		// Skip variants and other objects in "directories".
+		Delimiter: aws.String("/"),
+	})
+	if err != nil || len(out.Contents) == 0 {
+		return
+	}
+	key := aws.ToString(out.Contents[0].Key)
+	if uid := ah.keyCodec.decode(key); uid.IsZero() || ah.keyCodec.encode(uid) != key {
+		logs.Warn.Println("s3: existing object key", ah.redact.ref(key), "does not match key_encoding", ah.conf.KeyEncoding,
+			"- such objects are served and deleted by their stored location only")
+	}
+}
+
+// initKeyLayout validates the layout of object keys.
+func (ah *awshandler) initKeyLayout() error {
+	switch ah.conf.KeyLayout {
+	case "":
+		ah.conf.KeyLayout = keyLayoutFlat
+	case keyLayoutFlat, keyLayoutByTopic:
+	default:
+		return errors.New("unknown key_layout '" + ah.conf.KeyLayout + "'")
+	}
+	return nil
+}
+
+// objectKey returns the key of a new object for the given file ID.
+func (ah *awshandler) objectKey(uid types.Uid) string {
+	return ah.keyCodec.encode(uid)
+}
+
+// uploadObjectKey returns the key of a new object for the file uploaded with the request of the context.
+// In by_topic layout, the key includes the topic of the request. Uploads without a topic or with a topic
+// name unsafe for a key are stored as in the flat layout.
+func (ah *awshandler) uploadObjectKey(ctx context.Context, uid types.Uid) string {
+	key := ah.objectKey(uid)
+	if ah.conf.KeyLayout != keyLayoutByTopic {
+		return key
+	}
+	if info := media.RequestInfoFromContext(ctx); info != nil && isKeySafeTopic(info.Topic) {
+		return topicKeyPrefix + info.Topic + "/" + key
+	}
+	return key
+}
+
+// isKeySafeTopic checks if the topic name can be used in an object key as is.
+func isKeySafeTopic(topic string) bool {
+	if topic == "" || len(topic) > maxTopicKeyLength {
+		return false
+	}
+	for _, r := range topic {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// objectLocation returns the key of an existing object. The stored location takes precedence
+// over the key computed from the file ID so objects stored with different key encodings coexist.
+func (ah *awshandler) objectLocation(fdef *types.FileDef) string {
+	if fdef.Location != "" {
+		return fdef.Location
+	}
+	// Legacy records without location.
+	return fdef.Uid().String32()
+}
@@ -0,0 +1,53 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Sources of the last modification time of files reported to clients by Last-Modified of proxied
+// downloads and by file metadata.
+const (
+	// The time the upload was completed, stored in the file record.
+	lastModifiedRecord = "record"
+	// LastModified of the object in S3, which costs a HEAD request. Accurate if objects are replaced
+	// out of band.
+	lastModifiedObject = "object"
+)
+
+// initLastModifiedSource validates the source of last modification times.
+func (ah *awshandler) initLastModifiedSource() error {
+	switch ah.conf.LastModifiedSource {
+	case "":
+		ah.conf.LastModifiedSource = lastModifiedRecord
+	case lastModifiedRecord, lastModifiedObject:
+	default:
+		return errors.New("invalid last_modified_source '" + ah.conf.LastModifiedSource + "'")
+	}
+	return nil
+}
+
+// lastModified returns the time the file was last modified. Falls back to the time in the file record
+// if the object can't be checked.
+func (ah *awshandler) lastModified(ctx context.Context, fdef *types.FileDef) time.Time {
+	if ah.conf.LastModifiedSource != lastModifiedObject {
+		return fdef.UpdatedAt
+	}
+	head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(ah.objectLocation(fdef)),
+	})
+	if err != nil || head.LastModified == nil {
+		logs.Warn.Println("s3: failed to get last modified time of object", ah.redact.ref(fdef.Id), err)
+		return fdef.UpdatedAt
+	}
+	return *head.LastModified
+}
@@ -0,0 +1,57 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+const (
+	// Values of the "log_file_ids" config option.
+	logIDsFull = "full"
+	logIDsHash = "hash"
+
+	// Length of the logged hashes, in base64 characters.
+	logHashLen = 12
+)
+
+// logRedactor replaces file IDs and object keys in logs with hashes, so the logs can't be used
+// to construct download URLs. A nil redactor logs them as is.
+type logRedactor struct {
+	secret []byte
+}
+
+// initLogRedactor validates the configuration of file IDs in logs.
+func (ah *awshandler) initLogRedactor() error {
+	switch ah.conf.LogFileIds {
+	case "", logIDsFull:
+		ah.conf.LogFileIds = logIDsFull
+		return nil
+	case logIDsHash:
+	default:
+		return errors.New("invalid log_file_ids '" + ah.conf.LogFileIds + "'")
+	}
+
+	secret := []byte(ah.conf.LogIdSecret)
+	if len(secret) == 0 {
+		// Hashes are consistent within the lifetime of the process only.
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+	}
+	ah.redact = &logRedactor{secret: secret}
+	return nil
+}
+
+// ref returns the representation of the file ID or the object key to log.
+func (lr *logRedactor) ref(value string) string {
+	if lr == nil || value == "" {
+		return value
+	}
+	mac := hmac.New(sha256.New, lr.secret)
+	mac.Write([]byte(value))
+	return "#" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:logHashLen]
+}
@@ -0,0 +1,87 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// parseMetaKeys validates the allowlist of object metadata keys. S3 returns the keys in lower case.
+func parseMetaKeys(keys []string) (map[string]bool, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	allowed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		key = strings.TrimPrefix(strings.ToLower(key), "x-amz-meta-")
+		if key == "" || strings.ContainsAny(key, " \t\r\n:") {
+			return nil, errors.New("invalid meta_keys entry '" + key + "'")
+		}
+		allowed[key] = true
+	}
+	return allowed, nil
+}
+
+// FileMetadata describes the file with the given URL. If full is true, the object metadata from
+// the meta_keys allowlist is included. Other keys are never returned.
+func (ah *awshandler) FileMetadata(ctx context.Context, url string, full bool) (*media.FileMetadata, error) {
+	fid := ah.GetIdFromUrl(url)
+	if fid.IsZero() {
+		return nil, types.ErrNotFound
+	}
+	fdef, err := ah.getFileRecord(ctx, fid)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &media.FileMetadata{
+		Id:        fdef.Id,
+		MimeType:  fdef.MimeType,
+		Size:      fdef.Size,
+		ETag:      fdef.ETag,
+		CreatedAt: fdef.CreatedAt,
+		UpdatedAt: fdef.UpdatedAt,
+	}
+	meta.Placeholder = ah.placeholder(ctx, fdef)
+	if ah.thumbnailType(ctx, fdef) != "" {
+		meta.Thumbnail = ah.thumbnailURL(fdef)
+	}
+	if !full || len(ah.metaKeys) == 0 {
+		meta.UpdatedAt = ah.lastModified(ctx, fdef)
+		return meta, nil
+	}
+
+	key := ah.objectLocation(fdef)
+	head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(key),
+	})
+	if err != nil {
+		if isAPIError(err, "NotFound", "NoSuchKey") {
+			logs.Warn.Println("s3: object of file record is missing", ah.redact.ref(fdef.Id), ah.redact.ref(key))
+			return nil, types.ErrNotFound
+		}
+		return nil, err
+	}
+	ah.cacheMetadata(key, head.Metadata)
+	if ah.conf.LastModifiedSource == lastModifiedObject && head.LastModified != nil {
+		meta.UpdatedAt = *head.LastModified
+	}
+	for name, value := range head.Metadata {
+		if !ah.metaKeys[strings.ToLower(name)] {
+			continue
+		}
+		if meta.Meta == nil {
+			meta.Meta = map[string]string{}
+		}
+		meta.Meta[strings.ToLower(name)] = value
+	}
+	return meta, nil
+}
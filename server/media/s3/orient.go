@@ -0,0 +1,193 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// JPEG images with the EXIF orientation tag are rotated to the displayed orientation when uploaded,
+// so clients which ignore the tag show them correctly. Re-encoded images carry no EXIF metadata.
+const (
+	// Default maximum size of an image in bytes to normalize the orientation of.
+	defaultOrientationMaxSize = 10 * 1024 * 1024
+	// Quality of re-encoded images.
+	orientationQuality = 90
+
+	exifOrientationTag = 0x0112
+)
+
+// initOrientation validates the configuration of orientation normalization.
+func (ah *awshandler) initOrientation() error {
+	if ah.conf.OrientationMaxSize < 0 {
+		return errors.New("invalid orientation_max_size")
+	}
+	if ah.conf.OrientationMaxSize == 0 {
+		ah.conf.OrientationMaxSize = defaultOrientationMaxSize
+	}
+	return nil
+}
+
+// errReader is a stream which fails with the error.
+type errReader struct {
+	err error
+}
+
+func (er errReader) Read([]byte) (int, error) {
+	return 0, er.err
+}
+
+// normalizeOrientation rotates the uploaded JPEG image to the orientation of its EXIF tag. Returns
+// the stream to upload, its size and the original image if it was rotated. Other files, images without
+// the tag, images which are too large and images not matching the declared size are returned unchanged
+// for the upload to check them as usual.
+func (ah *awshandler) normalizeOrientation(fdef *types.FileDef, file io.Reader, size, limit,
+	declared int64) (io.Reader, int64, []byte) {
+	if !ah.conf.NormalizeOrientation || fdef.MimeType != "image/jpeg" || size > ah.conf.OrientationMaxSize {
+		return file, size, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, ah.conf.OrientationMaxSize+1))
+	if err != nil {
+		// Let the upload fail with the error of the source.
+		return io.MultiReader(bytes.NewReader(data), errReader{err}), size, nil
+	}
+	if int64(len(data)) > ah.conf.OrientationMaxSize {
+		return io.MultiReader(bytes.NewReader(data), file), size, nil
+	}
+	original := bytes.NewReader(data)
+
+	orientation := jpegOrientation(data)
+	if orientation < 2 || orientation > 8 || !ah.sizeMatches(declared, int64(len(data))) {
+		return original, int64(len(data)), nil
+	}
+	rotated, err := rotateJPEG(data, orientation)
+	if err != nil {
+		logs.Info.Println("s3: failed to normalize orientation of", ah.redact.ref(fdef.Id), err)
+		return original, int64(len(data)), nil
+	}
+	if limit > 0 && int64(len(rotated)) > limit {
+		// Re-encoded image is larger than the original.
+		return original, int64(len(data)), nil
+	}
+	return bytes.NewReader(rotated), int64(len(rotated)), data
+}
+
+// rotateJPEG decodes the image, transforms it to the displayed orientation and encodes it again.
+func rotateJPEG(data []byte, orientation int) ([]byte, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxPlaceholderPixels {
+		return nil, errors.New("image too large to decode")
+	}
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Rotated by 90 or 270 degrees.
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		for x := range dw {
+			// Coordinates of the source pixel displayed at (x, y).
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: orientationQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jpegOrientation returns the value of the EXIF orientation tag of the JPEG image, or 0 if there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0
+	}
+	// Markers of the segments before the image data.
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return 0
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: no EXIF.
+			return 0
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 0
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 0
+}
+
+// exifOrientation returns the orientation tag of the first IFD of the TIFF structure of EXIF.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := range count {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			// SHORT value stored in the entry itself.
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Processing at upload, like normalizing the orientation of JPEG images, alters the stored bytes. With
+// originals, the untouched upload is kept too, e.g. for legal or archival needs where provenance matters.
+// The processed copy is stored under the key of the file and served as usual. The original is stored under
+// <originals prefix><object key>, is never served and its key is recorded in FileDef.OriginalLocation.
+// The bucket policy should restrict access to the prefix. Originals are deleted with their files.
+const defaultOriginalsPrefix = "originals/"
+
+type originalsConfig struct {
+	// Prefix of keys of originals, "originals/" if empty.
+	Prefix string `json:"prefix"`
+}
+
+// initOriginals validates the prefix of originals. It must not overlap with other prefixes of keys.
+func (ah *awshandler) initOriginals() error {
+	conf := ah.conf.Originals
+	if conf == nil {
+		return nil
+	}
+	if conf.Prefix == "" {
+		conf.Prefix = defaultOriginalsPrefix
+	}
+	if !strings.HasSuffix(conf.Prefix, "/") || strings.HasPrefix(conf.Prefix, "/") {
+		return errors.New("originals prefix must end with '/' and must not start with '/'")
+	}
+	reserved := []string{topicKeyPrefix, ah.conf.VariantPrefix}
+	if ah.conf.Immutable != nil {
+		reserved = append(reserved, ah.conf.Immutable.Prefix)
+	}
+	for i := range ah.conf.Tenants {
+		reserved = append(reserved, ah.conf.Tenants[i].Prefix)
+	}
+	for _, other := range reserved {
+		if strings.HasPrefix(conf.Prefix, other) || strings.HasPrefix(other, conf.Prefix) {
+			return errors.New("originals prefix overlaps with '" + other + "'")
+		}
+	}
+	return nil
+}
+
+// originalKey is the key of the original of the object.
+func (ah *awshandler) originalKey(location string) string {
+	return ah.conf.Originals.Prefix + location
+}
+
+// storeOriginal stores the unprocessed upload of the object with the given key. Returns the key of the original.
+func (ah *awshandler) storeOriginal(ctx context.Context, fdef *types.FileDef, key string, data []byte) (string, error) {
+	original := ah.originalKey(key)
+	_, err := ah.svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(ah.conf.BucketName),
+		RequestPayer:  ah.requestPayer(),
+		Key:           aws.String(original),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String(fdef.MimeType),
+	})
+	if err != nil {
+		logs.Warn.Println("s3: failed to store original", ah.redact.ref(original), err)
+		return "", err
+	}
+	return original, nil
+}
+
+// deleteOriginals deletes the originals of the objects, if kept.
+func (ah *awshandler) deleteOriginals(ctx context.Context, locations []string) {
+	if ah.conf.Originals == nil || len(locations) == 0 {
+		return
+	}
+	objects := make([]s3types.ObjectIdentifier, len(locations))
+	for i, loc := range locations {
+		objects[i] = s3types.ObjectIdentifier{Key: aws.String(ah.originalKey(loc))}
+	}
+	resp, err := ah.svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Delete:       &s3types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		logs.Warn.Println("s3: failed to delete originals of", len(locations), "objects", err)
+		return
+	}
+	for _, e := range resp.Errors {
+		logs.Warn.Println("s3: failed to delete original", ah.redact.ref(aws.ToString(e.Key)), aws.ToString(e.Code))
+	}
+}
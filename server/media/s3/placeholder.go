@@ -0,0 +1,257 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"math"
+	"strings"
+
+	// Formats of images with placeholders.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Placeholders of images are BlurHash strings, see https://blurha.sh. They are computed while
+// the image is uploaded and stored as a variant of the object.
+const (
+	placeholderKind = "blurhash"
+
+	// Default maximum size of an image in bytes to compute the placeholder for.
+	defaultPlaceholderMaxSize = 10 * 1024 * 1024
+	// Images with more pixels are not decoded.
+	maxPlaceholderPixels = 50 * 1000 * 1000
+
+	// Number of BlurHash components along the X and Y axes.
+	blurhashComponentsX = 4
+	blurhashComponentsY = 3
+	// The image is sampled at most at this many points along each axis.
+	blurhashSamples = 64
+)
+
+// initPlaceholders validates the configuration of image placeholders.
+func (ah *awshandler) initPlaceholders() error {
+	if ah.conf.PlaceholderMaxSize < 0 {
+		return errors.New("invalid placeholder_max_size")
+	}
+	if ah.conf.PlaceholderMaxSize == 0 {
+		ah.conf.PlaceholderMaxSize = defaultPlaceholderMaxSize
+	}
+	ah.placeholders = newObjectCache[string]()
+	return nil
+}
+
+// placeholderBuffer collects the image while it's uploaded, for placeholders or thumbnails. The image is
+// dropped if it's too large.
+type placeholderBuffer struct {
+	buf    bytes.Buffer
+	limit  int64
+	failed bool
+}
+
+func (pb *placeholderBuffer) Write(p []byte) (int, error) {
+	if pb.failed {
+		return len(p), nil
+	}
+	if int64(pb.buf.Len()+len(p)) > pb.limit {
+		pb.failed = true
+		pb.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return pb.buf.Write(p)
+}
+
+// newPlaceholderBuffer creates the buffer for the upload or returns nil if the placeholder should not be computed.
+func (ah *awshandler) newPlaceholderBuffer(fdef *types.FileDef, size int64) *placeholderBuffer {
+	if !ah.conf.Placeholders || !ah.variantAllowed(placeholderKind) || !strings.HasPrefix(fdef.MimeType, "image/") ||
+		size > ah.conf.PlaceholderMaxSize {
+		return nil
+	}
+	return &placeholderBuffer{limit: ah.conf.PlaceholderMaxSize}
+}
+
+// storePlaceholder computes the placeholder of the uploaded image and stores it. The placeholder and
+// the dimensions of the image are added to the result. Failures are logged but otherwise ignored:
+// the placeholder is optional.
+func (ah *awshandler) storePlaceholder(ctx context.Context, fdef *types.FileDef, pb *placeholderBuffer,
+	res *media.UploadResult) {
+	if pb == nil || pb.failed {
+		return
+	}
+	hash, cfg, err := imageBlurhash(bytes.NewReader(pb.buf.Bytes()))
+	if err != nil {
+		// Unsupported format or not an image after all.
+		logs.Info.Println("s3: no placeholder for", ah.redact.ref(fdef.Id), err)
+		return
+	}
+	key := ah.variantKey(fdef.Location, placeholderKind)
+	_, err = ah.svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(ah.conf.BucketName),
+		RequestPayer:  ah.requestPayer(),
+		Key:           aws.String(key),
+		Body:          strings.NewReader(hash),
+		ContentLength: aws.Int64(int64(len(hash))),
+		ContentType:   aws.String("text/plain; charset=utf-8"),
+	})
+	if err != nil {
+		logs.Warn.Println("s3: failed to store placeholder", ah.redact.ref(key), err)
+		return
+	}
+	ah.placeholders.set(key, hash)
+	res.Width, res.Height, res.Placeholder = cfg.Width, cfg.Height, hash
+}
+
+// placeholder returns the placeholder of the image or an empty string if there is none.
+func (ah *awshandler) placeholder(ctx context.Context, fdef *types.FileDef) string {
+	if !ah.conf.Placeholders || !ah.variantAllowed(placeholderKind) || !strings.HasPrefix(fdef.MimeType, "image/") ||
+		ah.variantsMissing(fdef) {
+		return ""
+	}
+	key := ah.variantKey(ah.objectLocation(fdef), placeholderKind)
+	if hash, ok := ah.placeholders.get(key); ok {
+		return hash
+	}
+	out, err := ah.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(key),
+	})
+	if err != nil {
+		if isAPIError(err, "NotFound", "NoSuchKey") {
+			// Uploaded before placeholders were enabled or the image could not be decoded.
+			ah.placeholders.setExpiring(key, "", ah.missingVariantTTL())
+		}
+		return ""
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(out.Body, 256))
+	if err != nil {
+		return ""
+	}
+	ah.placeholders.set(key, string(data))
+	return string(data)
+}
+
+// imageBlurhash decodes the image and computes its BlurHash. Returns the hash and the dimensions of
+// the image. Images with too many pixels are rejected before decoding.
+func imageBlurhash(r io.ReadSeeker) (string, image.Config, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", cfg, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxPlaceholderPixels {
+		return "", cfg, errors.New("image too large to decode")
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return "", cfg, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", cfg, err
+	}
+	return blurhash(img), cfg, nil
+}
+
+// Digits of the base 83 encoding of BlurHash.
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurhash encodes the image as BlurHash with blurhashComponentsX by blurhashComponentsY components.
+func blurhash(img image.Image) string {
+	bounds := img.Bounds()
+	width := min(bounds.Dx(), blurhashSamples)
+	height := min(bounds.Dy(), blurhashSamples)
+
+	// Linear RGB of the sampled points.
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height).RGBA()
+			pixels[y*width+x] = [3]float64{srgbToLinear(r >> 8), srgbToLinear(g >> 8), srgbToLinear(b >> 8)}
+		}
+	}
+
+	factors := make([][3]float64, 0, blurhashComponentsX*blurhashComponentsY)
+	for j := 0; j < blurhashComponentsY; j++ {
+		for i := 0; i < blurhashComponentsX; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					for c := range f {
+						f[c] += basis * pixels[y*width+x][c]
+					}
+				}
+			}
+			scale := norm / float64(width*height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((blurhashComponentsX-1)+(blurhashComponentsY-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = max(actualMax, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encode83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encode83(0, 1))
+	}
+
+	sb.WriteString(encode83(linearToSrgb(dc[0])<<16|linearToSrgb(dc[1])<<8|linearToSrgb(dc[2]), 4))
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encode83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return sb.String()
+}
+
+func encode83(value, length int) string {
+	buf := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		buf[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(buf)
+}
+
+func srgbToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,90 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/tinode/chat/server/media"
+)
+
+// Presigning is CPU-bound. A burst of downloads which miss the URL cache may presign so many URLs at once
+// that the rest of the server is starved. With presign_concurrency, only so many URLs are presigned at a
+// time. Requests over the limit wait for presign_wait milliseconds and then get 503 with Retry-After.
+const (
+	// Default time to wait for presigning in milliseconds.
+	defaultPresignWait = 100
+	// Retry-After of requests rejected by the limit.
+	presignRetryAfter = time.Second
+)
+
+// Requests waiting to presign and requests rejected by the limit, reported through expvar.
+var (
+	presignQueue    = expvar.NewInt("S3PresignQueue")
+	presignRejected = expvar.NewInt("S3PresignRejected")
+)
+
+var errPresignBusy = errors.New("too many concurrent presign operations")
+
+// presignLimiter limits the number of concurrent presign operations.
+type presignLimiter struct {
+	slots chan struct{}
+	// Time to wait for a free slot.
+	wait time.Duration
+}
+
+// newPresignLimiter returns the limiter of presigning, nil if not limited.
+func newPresignLimiter(concurrency, wait int) (*presignLimiter, error) {
+	if concurrency < 0 || wait < 0 {
+		return nil, errors.New("invalid presign_concurrency or presign_wait")
+	}
+	if concurrency == 0 {
+		return nil, nil
+	}
+	if wait == 0 {
+		wait = defaultPresignWait
+	}
+	return &presignLimiter{
+		slots: make(chan struct{}, concurrency),
+		wait:  time.Millisecond * time.Duration(wait),
+	}, nil
+}
+
+// acquire waits until a URL may be presigned. The returned function must be called once the URL
+// is presigned. Fails with media.ThrottledError if no slot gets free in time.
+func (pl *presignLimiter) acquire(ctx context.Context) (func(), error) {
+	if pl == nil {
+		return func() {}, nil
+	}
+	release := func() { <-pl.slots }
+	select {
+	case pl.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	presignQueue.Add(1)
+	defer presignQueue.Add(-1)
+	timer := time.NewTimer(pl.wait)
+	defer timer.Stop()
+	select {
+	case pl.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		presignRejected.Add(1)
+		return nil, &media.ThrottledError{RetryAfter: presignRetryAfter, Err: errPresignBusy}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// limitedPresign presigns the URL once the limit allows.
+func (ah *awshandler) limitedPresign(ctx context.Context, sign func() (string, error)) (string, error) {
+	release, err := ah.presignLimit.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return sign()
+}
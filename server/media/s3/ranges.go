@@ -0,0 +1,76 @@
+package s3
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// unsatisfiableRange checks the Range header of a GET request against the size of the file in the record.
+// Returns the headers of the 416 response if none of the ranges can be satisfied, so the client gets
+// a proper response without a round trip to S3. Invalid headers and ranges of other representations
+// (If-Range does not match) are ignored like by S3.
+func unsatisfiableRange(fdef *types.FileDef, headers http.Header) http.Header {
+	header := headers.Get("Range")
+	if header == "" || fdef.Size <= 0 {
+		return nil
+	}
+	if ifRange := headers.Get("If-Range"); ifRange != "" && (fdef.ETag == "" || ifRange != `"`+fdef.ETag+`"`) {
+		// The whole file will be served.
+		return nil
+	}
+	if !rangesUnsatisfiable(header, fdef.Size) {
+		return nil
+	}
+	return http.Header{
+		"Content-Range": {"bytes */" + strconv.FormatInt(fdef.Size, 10)},
+		// The response depends on the Range of the request.
+		"Cache-Control": {"no-store"},
+	}
+}
+
+// rangesUnsatisfiable checks if the value of the Range header is valid but none of its byte ranges
+// overlaps the content of the given size.
+func rangesUnsatisfiable(header string, size int64) bool {
+	unit, set, ok := strings.Cut(header, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return false
+	}
+	count := 0
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return false
+		}
+		if first == "" {
+			// Suffix range: the last N bytes.
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix != 0 {
+				// Invalid or satisfiable by a non-empty file.
+				return false
+			}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return false
+			}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return false
+				}
+			}
+			if start < size {
+				return false
+			}
+		}
+		count++
+	}
+	return count > 0
+}
@@ -0,0 +1,146 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// objectReader reads S3 object as media.ReadSeekCloser. The object is fetched lazily with
+// a ranged GET starting at the current offset, so seeking to serve a Range request does not
+// download the skipped bytes. Ranges are requested only from the object with the ETag of the
+// file record, so a resumed download is not assembled from different objects.
+type objectReader struct {
+	ctx    context.Context
+	svc    *s3.Client
+	bucket string
+	key    string
+	size   int64
+	offset int64
+	// ETag of the object to read, any object if empty.
+	etag string
+	// Set for Requester Pays buckets.
+	requestPayer s3types.RequestPayer
+	redact       *logRedactor
+	// Body of the current GET response, nil if not requested yet or after seeking.
+	body io.ReadCloser
+	// Running MD5 of the object read from the start, nil if not verified.
+	digest hash.Hash
+	// Number of bytes added to the digest.
+	digested int64
+}
+
+func newObjectReader(ctx context.Context, ah *awshandler, fdef *types.FileDef) (*objectReader, error) {
+	or := &objectReader{
+		ctx:    ctx,
+		svc:    ah.svc,
+		bucket: ah.conf.BucketName,
+		key:    ah.objectLocation(fdef),
+		size:   fdef.Size,
+		etag:   ah.objectETag(fdef),
+
+		requestPayer: ah.requestPayer(),
+		redact:       ah.redact,
+	}
+
+	if or.size <= 0 {
+		// Size is unknown, get it from S3.
+		head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:       aws.String(or.bucket),
+			RequestPayer: ah.requestPayer(),
+			Key:          aws.String(or.key),
+		})
+		if err != nil {
+			if isAPIError(err, "NoSuchKey", "NotFound") {
+				err = types.ErrNotFound
+			}
+			return nil, err
+		}
+		or.size = aws.ToInt64(head.ContentLength)
+	}
+	if ah.conf.VerifyProxiedDownloads && isContentMD5(or.etag) {
+		or.digest = md5.New()
+	}
+	return or, nil
+}
+
+// Read reads the object starting at the current offset.
+func (or *objectReader) Read(p []byte) (int, error) {
+	if or.offset >= or.size {
+		return 0, io.EOF
+	}
+
+	if or.body == nil {
+		input := &s3.GetObjectInput{
+			Bucket:       aws.String(or.bucket),
+			RequestPayer: or.requestPayer,
+			Key:          aws.String(or.key),
+			Range:        aws.String("bytes=" + strconv.FormatInt(or.offset, 10) + "-"),
+		}
+		if or.etag != "" {
+			input.IfMatch = aws.String(`"` + or.etag + `"`)
+		}
+		out, err := or.svc.GetObject(or.ctx, input)
+		if err != nil {
+			if isAPIError(err, "PreconditionFailed") {
+				logs.Warn.Println("s3: object changed since the file record was written", or.redact.ref(or.key))
+			}
+			return 0, err
+		}
+		or.body = out.Body
+	}
+
+	n, err := or.body.Read(p)
+	if or.digest != nil && or.digested == or.offset {
+		or.digest.Write(p[:n])
+		or.digested += int64(n)
+	}
+	or.offset += int64(n)
+	if or.digest != nil && or.digested == or.size {
+		or.verifyDigest()
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (or *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += or.offset
+	case io.SeekEnd:
+		offset += or.size
+	default:
+		return 0, errors.New("objectReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("objectReader.Seek: negative position")
+	}
+
+	if offset != or.offset {
+		// The next read will request the object from the new position.
+		or.Close()
+		or.offset = offset
+	}
+	return offset, nil
+}
+
+// Close releases the current GET response, if any.
+func (or *objectReader) Close() error {
+	if or.body == nil {
+		return nil
+	}
+	err := or.body.Close()
+	or.body = nil
+	return err
+}
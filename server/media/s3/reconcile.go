@@ -0,0 +1,105 @@
+package s3
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Number of file records to read from the store at once while reconciling.
+	reconcileBatchSize = 100
+	// Log progress of reconciling after this many records.
+	reconcileReportEvery = 1000
+)
+
+// ReconcileRecords implements media.RecordReconciler: it checks with HeadObject that the object of
+// every completed upload exists and deletes the records of missing objects.
+func (ah *awshandler) ReconcileRecords(ctx context.Context, dryRun bool, rate int) (*media.ReconcileStats, error) {
+	var throttle <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	stats := &media.ReconcileStats{}
+	after := ""
+	for {
+		var fdefs []types.FileDef
+		err := ah.storeBreaker.call(func() error {
+			var err error
+			fdefs, err = store.Files.List(after, reconcileBatchSize)
+			return err
+		})
+		if err != nil {
+			return stats, err
+		}
+		if len(fdefs) == 0 {
+			break
+		}
+
+		for i := range fdefs {
+			if throttle != nil {
+				select {
+				case <-throttle:
+				case <-ctx.Done():
+					return stats, ctx.Err()
+				}
+			} else if err = ctx.Err(); err != nil {
+				return stats, err
+			}
+
+			ah.reconcileRecord(ctx, &fdefs[i], dryRun, stats)
+			if stats.Checked%reconcileReportEvery == 0 {
+				logs.Info.Printf("s3: reconciling file records: %d checked, %d missing, %d deleted, %d failed",
+					stats.Checked, stats.Missing, stats.Deleted, stats.Failed)
+			}
+		}
+		after = fdefs[len(fdefs)-1].Id
+	}
+	return stats, nil
+}
+
+// reconcileRecord checks one file record and updates the stats.
+func (ah *awshandler) reconcileRecord(ctx context.Context, fdef *types.FileDef, dryRun bool, stats *media.ReconcileStats) {
+	stats.Checked++
+	key := ah.objectLocation(fdef)
+	_, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(key),
+	})
+	if err == nil {
+		return
+	}
+	if !isAPIError(err, "NotFound", "NoSuchKey") {
+		logs.Warn.Println("s3: failed to check object of file record", ah.redact.ref(fdef.Id), ah.redact.ref(key), err)
+		stats.Failed++
+		return
+	}
+
+	stats.Missing++
+	if dryRun {
+		logs.Info.Println("s3: object of file record is missing", ah.redact.ref(fdef.Id), ah.redact.ref(key))
+		return
+	}
+	err = ah.storeBreaker.call(func() error {
+		// Failed upload: the record is deleted.
+		_, err := store.Files.FinishUpload(fdef, false, 0)
+		return err
+	})
+	if err != nil {
+		logs.Warn.Println("s3: failed to delete file record of missing object", ah.redact.ref(fdef.Id), err)
+		stats.Failed++
+		return
+	}
+	logs.Info.Println("s3: deleted file record of missing object", ah.redact.ref(fdef.Id), ah.redact.ref(key))
+	stats.Deleted++
+}
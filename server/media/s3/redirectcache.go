@@ -0,0 +1,53 @@
+package s3
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redirects to presigned URLs used to carry the Cache-Control of the content, so browsers could reuse
+// a redirect long after the URL expired. The max-age of such redirects is limited to redirect_cache_ratio of
+// the time the URL remains valid, so clients come back for a fresh URL before the old one expires.
+const defaultRedirectCacheRatio = 0.8
+
+// initRedirectCacheRatio validates the fraction of the lifetime of presigned URLs redirects are cached for.
+func (ah *awshandler) initRedirectCacheRatio() error {
+	if ah.conf.RedirectCacheRatio < 0 || ah.conf.RedirectCacheRatio > 1 {
+		return errors.New("invalid redirect_cache_ratio")
+	}
+	if ah.conf.RedirectCacheRatio == 0 {
+		ah.conf.RedirectCacheRatio = defaultRedirectCacheRatio
+	}
+	return nil
+}
+
+// redirectCacheControl returns the Cache-Control of the redirect to a URL presigned for ttl: the directives
+// of the content with max-age limited by the lifetime of the URL. Directives which let caches keep the
+// redirect longer are dropped.
+func (ah *awshandler) redirectCacheControl(cacheControl string, ttl time.Duration) string {
+	if ah.urlCache != nil && ttl > ah.urlCacheTTL {
+		// The URL may come from the cache, presigned up to the lifetime of cached URLs ago.
+		ttl -= ah.urlCacheTTL
+	}
+	maxAge := int64(ttl.Seconds() * ah.conf.RedirectCacheRatio)
+	var directives []string
+	for _, part := range strings.Split(cacheControl, ",") {
+		directive := strings.TrimSpace(part)
+		name, arg, _ := strings.Cut(directive, "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			// The redirect is not cached at all.
+			return cacheControl
+		case "max-age":
+			if secs, err := strconv.ParseInt(arg, 10, 64); err == nil {
+				maxAge = min(maxAge, secs)
+			}
+		case "", "s-maxage", "immutable", "stale-while-revalidate", "stale-if-error":
+		default:
+			directives = append(directives, directive)
+		}
+	}
+	return strings.Join(append(directives, "max-age="+strconv.FormatInt(maxAge, 10)), ", ")
+}
@@ -0,0 +1,78 @@
+package s3
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Header with the region hint of the request, if not configured.
+const defaultRegionHintHeader = "CloudFront-Viewer-Country"
+
+// readReplica is a replica of the bucket in another region used for serving downloads.
+type readReplica struct {
+	Region string `json:"region"`
+	Bucket string `json:"bucket"`
+	// Optional custom endpoint of the replica.
+	Endpoint string `json:"endpoint"`
+	// Values of the region hint header routed to the replica, like country codes.
+	// The name of the region is always routed to the replica.
+	Hints []string `json:"hints"`
+}
+
+// replicaClient presigns requests to a read replica.
+type replicaClient struct {
+	bucket  string
+	presign *s3.PresignClient
+}
+
+// initReplicas creates clients of the read replicas. The clients share the configuration, including
+// the credentials, with the client which presigns downloads from the primary.
+func (ah *awshandler) initReplicas(cfg aws.Config, clientOpts []func(*s3.Options)) error {
+	if len(ah.conf.ReadReplicas) == 0 {
+		return nil
+	}
+	if ah.conf.RegionHintHeader == "" {
+		ah.conf.RegionHintHeader = defaultRegionHintHeader
+	}
+
+	ah.replicas = make(map[string]*replicaClient)
+	for _, rep := range ah.conf.ReadReplicas {
+		if rep.Region == "" || rep.Bucket == "" {
+			return errors.New("read replica must have region and bucket")
+		}
+		opts := append(clientOpts[:len(clientOpts):len(clientOpts)], func(o *s3.Options) {
+			o.Region = rep.Region
+			if rep.Endpoint != "" {
+				o.BaseEndpoint = aws.String(ah.endpointURL(rep.Endpoint))
+			}
+		})
+		client := &replicaClient{
+			bucket:  rep.Bucket,
+			presign: ah.newPresignClient(s3.NewFromConfig(cfg, opts...)),
+		}
+		for _, hint := range append([]string{rep.Region}, rep.Hints...) {
+			hint = strings.ToLower(hint)
+			if _, ok := ah.replicas[hint]; ok {
+				return errors.New("duplicate read replica hint '" + hint + "'")
+			}
+			ah.replicas[hint] = client
+		}
+	}
+	return nil
+}
+
+// presignClient returns the client for presigning downloads and the bucket to use
+// given the region hint of the request. Falls back to the primary bucket.
+func (ah *awshandler) presignClient(headers http.Header) (*s3.PresignClient, string) {
+	if ah.replicas != nil {
+		hint := strings.ToLower(strings.TrimSpace(headers.Get(ah.conf.RegionHintHeader)))
+		if rep := ah.replicas[hint]; rep != nil {
+			return rep.presign, rep.bucket
+		}
+	}
+	return ah.downloadPresign, ah.conf.BucketName
+}
@@ -0,0 +1,51 @@
+package s3
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+)
+
+// The request IDs of failed S3 requests are what AWS support asks for. They are logged with the failure
+// of uploads, downloads and deletes. With expose_request_id, the errors also carry the IDs as
+// media.RequestError, so the ID is returned to the client in the X-Amz-Request-Id header.
+const requestIDHeader = "X-Amz-Request-Id"
+
+// requestIDs returns the request ID and the extended request ID of the failed S3 request, if any.
+func requestIDs(err error) (string, string) {
+	var throttled *media.ThrottledError
+	if errors.As(err, &throttled) {
+		// ThrottledError unwraps to types.ErrUnavailable rather than the error of the request.
+		err = throttled.Err
+	}
+	var respErr s3.ResponseError
+	if !errors.As(err, &respErr) || respErr.ServiceRequestID() == "" {
+		return "", ""
+	}
+	return respErr.ServiceRequestID(), respErr.ServiceHostID()
+}
+
+// requestFailed logs the IDs of the failed S3 request and attaches them to the error if exposed.
+func (ah *awshandler) requestFailed(op string, err error) error {
+	requestID, hostID := requestIDs(err)
+	if requestID == "" {
+		return err
+	}
+	logs.Warn.Println("s3:", op, "failed, request id", requestID, "host id", hostID, err)
+	if !ah.conf.ExposeRequestID {
+		return err
+	}
+	return &media.RequestError{RequestID: requestID, HostID: hostID, Err: err}
+}
+
+// exposeRequestID adds the request ID of the failed S3 request to the response headers.
+func (ah *awshandler) exposeRequestID(resp http.Header, err error) {
+	var reqErr *media.RequestError
+	if errors.As(err, &reqErr) {
+		resp.Set(requestIDHeader, reqErr.RequestID)
+	}
+}
@@ -2,30 +2,43 @@
 package s3
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"io"
 	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	tmtypes "github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
 
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/media"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
+	"golang.org/x/text/language"
 )
 
 const (
@@ -33,29 +46,407 @@ const (
 	defaultCacheControl = "no-cache, must-revalidate"
 
 	handlerName = "s3"
+	// Product name reported in the User-Agent of S3 requests.
+	userAgentName = "tinode-chat"
 	// Presign GET URLs for this number of seconds.
 	defaultPresignDuration = 120
+	// Region of S3-compatible services which ignore it. The SDK needs one to sign requests.
+	defaultEndpointRegion = "us-east-1"
+
+	// Number of bytes used for detecting the content type, see http.DetectContentType.
+	sniffLen = 512
+
+	// The minimum size of a part of a multipart upload accepted by S3.
+	minPartSize = 5 * 1024 * 1024
+
+	// Maximum length of the file name in Content-Disposition in bytes.
+	maxFilenameLength = 255
+
+	// Maximum number of keys in one DeleteObjects request.
+	maxDeleteBatch = 1000
+
+	// Query parameter of the serve URL with the version of the content.
+	contentVersionParam = "cv"
+
+	// Values of the "mime_detection" config option.
+	mimeClient        = "client"
+	mimeSniff         = "sniff"
+	mimeSniffFallback = "sniff_fallback"
+
+	// Sources of the content type when it's generic.
+	mimeFromExtension = "extension"
+	mimeFromContent   = "sniff"
+
+	// Default delay in milliseconds before retrying creation of the file record.
+	defaultStoreRetryBackoff = 100
+
+	// Default time in seconds to stop calling the store after it failed.
+	defaultBreakerCooldown = 30
+
+	// Longest delay between retries of the initial check of the bucket.
+	maxInitRetryDelay = 10 * time.Second
+
+	// Values of the "proxy" config option.
+	proxyOff     = "off"
+	proxyRequest = "request"
+	proxyAlways  = "always"
+
+	// Values of the "head_metadata" config option.
+	headMetadataDB     = "db"
+	headMetadataVerify = "verify"
+	// Query parameter of the serve URL which requests verification of HEAD metadata.
+	headVerifyParam = "verify"
 )
 
 type awsconfig struct {
-	AccessKeyId     string   `json:"access_key_id"`
-	SecretAccessKey string   `json:"secret_access_key"`
-	Region          string   `json:"region"`
-	DisableSSL      bool     `json:"disable_ssl"`
-	ForcePathStyle  bool     `json:"force_path_style"`
-	Endpoint        string   `json:"endpoint"`
-	BucketName      string   `json:"bucket"`
-	CorsOrigins     []string `json:"cors_origins"`
-	ServeURL        string   `json:"serve_url"`
-	PresignTTL      int      `json:"presign_ttl"`
-	CacheControl    string   `json:"cache_control"`
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Region          string `json:"region"`
+	DisableSSL      bool   `json:"disable_ssl"`
+	// Minimum TLS version of connections to S3: "1.0", "1.1", "1.2", "1.3". The SDK default (1.2) if empty.
+	MinTLSVersion  string   `json:"min_tls_version"`
+	ForcePathStyle bool     `json:"force_path_style"`
+	Endpoint       string   `json:"endpoint"`
+	BucketName     string   `json:"bucket"`
+	CorsOrigins    []string `json:"cors_origins"`
+	ServeURL       string   `json:"serve_url"`
+	PresignTTL     int      `json:"presign_ttl"`
+	CacheControl   string   `json:"cache_control"`
+	// Path the server is mounted under, like "/chat", prepended to relative serve URLs.
+	ServeURLBase string `json:"serve_url_base"`
+	// CORS rules of a newly created bucket. If empty, a single rule allowing GET and HEAD
+	// from CorsOrigins is used.
+	CorsRules []corsRule `json:"cors_rules"`
+	// Set the CORS rules of a newly created bucket, true if missing. False if CORS of the bucket
+	// is managed externally.
+	ManageCors *bool `json:"manage_cors"`
+	// Maximum size of an uploaded object in bytes, 0 means unlimited.
+	MaxFileSize int64 `json:"max_file_size"`
+	// Maximum sizes of uploaded objects by MIME type pattern, like "image/*", override max_file_size.
+	MaxFileSizeByType map[string]int64 `json:"max_file_size_by_type"`
+	// Reject uploads which differ from the size declared by the client by more than declared_size_tolerance bytes.
+	EnforceDeclaredSize   bool  `json:"enforce_declared_size"`
+	DeclaredSizeTolerance int64 `json:"declared_size_tolerance"`
+	// Size of the parts of multipart uploads in bytes.
+	PartSize int64 `json:"part_size"`
+	// Objects of known size smaller than this are uploaded with a single PUT.
+	MultipartThreshold int64 `json:"multipart_threshold"`
+	// Multipart uploads: "auto" (default) to fall back to single PUT uploads if the storage doesn't
+	// support them, "off" to always upload with a single PUT.
+	Multipart string `json:"multipart"`
+	// Uploads larger than this are rejected in single PUT mode, 5GB if 0.
+	SinglePutMaxSize int64 `json:"single_put_max_size"`
+	// Size of the buffers for small uploads shared by all uploads, 0 disables.
+	UploadBufferSize int `json:"upload_buffer_size"`
+	// Optional identifier of the deployment added to the User-Agent of S3 requests.
+	DeploymentId string `json:"deployment_id"`
+	// Stream objects through the server instead of redirecting to S3: "off" (default),
+	// "request" when requested with ?proxy=1, "always".
+	Proxy string `json:"proxy"`
+	// Source of the size and ETag of proxied HEAD responses: "db" (default) trusts the file record,
+	// "verify" checks them against the object and repairs the record if they differ.
+	HeadMetadata string `json:"head_metadata"`
+	// Fraction of proxied HEAD requests, 0 to 1, verified with "head_metadata": "verify", 1 if 0.
+	// Requests with ?verify=1 are always verified.
+	HeadVerifyRate float64 `json:"head_verify_rate"`
+	// Verify the MD5 of proxied downloads of whole objects against their ETag while streaming them.
+	VerifyProxiedDownloads bool `json:"verify_proxied_downloads"`
+	// Number of consecutive failures of the file records store which makes the handler
+	// reject requests without calling the store; 0 disables the circuit breaker.
+	StoreBreakerThreshold int `json:"store_breaker_threshold"`
+	// Time in seconds to reject requests after the breaker opens.
+	StoreBreakerCooldown int `json:"store_breaker_cooldown"`
+	// Number of retries of a failed creation of the file record, 0 disables.
+	StoreRetries int `json:"store_retries"`
+	// Delay before the first retry in milliseconds, doubled with every retry.
+	StoreRetryBackoff int `json:"store_retry_backoff"`
+	// Encoding of file IDs into object keys: "base32" (default), "hex" or "hmac".
+	KeyEncoding string `json:"key_encoding"`
+	// Secret salt of keys in "hmac" encoding. Must not change for the lifetime of the deployment.
+	KeySalt string `json:"key_salt"`
+	// Layout of keys of new objects: "flat" (default) or "by_topic". Existing objects are accessed
+	// by their stored location, so the layouts coexist.
+	KeyLayout string `json:"key_layout"`
+	// URL to POST notifications of completed uploads to.
+	UploadWebhookURL string `json:"upload_webhook_url"`
+	// Key for signing webhook request bodies with HMAC-SHA256.
+	UploadWebhookSecret string `json:"upload_webhook_secret"`
+
+	// Paths to files with the values of the options above. The contents of a file take
+	// precedence over the inline value.
+	AccessKeyIdFile         string `json:"access_key_id_file"`
+	SecretAccessKeyFile     string `json:"secret_access_key_file"`
+	BucketNameFile          string `json:"bucket_file"`
+	UploadWebhookSecretFile string `json:"upload_webhook_secret_file"`
+	KeySaltFile             string `json:"key_salt_file"`
+
+	// Optional credentials for presigning downloads, like a restricted key allowed to GetObject only.
+	// Uploads, deletes and everything else use the main credentials. The main credentials presign
+	// downloads too if not set.
+	PresignAccessKeyId         string `json:"presign_access_key_id"`
+	PresignSecretAccessKey     string `json:"presign_secret_access_key"`
+	PresignAccessKeyIdFile     string `json:"presign_access_key_id_file"`
+	PresignSecretAccessKeyFile string `json:"presign_secret_access_key_file"`
+	// Interval in seconds between re-reading credentials from the files.
+	CredentialsRefresh int `json:"credentials_refresh"`
+	// Store compressed variants of compressible objects with these encodings,
+	// "br" and/or "gzip". Off if empty.
+	Compress []string `json:"compress"`
+	// Objects larger than this are not compressed.
+	CompressMaxSize int64 `json:"compress_max_size"`
+	// Compute BlurHash placeholders of uploaded images.
+	Placeholders bool `json:"placeholders"`
+	// Placeholders are not computed for images larger than this.
+	PlaceholderMaxSize int64 `json:"placeholder_max_size"`
+	// Thumbnails of uploaded images. Off if not configured.
+	Thumbnails *thumbnailConfig `json:"thumbnails"`
+	// Generate variants in background after the upload returns. Off if not configured.
+	AsyncVariants *asyncVariantsConfig `json:"async_variants"`
+	// Rotate uploaded JPEG images to the orientation of their EXIF tag.
+	NormalizeOrientation bool `json:"normalize_orientation"`
+	// Orientation of images larger than this is not normalized.
+	OrientationMaxSize int64 `json:"orientation_max_size"`
+	// Limits of dimensions of uploaded JPEG, PNG and GIF images. Not checked if not configured.
+	ImageLimits *imageLimitsConfig `json:"image_limits"`
+	// How to determine the content type of uploads: "client" (default), "sniff", "sniff_fallback".
+	MimeDetection string `json:"mime_detection"`
+	// Prefix of keys of objects derived from uploads, like compressed variants.
+	VariantPrefix string `json:"variant_prefix"`
+	// Kinds of variants which may be created: "br", "gz", "blurhash". All enabled kinds if not set.
+	VariantKinds []string `json:"variant_kinds"`
+	// Interval in seconds between scans of the bucket for reporting its size, 0 disables.
+	BucketStatsPeriod int `json:"bucket_stats_period"`
+	// Replicas of the bucket in other regions to serve downloads from.
+	ReadReplicas []readReplica `json:"read_replicas"`
+	// Header of the request with the hint which replica to use.
+	RegionHintHeader string `json:"region_hint_header"`
+	// Extensions of serve URLs by MIME type, override the defaults.
+	Extensions map[string]string `json:"extensions"`
+	// Patterns of serve URLs of older versions, see media.ParseLegacyUrls.
+	LegacyServeURLs []string `json:"legacy_serve_urls"`
+	// Cache-Control of video files, e.g. long-lived and public so CDNs cache the ranges requested
+	// while scrubbing. The cache_control if empty.
+	VideoCacheControl string `json:"video_cache_control"`
+	// Accept Cache-Control directives for individual files from clients.
+	FileCacheControl bool `json:"file_cache_control"`
+	// Serve presigned downloads with the Cache-Control stored with the object instead of overriding it
+	// with the configured one, for objects which carry their own cache policy.
+	RespectObjectCacheControl bool `json:"respect_object_cache_control"`
+	// Accept lifetimes of individual files from clients. Expired files are not served.
+	FileExpiry bool `json:"file_expiry"`
+	// Accept limits of the number of downloads of individual files from clients, like for "view once" media.
+	// Files downloaded as many times as allowed are not served.
+	FileDownloadLimit bool `json:"file_download_limit"`
+	// Delete objects of files downloaded as many times as allowed.
+	DeleteExhausted bool `json:"delete_exhausted"`
+	// Fraction of served requests, 0 to 1, which compare the ETag of the object with the file record.
+	ETagCheckRate float64 `json:"etag_check_rate"`
+	// Source of ETags of file records: "s3" (default) for the ETag returned by S3 or "content_hash"
+	// for the SHA-256 of the uploaded content.
+	ETagSource string `json:"etag_source"`
+	// Signature version of presigned download URLs: "v4" (default) or "v2" for old S3-compatible
+	// servers. "v2" requires a custom endpoint.
+	SignatureVersion string `json:"signature_version"`
+	// Source of last modification times of files: "record" (default) for the time the upload completed
+	// or "object" for LastModified of the object, checked with a HEAD request.
+	LastModifiedSource string `json:"last_modified_source"`
+	// Check that the object exists before serving and respond with this status, 404 or 410, if it's missing.
+	// 0 disables the check.
+	MissingObjectStatus int `json:"missing_object_status"`
+	// The bucket is a Requester Pays bucket: requests, including presigned ones, are billed to the requester.
+	RequesterPays bool `json:"requester_pays"`
+	// Never create the bucket or set its CORS rules, fail if the bucket does not exist.
+	NeverCreateBucket bool `json:"never_create_bucket"`
+	// Write-once storage of uploads requested as immutable. Off if not configured.
+	Immutable *immutableConfig `json:"immutable"`
+	// Audit log of downloads: path of a file to append JSON lines to, or an http(s) URL to POST records to.
+	// Off if empty.
+	AuditLog string `json:"audit_log"`
+	// Maximum number of audit records waiting to be written.
+	AuditQueueSize int `json:"audit_queue_size"`
+	// File IDs and object keys in logs: "full" (default) or "hash", so logs can't be used to access files.
+	LogFileIds string `json:"log_file_ids"`
+	// Secret of the logged hashes, so they match across nodes and restarts. Random if empty.
+	LogIdSecret string `json:"log_id_secret"`
+	// Remember results of completed uploads with idempotency keys for this many seconds, 0 disables.
+	IdempotencyTTL int `json:"idempotency_ttl"`
+	// Treatment of uploads of files with existing records, like client retries with the same file ID:
+	// "overwrite" (default) uploads the object again, "existing" returns the stored object if there is one.
+	DuplicateUpload string `json:"duplicate_upload"`
+	// Require single-use download tokens valid for this many seconds to serve files, 0 disables.
+	DownloadTokenTTL int `json:"download_token_ttl"`
+	// Presigning download URLs of several files at once. Off if not configured.
+	BatchPresign *batchPresignConfig `json:"batch_presign"`
+	// Keys of user-defined object metadata which may be returned to clients with the file description.
+	MetaKeys []string `json:"meta_keys"`
+	// Retry the initial check of the bucket for this many seconds if S3 is not reachable, e.g. on cold
+	// start before the network is ready. 0 disables retries.
+	InitRetrySeconds int `json:"init_retry_seconds"`
+	// Maximum number of objects deleted per second, 0 means no limit.
+	DeleteRate int `json:"delete_rate"`
+	// Maximum number of concurrent requests deleting batches of objects, 1 if 0.
+	DeleteConcurrency int `json:"delete_concurrency"`
+	// Cache of presigned URLs, possibly shared by the nodes of the cluster. Off if not configured.
+	URLCache *urlCacheConfig `json:"url_cache"`
+	// Base URL of direct access to objects tagged visibility=public, e.g. of the bucket or a CDN.
+	// Objects are not checked for the tag if empty.
+	PublicURL string `json:"public_url"`
+	// Time in seconds to remember the visibility of an object.
+	VisibilityCacheTTL int `json:"visibility_cache_ttl"`
+	// Base URL of a CDN which authorizes requests with signed cookies. Downloads are redirected to
+	// the object at the CDN without presigning. Off if empty.
+	CDNCookieURL string `json:"cdn_cookie_url"`
+	// Extensions of names of files which are always downloaded as attachments of type application/octet-stream.
+	// The default list is used if missing, none if empty.
+	DangerousExtensions []string `json:"dangerous_extensions"`
+	// MIME type patterns, like "image/*", of files which may render inline. Files of other types are
+	// downloaded as attachments. All types may render inline if missing.
+	InlineTypes []string `json:"inline_types"`
+	// MIME type patterns of files which are always downloaded as attachments. Can't be used with inline_types.
+	ForceDownloadTypes []string `json:"force_download_types"`
+	// Sources of the content type, in order, when it's generic after mime_detection: "extension" of
+	// the file name and "sniff" of the content. Generic types are kept if empty.
+	MimeCorrection []string `json:"mime_correction"`
+	// Add the version of the content to serve URLs of uploads, so clients don't show cached old versions.
+	VersionedURLs bool `json:"versioned_urls"`
+	// Presign download URLs which work only from the network of the client.
+	PinPresignToIP bool `json:"pin_presign_to_ip"`
+	// Role assumed to get the credentials for pinned URLs.
+	PinPresignRoleARN string `json:"pin_presign_role_arn"`
+	// Lengths of the network prefixes URLs are pinned to, 32 and 64 if 0.
+	PinPresignIPv4Prefix int `json:"pin_presign_ipv4_prefix"`
+	PinPresignIPv6Prefix int `json:"pin_presign_ipv6_prefix"`
+	// Lifetime in seconds of the credentials for pinned URLs, presign_ttl plus 900 if 0.
+	PinPresignSessionTTL int `json:"pin_presign_session_ttl"`
+	// STS endpoint, the default for the region if empty.
+	STSEndpoint string `json:"sts_endpoint"`
+	// Retry-After in seconds of requests throttled by S3, 1 if 0. Doubled while throttling continues
+	// up to ThrottleMaxRetryAfter, 60 if 0.
+	ThrottleRetryAfter    int `json:"throttle_retry_after"`
+	ThrottleMaxRetryAfter int `json:"throttle_max_retry_after"`
+	// Tenants sharing the bucket with their own key prefixes and quotas. Off if empty.
+	Tenants []tenantConfig `json:"tenants"`
+	// In-memory cache of small objects served without redirect. Off if not configured.
+	HotCache *hotCacheConfig `json:"hot_cache"`
+	// Presign with the time of S3 if the local clock is skewed.
+	CorrectClockSkew bool `json:"correct_clock_skew"`
+	// Maximum number of URLs presigned concurrently, 0 if unlimited.
+	PresignConcurrency int `json:"presign_concurrency"`
+	// Time in milliseconds to wait for presigning over the limit before failing with 503, 100 if 0.
+	PresignWait int `json:"presign_wait"`
+	// Return request IDs of failed S3 requests to clients in the X-Amz-Request-Id header.
+	ExposeRequestID bool `json:"expose_request_id"`
+	// Maximum length of object keys in bytes including keys of variants, 1024 if 0.
+	MaxKeyLength int `json:"max_key_length"`
+	// Redirects to presigned URLs are cached for this fraction of the lifetime of the URL, 0.8 if 0.
+	RedirectCacheRatio float64 `json:"redirect_cache_ratio"`
+	// Keep unprocessed originals of files altered at upload. Off if not configured.
+	Originals *originalsConfig `json:"originals"`
+}
+
+// Delay before the first retry of the initial check of the bucket, doubled on each retry.
+var initRetryDelay = 500 * time.Millisecond
+
+// TLS versions accepted in min_tls_version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// corsRule is a CORS rule of the bucket, see s3types.CORSRule.
+type corsRule struct {
+	Methods       []string `json:"methods"`
+	Origins       []string `json:"origins"`
+	Headers       []string `json:"headers"`
+	ExposeHeaders []string `json:"expose_headers"`
+	// Time in seconds the browser may cache the preflight response.
+	MaxAge int32 `json:"max_age"`
 }
 
 type awshandler struct {
-	svc         *s3.Client
-	presign     *s3.PresignClient
-	conf        awsconfig
-	corsOrigins []media.AllowedOrigin
+	svc     *s3.Client
+	presign *s3.PresignClient
+	// Presigns downloads, with the presign credentials if configured.
+	downloadPresign *s3.PresignClient
+	uploader        *transfermanager.Client
+	conf            awsconfig
+	corsOrigins     []media.AllowedOrigin
+	// Serve URL with the base path, returned to clients.
+	serveURL string
+	// Circuit breaker for calls to store.Files.
+	storeBreaker *circuitBreaker
+	// Encoder of file IDs into object keys.
+	keyCodec keyCodec
+	// Notifier of completed uploads, nil if not configured.
+	webhook *webhookNotifier
+	// Audit log of downloads, nil if not configured.
+	audit *auditLogger
+	// Single-use download tokens, nil if not required.
+	downloadTokens *downloadTokens
+	// Rate limit of batch presigning, nil if disabled.
+	batchLimiter *batchLimiter
+	// Known compressed variants of objects.
+	variants *objectCache[bool]
+	// Generates variants after uploads return, nil if variants are generated while uploading.
+	variantWorkers *variantWorkers
+	// Retry-After of requests throttled by S3.
+	throttle throttleBackoff
+	// Lowercase extensions of dangerous_extensions with the leading dot.
+	dangerousExts map[string]bool
+	// Kinds of variants allowed by variant_kinds, nil if all are allowed.
+	variantKinds map[string]bool
+	// Size limits by MIME type pattern, most specific first.
+	typeSizeLimits []typeSizeLimit
+	// Placeholders of images, empty if none.
+	placeholders *objectCache[string]
+	// Creates thumbnails of images, nil if disabled.
+	thumbnailer media.Thumbnailer
+	// Content types of thumbnails of images, empty if none.
+	thumbnails *objectCache[string]
+	// Cache-Control of individual objects, empty for the default.
+	cacheControls *objectCache[string]
+	// Expiration time of individual objects, zero if the object does not expire.
+	expiries *objectCache[time.Time]
+	// Uploads in progress on this node.
+	inflight inflightUploads
+	// Redactor of file IDs and object keys in logs, nil if logged as is.
+	redact *logRedactor
+	// Results of completed uploads with idempotency keys, nil if not remembered.
+	completed *objectCache[completedUpload]
+	// Size of the bucket, nil if not collected.
+	bucketStats *bucketStats
+	// Buffers for small uploads, nil if disabled.
+	buffers *bufferPool
+	// Read replicas by region hint, nil if not configured.
+	replicas map[string]*replicaClient
+	// Overrides of extensions of serve URLs by MIME type.
+	extensions map[string]string
+	// Patterns of serve URLs of older versions.
+	legacyURLs []*regexp.Regexp
+	// Keys of object metadata exposed to clients.
+	metaKeys map[string]bool
+	// Pacing of deletions.
+	deletes *deletePacer
+	// Visibility of objects by key, nil if public_url is not configured.
+	visibilities *objectCache[visibility]
+	// Cache of presigned URLs, nil if not configured.
+	urlCache    media.URLCache
+	urlCacheTTL time.Duration
+	// Credentials which sign download URLs.
+	downloadCredentials *rotatingCredentials
+	// Issuer of credentials for presigned URLs pinned to the client network, nil if not configured.
+	pinner *ipPinner
+	// Contents of small hot objects, nil if not configured.
+	hotCache *hotCache
+	// Skew of the local clock from the clock of S3 in nanoseconds.
+	clockSkew atomic.Int64
+	// Limit of concurrent presigning, nil if unlimited.
+	presignLimit *presignLimiter
+	// The storage is known to support or not to support multipart uploads.
+	multipartSupported   atomic.Bool
+	multipartUnsupported atomic.Bool
 }
 
 // readerCounter is a byte counter for bytes read through the io.Reader
@@ -63,30 +454,180 @@ type readerCounter struct {
 	io.Reader
 	count  int64
 	reader io.Reader
+	// Maximum number of bytes which can be read, 0 means no limit.
+	limit int64
+	// Size declared by the client and the allowed difference, 0 means the size is not checked.
+	declared  int64
+	tolerance int64
+	// Error of the reader, as opposed to the errors of the storage.
+	readErr error
 }
 
 // Read reads the bytes and records the number of read bytes.
 func (rc *readerCounter) Read(buf []byte) (int, error) {
 	n, err := rc.reader.Read(buf)
-	atomic.AddInt64(&rc.count, int64(n))
+	if err != nil && err != io.EOF {
+		rc.readErr = err
+	}
+	count := atomic.AddInt64(&rc.count, int64(n))
+	if rc.limit > 0 && count > rc.limit {
+		return n, &media.SizeLimitError{Limit: rc.limit}
+	}
+	// Longer streams fail as soon as they exceed the tolerance, shorter ones at the end.
+	if rc.declared > 0 && (count > rc.declared+rc.tolerance || (err == io.EOF && count < rc.declared-rc.tolerance)) {
+		return n, errSizeMismatch
+	}
 	return n, err
 }
 
+// typeSizeLimit is the maximum size of objects of the MIME types matching the pattern.
+type typeSizeLimit struct {
+	pattern string
+	limit   int64
+}
+
+// parseTypeSizeLimits validates max_file_size_by_type and orders the limits by specificity: longer
+// patterns first, so "image/svg+xml" takes precedence over "image/*".
+func parseTypeSizeLimits(conf map[string]int64) ([]typeSizeLimit, error) {
+	var limits []typeSizeLimit
+	for pattern, limit := range conf {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+			return nil, errors.New("invalid max_file_size_by_type pattern '" + pattern + "'")
+		}
+		if limit < 0 {
+			return nil, errors.New("invalid max_file_size_by_type limit for '" + pattern + "'")
+		}
+		limits = append(limits, typeSizeLimit{pattern: pattern, limit: limit})
+	}
+	slices.SortFunc(limits, func(a, b typeSizeLimit) int {
+		if len(a.pattern) != len(b.pattern) {
+			return len(b.pattern) - len(a.pattern)
+		}
+		return strings.Compare(a.pattern, b.pattern)
+	})
+	return limits, nil
+}
+
+// sizeLimit returns the maximum size of objects of the MIME type, 0 means unlimited.
+func (ah *awshandler) sizeLimit(mimeType string) int64 {
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		for _, tl := range ah.typeSizeLimits {
+			if ok, _ := path.Match(tl.pattern, mediaType); ok {
+				return tl.limit
+			}
+		}
+	}
+	return ah.conf.MaxFileSize
+}
+
+// uploadSizeLimit returns the maximum size of the upload and the reader to use instead of file.
+// The limit is looked up by the type detected from the content, so it doesn't depend on the type
+// claimed by the client, or by the claimed type if the content is not recognized.
+func (ah *awshandler) uploadSizeLimit(mimeType string, file io.Reader) (int64, io.Reader) {
+	if len(ah.typeSizeLimits) == 0 {
+		return ah.conf.MaxFileSize, file
+	}
+	sniffed, file := sniffContentType(file)
+	if !isGenericMimeType(sniffed) {
+		mimeType = sniffed
+	}
+	return ah.sizeLimit(mimeType), file
+}
+
+// errSizeMismatch is returned when the size of the upload differs from the declared one.
+var errSizeMismatch = errors.New("upload size differs from declared size")
+
+// declaredSize returns the size declared by the client if it must be enforced, 0 otherwise.
+func (ah *awshandler) declaredSize(fdef *types.FileDef) int64 {
+	if !ah.conf.EnforceDeclaredSize || fdef.Size <= 0 {
+		return 0
+	}
+	return fdef.Size
+}
+
+// sizeMatches checks if the size of the stream, if known, is within the tolerance of the declared size.
+func (ah *awshandler) sizeMatches(declared, size int64) bool {
+	if declared == 0 || size < 0 {
+		return true
+	}
+	diff := size - declared
+	return diff <= ah.conf.DeclaredSizeTolerance && -diff <= ah.conf.DeclaredSizeTolerance
+}
+
+// streamSize returns the number of bytes remaining in the stream or -1 if the size is
+// unknown, e.g. the body is sent with chunked transfer encoding.
+func streamSize(r io.Reader) int64 {
+	switch s := r.(type) {
+	case interface{ Len() int }:
+		return int64(s.Len())
+	case io.Seeker:
+		cur, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := s.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		if _, err = s.Seek(cur, io.SeekStart); err != nil {
+			return -1
+		}
+		return end - cur
+	}
+	return -1
+}
+
 // Init initializes the media handler.
 func (ah *awshandler) Init(jsconf string) error {
 	var err error
-	if err = json.Unmarshal([]byte(jsconf), &ah.conf); err != nil {
+	// Unknown options are most likely typos, which must not be silently ignored.
+	dec := json.NewDecoder(strings.NewReader(jsconf))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&ah.conf); err != nil {
 		return errors.New("failed to parse config: " + err.Error())
 	}
 
+	for _, secret := range []struct {
+		path  string
+		value *string
+	}{
+		{ah.conf.AccessKeyIdFile, &ah.conf.AccessKeyId},
+		{ah.conf.SecretAccessKeyFile, &ah.conf.SecretAccessKey},
+		{ah.conf.BucketNameFile, &ah.conf.BucketName},
+		{ah.conf.UploadWebhookSecretFile, &ah.conf.UploadWebhookSecret},
+		{ah.conf.KeySaltFile, &ah.conf.KeySalt},
+		{ah.conf.PresignAccessKeyIdFile, &ah.conf.PresignAccessKeyId},
+		{ah.conf.PresignSecretAccessKeyFile, &ah.conf.PresignSecretAccessKey},
+	} {
+		if secret.path == "" {
+			continue
+		}
+		if *secret.value, err = readSecretFile(secret.path); err != nil {
+			return err
+		}
+	}
+
+	// Init logs file IDs too.
+	if err = ah.initLogRedactor(); err != nil {
+		return err
+	}
+
 	if ah.conf.AccessKeyId == "" {
 		return errors.New("missing Access Key ID")
 	}
 	if ah.conf.SecretAccessKey == "" {
 		return errors.New("missing Secret Access Key")
 	}
+	if ah.hasPresignCredentials() && (ah.conf.PresignAccessKeyId == "" || ah.conf.PresignSecretAccessKey == "") {
+		return errors.New("presign credentials must have both access key ID and secret access key")
+	}
 	if ah.conf.Region == "" {
-		return errors.New("missing Region")
+		if ah.conf.Endpoint == "" {
+			// Required by AWS.
+			return errors.New("missing Region")
+		}
+		ah.conf.Region = defaultEndpointRegion
 	}
 	if ah.conf.BucketName == "" {
 		return errors.New("missing Bucket")
@@ -100,18 +641,258 @@ func (ah *awshandler) Init(jsconf string) error {
 	if ah.conf.ServeURL == "" {
 		ah.conf.ServeURL = defaultServeURL
 	}
+	if ah.conf.ServeURLBase, err = media.ParseServeURLBase(ah.conf.ServeURLBase); err != nil {
+		return err
+	}
+	ah.serveURL = media.WithServeURLBase(ah.conf.ServeURLBase, ah.conf.ServeURL)
+	if err = ah.initVisibility(); err != nil {
+		return err
+	}
+	if err = ah.initCDNCookies(); err != nil {
+		return err
+	}
+	if err = ah.initURLCache(); err != nil {
+		return err
+	}
+	if err = ah.initRedirectCacheRatio(); err != nil {
+		return err
+	}
+	if ah.conf.VideoCacheControl != "" {
+		if ah.conf.VideoCacheControl, err = parseCacheControl(ah.conf.VideoCacheControl); err != nil {
+			return errors.New("invalid video_cache_control")
+		}
+	}
+	if ah.metaKeys, err = parseMetaKeys(ah.conf.MetaKeys); err != nil {
+		return err
+	}
+	if ah.deletes, err = newDeletePacer(ah.conf.DeleteRate, ah.conf.DeleteConcurrency); err != nil {
+		return err
+	}
+	if ah.conf.InitRetrySeconds < 0 {
+		return errors.New("invalid init_retry_seconds")
+	}
+	if ah.conf.MaxFileSize < 0 {
+		return errors.New("invalid max_file_size")
+	}
+	if ah.typeSizeLimits, err = parseTypeSizeLimits(ah.conf.MaxFileSizeByType); err != nil {
+		return err
+	}
+	if ah.conf.DeclaredSizeTolerance < 0 {
+		return errors.New("invalid declared_size_tolerance")
+	}
+	if ah.conf.PartSize != 0 && ah.conf.PartSize < minPartSize {
+		return errors.New("part_size must be at least 5MB")
+	}
+	if ah.conf.MultipartThreshold < 0 {
+		return errors.New("invalid multipart_threshold")
+	}
+	if ah.conf.UploadBufferSize < 0 {
+		return errors.New("invalid upload_buffer_size")
+	}
+	if ah.conf.UploadBufferSize > 0 {
+		ah.buffers = newBufferPool(ah.conf.UploadBufferSize)
+	}
+	if ah.conf.BucketStatsPeriod < 0 {
+		return errors.New("invalid bucket_stats_period")
+	}
+	if ah.conf.ETagCheckRate < 0 || ah.conf.ETagCheckRate > 1 {
+		return errors.New("etag_check_rate must be between 0 and 1")
+	}
+	if err = ah.initETagSource(); err != nil {
+		return err
+	}
+	if err = ah.initLastModifiedSource(); err != nil {
+		return err
+	}
+	if err = ah.initMultipart(); err != nil {
+		return err
+	}
+	if err = ah.initSignatureVersion(); err != nil {
+		return err
+	}
+	switch ah.conf.MissingObjectStatus {
+	case 0, http.StatusNotFound, http.StatusGone:
+	default:
+		return errors.New("missing_object_status must be 404 or 410")
+	}
+	if ah.conf.BucketStatsPeriod > 0 && ah.conf.BucketStatsPeriod < minBucketStatsPeriod {
+		ah.conf.BucketStatsPeriod = minBucketStatsPeriod
+	}
+	if ah.conf.CredentialsRefresh < 0 {
+		return errors.New("invalid credentials_refresh")
+	}
+	if ah.conf.StoreBreakerThreshold < 0 {
+		return errors.New("invalid store_breaker_threshold")
+	}
+	if ah.conf.StoreRetries < 0 {
+		return errors.New("invalid store_retries")
+	}
+	if ah.conf.StoreRetryBackoff <= 0 {
+		ah.conf.StoreRetryBackoff = defaultStoreRetryBackoff
+	}
+	if ah.conf.StoreBreakerCooldown <= 0 {
+		ah.conf.StoreBreakerCooldown = defaultBreakerCooldown
+	}
+	ah.storeBreaker = &circuitBreaker{
+		name:      "store.Files",
+		threshold: ah.conf.StoreBreakerThreshold,
+		cooldown:  time.Second * time.Duration(ah.conf.StoreBreakerCooldown),
+	}
+	if err = ah.initKeyEncoding(); err != nil {
+		return err
+	}
+	if err = ah.initKeyLayout(); err != nil {
+		return err
+	}
+	if err = ah.initVariants(); err != nil {
+		return err
+	}
+	if err = ah.initPlaceholders(); err != nil {
+		return err
+	}
+	if err = ah.initOrientation(); err != nil {
+		return err
+	}
+	if err = ah.initImageLimits(); err != nil {
+		return err
+	}
+	if err = ah.initCompression(); err != nil {
+		return err
+	}
+	if err = ah.initImmutable(); err != nil {
+		return err
+	}
+	if err = ah.initTenants(); err != nil {
+		return err
+	}
+	if err = ah.initOriginals(); err != nil {
+		return err
+	}
+	if ah.webhook, err = newWebhookNotifier(ah.conf.UploadWebhookURL, ah.conf.UploadWebhookSecret, ah.redact); err != nil {
+		return err
+	}
+	if ah.audit, err = newAuditLogger(ah.conf.AuditLog, ah.conf.AuditQueueSize, ah.redact); err != nil {
+		return err
+	}
+	if ah.conf.IdempotencyTTL < 0 {
+		return errors.New("invalid idempotency_ttl")
+	}
+	if ah.conf.IdempotencyTTL > 0 {
+		ah.completed = newObjectCache[completedUpload]()
+	}
+	switch ah.conf.DuplicateUpload {
+	case "":
+		ah.conf.DuplicateUpload = duplicateUploadOverwrite
+	case duplicateUploadOverwrite, duplicateUploadExisting:
+	default:
+		return errors.New("invalid duplicate_upload '" + ah.conf.DuplicateUpload + "'")
+	}
+	if ah.conf.DownloadTokenTTL < 0 {
+		return errors.New("invalid download_token_ttl")
+	}
+	if ah.conf.DownloadTokenTTL > 0 {
+		ah.downloadTokens = newDownloadTokens(time.Second * time.Duration(ah.conf.DownloadTokenTTL))
+	}
+	if err = ah.initThumbnails(); err != nil {
+		return err
+	}
+	if err = ah.initAsyncVariants(); err != nil {
+		return err
+	}
+	if err = ah.initMaxKeyLength(); err != nil {
+		return err
+	}
+	if err = ah.initHotCache(); err != nil {
+		return err
+	}
+	if ah.presignLimit, err = newPresignLimiter(ah.conf.PresignConcurrency, ah.conf.PresignWait); err != nil {
+		return err
+	}
+	if err = ah.initThrottling(); err != nil {
+		return err
+	}
+	if err = ah.initBatchPresign(); err != nil {
+		return err
+	}
+	if err = ah.initDangerousExtensions(); err != nil {
+		return err
+	}
+	if err = ah.initInlineTypes(); err != nil {
+		return err
+	}
+	switch ah.conf.MimeDetection {
+	case "":
+		ah.conf.MimeDetection = mimeClient
+	case mimeClient, mimeSniff, mimeSniffFallback:
+	default:
+		return errors.New("invalid mime_detection '" + ah.conf.MimeDetection + "'")
+	}
+	for _, source := range ah.conf.MimeCorrection {
+		if source != mimeFromExtension && source != mimeFromContent {
+			return errors.New("invalid mime_correction source '" + source + "'")
+		}
+	}
+	switch ah.conf.Proxy {
+	case "":
+		ah.conf.Proxy = proxyOff
+	case proxyOff, proxyRequest, proxyAlways:
+	default:
+		return errors.New("invalid proxy mode '" + ah.conf.Proxy + "'")
+	}
+	switch ah.conf.HeadMetadata {
+	case "":
+		ah.conf.HeadMetadata = headMetadataDB
+	case headMetadataDB, headMetadataVerify:
+	default:
+		return errors.New("invalid head_metadata '" + ah.conf.HeadMetadata + "'")
+	}
+	if ah.conf.HeadVerifyRate < 0 || ah.conf.HeadVerifyRate > 1 {
+		return errors.New("head_verify_rate must be between 0 and 1")
+	}
+	if ah.conf.HeadVerifyRate == 0 {
+		ah.conf.HeadVerifyRate = 1
+	}
+	ah.initIntegrity()
 	ah.corsOrigins, err = media.ParseCORSAllow(ah.conf.CorsOrigins)
 	if err != nil {
 		return errors.New("failed to parse CORS allowed origins: " + err.Error())
 	}
+	ah.extensions, err = media.ParseExtensions(ah.conf.Extensions)
+	if err != nil {
+		return errors.New("failed to parse extensions: " + err.Error())
+	}
+	if ah.legacyURLs, err = media.ParseLegacyUrls(ah.conf.LegacyServeURLs); err != nil {
+		return err
+	}
+	ah.cacheControls = newObjectCache[string]()
+	ah.expiries = newObjectCache[time.Time]()
+	rules, err := ah.bucketCORSRules()
+	if err != nil {
+		return err
+	}
+	manageCors := ah.conf.ManageCors == nil || *ah.conf.ManageCors
+	if !manageCors && len(ah.conf.CorsRules) > 0 {
+		return errors.New("cors_rules can't be used when manage_cors is false")
+	}
 
+	ah.downloadCredentials = ah.newCredentialsProvider(ah.conf.AccessKeyIdFile, ah.conf.SecretAccessKeyFile,
+		ah.conf.AccessKeyId, ah.conf.SecretAccessKey)
 	cfgOpts := []func(*config.LoadOptions) error{
 		config.WithRegion(ah.conf.Region),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			ah.conf.AccessKeyId,
-			ah.conf.SecretAccessKey,
-			"",
-		)),
+		config.WithCredentialsProvider(ah.downloadCredentials.CredentialsCache),
+	}
+	if ah.conf.MinTLSVersion != "" {
+		minVersion, ok := tlsVersions[ah.conf.MinTLSVersion]
+		if !ok {
+			return errors.New("invalid min_tls_version '" + ah.conf.MinTLSVersion + "'")
+		}
+		cfgOpts = append(cfgOpts, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(
+			func(tr *http.Transport) {
+				if tr.TLSClientConfig == nil {
+					tr.TLSClientConfig = &tls.Config{}
+				}
+				tr.TLSClientConfig.MinVersion = minVersion
+			})))
 	}
 
 	var cfg aws.Config
@@ -123,28 +904,58 @@ func (ah *awshandler) Init(jsconf string) error {
 	clientOpts := []func(*s3.Options){
 		func(o *s3.Options) {
 			o.UsePathStyle = ah.conf.ForcePathStyle
+			// Tag requests for correlation in CloudTrail and S3 access logs. User-Agent is not
+			// signed, so it does not affect presigned URLs.
+			o.APIOptions = append(o.APIOptions, awsmiddleware.AddUserAgentKeyValue(userAgentName, serverVersion()))
+			if ah.conf.DeploymentId != "" {
+				o.APIOptions = append(o.APIOptions, awsmiddleware.AddUserAgentKeyValue("deployment", ah.conf.DeploymentId))
+			}
 		},
 	}
 	if ah.conf.Endpoint != "" {
-		endpoint := ah.conf.Endpoint
-		if !strings.Contains(endpoint, "://") {
-			if ah.conf.DisableSSL {
-				endpoint = "http://" + endpoint
-			} else {
-				endpoint = "https://" + endpoint
-			}
-		}
+		endpoint := ah.endpointURL(ah.conf.Endpoint)
 		clientOpts = append(clientOpts, func(o *s3.Options) {
 			o.BaseEndpoint = aws.String(endpoint)
 		})
 	}
 	ah.svc = s3.NewFromConfig(cfg, clientOpts...)
-	ah.presign = s3.NewPresignClient(ah.svc)
+	ah.presign = ah.newPresignClient(ah.svc)
+	ah.downloadPresign = ah.presign
+	downloadOpts := clientOpts
+	if ah.hasPresignCredentials() {
+		provider := ah.newCredentialsProvider(ah.conf.PresignAccessKeyIdFile, ah.conf.PresignSecretAccessKeyFile,
+			ah.conf.PresignAccessKeyId, ah.conf.PresignSecretAccessKey)
+		downloadOpts = append(clientOpts[:len(clientOpts):len(clientOpts)], func(o *s3.Options) {
+			o.Credentials = provider.CredentialsCache
+		})
+		ah.downloadCredentials = provider
+		downloadSvc := s3.NewFromConfig(cfg, downloadOpts...)
+		if err = checkPresignCredentials(context.Background(), downloadSvc, ah.conf.BucketName, ah.requestPayer()); err != nil {
+			return err
+		}
+		ah.downloadPresign = ah.newPresignClient(downloadSvc)
+	}
+	if err = ah.initReplicas(cfg, downloadOpts); err != nil {
+		return err
+	}
+	if err = ah.initIPPinning(cfg); err != nil {
+		return err
+	}
+	ah.uploader = transfermanager.New(ah.svc, func(o *transfermanager.Options) {
+		// Zero values are replaced with the defaults.
+		o.PartSizeBytes = ah.conf.PartSize
+		o.MultipartUploadThreshold = ah.conf.MultipartThreshold
+	})
 
 	// Check if bucket already exists.
-	_, err = ah.svc.HeadBucket(context.Background(), &s3.HeadBucketInput{Bucket: aws.String(ah.conf.BucketName)})
+	err = ah.headBucket(context.Background())
 	if err == nil {
 		// Bucket exists
+		if err = ah.checkObjectLock(context.Background()); err != nil {
+			return err
+		}
+		ah.checkKeyEncoding(context.Background())
+		ah.startBackgroundTasks()
 		return nil
 	}
 
@@ -153,186 +964,1102 @@ func (ah *awshandler) Init(jsconf string) error {
 		return err
 	}
 
+	if ah.conf.RequesterPays {
+		// Requester Pays buckets are owned by someone else.
+		return errors.New("requester_pays bucket '" + ah.conf.BucketName + "' does not exist")
+	}
+	if ah.conf.NeverCreateBucket {
+		return errors.New("bucket '" + ah.conf.BucketName + "' does not exist and never_create_bucket is set")
+	}
+
 	// Bucket does not exist. Create one.
-	_, err = ah.svc.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String(ah.conf.BucketName)})
+	_, err = ah.svc.CreateBucket(context.Background(), &s3.CreateBucketInput{
+		Bucket: aws.String(ah.conf.BucketName),
+		// Object Lock can be enabled only when the bucket is created.
+		ObjectLockEnabledForBucket: aws.Bool(ah.conf.Immutable != nil),
+	})
 	if err != nil {
 		if isAPIError(err, "BucketAlreadyExists", "BucketAlreadyOwnedByYou", "OperationAborted") {
 			// Check if someone has already created a bucket (possible in a cluster).
 			err = nil
 		}
-	} else {
+	} else if manageCors {
 		// This is a new bucket.
 
 		// The following serves two purposes:
 		// 1. Setup CORS policy to be able to serve media directly from S3.
 		// 2. Verify that the bucket is accessible to the current user.
-		origins := ah.conf.CorsOrigins
-		if len(origins) == 0 {
-			origins = append(origins, "*")
-		}
 		_, err = ah.svc.PutBucketCors(context.Background(), &s3.PutBucketCorsInput{
-			Bucket: aws.String(ah.conf.BucketName),
-			CORSConfiguration: &s3types.CORSConfiguration{
-				CORSRules: []s3types.CORSRule{{
-					AllowedMethods: []string{http.MethodGet, http.MethodHead},
-					AllowedOrigins: origins,
-					AllowedHeaders: []string{"*"},
-				}},
-			},
+			Bucket:            aws.String(ah.conf.BucketName),
+			CORSConfiguration: &s3types.CORSConfiguration{CORSRules: rules},
 		})
 	}
+	if err == nil {
+		ah.startBackgroundTasks()
+	}
 	return err
 }
 
-// Headers adds CORS headers and redirects GET and HEAD requests to the AWS server.
-func (ah *awshandler) Headers(method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
-	// Add CORS headers, if necessary.
-	headers, status := media.CORSHandler(method, headers, ah.corsOrigins, serve)
-	if status != 0 || method == http.MethodPost || method == http.MethodPut {
-		return headers, status, nil
+// headBucket checks if the bucket exists. Requests which got no response from S3 or failed with
+// a server error are retried with backoff for init_retry_seconds. Other errors, like denied
+// access, are returned immediately.
+func (ah *awshandler) headBucket(ctx context.Context) error {
+	deadline := time.Now().Add(time.Second * time.Duration(ah.conf.InitRetrySeconds))
+	delay := initRetryDelay
+	for {
+		sent := time.Now()
+		out, err := ah.svc.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(ah.conf.BucketName)})
+		var metadata middleware.Metadata
+		if out != nil {
+			metadata = out.ResultMetadata
+		}
+		ah.measureClockSkew(metadata, err, sent)
+		if err == nil || !isTransientError(err) || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		logs.Warn.Println("s3: bucket check failed, retrying in", delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, maxInitRetryDelay)
 	}
+}
 
-	fid := ah.GetIdFromUrl(url.String())
-	if fid.IsZero() {
-		return nil, 0, types.ErrNotFound
+// startBackgroundTasks starts periodic tasks once the bucket is accessible.
+func (ah *awshandler) startBackgroundTasks() {
+	if ah.conf.BucketStatsPeriod > 0 {
+		ah.startBucketStats(time.Second * time.Duration(ah.conf.BucketStatsPeriod))
 	}
+}
 
-	fdef, err := ah.getFileRecord(fid)
-	if err != nil {
-		return nil, 0, err
+// bucketCORSRules converts configured CORS rules to S3 rules.
+func (ah *awshandler) bucketCORSRules() ([]s3types.CORSRule, error) {
+	defaultOrigins := ah.conf.CorsOrigins
+	if len(defaultOrigins) == 0 {
+		defaultOrigins = []string{"*"}
 	}
 
-	if fdef.ETag != "" && headers.Get("If-None-Match") == `"`+fdef.ETag+`"` {
-		return http.Header{
-				"ETag":          {`"` + fdef.ETag + `"`},
-				"Cache-Control": {ah.conf.CacheControl},
-			},
-			http.StatusNotModified, nil
+	if len(ah.conf.CorsRules) == 0 {
+		return []s3types.CORSRule{{
+			AllowedMethods: []string{http.MethodGet, http.MethodHead},
+			AllowedOrigins: defaultOrigins,
+			AllowedHeaders: []string{"*"},
+		}}, nil
 	}
 
-	ctx := context.Background()
-	var redirURL string
-	switch method {
-	case http.MethodGet:
-		// If the query parameter "asatt" is set to a true, set Content-Disposition to attachment.
-		// This will cause browsers to download the file rather than attempt to display it.
-		// This closes an XSS vulnerability when users upload HTML files.
-		var contentDisposition *string
-		if isAttachment, _ := strconv.ParseBool(url.Query().Get("asatt")); isAttachment {
-			contentDisposition = aws.String("attachment")
-		}
-		presigned, err := ah.presign.PresignGetObject(ctx, &s3.GetObjectInput{
-			Bucket:                     aws.String(ah.conf.BucketName),
-			Key:                        aws.String(fid.String32()),
-			ResponseCacheControl:       aws.String(ah.conf.CacheControl),
-			ResponseContentType:        aws.String(fdef.MimeType),
-			ResponseContentDisposition: contentDisposition,
-		}, func(opts *s3.PresignOptions) {
-			opts.Expires = time.Second * time.Duration(ah.conf.PresignTTL)
-		})
-		if err != nil {
-			return nil, 0, err
+	rules := make([]s3types.CORSRule, 0, len(ah.conf.CorsRules))
+	for _, cr := range ah.conf.CorsRules {
+		if len(cr.Methods) == 0 {
+			return nil, errors.New("CORS rule must have methods")
 		}
-		redirURL = presigned.URL
-	case http.MethodHead:
-		presigned, err := ah.presign.PresignHeadObject(ctx, &s3.HeadObjectInput{
-			Bucket: aws.String(ah.conf.BucketName),
-			Key:    aws.String(fid.String32()),
-		}, func(opts *s3.PresignOptions) {
-			opts.Expires = time.Second * time.Duration(ah.conf.PresignTTL)
-		})
-		if err != nil {
-			return nil, 0, err
+		methods := make([]string, 0, len(cr.Methods))
+		for _, m := range cr.Methods {
+			m = strings.ToUpper(m)
+			switch m {
+			case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete:
+			default:
+				return nil, errors.New("CORS rule method not supported by S3 '" + m + "'")
+			}
+			methods = append(methods, m)
+		}
+		if cr.MaxAge < 0 {
+			return nil, errors.New("invalid CORS rule max_age")
 		}
-		redirURL = presigned.URL
-	}
 
-	if redirURL != "" {
-		// Return presigned URL with 308 Permanent redirect. Let the client cache the response.
-		// The original URL will stop working after a short period of time to prevent use of Tinode
-		// as a free file server.
-		return http.Header{
-				"Location":      {redirURL},
-				"ETag":          {`"` + fdef.ETag + `"`},
-				"Content-Type":  {"application/json; charset=utf-8"},
-				"Cache-Control": {ah.conf.CacheControl},
-			},
-			http.StatusPermanentRedirect, nil
+		rule := s3types.CORSRule{
+			AllowedMethods: methods,
+			AllowedOrigins: cr.Origins,
+			AllowedHeaders: cr.Headers,
+			ExposeHeaders:  cr.ExposeHeaders,
+		}
+		if len(rule.AllowedOrigins) == 0 {
+			rule.AllowedOrigins = defaultOrigins
+		}
+		if cr.MaxAge > 0 {
+			rule.MaxAgeSeconds = aws.Int32(cr.MaxAge)
+		}
+		rules = append(rules, rule)
 	}
-	return nil, 0, nil
+	return rules, nil
 }
 
-// Upload processes request for a file upload. The file is given as io.Reader.
-func (ah *awshandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64, error) {
-	var err error
+// checkServeQuery rejects attempts to pass S3 parameters, like response header overrides,
+// through the serve URL. Response headers of presigned requests are set by the server only.
+func checkServeQuery(query url.Values) error {
+	for name := range query {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "response-") || strings.HasPrefix(name, "x-amz-") {
+			return types.ErrMalformed
+		}
+	}
+	_, err := media.ParseAsAttachment(query.Get("asatt"))
+	return err
+}
 
-	// Using String32 just for consistency with the file handler.
-	key := fdef.Uid().String32()
+// responseDisposition returns Content-Disposition of the response given the sanctioned query parameters
+// "asatt" and "filename", or nil if the default should be used.
+func responseDisposition(query url.Values) *string {
+	disposition := "inline"
+	// If the query parameter "asatt" is set to a true, set Content-Disposition to attachment.
+	// This will cause browsers to download the file rather than attempt to display it.
+	// This closes an XSS vulnerability when users upload HTML files.
+	// The value is validated by checkServeQuery.
+	if isAttachment, _ := media.ParseAsAttachment(query.Get("asatt")); isAttachment {
+		disposition = "attachment"
+	}
 
-	tmClient := transfermanager.New(ah.svc)
+	if name := query.Get("filename"); sanitizeFilename(name) != "" {
+		return aws.String(contentDisposition(disposition, name))
+	}
+	if disposition == "attachment" {
+		return aws.String(disposition)
+	}
+	return nil
+}
 
-	if err = store.Files.StartUpload(fdef); err != nil {
-		logs.Warn.Println("failed to create file record", fdef.Id, err)
-		return "", 0, err
+// readSecretFile reads a config value from a file, like one mounted by a secret manager.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.New("failed to read secret file: " + err.Error())
 	}
+	return strings.TrimSpace(string(data)), nil
+}
 
-	rc := readerCounter{reader: file}
-	result, err := tmClient.UploadObject(context.Background(), &transfermanager.UploadObjectInput{
-		CacheControl: aws.String(ah.conf.CacheControl),
+// endpointURL adds the scheme to the endpoint if missing.
+func (ah *awshandler) endpointURL(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	if ah.conf.DisableSSL {
+		return "http://" + endpoint
+	}
+	return "https://" + endpoint
+}
+
+// Headers adds CORS headers and redirects GET and HEAD requests to the AWS server.
+func (ah *awshandler) Headers(method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
+	return ah.HeadersWithContext(context.Background(), method, url, headers, serve)
+}
+
+// HeadersWithContext is Headers with the context of the client request.
+func (ah *awshandler) HeadersWithContext(ctx context.Context, method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
+	// Add CORS headers, if necessary.
+	corsHeaders, status := media.CORSHandler(method, headers, ah.corsOrigins, serve)
+	if method == http.MethodOptions {
+		// Preflight or a plain OPTIONS: nothing to look up.
+		return corsHeaders, http.StatusNoContent, nil
+	}
+	if status != 0 || !serve || method == http.MethodPost || method == http.MethodPut {
+		return corsHeaders, status, nil
+	}
+
+	resp, status, err := ah.serveHeaders(ctx, method, url, headers)
+	err = ah.requestFailed("download", ah.throttled(err))
+	var throttled *media.ThrottledError
+	if errors.As(err, &throttled) {
+		// S3 is overloaded, tell the client to retry later.
+		resp, status = http.Header{"Retry-After": {throttled.RetryAfterSeconds()}}, http.StatusServiceUnavailable
+		ah.exposeRequestID(resp, err)
+		err = nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp == nil {
+		resp = http.Header{}
+	}
+	for name, values := range corsHeaders {
+		resp[name] = append(resp[name], values...)
+	}
+	return resp, status, nil
+}
+
+// serveHeaders handles GET and HEAD requests for the file.
+func (ah *awshandler) serveHeaders(ctx context.Context, method string, url *url.URL, headers http.Header) (http.Header, int, error) {
+	if err := checkServeQuery(url.Query()); err != nil {
+		return nil, 0, err
+	}
+
+	fid := ah.GetIdFromUrl(url.Path)
+	if fid.IsZero() {
+		return nil, 0, types.ErrNotFound
+	}
+
+	fdef, err := ah.getFileRecord(ctx, fid)
+	if err == types.ErrUnavailable {
+		// Store is failing, tell the client to retry later.
+		return http.Header{
+			"Retry-After": {strconv.Itoa(int(ah.storeBreaker.retryAfter().Seconds()) + 1)},
+		}, http.StatusServiceUnavailable, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if downloadsExhausted(fdef) {
+		// The object may be deleted already. Or not, if the server was restarted before the delayed
+		// deletion after the last download.
+		ah.deleteExhausted(fdef, 0)
+		return ah.goneResponse()
+	}
+
+	if ah.conf.MissingObjectStatus != 0 && ah.objectMissing(ctx, fdef) {
+		// The record exists but the object is gone, e.g. deleted out of band.
+		logs.Warn.Println("s3: object of file record is missing", ah.redact.ref(fdef.Id))
+		return http.Header{
+			missingObjectHeader: {"1"},
+		}, ah.conf.MissingObjectStatus, nil
+	}
+
+	// Immutable files are served by the version pinned by the token of the URL.
+	var version *string
+	if ah.isImmutable(fdef) {
+		ver, err := ah.checkImmutableToken(fdef, url.Query())
+		if err != nil {
+			return nil, 0, err
+		}
+		version = aws.String(ver)
+	}
+
+	// Presigned URLs of self-destructing files must not outlive the files.
+	ttl := time.Second * time.Duration(ah.conf.PresignTTL)
+	expires := ah.objectExpiry(ctx, fdef)
+	if !expires.IsZero() {
+		remaining := time.Until(expires).Truncate(time.Second)
+		if remaining < time.Second {
+			return ah.goneResponse()
+		}
+		ttl = min(ttl, remaining)
+	}
+
+	limited := fdef.DownloadLimit > 0
+	if url.Query().Get(thumbnailParam) != "" {
+		if limited {
+			// A thumbnail would show the content without counting the download.
+			return nil, 0, types.ErrNotFound
+		}
+		if !ah.variantsMissing(fdef) {
+			resp, status, err := ah.serveThumbnail(ctx, method, fdef, headers, ttl)
+			if err != types.ErrNotFound || ah.variantWorkers == nil {
+				return resp, status, err
+			}
+			// Pending on another node or before a restart.
+		}
+		// The thumbnail is not generated yet or failed, the image itself is served instead.
+	}
+
+	fdef = ah.verifyETag(ctx, fdef)
+	cacheControl := ah.cacheControl(ctx, fdef)
+	if limited {
+		// Neither the redirect nor the content may be reused without counting the download.
+		cacheControl = limitedCacheControl
+		ttl = min(ttl, limitedPresignTTL)
+	}
+	if fdef.ETag != "" && headers.Get("If-None-Match") == `"`+fdef.ETag+`"` {
+		return http.Header{
+				"ETag":          {`"` + fdef.ETag + `"`},
+				"Cache-Control": {cacheControl},
+			},
+			http.StatusNotModified, nil
+	}
+	if method == http.MethodGet {
+		if resp := unsatisfiableRange(fdef, headers); resp != nil {
+			return resp, http.StatusRequestedRangeNotSatisfiable, nil
+		}
+	}
+	// Files requested under dangerous names are downloaded as attachments whatever their declared type.
+	served := fdef
+	if ah.dangerousDownload(url) {
+		url, served = forceAttachment(url, fdef)
+	} else if !ah.inlineAllowed(fdef.MimeType) {
+		url = attachmentURL(url)
+	}
+
+	// Small objects are served from memory, if configured. The object reader does not pin versions.
+	hot := version == nil && ah.hotCacheable(fdef, url)
+
+	// Public objects are redirected to as is, unless the response must be altered or streamed.
+	if !limited && responseDisposition(url.Query()) == nil && !ah.useProxy(url) && !hot && ah.isPublic(ctx, fdef, expires) {
+		if method == http.MethodGet {
+			ah.audit.log(ctx, fdef, false)
+		}
+		return http.Header{
+			"Location":      {ah.publicURL(fdef)},
+			"ETag":          {`"` + fdef.ETag + `"`},
+			"Cache-Control": {cacheControl},
+		}, http.StatusPermanentRedirect, nil
+	}
+
+	if ah.downloadTokens != nil && method == http.MethodGet &&
+		!ah.downloadTokens.consume(url.Query().Get(downloadTokenParam), fid, tokenOwner(ctx)) {
+		// The content is given out only once per token.
+		return nil, 0, types.ErrPermissionDenied
+	}
+
+	if limited && method == http.MethodGet {
+		counted, err := ah.countDownload(fdef, ttl)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !counted {
+			return ah.goneResponse()
+		}
+	}
+
+	// The CDN authorizes the client by its cookies, unless the response must be altered or streamed.
+	if responseDisposition(url.Query()) == nil && !ah.useProxy(url) && !hot && ah.cdnCookieEligible(fdef, expires) {
+		if method == http.MethodGet {
+			ah.audit.log(ctx, fdef, false)
+		}
+		return http.Header{
+			"Location":      {ah.cdnCookieURL(fdef)},
+			"ETag":          {`"` + fdef.ETag + `"`},
+			"Cache-Control": {cacheControl},
+		}, http.StatusFound, nil
+	}
+
+	// The object reader does not pin versions, immutable files are always redirected.
+	if hot || version == nil && ah.useProxy(url) {
+		// Let the server stream the object using Download.
+		logs.Info.Println("s3: proxy download", ah.redact.ref(fid.String()), method)
+		if method == http.MethodHead && ah.verifyHead(url) {
+			// The size and ETag of the response must match what a GET would return.
+			fdef = ah.verifyObject(ctx, fdef, true)
+		}
+		resp := http.Header{
+			"Cache-Control": {cacheControl},
+			"Accept-Ranges": {"bytes"},
+		}
+		if fdef.ETag != "" {
+			// Resumed downloads are validated with If-Range against the ETag.
+			resp["ETag"] = []string{`"` + fdef.ETag + `"`}
+		}
+		if method == http.MethodHead {
+			resp.Set("Content-Type", served.MimeType)
+			resp.Set("Content-Length", strconv.FormatInt(fdef.Size, 10))
+			// Last-Modified of GET responses is set from the file of Download.
+			if modified := ah.lastModified(ctx, fdef); !modified.IsZero() {
+				resp.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+			}
+		} else {
+			ah.audit.log(ctx, fdef, true)
+		}
+		return resp, 0, nil
+	}
+
+	// Downloads are served from the replica nearest to the client, if configured.
+	presign, bucket := ah.presignClient(headers)
+	// Presigned URLs work only from the network of the client, if configured.
+	pin := func(*s3.PresignOptions) {}
+	network := ah.clientNetwork(ctx)
+	if network != "" {
+		if pin, err = ah.pinPresign(ctx, network, ttl); err != nil {
+			return nil, 0, err
+		}
+	}
+	var redirURL string
+	switch method {
+	case http.MethodGet:
+		contentDisposition := responseDisposition(url.Query())
+		key := ah.objectLocation(fdef)
+		var contentEncoding *string
+		if version == nil {
+			// Immutable files have no variants.
+			if variant, enc := ah.negotiateVariant(ctx, fdef, headers.Get("Accept-Encoding")); variant != "" {
+				key = variant
+				contentEncoding = aws.String(enc)
+			}
+		}
+		redirURL, err = ah.presignGet(ctx, served, presign, bucket, key, version, cacheControl, contentEncoding,
+			contentDisposition, ttl, pin, network)
+		if err != nil {
+			return nil, 0, err
+		}
+		ah.audit.log(ctx, fdef, false)
+	case http.MethodHead:
+		contentDisposition := responseDisposition(url.Query())
+		key := ah.objectLocation(fdef)
+		responseCacheControl := ah.responseCacheControl(fdef, cacheControl)
+		redirURL, err = ah.cachedPresign(ctx, fdef.Id, ttl, func() (string, error) {
+			presigned, err := presign.PresignHeadObject(ctx, &s3.HeadObjectInput{
+				Bucket:       aws.String(bucket),
+				RequestPayer: ah.requestPayer(),
+				Key:          aws.String(key),
+				VersionId:    version,
+				// Same headers as of GET, the stored type of older objects is wrong.
+				ResponseCacheControl:       responseCacheControl,
+				ResponseContentType:        aws.String(served.MimeType),
+				ResponseContentDisposition: contentDisposition,
+			}, func(opts *s3.PresignOptions) {
+				opts.Expires = ttl
+			}, pin)
+			if err != nil {
+				return "", err
+			}
+			return presigned.URL, nil
+		}, method, bucket, key, aws.ToString(version), aws.ToString(responseCacheControl), served.MimeType,
+			aws.ToString(contentDisposition), network)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if redirURL != "" {
+		// Return presigned URL with 308 Permanent redirect. Let the client cache the response.
+		// The original URL will stop working after a short period of time to prevent use of Tinode
+		// as a free file server.
+		resp := http.Header{
+			"Location":      {redirURL},
+			"ETag":          {`"` + fdef.ETag + `"`},
+			"Content-Type":  {"application/json; charset=utf-8"},
+			"Cache-Control": {ah.redirectCacheControl(cacheControl, ttl)},
+		}
+		if len(ah.conf.Compress) > 0 {
+			// The redirect depends on the Accept-Encoding.
+			resp["Vary"] = append(resp["Vary"], "Accept-Encoding")
+		}
+		if ah.replicas != nil {
+			// The redirect depends on the region hint.
+			resp["Vary"] = append(resp["Vary"], ah.conf.RegionHintHeader)
+		}
+		if isVideo(fdef.MimeType) {
+			// Players scrub videos with range requests. The presigned URL does not sign the Range header,
+			// so any range of the object can be requested from S3 with it.
+			resp["Accept-Ranges"] = []string{"bytes"}
+		}
+		if limited {
+			// A cached permanent redirect would be followed without counting the download.
+			return resp, http.StatusTemporaryRedirect, nil
+		}
+		return resp, http.StatusPermanentRedirect, nil
+	}
+	return nil, 0, nil
+}
+
+// Upload processes request for a file upload. The file is given as io.Reader.
+func (ah *awshandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	return ah.UploadWithContext(context.Background(), fdef, file)
+}
+
+// UploadWithContext is Upload with the context of the client request.
+func (ah *awshandler) UploadWithContext(ctx context.Context, fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	result, err := ah.UploadEx(ctx, fdef, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return result.URL, result.Size, nil
+}
+
+// UploadEx is UploadWithContext which returns the description of the stored file.
+func (ah *awshandler) UploadEx(ctx context.Context, fdef *types.FileDef, file io.Reader) (*media.UploadResult, error) {
+	key := uploadKey(ctx, fdef)
+	call, first := ah.inflight.start(key)
+	if !first {
+		logs.Info.Println("s3: duplicate upload, waiting for the first one", ah.redact.ref(key))
+		return call.wait(ctx, fdef, file, ah.conf.MaxFileSize)
+	}
+
+	// Checked after registering the upload, so the result of the upload which just completed is not missed.
+	idemKey := idempotencyKey(ctx, fdef)
+	if done, ok := ah.completedResult(idemKey); ok {
+		logs.Info.Println("s3: repeated upload, returning the earlier result", ah.redact.ref(key))
+		drain(file, ah.conf.MaxFileSize)
+		*fdef = done.fdef
+		ah.inflight.finish(key, call, fdef, done.result, nil)
+		return reusedResult(done.result), nil
+	}
+
+	result, err := ah.upload(ctx, fdef, file)
+	err = ah.requestFailed("upload", ah.throttled(err))
+	if err == nil {
+		// Remembered before the upload is unregistered, so retries see either one or the other.
+		ah.rememberResult(idemKey, fdef, result)
+	}
+	ah.inflight.finish(key, call, fdef, result, err)
+	return result, err
+}
+
+// upload stores the object in the bucket.
+func (ah *awshandler) upload(ctx context.Context, fdef *types.FileDef, file io.Reader) (_ *media.UploadResult, err error) {
+	// The record of an earlier upload with the same file ID, e.g. a retry by the client. The record and
+	// the stored object are kept if this upload fails.
+	var existing bool
+	defer func() {
+		if err != nil && existing {
+			err = &media.ExistingFileError{Err: err}
+		}
+	}()
+
+	immutable, err := ah.immutableUpload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tenant := ah.uploadTenant(ctx)
+	key := tenant.keyPrefix() + ah.uploadObjectKey(ctx, fdef.Uid())
+	if immutable {
+		key = ah.conf.Immutable.Prefix + key
+	}
+	if err = ah.checkKeyLength(key); err != nil {
+		return nil, err
+	}
+
+	size := streamSize(file)
+	limit, file := ah.uploadSizeLimit(fdef.MimeType, file)
+	if limit > 0 && size > limit {
+		return nil, &media.SizeLimitError{Limit: limit}
+	}
+	declared := ah.declaredSize(fdef)
+	if !ah.sizeMatches(declared, size) {
+		logs.Warn.Println("s3: upload size", size, "differs from declared", declared, ah.redact.ref(fdef.Id))
+		return nil, types.ErrMalformed
+	}
+
+	// Validate the language and caching before creating the file record.
+	lang, err := contentLanguage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fileCacheControl, err := ah.uploadCacheControl(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expires, err := ah.uploadExpiry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cacheControl := ah.conf.CacheControl
+	metadata := map[string]string{}
+	if fileCacheControl != "" {
+		cacheControl = fileCacheControl
+		metadata[cacheControlMetaKey] = fileCacheControl
+	}
+	if !expires.IsZero() {
+		metadata[expiresMetaKey] = strconv.FormatInt(expires.Unix(), 10)
+	}
+
+	if fdef.DownloadLimit, err = ah.uploadDownloadLimit(ctx); err != nil {
+		return nil, err
+	}
+	if err = ah.checkTenantQuota(tenant, max(size, declared)); err != nil {
+		return nil, err
+	}
+
+	err = ah.startUpload(ctx, fdef)
+	if existing = err == types.ErrDuplicate; existing {
+		// A retry of the upload: the object may be stored already.
+		var res *media.UploadResult
+		if res, err = ah.existingUpload(ctx, fdef, file); res != nil || err != nil {
+			return res, err
+		}
+	}
+	if err != nil {
+		logs.Warn.Println("failed to create file record", ah.redact.ref(fdef.Id), err)
+		return nil, err
+	}
+
+	// Store the object with the correct content type so it's served correctly
+	// even without the per-request override.
+	fdef.MimeType, file = objectContentType(ah.conf.MimeDetection, fdef.MimeType, file)
+	fdef.MimeType, file = correctContentType(ah.conf.MimeCorrection, fdef.MimeType, uploadFilename(ctx), file)
+	// Check the dimensions before anything decodes the image.
+	if file, err = ah.checkImageDimensions(fdef, file); err != nil {
+		if !existing {
+			ah.markUploadFailed(fdef)
+		}
+		return nil, err
+	}
+	if !immutable {
+		var original []byte
+		if file, size, original = ah.normalizeOrientation(fdef, file, size, limit, declared); original != nil {
+			// The declared size is of the original image.
+			declared = 0
+		}
+		if original != nil && ah.conf.Originals != nil {
+			if fdef.OriginalLocation, err = ah.storeOriginal(ctx, fdef, key, original); err != nil {
+				if !existing {
+					ah.markUploadFailed(fdef)
+				}
+				return nil, err
+			}
+		}
+	}
+
+	// The size of the stream is also enforced while reading because the stream
+	// could be longer than reported or the size may not be known at all.
+	rc := readerCounter{reader: file, limit: limit, declared: declared, tolerance: ah.conf.DeclaredSizeTolerance}
+	var body io.Reader = &rc
+	// Compressed variants, placeholders and thumbnails are produced while the object is uploaded.
+	// Immutable files are stored as is.
+	var comps []*compressor
+	var lqip, thumb *placeholderBuffer
+	if !immutable && ah.variantWorkers == nil {
+		comps = ah.newCompressors(fdef, size)
+		lqip = ah.newPlaceholderBuffer(fdef, size)
+		thumb = ah.newThumbnailBuffer(fdef, size)
+	}
+	writers := variantWriters(comps, lqip, thumb)
+	digest := ah.newContentHash()
+	if digest != nil {
+		writers = append(writers, digest)
+	}
+	if len(writers) > 0 {
+		body = io.TeeReader(&rc, io.MultiWriter(writers...))
+	}
+	input := &transfermanager.UploadObjectInput{
+		CacheControl: aws.String(cacheControl),
+		Metadata:     metadata,
+		ContentType:  aws.String(fdef.MimeType),
+		// S3 returns the stored Content-Language with the object, including presigned GETs.
+		ContentLanguage: lang,
+		Bucket:          aws.String(ah.conf.BucketName),
+		Key:             aws.String(key),
+		Body:            body,
+		RequestPayer:    tmtypes.RequestPayer(ah.requestPayer()),
+	}
+	if immutable {
+		ah.lockObject(input)
+	}
+	var opts []func(*transfermanager.Options)
+	if size >= 0 {
+		input.ContentLength = aws.Int64(size)
+	} else {
+		// Unknown length: always use multipart upload. The stream is sent in parts
+		// as it arrives instead of being buffered to the threshold first.
+		opts = append(opts, func(o *transfermanager.Options) {
+			o.MultipartUploadThreshold = 0
+		})
+	}
+	var out *transfermanager.UploadObjectOutput
+	if ah.buffers.fits(size) {
+		out, err = ah.uploadBuffered(ctx, input, opts)
+	} else {
+		out, err = ah.uploadObject(ctx, input, opts)
+	}
+
+	if err != nil {
+		if fdef.OriginalLocation != "" && !existing {
+			// The original of the object which was not stored.
+			ah.deleteOriginals(context.WithoutCancel(ctx), []string{key})
+		}
+		if rc.readErr != nil {
+			logs.Warn.Println("s3: failed to read upload", ah.redact.ref(fdef.Id), "after", rc.count, "bytes", rc.readErr)
+			if !existing {
+				// The earlier object under the same key is left as is.
+				ah.discardUpload(ctx, fdef, key)
+			}
+			return nil, &media.SourceReadError{Err: rc.readErr}
+		}
+		var limitErr *media.SizeLimitError
+		if errors.As(err, &limitErr) {
+			// The error is wrapped by the uploader.
+			err = limitErr
+		} else if errors.Is(err, errSizeMismatch) {
+			logs.Warn.Println("s3: upload size", rc.count, "differs from declared", declared, ah.redact.ref(fdef.Id))
+			err = types.ErrMalformed
+		}
+		return nil, err
+	}
+
+	fdef.Location = key
+	if digest != nil {
+		fdef.ETag = contentHashETag(digest)
+	} else if out.ETag != nil {
+		fdef.ETag = strings.Trim(*out.ETag, "\"")
+	}
+	url, err := ah.uploadURL(fdef, immutable, out.VersionID)
+	if err != nil {
+		return nil, err
+	}
+
+	ah.cacheMetadata(key, metadata)
+	ah.storeVariants(ctx, fdef, comps, lang, cacheControl)
+	res := &media.UploadResult{
+		URL:      url,
+		Size:     rc.count,
+		ETag:     fdef.ETag,
+		Location: fdef.Location,
+		MimeType: fdef.MimeType,
+	}
+	ah.storePlaceholder(ctx, fdef, lqip, res)
+	ah.storeThumbnail(ctx, fdef, thumb, cacheControl, res)
+	if !immutable {
+		ah.queueVariants(fdef, rc.count, lang, cacheControl)
+	}
+	ah.webhook.notify(ctx, fdef, url, rc.count)
+
+	return res, nil
+}
+
+// uploadURL returns the serve URL of the stored file. Immutable files are served by the version of the object.
+func (ah *awshandler) uploadURL(fdef *types.FileDef, immutable bool, versionID *string) (string, error) {
+	url := ah.serveURL + fdef.Id + media.FileExtension(fdef.MimeType, ah.extensions)
+	if immutable {
+		if versionID == nil {
+			// Object Lock requires versioning, the bucket is misconfigured.
+			logs.Warn.Println("s3: immutable object stored without version", ah.redact.ref(fdef.Location))
+			return "", types.ErrInternal
+		}
+		url += "?" + ah.immutableToken(fdef.Id, *versionID).Encode()
+	}
+	if ah.conf.VersionedURLs && fdef.ETag != "" {
+		sep := "?"
+		if immutable {
+			sep = "&"
+		}
+		url += sep + contentVersionParam + "=" + contentVersion(fdef.ETag)
+	}
+	return url, nil
+}
+
+// presignGet presigns the URL to download the object of the file. The URL is cached by all parameters
+// which affect it.
+func (ah *awshandler) presignGet(ctx context.Context, fdef *types.FileDef, presign *s3.PresignClient, bucket, key string,
+	version *string, cacheControl string, contentEncoding, contentDisposition *string, ttl time.Duration,
+	pin func(*s3.PresignOptions), network string) (string, error) {
+	responseCacheControl := ah.responseCacheControl(fdef, cacheControl)
+	return ah.cachedPresign(ctx, fdef.Id, ttl, func() (string, error) {
+		presigned, err := presign.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket:                  aws.String(bucket),
+			RequestPayer:            ah.requestPayer(),
+			Key:                     aws.String(key),
+			VersionId:               version,
+			ResponseCacheControl:    responseCacheControl,
+			ResponseContentEncoding: contentEncoding,
+			// Objects uploaded by older versions were stored without the content type.
+			ResponseContentType:        aws.String(fdef.MimeType),
+			ResponseContentDisposition: contentDisposition,
+		}, func(opts *s3.PresignOptions) {
+			opts.Expires = ttl
+		}, pin)
+		if err != nil {
+			return "", err
+		}
+		return presigned.URL, nil
+	}, http.MethodGet, bucket, key, aws.ToString(version), aws.ToString(responseCacheControl),
+		aws.ToString(contentEncoding), fdef.MimeType, aws.ToString(contentDisposition), network)
+}
+
+// discardUpload cleans up after the upload failed because the source could not be read. Incomplete
+// multipart uploads are aborted by the uploader. The object is deleted in case the storage kept any of it,
+// and the file record is marked failed.
+func (ah *awshandler) discardUpload(ctx context.Context, fdef *types.FileDef, key string) {
+	// The request context may be already cancelled by the failure.
+	ctx = context.WithoutCancel(ctx)
+	_, err := ah.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
 		Key:          aws.String(key),
-		Body:         &rc,
 	})
+	if err != nil && !isAPIError(err, "NoSuchKey", "NotFound") {
+		logs.Warn.Println("s3: failed to delete partial upload", ah.redact.ref(key), err)
+	}
+	ah.markUploadFailed(fdef)
+}
 
+// markUploadFailed marks the file record of the rejected or discarded upload failed.
+func (ah *awshandler) markUploadFailed(fdef *types.FileDef) {
+	err := ah.storeBreaker.call(func() error {
+		_, err := store.Files.FinishUpload(fdef, false, 0)
+		return err
+	})
 	if err != nil {
-		return "", 0, err
+		logs.Warn.Println("s3: failed to mark upload failed", ah.redact.ref(fdef.Id), err)
 	}
+}
 
-	fname := fdef.Id
-	ext, _ := mime.ExtensionsByType(fdef.MimeType)
-	if len(ext) > 0 {
-		fname += ext[0]
+// contentVersion returns the short token of the version of the content with the ETag.
+func contentVersion(etag string) string {
+	hash := sha256.Sum256([]byte(etag))
+	return base64.RawURLEncoding.EncodeToString(hash[:6])
+}
+
+// MIME types which say nothing about the content.
+var genericMimeTypes = map[string]bool{
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/unknown":      true,
+}
+
+// objectContentType validates the MIME type of the upload. Depending on the detection mode or if it's
+// invalid, the type is detected from the first bytes of the stream. Returns the type and the reader to use
+// instead of file.
+func objectContentType(mode, mimeType string, file io.Reader) (string, io.Reader) {
+	if mode != mimeSniff {
+		if mediaType, params, err := mime.ParseMediaType(mimeType); err == nil {
+			if formatted := mime.FormatMediaType(mediaType, params); formatted != "" &&
+				(mode != mimeSniffFallback || !genericMimeTypes[mediaType]) {
+				return formatted, file
+			}
+		}
 	}
 
-	fdef.Location = key
-	if result.ETag != nil {
-		fdef.ETag = strings.Trim(*result.ETag, "\"")
+	buffered := bufio.NewReaderSize(file, sniffLen)
+	// Short or failed reads are fine: DetectContentType works with what's available
+	// and the error will be returned again by the next Read.
+	head, _ := buffered.Peek(sniffLen)
+	return http.DetectContentType(head), buffered
+}
+
+// correctContentType replaces the generic MIME type, like "application/octet-stream", with the type
+// inferred from the sources in the given order: the extension of the file name or the first bytes of
+// the stream. Returns the type and the reader to use instead of file.
+func correctContentType(sources []string, mimeType, filename string, file io.Reader) (string, io.Reader) {
+	if !isGenericMimeType(mimeType) {
+		return mimeType, file
 	}
-	return ah.conf.ServeURL + fname, rc.count, nil
+	for _, source := range sources {
+		var inferred string
+		switch source {
+		case mimeFromExtension:
+			if ext := path.Ext(filename); ext != "" {
+				inferred = mime.TypeByExtension(strings.ToLower(ext))
+			}
+		case mimeFromContent:
+			inferred, file = sniffContentType(file)
+		}
+		if inferred != "" && !isGenericMimeType(inferred) {
+			return inferred, file
+		}
+	}
+	return mimeType, file
+}
+
+// sniffContentType detects the MIME type from the first bytes of the stream. Returns the type and
+// the reader to use instead of file.
+func sniffContentType(file io.Reader) (string, io.Reader) {
+	buffered := bufio.NewReaderSize(file, sniffLen)
+	head, _ := buffered.Peek(sniffLen)
+	return http.DetectContentType(head), buffered
+}
+
+func isGenericMimeType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	return err != nil || genericMimeTypes[mediaType]
+}
+
+// uploadFilename returns the sanitized name of the uploaded file from the request info, if provided by the client.
+func uploadFilename(ctx context.Context) string {
+	if info := media.RequestInfoFromContext(ctx); info != nil {
+		return sanitizeFilename(info.Filename)
+	}
+	return ""
 }
 
-// Download processes request for file download.
+// contentLanguage returns the canonical language tag of the uploaded content from the request info,
+// nil if not provided, or ErrMalformed if the tag is not a well-formed BCP 47 tag.
+func contentLanguage(ctx context.Context) (*string, error) {
+	info := media.RequestInfoFromContext(ctx)
+	if info == nil || info.Language == "" {
+		return nil, nil
+	}
+	tag, err := language.Parse(info.Language)
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	return aws.String(tag.String()), nil
+}
+
+// startUpload creates the file record. Failures of the database are retried with exponential backoff.
+// A duplicate record found by a retry means an earlier attempt succeeded even though it reported an error.
+// Returns ErrDuplicate if the record existed before the upload.
+func (ah *awshandler) startUpload(ctx context.Context, fdef *types.FileDef) error {
+	if fdef.CreatedAt.IsZero() {
+		// Reported to clients as the time of the upload.
+		fdef.InitTimes()
+	}
+	backoff := time.Millisecond * time.Duration(ah.conf.StoreRetryBackoff)
+	for attempt := 0; ; attempt++ {
+		err := ah.storeBreaker.call(func() error { return store.Files.StartUpload(fdef) })
+		if err == types.ErrDuplicate {
+			if attempt > 0 {
+				return nil
+			}
+			logs.Info.Println("s3: file record already exists", ah.redact.ref(fdef.Id))
+			return err
+		}
+		if err == nil || err == types.ErrUnavailable || !isDependencyFailure(err) || attempt >= ah.conf.StoreRetries {
+			// Success, the breaker is open, a permanent error, or out of attempts.
+			return err
+		}
+		logs.Info.Println("s3: retrying file record", ah.redact.ref(fdef.Id), "after", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// Download processes request for file download. The object is streamed from S3 regardless of the proxy
+// mode, so callers which need the content, like migration tools, can read it.
 // The returned ReadSeekCloser must be closed after use.
 func (ah *awshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
-	return nil, nil, types.ErrUnsupported
+	fid := ah.GetIdFromUrl(url)
+	if fid.IsZero() {
+		return nil, nil, types.ErrNotFound
+	}
+
+	ctx := context.Background()
+	fdef, err := ah.getFileRecord(ctx, fid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var reader media.ReadSeekCloser
+	if reader, err = ah.hotObject(ctx, fdef); err != nil {
+		return nil, nil, err
+	}
+	if reader == nil {
+		if reader, err = newObjectReader(ctx, ah, fdef); err != nil {
+			return nil, nil, err
+		}
+	}
+	if modified := ah.lastModified(ctx, fdef); !modified.Equal(fdef.UpdatedAt) {
+		// Reported as Last-Modified of the response.
+		changed := *fdef
+		changed.UpdatedAt = modified
+		fdef = &changed
+	}
+	if ah.dangerousDownloadURL(url) {
+		// The server forces download of files of the safe type.
+		fdef = safeFileDef(fdef)
+	}
+	return fdef, reader, nil
+}
+
+// useProxy checks if the object should be streamed through the server rather than
+// served by redirect to S3.
+func (ah *awshandler) useProxy(u *url.URL) bool {
+	switch ah.conf.Proxy {
+	case proxyAlways:
+		return true
+	case proxyRequest:
+		proxy, _ := strconv.ParseBool(u.Query().Get("proxy"))
+		return proxy
+	}
+	return false
 }
 
 // Delete deletes files from aws by provided slice of locations.
 func (ah *awshandler) Delete(locations []string) error {
-	ctx := context.Background()
-	for i := 0; i < len(locations); i += 1000 {
-		end := i + 1000
-		if end > len(locations) {
-			end = len(locations)
+	return ah.DeleteWithProgress(context.Background(), locations, nil)
+}
+
+// DeleteWithProgress implements media.ProgressDeleteHandler. Objects are deleted in batches
+// of up to 1000 keys. Objects which failed to delete are counted and logged but are not an error.
+func (ah *awshandler) DeleteWithProgress(ctx context.Context, locations []string, progress media.DeleteProgress) error {
+	// Immutable objects are refused until their retention expires.
+	locations, versions, failed := ah.retainedObjects(ctx, locations)
+	if len(locations) == 0 && failed > 0 && progress != nil {
+		progress(0, failed)
+	}
+
+	// Batches are deleted concurrently as allowed by the pacer. Totals and progress are updated under the lock.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var deleted int
+	var firstErr error
+	// stop records the first error. Returns true if deleting must stop.
+	stop := func(err error) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
 		}
+		return firstErr != nil
+	}
+	size := ah.deletes.batchSize()
+	for i := 0; i < len(locations); i += size {
+		release, err := ah.deletes.acquire(ctx, min(size, len(locations)-i))
+		if stop(err) {
+			break
+		}
+
+		batch := locations[i:min(i+size, len(locations))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release()
+			ok, bad, err := ah.deleteBatch(ctx, batch, versions)
+			if err != nil {
+				stop(ah.requestFailed("delete", err))
+				return
+			}
+
+			// Counted even if another batch failed meanwhile: the objects are deleted.
+			mu.Lock()
+			defer mu.Unlock()
+			deleted += ok
+			failed += bad
+			if progress != nil {
+				progress(deleted, failed)
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
 
-		objects := make([]s3types.ObjectIdentifier, end-i)
-		for j, key := range locations[i:end] {
-			objects[j] = s3types.ObjectIdentifier{Key: aws.String(key)}
+// deleteBatch deletes the objects with a single request. Returns the numbers of deleted and failed objects.
+func (ah *awshandler) deleteBatch(ctx context.Context, batch []string, versions map[string]string) (int, int, error) {
+	objects := make([]s3types.ObjectIdentifier, len(batch))
+	for j, key := range batch {
+		objects[j] = s3types.ObjectIdentifier{Key: aws.String(key)}
+		if ver, ok := versions[key]; ok {
+			objects[j].VersionId = aws.String(ver)
 		}
+	}
 
-		_, err := ah.svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-			Bucket: aws.String(ah.conf.BucketName),
-			Delete: &s3types.Delete{
-				Objects: objects,
-				Quiet:   aws.Bool(true),
-			},
-		})
-		if err != nil {
-			return err
+	resp, err := ah.svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Delete: &s3types.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	failed := 0
+	for _, e := range resp.Errors {
+		if e.Key != nil && slices.Contains(batch, *e.Key) {
+			failed++
 		}
+		logs.Warn.Println("s3: failed to delete", ah.redact.ref(aws.ToString(e.Key)), aws.ToString(e.Code), aws.ToString(e.Message))
 	}
-	return nil
+	ah.deleteVariants(ctx, batch)
+	ah.deleteOriginals(ctx, batch)
+	ah.hotCache.remove(batch)
+	return len(batch) - failed, failed, nil
+}
+
+// requestPayer returns the RequestPayer of object requests.
+func (ah *awshandler) requestPayer() s3types.RequestPayer {
+	if ah.conf.RequesterPays {
+		return s3types.RequestPayerRequester
+	}
+	return ""
+}
+
+// serverVersion returns the server version to report in the User-Agent.
+func serverVersion() string {
+	if media.ServerVersion == "" {
+		return "undef"
+	}
+	return media.ServerVersion
+}
+
+// isTransientError checks if the request failed without a response from S3, e.g. a network
+// error, or with a server error.
+func isTransientError(err error) bool {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode() >= http.StatusInternalServerError
+	}
+	var apiErr smithy.APIError
+	return !errors.As(err, &apiErr)
 }
 
 func isAPIError(err error, codes ...string) bool {
@@ -350,19 +2077,25 @@ func isAPIError(err error, codes ...string) bool {
 
 // GetIdFromUrl converts an attahment URL to a file UID.
 func (ah *awshandler) GetIdFromUrl(url string) types.Uid {
-	return media.GetIdFromUrl(url, ah.conf.ServeURL)
+	return media.GetIdFromUrl(media.TrimServeURLBase(url, ah.conf.ServeURLBase), ah.conf.ServeURL, ah.legacyURLs...)
 }
 
 // getFileRecord given file ID reads file record from the database.
-func (ah *awshandler) getFileRecord(fid types.Uid) (*types.FileDef, error) {
-	fd, err := store.Files.Get(fid.String())
+// Form uploads are completed on the first access.
+func (ah *awshandler) getFileRecord(ctx context.Context, fid types.Uid) (*types.FileDef, error) {
+	var fd *types.FileDef
+	err := ah.storeBreaker.call(func() error {
+		var err error
+		fd, err = store.Files.Get(fid.String())
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	if fd == nil {
 		return nil, types.ErrNotFound
 	}
-	return fd, nil
+	return ah.completeFormUpload(ctx, fd)
 }
 
 func init() {
@@ -0,0 +1,4902 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const testBucket = "test-bucket"
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+type fakeObject struct {
+	data   []byte
+	header http.Header
+}
+
+// fakeS3 is a minimal in-memory S3-compatible server sufficient for exercising the handler.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	// Parts of incomplete multipart uploads by upload ID.
+	uploads map[string]map[int][]byte
+	// Operations performed by the server, like "PutObject".
+	ops []string
+	// Requests to objects without the X-Amz-Request-Payer header.
+	unpaid int
+	// Number of following GET requests of objects to deny.
+	failGets int
+	// Respond to requests of objects with SlowDown.
+	slowDown bool
+	// Offset of the Date of responses from the local time.
+	clockSkew time.Duration
+	// Reject multipart uploads as not implemented.
+	noMultipart bool
+	// User-Agent headers of requests.
+	userAgents []string
+}
+
+func newFakeS3(t testing.TB) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		objects: map[string]*fakeObject{},
+		uploads: map[string]map[int][]byte{},
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+func (f *fakeS3) record(op string) {
+	f.ops = append(f.ops, op)
+}
+
+func (f *fakeS3) hasOp(op string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, o := range f.ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeS3) object(key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+// readBody reads request body decoding aws-chunked encoding if necessary.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") &&
+		!strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return io.ReadAll(r.Body)
+	}
+	var out []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sz, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(sz, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			// Trailers follow, ignored.
+			return out, nil
+		}
+		chunk := make([]byte, n)
+		if _, err = io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+		// Skip CRLF after the chunk.
+		br.ReadString('\n')
+	}
+}
+
+// IDs the fake assigns to all requests.
+const (
+	testRequestID = "4442587FB7D0A2F9"
+	testHostID    = "fake-host-id"
+)
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, "<Error><Code>"+code+"</Code><Message>"+code+"</Message></Error>")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("X-Amz-Request-Id", testRequestID)
+	w.Header().Set("X-Amz-Id-2", testHostID)
+	f.userAgents = append(f.userAgents, r.Header.Get("User-Agent"))
+	if f.clockSkew != 0 {
+		w.Header().Set("Date", time.Now().Add(f.clockSkew).UTC().Format(http.TimeFormat))
+	}
+
+	if strings.Contains(r.Header.Get("Authorization"), "Credential=invalid/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testBucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	if key != "" && r.Header.Get("X-Amz-Request-Payer") == "" {
+		f.unpaid++
+	}
+	if key != "" && f.slowDown {
+		writeError(w, http.StatusServiceUnavailable, "SlowDown")
+		return
+	}
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			f.record("HeadBucket")
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			f.record("ListObjectsV2")
+			var keys []string
+			for key := range f.objects {
+				if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("continuation-token") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			maxKeys, _ := strconv.Atoi(query.Get("max-keys"))
+			if maxKeys <= 0 {
+				maxKeys = 1000
+			}
+			truncated := len(keys) > maxKeys
+			if truncated {
+				keys = keys[:maxKeys]
+			}
+			var buf strings.Builder
+			buf.WriteString("<ListBucketResult><Name>" + bucket + "</Name><KeyCount>" + strconv.Itoa(len(keys)) +
+				"</KeyCount><IsTruncated>" + strconv.FormatBool(truncated) + "</IsTruncated>")
+			if truncated {
+				buf.WriteString("<NextContinuationToken>" + keys[len(keys)-1] + "</NextContinuationToken>")
+			}
+			for _, key := range keys {
+				buf.WriteString("<Contents><Key>" + key + "</Key><Size>" + strconv.Itoa(len(f.objects[key].data)) +
+					"</Size></Contents>")
+			}
+			buf.WriteString("</ListBucketResult>")
+			io.WriteString(w, buf.String())
+		case r.Method == http.MethodGet && query.Has("object-lock"):
+			f.record("GetObjectLockConfiguration")
+			io.WriteString(w, "<ObjectLockConfiguration><ObjectLockEnabled>Enabled</ObjectLockEnabled></ObjectLockConfiguration>")
+		case r.Method == http.MethodPost && query.Has("delete"):
+			f.record("DeleteObjects")
+			body, _ := readBody(r)
+			var req struct {
+				Objects []struct {
+					Key string `xml:"Key"`
+				} `xml:"Object"`
+			}
+			xml.Unmarshal(body, &req)
+			for _, obj := range req.Objects {
+				if strings.HasPrefix(obj.Key, "broken") {
+					// Simulate a failure of the whole request.
+					writeError(w, http.StatusForbidden, "AccessDenied")
+					return
+				}
+			}
+			var result strings.Builder
+			for _, obj := range req.Objects {
+				if strings.HasPrefix(obj.Key, "locked") {
+					// Simulate a per-object failure.
+					result.WriteString("<Error><Key>" + obj.Key + "</Key><Code>AccessDenied</Code></Error>")
+					continue
+				}
+				delete(f.objects, obj.Key)
+			}
+			io.WriteString(w, "<DeleteResult>"+result.String()+"</DeleteResult>")
+		default:
+			writeError(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.record("CreateMultipartUpload")
+		if f.noMultipart {
+			writeError(w, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		io.WriteString(w, "<InitiateMultipartUploadResult><Bucket>"+bucket+"</Bucket><Key>"+key+
+			"</Key><UploadId>"+id+"</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		f.record("UploadPart")
+		parts := f.uploads[query.Get("uploadId")]
+		if parts == nil {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		num, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[num] = body
+		w.Header().Set("ETag", `"part`+strconv.Itoa(num)+`"`)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.record("CompleteMultipartUpload")
+		parts := f.uploads[query.Get("uploadId")]
+		delete(f.uploads, query.Get("uploadId"))
+		var nums []int
+		for n := range parts {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		var data []byte
+		for _, n := range nums {
+			data = append(data, parts[n]...)
+		}
+		f.objects[key] = &fakeObject{data: data, header: http.Header{"ETag": {`"mpu-etag"`}}}
+		io.WriteString(w, "<CompleteMultipartUploadResult><Bucket>"+bucket+"</Bucket><Key>"+key+
+			"</Key><ETag>&quot;mpu-etag&quot;</ETag></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.record("AbortMultipartUpload")
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.record("PutObject")
+		body, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		header := http.Header{"ETag": {`"put-etag"`}}
+		for name, val := range r.Header {
+			if strings.HasPrefix(name, "Content-Type") || strings.HasPrefix(name, "Cache-Control") ||
+				strings.HasPrefix(name, "Content-Language") ||
+				strings.HasPrefix(name, "X-Amz-Meta-") || strings.HasPrefix(name, "X-Amz-Object-Lock-") ||
+				name == "X-Amz-Tagging" {
+				header[name] = val
+			}
+		}
+		header.Set("X-Amz-Version-Id", "v1")
+		f.objects[key] = &fakeObject{data: body, header: header}
+		w.Header().Set("ETag", `"put-etag"`)
+		w.Header().Set("X-Amz-Version-Id", "v1")
+	case r.Method == http.MethodGet && query.Has("tagging"):
+		f.record("GetObjectTagging")
+		obj := f.objects[key]
+		if obj == nil {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		tags, _ := url.ParseQuery(obj.header.Get("X-Amz-Tagging"))
+		var result strings.Builder
+		for name := range tags {
+			result.WriteString("<Tag><Key>" + name + "</Key><Value>" + tags.Get(name) + "</Value></Tag>")
+		}
+		io.WriteString(w, "<Tagging><TagSet>"+result.String()+"</TagSet></Tagging>")
+	case r.Method == http.MethodHead, r.Method == http.MethodGet:
+		obj := f.objects[key]
+		if obj == nil {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				writeError(w, http.StatusNotFound, "NoSuchKey")
+			}
+			return
+		}
+		if r.Method == http.MethodHead {
+			f.record("HeadObject")
+		} else {
+			f.record("GetObject")
+			if f.failGets > 0 {
+				f.failGets--
+				writeError(w, http.StatusForbidden, "AccessDenied")
+				return
+			}
+		}
+		if match := r.Header.Get("If-Match"); match != "" && !slices.Contains(obj.header["ETag"], match) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		for name, val := range obj.header {
+			w.Header()[name] = val
+		}
+		// Overrides of response headers by presigned requests.
+		for param, name := range map[string]string{
+			"response-content-type":        "Content-Type",
+			"response-cache-control":       "Cache-Control",
+			"response-content-disposition": "Content-Disposition",
+		} {
+			if query.Has(param) {
+				w.Header().Set(name, query.Get(param))
+			}
+		}
+		data := obj.data
+		if rng := strings.TrimPrefix(r.Header.Get("Range"), "bytes="); rng != "" && r.Method == http.MethodGet {
+			from, to, _ := strings.Cut(rng, "-")
+			start, _ := strconv.Atoi(from)
+			end := len(data) - 1
+			if to != "" {
+				end, _ = strconv.Atoi(to)
+			}
+			if start >= len(data) {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(end)+"/"+strconv.Itoa(len(data)))
+			data = data[start : end+1]
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		f.record("DeleteObject")
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// newTestHandler creates a handler connected to a fake S3 server. Additional config
+// parameters are given as a JSON object fragment, like `"max_file_size": 10`.
+func newTestHandler(t testing.TB, extraConf string) (*awshandler, *fakeS3, *mock_store.MockFilePersistenceInterface) {
+	fake, srv := newFakeS3(t)
+
+	ctrl := gomock.NewController(t)
+	files := mock_store.NewMockFilePersistenceInterface(ctrl)
+	saved := store.Files
+	store.Files = files
+	t.Cleanup(func() { store.Files = saved })
+
+	conf := `{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "endpoint": "` + srv.URL + `", "force_path_style": true`
+	if extraConf != "" {
+		conf += ", " + extraConf
+	}
+	conf += "}"
+
+	ah := &awshandler{}
+	if err := ah.Init(conf); err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	return ah, fake, files
+}
+
+func newTestFileDef() *types.FileDef {
+	fdef := &types.FileDef{
+		ObjHeader: types.ObjHeader{Id: types.Uid(12345).String()},
+		MimeType:  "image/png",
+	}
+	fdef.InitTimes()
+	return fdef
+}
+
+// unsizedReader hides all methods of the underlying reader which could be used to find its size.
+type unsizedReader struct {
+	r io.Reader
+}
+
+func (ur *unsizedReader) Read(p []byte) (int, error) {
+	return ur.r.Read(p)
+}
+
+func TestUploadUnknownLength(t *testing.T) {
+	ah, fake, files := newTestHandler(t, "")
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	fdef := newTestFileDef()
+	url, size, err := ah.Upload(fdef, &unsizedReader{bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if size != int64(len(data)) {
+		t.Error("Wrong size", size, "expected", len(data))
+	}
+	if !strings.HasPrefix(url, defaultServeURL+fdef.Id) {
+		t.Error("Unexpected URL", url)
+	}
+	if !fake.hasOp("CreateMultipartUpload") || !fake.hasOp("CompleteMultipartUpload") {
+		t.Error("Stream of unknown length must be uploaded with multipart upload")
+	}
+	if obj := fake.object(fdef.Location); obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("Stored object does not match the upload")
+	}
+}
+
+func TestUploadKnownLength(t *testing.T) {
+	ah, fake, files := newTestHandler(t, "")
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+
+	data := []byte("small file")
+	fdef := newTestFileDef()
+	_, size, err := ah.Upload(fdef, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if size != int64(len(data)) {
+		t.Error("Wrong size", size, "expected", len(data))
+	}
+	if !fake.hasOp("PutObject") || fake.hasOp("CreateMultipartUpload") {
+		t.Error("Small stream of known length must be uploaded with a single PUT")
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"max_file_size": 100`)
+
+	data := bytes.Repeat([]byte("x"), 1000)
+
+	// Known size: rejected before the upload is started.
+	if _, _, err := ah.Upload(newTestFileDef(), bytes.NewReader(data)); !errors.Is(err, types.ErrTooLarge) {
+		t.Error("Expected ErrTooLarge for sized stream, got", err)
+	}
+
+	// Unknown size: rejected while streaming.
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	_, _, err := ah.Upload(newTestFileDef(), &unsizedReader{bytes.NewReader(data)})
+	if !errors.Is(err, types.ErrTooLarge) {
+		t.Error("Expected ErrTooLarge for unsized stream, got", err)
+	}
+	if fake.hasOp("CompleteMultipartUpload") {
+		t.Error("Upload exceeding the limit must not be completed")
+	}
+}
+
+// failingReader returns n bytes of data then fails.
+type failingReader struct {
+	n int
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := min(len(p), fr.n)
+	clear(p[:n])
+	fr.n -= n
+	return n, nil
+}
+
+func TestUploadSourceReadError(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"part_size": 5242880`)
+
+	// The source fails after the multipart upload is started.
+	fdef := newTestFileDef()
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	files.EXPECT().FinishUpload(fdef, false, int64(0)).Return(nil, nil)
+	_, _, err := ah.Upload(fdef, &failingReader{n: 6 << 20})
+	var readErr *media.SourceReadError
+	if !errors.As(err, &readErr) || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatal("Expected source read error, got", err)
+	}
+	if !fake.hasOp("AbortMultipartUpload") || fake.hasOp("CompleteMultipartUpload") {
+		t.Error("Expected multipart upload aborted")
+	}
+	if !fake.hasOp("DeleteObject") {
+		t.Error("Expected partial object deleted")
+	}
+	if fake.object(ah.uploadObjectKey(context.Background(), fdef.Uid())) != nil {
+		t.Error("Partial object stored")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"tenants": [{"name": "acme", "prefix": "acme/", "quota": 100, "topics": ["grpAcme*"]},
+		{"name": "beta", "prefix": "beta/", "topics": ["grpBeta*"]}]`)
+	upload := func(topic string, id types.Uid) (*types.FileDef, error) {
+		fdef := newTestFileDef()
+		fdef.Id = id.String()
+		ctx := media.NewContext(context.Background(), &media.RequestInfo{Topic: topic})
+		_, _, err := ah.UploadWithContext(ctx, fdef, strings.NewReader("tenant"))
+		return fdef, err
+	}
+
+	// Within the quota.
+	files.EXPECT().UsedBytesByPrefix("acme/").Return(int64(90), nil)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(4)
+	fdef, err := upload("grpAcme1", 1)
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if !strings.HasPrefix(fdef.Location, "acme/") || fake.object(fdef.Location) == nil {
+		t.Error("Object not stored under the prefix of the tenant:", fdef.Location)
+	}
+
+	// Over the quota.
+	files.EXPECT().UsedBytesByPrefix("acme/").Return(int64(98), nil)
+	_, err = upload("grpAcme1", 2)
+	var quotaErr *media.QuotaExceededError
+	if !errors.As(err, &quotaErr) || quotaErr.Tenant != "acme" || quotaErr.Quota != 100 || !errors.Is(err, types.ErrPolicy) {
+		t.Error("Expected quota of acme exceeded, got", err)
+	}
+
+	// No quota, and no tenant.
+	if fdef, err = upload("grpBeta1", 3); err != nil || !strings.HasPrefix(fdef.Location, "beta/") {
+		t.Error("Upload of beta failed:", fdef.Location, err)
+	}
+	if fdef, err = upload("grpOther", 4); err != nil || strings.Contains(fdef.Location, "/") {
+		t.Error("Upload of no tenant failed:", fdef.Location, err)
+	}
+
+	// The tenant is never taken from the request.
+	fdef = newTestFileDef()
+	fdef.Id = types.Uid(5).String()
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{Topic: "grpOther",
+		Header: http.Header{"X-Tenant": {"acme"}}})
+	if _, _, err = ah.UploadWithContext(ctx, fdef, strings.NewReader("tenant")); err != nil ||
+		strings.HasPrefix(fdef.Location, "acme/") {
+		t.Error("Upload stored under the tenant of the header:", fdef.Location, err)
+	}
+
+	for _, tenants := range []string{
+		`[{"name": "a", "prefix": "a/"}, {"name": "b", "prefix": "a/b/"}]`,
+		`[{"name": "a", "prefix": "a/"}, {"name": "a", "prefix": "b/"}]`,
+		`[{"name": "a", "prefix": "variants/"}]`,
+		`[{"name": "a", "prefix": "a"}]`,
+		`[{"name": "a", "prefix": "a/", "quota": -1}]`,
+	} {
+		if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + testBucket + `", "tenants": ` + tenants + `}`); err == nil {
+			t.Error("Invalid tenants accepted:", tenants)
+		}
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"throttle_retry_after": 2, "throttle_max_retry_after": 5`)
+	fake.mu.Lock()
+	fake.slowDown = true
+	fake.mu.Unlock()
+
+	throttled := throttledRequests.Value()
+	fdef := newTestFileDef()
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	files.EXPECT().FinishUpload(fdef, false, int64(0)).Return(nil, nil).AnyTimes()
+	_, _, err := ah.Upload(fdef, strings.NewReader("slow down"))
+	var throttledErr *media.ThrottledError
+	if !errors.As(err, &throttledErr) || !errors.Is(err, types.ErrUnavailable) {
+		t.Fatal("Expected throttled error, got", err)
+	}
+	if got := throttledErr.RetryAfterSeconds(); got != "2" {
+		t.Error("Expected Retry-After 2, got", got)
+	}
+	if throttledRequests.Value() != throttled+1 {
+		t.Error("Throttled upload not counted")
+	}
+
+	// The delay doubles while throttling continues, up to the limit, and starts over once it stops.
+	ah.throttle.raised = time.Now().Add(-time.Minute)
+	if got := ah.throttle.next(2*time.Second, 5*time.Second); got != 4*time.Second {
+		t.Error("Expected doubled delay, got", got)
+	}
+	if got := ah.throttle.next(2*time.Second, 5*time.Second); got != 4*time.Second {
+		t.Error("Delay doubled more than once per period:", got)
+	}
+	ah.throttle.raised = time.Now().Add(-time.Minute)
+	if got := ah.throttle.next(2*time.Second, 5*time.Second); got != 5*time.Second {
+		t.Error("Expected delay limited to 5s, got", got)
+	}
+	ah.throttle.last = time.Now().Add(-time.Minute)
+	if got := ah.throttle.next(2*time.Second, 5*time.Second); got != 2*time.Second {
+		t.Error("Expected delay reset, got", got)
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "throttle_retry_after": 10, "throttle_max_retry_after": 5}`); err == nil {
+		t.Error("Maximum Retry-After less than the initial one accepted")
+	}
+}
+
+func TestTypeSizeLimits(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"max_file_size": 1000,
+		"max_file_size_by_type": {"image/*": 100, "image/svg+xml": 5000, "text/*": 0}`)
+
+	large := bytes.Repeat([]byte("x"), 2000)
+	img := append([]byte("\x89PNG\r\n\x1a\n"), large...)
+
+	for _, tc := range []struct {
+		mimeType string
+		data     []byte
+		limit    int64
+	}{
+		// Sniffed PNG claimed to be a video.
+		{"video/mp4", img, 100},
+		// Unrecognized content, the claimed type is used.
+		{"image/svg+xml", append([]byte{0}, large...), 0},
+		{"application/octet-stream", append([]byte{0}, large...), 1000},
+	} {
+		fdef := newTestFileDef()
+		fdef.MimeType = tc.mimeType
+		files.EXPECT().StartUpload(gomock.Any()).Return(nil).MaxTimes(1)
+		_, _, err := ah.Upload(fdef, &unsizedReader{bytes.NewReader(tc.data)})
+		var limitErr *media.SizeLimitError
+		if tc.limit == 0 {
+			if err != nil {
+				t.Error("Upload of", tc.mimeType, "failed", err)
+			}
+		} else if !errors.As(err, &limitErr) || limitErr.Limit != tc.limit || !errors.Is(err, types.ErrTooLarge) {
+			t.Error("Expected size limit", tc.limit, "for", tc.mimeType, "got", err)
+		}
+	}
+
+	// Text is unlimited. Sized streams of other types are rejected by the default limit before the upload is started.
+	fdef := newTestFileDef()
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	if _, _, err := ah.Upload(fdef, strings.NewReader(string(large))); err != nil {
+		t.Error("Upload of unlimited type failed", err)
+	}
+	fake.mu.Lock()
+	ops := len(fake.ops)
+	fake.mu.Unlock()
+	fdef = newTestFileDef()
+	fdef.MimeType = "application/octet-stream"
+	var limitErr *media.SizeLimitError
+	if _, _, err := ah.Upload(fdef, bytes.NewReader(append([]byte{0}, large...))); !errors.As(err, &limitErr) ||
+		limitErr.Limit != 1000 {
+		t.Error("Expected default size limit, got", err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.ops) != ops {
+		t.Error("Upload exceeding the limit must not be started")
+	}
+
+	for _, conf := range []string{`{"image[": 100}`, `{"image": 100}`, `{"image/*": -1}`} {
+		err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + testBucket + `", "max_file_size_by_type": ` + conf + `}`)
+		if err == nil || !strings.Contains(err.Error(), "max_file_size_by_type") {
+			t.Error("Expected invalid max_file_size_by_type", conf, "got", err)
+		}
+	}
+}
+
+func TestEnforceDeclaredSize(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"enforce_declared_size": true, "declared_size_tolerance": 10`)
+
+	data := bytes.Repeat([]byte("x"), 1000)
+	declared := func(size int64) *types.FileDef {
+		fdef := newTestFileDef()
+		fdef.Size = size
+		return fdef
+	}
+
+	// Known size: rejected before the upload is started.
+	if _, _, err := ah.Upload(declared(500), bytes.NewReader(data)); err != types.ErrMalformed {
+		t.Error("Expected ErrMalformed for sized stream, got", err)
+	}
+
+	// Unknown size: inflated and truncated streams are rejected while streaming.
+	for _, size := range []int64{500, 2000} {
+		files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+		if _, _, err := ah.Upload(declared(size), &unsizedReader{bytes.NewReader(data)}); err != types.ErrMalformed {
+			t.Error("Expected ErrMalformed for unsized stream declared of size", size, "got", err)
+		}
+	}
+	if fake.hasOp("CompleteMultipartUpload") {
+		t.Error("Upload of mismatched size must not be completed")
+	}
+
+	// Within the tolerance or not declared.
+	for _, size := range []int64{995, 1010, 0} {
+		files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+		if _, n, err := ah.Upload(declared(size), &unsizedReader{bytes.NewReader(data)}); err != nil || n != 1000 {
+			t.Error("Upload declared of size", size, "failed", n, err)
+		}
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "declared_size_tolerance": -1}`); err == nil ||
+		!strings.Contains(err.Error(), "declared_size_tolerance") {
+		t.Error("Expected invalid declared_size_tolerance, got", err)
+	}
+}
+
+func TestDownloadProxy(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"proxy": "request"`)
+
+	data := []byte("0123456789abcdef")
+	fdef := newTestFileDef()
+	fdef.Location = fdef.Uid().String32()
+	fdef.Size = int64(len(data))
+	fdef.ETag = "put-etag"
+	fdef.Status = types.UploadCompleted
+	fake.objects[fdef.Location] = &fakeObject{data: data, header: http.Header{"ETag": {`"put-etag"`}}}
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	serveURL := defaultServeURL + fdef.Id + ".png"
+
+	// Redirect by default.
+	u, _ := url.Parse(serveURL)
+	_, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil || status != http.StatusPermanentRedirect {
+		t.Fatal("Expected redirect, got", status, err)
+	}
+
+	// Proxy on request.
+	u, _ = url.Parse(serveURL + "?proxy=1")
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil || status != 0 {
+		t.Fatal("Expected proxied download, got", status, err)
+	}
+	if etag := hdr["ETag"]; len(etag) != 1 || etag[0] != `"put-etag"` {
+		t.Error("Missing ETag", hdr)
+	}
+
+	_, rsc, err := ah.Download(u.String())
+	if err != nil {
+		t.Fatal("Download failed:", err)
+	}
+	defer rsc.Close()
+
+	if _, err = rsc.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(rsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tail) != "abcdef" {
+		t.Error("Unexpected content after seek", string(tail))
+	}
+}
+
+func TestResumeProxyDownload(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"proxy": "always"`)
+
+	data := []byte("0123456789abcdef")
+	fdef := newTestFileDef()
+	fdef.Location = fdef.Uid().String32()
+	fdef.Size = int64(len(data))
+	fdef.ETag = "put-etag"
+	fdef.Status = types.UploadCompleted
+	fake.objects[fdef.Location] = &fakeObject{data: data, header: http.Header{"ETag": {`"put-etag"`}}}
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+
+	// Serve the way the server does: handler headers, then the content.
+	serve := func(ifRange string) *httptest.ResponseRecorder {
+		hdr, _, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+		if err != nil {
+			t.Fatal("Headers failed:", err)
+		}
+		_, rsc, err := ah.Download(u.String())
+		if err != nil {
+			t.Fatal("Download failed:", err)
+		}
+		defer rsc.Close()
+		req := httptest.NewRequest(http.MethodGet, u.String(), nil)
+		req.Header.Set("Range", "bytes=10-")
+		req.Header.Set("If-Range", ifRange)
+		rec := httptest.NewRecorder()
+		for name, values := range hdr {
+			for _, value := range values {
+				rec.Header().Add(name, value)
+			}
+		}
+		http.ServeContent(rec, req, "", fdef.UpdatedAt, rsc)
+		return rec
+	}
+
+	if rec := serve(`"put-etag"`); rec.Code != http.StatusPartialContent || rec.Body.String() != "abcdef" {
+		t.Error("Expected the rest of the object", rec.Code, rec.Body.String())
+	}
+	if rec := serve(`"old-etag"`); rec.Code != http.StatusOK || rec.Body.String() != string(data) {
+		t.Error("Expected the full object", rec.Code, rec.Body.String())
+	}
+
+	// Replaced out of band: the range is not read from another object.
+	fake.mu.Lock()
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("FEDCBA9876543210"), header: http.Header{"ETag": {`"new-etag"`}}}
+	fake.mu.Unlock()
+	_, rsc, err := ah.Download(u.String())
+	if err != nil {
+		t.Fatal("Download failed:", err)
+	}
+	defer rsc.Close()
+	rsc.Seek(10, io.SeekStart)
+	if _, err = io.ReadAll(rsc); !isAPIError(err, "PreconditionFailed") {
+		t.Error("Expected PreconditionFailed, got", err)
+	}
+}
+
+func TestHotCache(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"hot_cache": {"max_size": 32, "max_object_size": 16}`)
+
+	data := []byte("0123456789abcdef")
+	fdef := newTestFileDef()
+	fdef.Location = fdef.Uid().String32()
+	fdef.Size = int64(len(data))
+	fdef.ETag = "put-etag"
+	fdef.Status = types.UploadCompleted
+	fake.objects[fdef.Location] = &fakeObject{data: data, header: http.Header{"ETag": {`"put-etag"`}}}
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	large := &types.FileDef{ObjHeader: types.ObjHeader{Id: types.Uid(34567).String()}, MimeType: "image/png"}
+	large.InitTimes()
+	large.Location = large.Uid().String32()
+	large.Size = 17
+	large.Status = types.UploadCompleted
+	files.EXPECT().Get(large.Id).Return(large, nil).AnyTimes()
+
+	gets := func() int {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		n := 0
+		for _, op := range fake.ops {
+			if op == "GetObject" {
+				n++
+			}
+		}
+		return n
+	}
+	download := func() string {
+		_, rsc, err := ah.Download(defaultServeURL + fdef.Id + ".png")
+		if err != nil {
+			t.Fatal("Download failed:", err)
+		}
+		defer rsc.Close()
+		content, err := io.ReadAll(rsc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	// Small objects are served by the server.
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil || status != 0 {
+		t.Fatal("Expected download from the cache, got", status, err)
+	}
+	if etag := hdr["ETag"]; len(etag) != 1 || etag[0] != `"put-etag"` {
+		t.Error("Missing ETag", hdr)
+	}
+	if got := download(); got != string(data) {
+		t.Error("Unexpected content", got)
+	}
+	if got := download(); got != string(data) || gets() != 1 {
+		t.Error("Expected the object to be read once, got", gets(), got)
+	}
+
+	// Large objects and attachments are redirected to.
+	u, _ = url.Parse(defaultServeURL + large.Id + ".png")
+	if _, status, err = ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusPermanentRedirect {
+		t.Error("Expected redirect of a large object, got", status, err)
+	}
+	u, _ = url.Parse(defaultServeURL + fdef.Id + ".png?filename=a.png")
+	if _, status, err = ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusPermanentRedirect {
+		t.Error("Expected redirect of an attachment, got", status, err)
+	}
+
+	// Deleted objects are dropped.
+	if err = ah.Delete([]string{fdef.Location}); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+	if _, ok := ah.hotCache.get(fdef.Location, ah.objectETag(fdef)); ok {
+		t.Error("Deleted object is still cached")
+	}
+
+	// Least recently used objects are evicted.
+	hc := ah.hotCache
+	hc.set("a", "", data)
+	hc.set("b", "", data)
+	hc.get("a", "")
+	hc.set("c", "", data)
+	if _, ok := hc.get("b", ""); ok || hc.size != 32 {
+		t.Error("Expected eviction of the least recently used object", hc.size)
+	}
+	if _, ok := hc.get("a", "other-etag"); ok {
+		t.Error("Replaced object served from the cache")
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "hot_cache": {"max_size": 16, "max_object_size": 32}}`); err == nil {
+		t.Error("Expected error for max_object_size over max_size")
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	// The local clock is an hour ahead of S3.
+	fake.clockSkew = -time.Hour
+
+	ctrl := gomock.NewController(t)
+	files := mock_store.NewMockFilePersistenceInterface(ctrl)
+	saved := store.Files
+	store.Files = files
+	t.Cleanup(func() { store.Files = saved })
+
+	conf := `{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "endpoint": "` + srv.URL + `", "force_path_style": true`
+	ah := &awshandler{}
+	if err := ah.Init(conf + `, "correct_clock_skew": true}`); err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	if skew := time.Duration(ah.clockSkew.Load()); skew != -time.Hour {
+		t.Fatal("Wrong clock skew", skew)
+	}
+
+	// Presigned with the time of S3.
+	signedAt := func(date string) time.Duration {
+		at, err := time.Parse("20060102T150405Z", date)
+		if err != nil {
+			t.Fatal("Invalid X-Amz-Date", date)
+		}
+		return time.Until(at)
+	}
+	fdef := newTestFileDef()
+	fdef.Location = fdef.Uid().String32()
+	fdef.Size = 10
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	hdr, _, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil {
+		t.Fatal("Headers failed:", err)
+	}
+	presigned, _ := url.Parse(hdr.Get("Location"))
+	if at := signedAt(presigned.Query().Get("X-Amz-Date")); at > -59*time.Minute || at < -61*time.Minute {
+		t.Error("Download URL must be signed with the time of S3", at)
+	}
+
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	policy, err := ah.FormUploadPolicy(context.Background(), newTestFileDef(), 0)
+	if err != nil {
+		t.Fatal("FormUploadPolicy failed:", err)
+	}
+	if at := signedAt(policy.Fields["X-Amz-Date"]); at > -59*time.Minute || at < -61*time.Minute {
+		t.Error("Form policy must be signed with the time of S3", at)
+	}
+
+	// Not corrected unless configured.
+	ah = &awshandler{}
+	if err := ah.Init(conf + "}"); err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	hdr, _, err = ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil {
+		t.Fatal("Headers failed:", err)
+	}
+	presigned, _ = url.Parse(hdr.Get("Location"))
+	if at := signedAt(presigned.Query().Get("X-Amz-Date")); at.Abs() > time.Minute {
+		t.Error("Download URL must be signed with the local time", at)
+	}
+
+	// Small skews are ignored.
+	fake.mu.Lock()
+	fake.clockSkew = time.Second
+	fake.mu.Unlock()
+	ah = &awshandler{}
+	if err := ah.Init(conf + `, "correct_clock_skew": true}`); err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	if skew := ah.clockSkew.Load(); skew != 0 {
+		t.Error("Expected no correction of a small skew", time.Duration(skew))
+	}
+}
+
+func TestPresignLimit(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"presign_concurrency": 1, "presign_wait": 20`)
+	fdef := newTestFileDef()
+	fdef.Location = fdef.Uid().String32()
+	fdef.Size = 10
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+
+	// Over the limit.
+	release, err := ah.presignLimit.acquire(context.Background())
+	if err != nil {
+		t.Fatal("acquire failed:", err)
+	}
+	rejected := presignRejected.Value()
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil || status != http.StatusServiceUnavailable || hdr.Get("Retry-After") != "1" {
+		t.Error("Expected 503 with Retry-After, got", status, hdr, err)
+	}
+	if presignRejected.Value() != rejected+1 {
+		t.Error("Rejection must be counted")
+	}
+	release()
+	if _, status, err = ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusPermanentRedirect {
+		t.Error("Expected redirect, got", status, err)
+	}
+
+	// Requests wait for a free slot.
+	pl, _ := newPresignLimiter(1, 5000)
+	release, _ = pl.acquire(context.Background())
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := pl.acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	for deadline := time.Now().Add(time.Second); presignQueue.Value() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("Waiting request not counted in the queue", presignQueue.Value())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	if err := <-acquired; err != nil {
+		t.Error("Queued request failed:", err)
+	}
+	if presignQueue.Value() != 0 {
+		t.Error("Queue not drained", presignQueue.Value())
+	}
+
+	if l, err := newPresignLimiter(0, 0); l != nil || err != nil {
+		t.Error("Expected no limit by default", l, err)
+	}
+	if _, err := newPresignLimiter(-1, 0); err == nil {
+		t.Error("Expected error for negative presign_concurrency")
+	}
+}
+
+func TestSinglePutFallback(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"single_put_max_size": 30000`)
+	fake.noMultipart = true
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+
+	// Stream of unknown length is retried with a single PUT once multipart upload is rejected.
+	data := bytes.Repeat([]byte("0123456789"), 2000)
+	fdef := newTestFileDef()
+	if _, size, err := ah.Upload(fdef, &unsizedReader{bytes.NewReader(data)}); err != nil || size != int64(len(data)) {
+		t.Fatal("Upload failed:", size, err)
+	}
+	if !fake.hasOp("CreateMultipartUpload") || !fake.hasOp("PutObject") {
+		t.Error("Upload must fall back to a single PUT")
+	}
+	if obj := fake.object(fdef.Location); obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("Object not stored correctly")
+	}
+
+	// Multipart upload is not tried again.
+	fake.mu.Lock()
+	fake.ops = nil
+	fake.mu.Unlock()
+	fdef = newTestFileDef()
+	fdef.Id = types.Uid(23456).String()
+	if _, _, err := ah.Upload(fdef, &unsizedReader{bytes.NewReader(data)}); err != nil {
+		t.Fatal("Second upload failed:", err)
+	}
+	if fake.hasOp("CreateMultipartUpload") || !fake.hasOp("PutObject") {
+		t.Error("Second upload must be sent with a single PUT only")
+	}
+	if obj := fake.object(fdef.Location); obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("Second object not stored correctly")
+	}
+
+	// Single PUT uploads are limited in size.
+	large := bytes.Repeat([]byte("x"), 40000)
+	if _, _, err := ah.Upload(newTestFileDef(), &unsizedReader{bytes.NewReader(large)}); !errors.Is(err, types.ErrTooLarge) {
+		t.Error("Expected ErrTooLarge, got", err)
+	}
+
+	// Multipart uploads are never tried when turned off.
+	ah, fake, files = newTestHandler(t, `"multipart": "off"`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	fdef = newTestFileDef()
+	if _, _, err := ah.Upload(fdef, &unsizedReader{bytes.NewReader(data)}); err != nil {
+		t.Fatal("Upload with multipart off failed:", err)
+	}
+	if fake.hasOp("CreateMultipartUpload") || !fake.hasOp("PutObject") {
+		t.Error("Upload with multipart off must be sent with a single PUT")
+	}
+	if obj := fake.object(fdef.Location); obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("Object with multipart off not stored correctly")
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "multipart": "never"}`); err == nil {
+		t.Error("Invalid multipart must be rejected")
+	}
+}
+
+func TestExposeRequestID(t *testing.T) {
+	for _, expose := range []bool{false, true} {
+		ah, _, _ := newTestHandler(t, `"expose_request_id": `+strconv.FormatBool(expose))
+		_, err := ah.svc.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String(testBucket),
+			Key:    aws.String("missing"),
+		})
+		if requestID, hostID := requestIDs(err); requestID != testRequestID || hostID != testHostID {
+			t.Error("Wrong request IDs", requestID, hostID)
+		}
+
+		// IDs are found in throttled errors too, which are still reported as throttled.
+		err = ah.requestFailed("download", &media.ThrottledError{RetryAfter: time.Second, Err: err})
+		var throttled *media.ThrottledError
+		if !errors.As(err, &throttled) {
+			t.Error("Throttled error lost:", err)
+		}
+		var reqErr *media.RequestError
+		if errors.As(err, &reqErr) != expose {
+			t.Error("Request ID exposed:", !expose, err)
+		} else if expose && reqErr.RequestID != testRequestID {
+			t.Error("Wrong exposed request ID", reqErr.RequestID)
+		}
+
+		resp := http.Header{}
+		ah.exposeRequestID(resp, err)
+		if got := resp.Get("X-Amz-Request-Id"); expose && got != testRequestID || !expose && got != "" {
+			t.Error("Wrong X-Amz-Request-Id header", got)
+		}
+	}
+
+	// Errors not of S3 requests carry no IDs.
+	if requestID, _ := requestIDs(errors.New("not a request")); requestID != "" {
+		t.Error("Unexpected request ID", requestID)
+	}
+}
+
+func TestMaxKeyLength(t *testing.T) {
+	// Keys of flat layout fit, keys with the topic only if the topic is short enough.
+	ah, fake, files := newTestHandler(t, `"key_layout": "by_topic", "max_key_length": 40`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	fdef := newTestFileDef()
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{Topic: "grpShort"})
+	if _, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload with short key failed:", err)
+	}
+
+	fdef = newTestFileDef()
+	fdef.Id = types.Uid(23456).String()
+	ctx = media.NewContext(context.Background(), &media.RequestInfo{Topic: strings.Repeat("t", 30)})
+	if _, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader([]byte("data"))); err == nil {
+		t.Error("Upload with too long key must fail")
+	}
+	if fake.mu.Lock(); len(fake.objects) != 1 {
+		t.Error("Object with too long key stored")
+	}
+	fake.mu.Unlock()
+
+	for _, extra := range []string{
+		`"max_key_length": -1`,
+		// Longer than the encoded ID.
+		`"max_key_length": 10`,
+		// Keys of variants are longer.
+		`"max_key_length": 20, "compress": ["gzip"]`,
+		`"max_key_length": 20, "tenants": [{"name": "a", "prefix": "tenant-a/", "topics": ["grp*"]}]`,
+	} {
+		if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + testBucket + `", ` + extra + `}`); err == nil {
+			t.Error("Too long keys accepted:", extra)
+		}
+	}
+}
+
+func TestRedirectCacheControl(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"presign_ttl": 600, "redirect_cache_ratio": 0.5`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+
+	// The redirect expires before the presigned URL.
+	u, _ := url.Parse(defaultServeURL + fdef.Id)
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil || status != http.StatusPermanentRedirect {
+		t.Fatal("Expected redirect, got", status, err)
+	}
+	if got := hdr.Get("Cache-Control"); got != ah.conf.CacheControl+", max-age=300" {
+		t.Error("Wrong Cache-Control of the redirect", got)
+	}
+
+	for _, tc := range []struct {
+		cacheControl string
+		expected     string
+	}{
+		{"public, max-age=31536000, immutable", "public, max-age=300"},
+		{"public, max-age=60", "public, max-age=60"},
+		{"private, s-maxage=86400, stale-while-revalidate=3600", "private, max-age=300"},
+		{"no-store", "no-store"},
+		{"", "max-age=300"},
+	} {
+		if got := ah.redirectCacheControl(tc.cacheControl, 10*time.Minute); got != tc.expected {
+			t.Errorf("'%s': expected '%s', got '%s'", tc.cacheControl, tc.expected, got)
+		}
+	}
+
+	// URLs from the URL cache may have been presigned up to its TTL ago.
+	ah, _, _ = newTestHandler(t, `"presign_ttl": 600, "redirect_cache_ratio": 0.5, "url_cache": {"name": "memory", "ttl": 240}`)
+	if got := ah.redirectCacheControl("public", 10*time.Minute); got != "public, max-age=180" {
+		t.Error("Lifetime of cached URLs not accounted for:", got)
+	}
+
+	for _, ratio := range []string{"-0.5", "1.5"} {
+		if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + testBucket + `", "redirect_cache_ratio": ` + ratio + `}`); err == nil {
+			t.Error("Invalid redirect_cache_ratio accepted:", ratio)
+		}
+	}
+}
+
+func TestKeepOriginals(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"normalize_orientation": true, "originals": {}`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+
+	// The rotated image is served, the original is kept as uploaded.
+	data := exifJPEG(t, 6)
+	fdef := newTestFileDef()
+	fdef.MimeType = "image/jpeg"
+	if _, err := ah.UploadEx(context.Background(), fdef, bytes.NewReader(data)); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if bytes.Equal(fake.object(fdef.Location).data, data) {
+		t.Error("Rotated image not stored")
+	}
+	if fdef.OriginalLocation != "originals/"+fdef.Location {
+		t.Fatal("Wrong location of the original", fdef.OriginalLocation)
+	}
+	if obj := fake.object(fdef.OriginalLocation); obj == nil || !bytes.Equal(obj.data, data) {
+		t.Error("Original not kept")
+	}
+
+	// Unprocessed uploads have no originals.
+	plain := newTestFileDef()
+	plain.Id = types.Uid(23456).String()
+	plain.MimeType = "image/jpeg"
+	if _, err := ah.UploadEx(context.Background(), plain, bytes.NewReader(exifJPEG(t, 1))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if plain.OriginalLocation != "" || fake.object("originals/"+plain.Location) != nil {
+		t.Error("Original of unprocessed upload kept")
+	}
+
+	// Originals are deleted with their files.
+	if err := ah.Delete([]string{fdef.Location}); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+	if fake.object(fdef.Location) != nil || fake.object(fdef.OriginalLocation) != nil {
+		t.Error("Original not deleted with the file")
+	}
+
+	for _, prefix := range []string{"/originals/", "originals", "variants/originals/"} {
+		if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + testBucket + `", "originals": {"prefix": "` + prefix + `"}}`); err == nil {
+			t.Error("Invalid originals prefix accepted:", prefix)
+		}
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	saved := media.ServerVersion
+	media.ServerVersion = "0.25.1"
+	t.Cleanup(func() { media.ServerVersion = saved })
+
+	ah, fake, files := newTestHandler(t, `"deployment_id": "prod-1"`)
+	fake.mu.Lock()
+	agent := fake.userAgents[0]
+	fake.mu.Unlock()
+	if !strings.Contains(agent, " tinode-chat/0.25.1") || !strings.Contains(agent, " deployment/prod-1") {
+		t.Error("Expected server version and deployment in User-Agent, got", agent)
+	}
+
+	// Presigned URLs don't sign the User-Agent, so they are valid for any client.
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	hdr, _, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil {
+		t.Fatal("Headers failed:", err)
+	}
+	presigned, err := url.Parse(hdr.Get("Location"))
+	if err != nil {
+		t.Fatal("Invalid presigned URL:", err)
+	}
+	query := presigned.Query()
+	if signed := query.Get("X-Amz-SignedHeaders"); signed != "host" {
+		t.Error("Expected only host signed, got", signed)
+	}
+
+	// Sign the request again with a different User-Agent: the signature must match.
+	signature := query.Get("X-Amz-Signature")
+	signingTime, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+	if err != nil {
+		t.Fatal("Invalid X-Amz-Date:", err)
+	}
+	for _, param := range []string{"X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-SignedHeaders",
+		"X-Amz-Signature"} {
+		query.Del(param)
+	}
+	unsigned := *presigned
+	unsigned.RawQuery = query.Encode()
+	req, _ := http.NewRequest(http.MethodGet, unsigned.String(), nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	resigned, _, err := v4.NewSigner(func(o *v4.SignerOptions) {
+		o.DisableURIPathEscaping = true
+	}).PresignHTTP(context.Background(), aws.Credentials{AccessKeyID: "key", SecretAccessKey: "secret"}, req,
+		"UNSIGNED-PAYLOAD", "s3", "us-east-1", signingTime)
+	if err != nil {
+		t.Fatal("PresignHTTP failed:", err)
+	}
+	if resignedURL, _ := url.Parse(resigned); resignedURL.Query().Get("X-Amz-Signature") != signature {
+		t.Error("Presigned URL does not verify", hdr.Get("Location"))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := &circuitBreaker{name: "test", threshold: 2, cooldown: 50 * time.Millisecond}
+	failure := errors.New("db down")
+	fail := func() error { return failure }
+	succeed := func() error { return nil }
+
+	// Not found is a valid response, not a failure.
+	for range 3 {
+		cb.call(func() error { return types.ErrNotFound })
+	}
+	if err := cb.call(succeed); err != nil {
+		t.Fatal("Breaker must stay closed on valid responses, got", err)
+	}
+
+	cb.call(fail)
+	if err := cb.call(fail); err != failure {
+		t.Fatal("Call must go through before reaching threshold, got", err)
+	}
+	if err := cb.call(succeed); err != types.ErrUnavailable {
+		t.Fatal("Open breaker must fast-fail, got", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	// Failed probe reopens the breaker.
+	if err := cb.call(fail); err != failure {
+		t.Fatal("Probe must go through after cooldown, got", err)
+	}
+	if err := cb.call(succeed); err != types.ErrUnavailable {
+		t.Fatal("Breaker must reopen after failed probe, got", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := cb.call(succeed); err != nil {
+		t.Fatal("Probe must go through after cooldown, got", err)
+	}
+	if err := cb.call(succeed); err != nil {
+		t.Fatal("Breaker must close after successful probe, got", err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	for name, codec := range keyCodecs {
+		for _, uid := range []types.Uid{1, 12345, 0x7fffffffffffffff} {
+			key := codec.encode(uid)
+			if key != strings.ToLower(key) {
+				t.Error(name, "key must be lowercase", key)
+			}
+			if codec.decode(key) != uid {
+				t.Error(name, "failed to decode key", key, "back to", uid)
+			}
+		}
+	}
+
+	ah, fake, files := newTestHandler(t, `"key_encoding": "hex"`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	fdef := newTestFileDef()
+	if _, _, err := ah.Upload(fdef, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if fdef.Location != "3930000000000000" || fake.object(fdef.Location) == nil {
+		t.Error("Object must be stored under hex key, got", fdef.Location)
+	}
+}
+
+func TestHMACKeyEncoding(t *testing.T) {
+	salted := hmacKeyCodec("deployment-one-salt")
+	key := salted.encode(12345)
+	if len(key) != 32 || key != strings.ToLower(key) || key != salted.encode(12345) {
+		t.Error("Wrong key", key)
+	}
+	if key == salted.encode(12346) || key == hmacKeyCodec("deployment-two-salt").encode(12345) {
+		t.Error("Keys must differ by ID and salt")
+	}
+
+	// IDs are partly time-ordered, the keys of sequential IDs must not be.
+	unordered := 0
+	for uid := types.Uid(0x0123456789abcdef); uid < 0x0123456789abcdef+32; uid++ {
+		prev, next := salted.encode(uid), salted.encode(uid+1)
+		if prev > next {
+			unordered++
+		}
+		if prev[:4] == next[:4] {
+			t.Error("Keys of sequential IDs share a prefix", prev, next)
+		}
+	}
+	if unordered == 0 || unordered == 32 {
+		t.Error("Keys of sequential IDs must not be ordered", unordered)
+	}
+
+	ah, fake, files := newTestHandler(t, `"key_encoding": "hmac", "key_salt": "deployment-one-salt"`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	fdef := newTestFileDef()
+	if _, _, err := ah.Upload(fdef, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if fdef.Location != key || fake.object(fdef.Location) == nil {
+		t.Error("Object must be stored under the salted key, got", fdef.Location)
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "key_encoding": "hmac", "key_salt": "short"}`); err == nil ||
+		!strings.Contains(err.Error(), "key_salt") {
+		t.Error("Short salt accepted", err)
+	}
+}
+
+func TestUploadWebhook(t *testing.T) {
+	const secret = "hook-secret"
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer hook.Close()
+
+	ah, _, files := newTestHandler(t, `"upload_webhook_url":"`+hook.URL+`","upload_webhook_secret":"`+secret+`"`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+
+	fdef := newTestFileDef()
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{Topic: "grpAbc"})
+	if _, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+
+	var req *http.Request
+	var body []byte
+	select {
+	case req = <-received:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not called")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if sig := req.Header.Get(webhookSignatureHeader); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Error("Invalid signature", sig)
+	}
+	var event uploadEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal("Invalid payload:", err)
+	}
+	if event.Id != fdef.Id || event.Topic != "grpAbc" || event.Size != 4 || event.Location != fdef.Location {
+		t.Errorf("Wrong payload %+v", event)
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("  file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ah, _, _ := newTestHandler(t, `"secret_access_key_file": "`+path+`"`)
+	if ah.conf.SecretAccessKey != "file-secret" {
+		t.Errorf("Secret not read from file: '%s'", ah.conf.SecretAccessKey)
+	}
+
+	ah = &awshandler{}
+	err := ah.Init(`{"access_key_id": "key", "secret_access_key_file": "` + path + `.missing",
+		"region": "us-east-1", "bucket": "` + testBucket + `"}`)
+	if err == nil {
+		t.Error("Missing secret file must fail Init")
+	}
+}
+
+func TestBucketCORSRules(t *testing.T) {
+	ah := &awshandler{}
+	rules, err := ah.bucketCORSRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || len(rules[0].AllowedMethods) != 2 || rules[0].AllowedOrigins[0] != "*" {
+		t.Errorf("Wrong default rule %+v", rules)
+	}
+
+	ah.conf.CorsOrigins = []string{"https://example.com"}
+	ah.conf.CorsRules = []corsRule{
+		{Methods: []string{"get", "HEAD"}},
+		{Methods: []string{"PUT", "POST"}, Origins: []string{"https://up.example.com"},
+			Headers: []string{"Content-Type"}, ExposeHeaders: []string{"ETag"}, MaxAge: 600},
+	}
+	if rules, err = ah.bucketCORSRules(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatal("Expected 2 rules, got", len(rules))
+	}
+	if rules[0].AllowedMethods[0] != http.MethodGet || rules[0].AllowedOrigins[0] != "https://example.com" {
+		t.Errorf("Wrong first rule %+v", rules[0])
+	}
+	if rules[1].AllowedOrigins[0] != "https://up.example.com" || rules[1].ExposeHeaders[0] != "ETag" ||
+		rules[1].MaxAgeSeconds == nil || *rules[1].MaxAgeSeconds != 600 {
+		t.Errorf("Wrong second rule %+v", rules[1])
+	}
+
+	ah.conf.CorsRules = []corsRule{{Methods: []string{"PATCH"}}}
+	if _, err = ah.bucketCORSRules(); err == nil {
+		t.Error("Unsupported method must be rejected")
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	ah, fake, files := newTestHandler(t, "")
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(2)
+
+	fdef := newTestFileDef()
+	if _, _, err := ah.Upload(fdef, bytes.NewReader([]byte("\x89PNG\r\n\x1a\n"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if ct := fake.object(fdef.Location).header.Get("Content-Type"); ct != "image/png" {
+		t.Error("Wrong stored content type", ct)
+	}
+
+	// Invalid MIME type is replaced by the detected one.
+	data := []byte("<html><body>hello</body></html>")
+	fdef = newTestFileDef()
+	fdef.Id = types.Uid(12346).String()
+	fdef.MimeType = "not a mime type"
+	_, size, err := ah.Upload(fdef, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if size != int64(len(data)) {
+		t.Error("Sniffing lost data, size", size)
+	}
+	if fdef.MimeType != "text/html; charset=utf-8" {
+		t.Error("Wrong detected content type", fdef.MimeType)
+	}
+	if ct := fake.object(fdef.Location).header.Get("Content-Type"); ct != fdef.MimeType {
+		t.Error("Wrong stored content type", ct)
+	}
+}
+
+func TestCredentialsRotation(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	os.WriteFile(keyFile, []byte("key-1\n"), 0600)
+
+	fc := &fileCredentials{keyIdFile: keyFile, secret: "secret", refresh: time.Minute}
+	creds, err := fc.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "key-1" || !creds.CanExpire || creds.Expires.Before(time.Now()) {
+		t.Errorf("Wrong credentials %+v", creds)
+	}
+
+	os.WriteFile(keyFile, []byte("key-2\n"), 0600)
+	if creds, err = fc.Retrieve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "key-2" || fc.generation != 1 {
+		t.Errorf("Rotation not detected: %s, generation %d", creds.AccessKeyID, fc.generation)
+	}
+
+	os.Remove(keyFile)
+	if _, err = fc.Retrieve(context.Background()); err == nil {
+		t.Error("Missing credentials file must fail")
+	}
+}
+
+func TestPresignCredentials(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"presign_access_key_id": "presign-key", "presign_secret_access_key": "presign-secret",
+		"read_replicas": [{"region": "eu-west-1", "bucket": "replica"}]`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+
+	// Downloads from the primary and the replicas are signed with the presign credentials.
+	for _, region := range []string{"", "eu-west-1"} {
+		hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{defaultRegionHintHeader: {region}}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		loc, _ := url.Parse(hdr["Location"][0])
+		if cred := loc.Query().Get("X-Amz-Credential"); !strings.HasPrefix(cred, "presign-key/") {
+			t.Errorf("'%s': download signed with wrong credentials %s", region, cred)
+		}
+	}
+
+	// Uploads use the main credentials.
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	policy, err := ah.FormUploadPolicy(context.Background(), newTestFileDef(), 0)
+	if err != nil || !strings.HasPrefix(policy.Fields["X-Amz-Credential"], "key/") {
+		t.Error("Upload signed with wrong credentials", policy, err)
+	}
+
+	for _, conf := range []string{
+		`"presign_access_key_id": "presign-key"`,
+		`"presign_access_key_id": "invalid", "presign_secret_access_key": "presign-secret"`,
+	} {
+		_, srv := newFakeS3(t)
+		bad := &awshandler{}
+		if err := bad.Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + testBucket + `", "endpoint": "` + srv.URL + `", "force_path_style": true, ` + conf + `}`); err == nil {
+			t.Error("Invalid presign credentials must be rejected:", conf)
+		}
+	}
+}
+
+func TestCompressedVariants(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"compress": ["br", "gzip"]`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+
+	data := bytes.Repeat([]byte("compress me please "), 200)
+	fdef := newTestFileDef()
+	fdef.MimeType = "text/plain; charset=utf-8"
+	if _, _, err := ah.Upload(fdef, bytes.NewReader(data)); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+
+	br := fake.object(ah.variantKey(fdef.Location, "br"))
+	if br == nil {
+		t.Fatal("Brotli variant not stored")
+	}
+	decoded, err := io.ReadAll(brotli.NewReader(bytes.NewReader(br.data)))
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Error("Brotli variant does not match the original", err)
+	}
+	if fake.object(ah.variantKey(fdef.Location, "gz")) == nil {
+		t.Error("Gzip variant not stored")
+	}
+
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".txt")
+	for _, tc := range []struct {
+		accept   string
+		key      string
+		encoding string
+	}{
+		{"gzip, deflate, br", ah.variantKey(fdef.Location, "br"), "br"},
+		{"gzip", ah.variantKey(fdef.Location, "gz"), "gzip"},
+		{"br;q=0, *", ah.variantKey(fdef.Location, "gz"), "gzip"},
+		{"", fdef.Location, ""},
+	} {
+		hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{"Accept-Encoding": {tc.accept}}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		loc, _ := url.Parse(hdr["Location"][0])
+		if !strings.HasSuffix(loc.Path, "/"+tc.key) || loc.Query().Get("response-content-encoding") != tc.encoding {
+			t.Errorf("Accept-Encoding '%s': wrong redirect %s", tc.accept, loc)
+		}
+	}
+
+	// Variants are deleted with the object.
+	if err := ah.Delete([]string{fdef.Location}); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+	for key := range fake.objects {
+		if strings.HasPrefix(key, ah.variantPrefix(fdef.Location)) || key == fdef.Location {
+			t.Error("Not deleted", key)
+		}
+	}
+
+	// Objects which are not worth compressing are stored as is.
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	fdef = newTestFileDef()
+	fdef.Id = types.Uid(12346).String()
+	if _, _, err := ah.Upload(fdef, bytes.NewReader(data)); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if fake.object(ah.variantKey(fdef.Location, "br")) != nil {
+		t.Error("Image must not be compressed")
+	}
+}
+
+// blockingReader blocks the first Read until released.
+type blockingReader struct {
+	r       io.Reader
+	release chan struct{}
+}
+
+func (br *blockingReader) Read(p []byte) (int, error) {
+	<-br.release
+	return br.r.Read(p)
+}
+
+func TestUploadDeduplication(t *testing.T) {
+	ah, fake, files := newTestHandler(t, "")
+	// Only the first upload creates a file record.
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(1)
+
+	data := []byte("uploaded twice")
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{
+		Header: http.Header{idempotencyKeyHeader: {"retry-1"}},
+	})
+
+	first := newTestFileDef()
+	release := make(chan struct{})
+	type result struct {
+		res *media.UploadResult
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		res, err := ah.UploadEx(ctx, first, &blockingReader{r: bytes.NewReader(data), release: release})
+		done <- result{res, err}
+	}()
+
+	// Wait for the first upload to register.
+	for range 100 {
+		ah.inflight.mu.Lock()
+		n := len(ah.inflight.calls)
+		ah.inflight.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second := newTestFileDef()
+	second.Id = types.Uid(12346).String()
+	go func() {
+		res, err := ah.UploadEx(ctx, second, bytes.NewReader(data))
+		done <- result{res, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	r1, r2 := <-done, <-done
+	if r1.err != nil || r2.err != nil {
+		t.Fatal("Upload failed:", r1.err, r2.err)
+	}
+	if r1.res.URL != r2.res.URL || second.Id != first.Id || second.Location != first.Location {
+		t.Error("Duplicate upload must reuse the first result", r1.res.URL, r2.res.URL, second.Id)
+	}
+	// Only the duplicate is marked, so its object is not deleted if its record fails to update.
+	if r1.res.Reused == r2.res.Reused {
+		t.Error("Expected only the duplicate result reused", r1.res.Reused, r2.res.Reused)
+	}
+	if len(fake.objects) != 1 {
+		t.Error("Expected one stored object, got", len(fake.objects))
+	}
+	if len(ah.inflight.calls) != 0 {
+		t.Error("In-flight upload not cleaned up")
+	}
+}
+
+func TestFormUploadPolicy(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"max_file_size": 1000`)
+
+	var started *types.FileDef
+	files.EXPECT().StartUpload(gomock.Any()).DoAndReturn(func(fd *types.FileDef) error {
+		copied := *fd
+		started = &copied
+		return nil
+	})
+
+	fdef := newTestFileDef()
+	policy, err := ah.FormUploadPolicy(context.Background(), fdef, 5000)
+	if err != nil {
+		t.Fatal("FormUploadPolicy failed:", err)
+	}
+	if started == nil || started.Location == "" || started.Location != policy.Fields["key"] {
+		t.Fatal("File record must be created with the object key")
+	}
+	if policy.Fields["Content-Type"] != "image/png" || policy.Fields["policy"] == "" ||
+		policy.Fields["X-Amz-Signature"] == "" {
+		t.Errorf("Missing form fields %v", policy.Fields)
+	}
+	if !strings.HasSuffix(policy.Ref, fdef.Id+".png") {
+		t.Error("Wrong file reference", policy.Ref)
+	}
+	doc, _ := base64.StdEncoding.DecodeString(policy.Fields["policy"])
+	if !strings.Contains(string(doc), `["content-length-range",1,1000]`) {
+		t.Error("Policy must limit the size to max_file_size", string(doc))
+	}
+
+	// Not uploaded yet.
+	files.EXPECT().Get(fdef.Id).Return(started, nil)
+	u, _ := url.Parse(policy.Ref)
+	if _, _, err = ah.Headers(http.MethodGet, u, http.Header{}, true); err != types.ErrNotFound {
+		t.Error("Expected ErrNotFound before the upload, got", err)
+	}
+
+	// Uploaded by the client: completed on access.
+	fake.objects[started.Location] = &fakeObject{data: []byte("png data"), header: http.Header{"ETag": {`"form-etag"`}}}
+	files.EXPECT().Get(fdef.Id).Return(started, nil)
+	files.EXPECT().FinishUpload(gomock.Any(), true, int64(8)).DoAndReturn(
+		func(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+			fd.Status = types.UploadCompleted
+			fd.Size = size
+			return fd, nil
+		})
+	if _, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusPermanentRedirect {
+		t.Error("Expected redirect after the upload, got", status, err)
+	}
+	if started.ETag != "form-etag" {
+		t.Error("ETag not taken from the object", started.ETag)
+	}
+}
+
+func TestScanBucket(t *testing.T) {
+	ah, fake, _ := newTestHandler(t, "")
+	// More than one page of the ListObjectsV2 response.
+	for i := range 1500 {
+		fake.objects["obj"+strconv.Itoa(i)] = &fakeObject{data: []byte("abc")}
+	}
+
+	objects, size, err := ah.scanBucket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects != 1500 || size != 4500 {
+		t.Error("Wrong bucket stats", objects, size)
+	}
+}
+
+func TestMimeDetection(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\nrest of the image"
+	for _, tc := range []struct {
+		mode     string
+		client   string
+		expected string
+	}{
+		{mimeClient, "text/plain", "text/plain"},
+		{mimeClient, "application/octet-stream", "application/octet-stream"},
+		{mimeClient, "", "image/png"},
+		{mimeSniff, "text/plain", "image/png"},
+		{mimeSniffFallback, "text/plain", "text/plain"},
+		{mimeSniffFallback, "application/octet-stream", "image/png"},
+		{mimeSniffFallback, "", "image/png"},
+	} {
+		mimeType, reader := objectContentType(tc.mode, tc.client, strings.NewReader(png))
+		if mimeType != tc.expected {
+			t.Errorf("%s '%s': expected '%s', got '%s'", tc.mode, tc.client, tc.expected, mimeType)
+		}
+		if data, _ := io.ReadAll(reader); string(data) != png {
+			t.Errorf("%s '%s': content changed by detection", tc.mode, tc.client)
+		}
+	}
+}
+
+func TestMimeCorrection(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\nrest of the image"
+	both := []string{mimeFromExtension, mimeFromContent}
+	for _, tc := range []struct {
+		sources  []string
+		client   string
+		filename string
+		content  string
+		expected string
+	}{
+		{nil, "application/octet-stream", "photo.png", png, "application/octet-stream"},
+		{both, "text/plain", "photo.png", png, "text/plain"},
+		{both, "application/octet-stream", "doc.PDF", png, "application/pdf"},
+		{both, "application/octet-stream", "photo", png, "image/png"},
+		{both, "application/octet-stream", "data.unknown-ext", png, "image/png"},
+		{[]string{mimeFromContent, mimeFromExtension}, "application/octet-stream", "doc.pdf", png, "image/png"},
+		{[]string{mimeFromExtension}, "binary/octet-stream", "photo", png, "binary/octet-stream"},
+		{both, "application/octet-stream", "", "\x00\x01\x02", "application/octet-stream"},
+	} {
+		mimeType, reader := correctContentType(tc.sources, tc.client, tc.filename, strings.NewReader(tc.content))
+		if mimeType != tc.expected {
+			t.Errorf("%v '%s' '%s': expected '%s', got '%s'", tc.sources, tc.client, tc.filename, tc.expected, mimeType)
+		}
+		if data, _ := io.ReadAll(reader); string(data) != tc.content {
+			t.Errorf("%v '%s' '%s': content changed by correction", tc.sources, tc.client, tc.filename)
+		}
+	}
+
+	ah, fake, files := newTestHandler(t, `"mime_correction": ["extension", "sniff"]`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	fdef := newTestFileDef()
+	fdef.MimeType = "application/octet-stream"
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{Filename: "report.pdf"})
+	url, _, err := ah.UploadWithContext(ctx, fdef, strings.NewReader("%PDF-1.7"))
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if fdef.MimeType != "application/pdf" || !strings.HasSuffix(url, ".pdf") ||
+		fake.object(fdef.Location).header.Get("Content-Type") != "application/pdf" {
+		t.Error("Type not corrected", fdef.MimeType, url)
+	}
+
+	if err = (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "mime_correction": ["guess"]}`); err == nil || !strings.Contains(err.Error(), "mime_correction") {
+		t.Error("Invalid mime_correction accepted", err)
+	}
+}
+
+func TestDeleteWithProgress(t *testing.T) {
+	ah, fake, _ := newTestHandler(t, "")
+
+	var locations []string
+	for i := range 2500 {
+		key := "obj" + strconv.Itoa(i)
+		if i%1000 == 0 {
+			key = "locked" + strconv.Itoa(i)
+		}
+		fake.objects[key] = &fakeObject{data: []byte("x")}
+		locations = append(locations, key)
+	}
+
+	var calls [][2]int
+	err := ah.DeleteWithProgress(context.Background(), locations, func(deleted, failed int) {
+		calls = append(calls, [2]int{deleted, failed})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 3 || calls[2] != [2]int{2497, 3} {
+		t.Error("Wrong progress", calls)
+	}
+	if len(fake.objects) != 3 {
+		t.Error("Expected 3 objects to remain, got", len(fake.objects))
+	}
+
+	// Cancelled after the first batch.
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = nil
+	err = ah.DeleteWithProgress(ctx, locations, func(deleted, failed int) {
+		calls = append(calls, [2]int{deleted, failed})
+		cancel()
+	})
+	if err != context.Canceled || len(calls) != 1 {
+		t.Error("Expected cancellation after one batch", err, calls)
+	}
+}
+
+func TestDeleteBatchFailure(t *testing.T) {
+	ah, fake, _ := newTestHandler(t, `"delete_concurrency": 3`)
+
+	var locations []string
+	for i := range 3000 {
+		key := "obj" + strconv.Itoa(i)
+		if i == 0 {
+			// Fails the first batch.
+			key = "broken"
+		}
+		fake.objects[key] = &fakeObject{data: []byte("x")}
+		locations = append(locations, key)
+	}
+
+	// All batches are sent before any is answered.
+	fake.mu.Lock()
+	var calls [][2]int
+	done := make(chan error)
+	go func() {
+		done <- ah.DeleteWithProgress(context.Background(), locations, func(deleted, failed int) {
+			calls = append(calls, [2]int{deleted, failed})
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	fake.mu.Unlock()
+
+	if err := <-done; err == nil {
+		t.Error("Expected the error of the failed batch")
+	}
+	// The other batches are counted however they finish.
+	if len(fake.objects) != 1000 {
+		t.Error("Expected the objects of the failed batch to remain, got", len(fake.objects))
+	}
+	if len(calls) != 2 || calls[1] != [2]int{2000, 0} {
+		t.Error("Deleted batches not counted", calls)
+	}
+}
+
+func TestDeletePacing(t *testing.T) {
+	ah, fake, _ := newTestHandler(t, `"delete_rate": 100, "delete_concurrency": 2`)
+
+	var locations []string
+	for i := range 150 {
+		key := "obj" + strconv.Itoa(i)
+		fake.objects[key] = &fakeObject{data: []byte("x")}
+		locations = append(locations, key)
+	}
+
+	var calls int
+	start := time.Now()
+	err := ah.DeleteWithProgress(context.Background(), locations, func(deleted, failed int) {
+		calls++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Batches of 100 objects, the second one a second after the first.
+	if calls != 2 || len(fake.objects) != 0 {
+		t.Error("Expected 2 batches deleting all objects", calls, len(fake.objects))
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Error("Deleted too fast", elapsed)
+	}
+
+	// No more than 2 batches at a time.
+	pacer, _ := newDeletePacer(0, 2)
+	first, _ := pacer.acquire(context.Background(), 1)
+	pacer.acquire(context.Background(), 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = pacer.acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("Third batch started", err)
+	}
+	first()
+	if _, err = pacer.acquire(context.Background(), 1); err != nil {
+		t.Error("Released slot not reused", err)
+	}
+
+	if _, err = newDeletePacer(-1, 0); err == nil {
+		t.Error("Negative delete_rate accepted")
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	// No store calls are expected: the mock fails on any.
+	ah, _, _ := newTestHandler(t, `"cors_origins": ["https://example.com"]`)
+	u, _ := url.Parse(defaultServeURL + types.Uid(12345).String() + ".png")
+
+	hdr, status, err := ah.Headers(http.MethodOptions, u, http.Header{
+		"Origin":                         {"https://example.com"},
+		"Access-Control-Request-Method":  {"GET"},
+		"Access-Control-Request-Headers": {"Authorization, X-Tinode-Auth"},
+	}, true)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatal("Expected 204, got", status, err)
+	}
+	if got := hdr["Access-Control-Allow-Origin"]; len(got) != 1 || got[0] != "https://example.com" {
+		t.Error("Wrong allowed origin", got)
+	}
+	if got := hdr["Access-Control-Allow-Headers"]; len(got) != 1 || got[0] != "Authorization, X-Tinode-Auth" {
+		t.Error("Requested headers must be echoed", got)
+	}
+	if hdr["Access-Control-Max-Age"] == nil || !strings.Contains(hdr["Access-Control-Allow-Methods"][0], "GET") {
+		t.Error("Missing preflight headers", hdr)
+	}
+
+	// Upload endpoint allows POST.
+	hdr, status, _ = ah.Headers(http.MethodOptions, u, http.Header{
+		"Origin":                        {"https://example.com"},
+		"Access-Control-Request-Method": {"POST"},
+	}, false)
+	if status != http.StatusNoContent || hdr["Access-Control-Allow-Origin"] == nil {
+		t.Error("POST preflight to the upload endpoint must be allowed", status, hdr)
+	}
+
+	// Disallowed origin.
+	hdr, status, err = ah.Headers(http.MethodOptions, u, http.Header{
+		"Origin":                        {"https://evil.com"},
+		"Access-Control-Request-Method": {"GET"},
+	}, true)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatal("Expected 204, got", status, err)
+	}
+	if hdr["Access-Control-Allow-Origin"] != nil || hdr["Access-Control-Allow-Methods"] != nil {
+		t.Error("Disallowed origin must not get CORS headers", hdr)
+	}
+
+	// Plain OPTIONS, not a preflight.
+	if _, status, err = ah.Headers(http.MethodOptions, u, http.Header{}, true); err != nil || status != http.StatusNoContent {
+		t.Error("Expected 204 for plain OPTIONS, got", status, err)
+	}
+}
+
+func TestPresignResponseHeaders(t *testing.T) {
+	ah, _, files := newTestHandler(t, "")
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	serveURL := defaultServeURL + fdef.Id + ".png"
+
+	// Attempts to inject S3 parameters are rejected.
+	for _, query := range []string{
+		"?response-content-type=text/html",
+		"?Response-Content-Disposition=inline",
+		"?asatt=1&response-cache-control=max-age%3D999999",
+		"?X-Amz-Expires=604800",
+		"?asatt=maybe",
+	} {
+		u, _ := url.Parse(serveURL + query)
+		if _, _, err := ah.Headers(http.MethodGet, u, http.Header{}, true); err != types.ErrMalformed {
+			t.Errorf("Query '%s' must be rejected, got %v", query, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query       string
+		disposition string
+	}{
+		{"", ""},
+		{"?asatt=1", "attachment"},
+		{"?asatt=download", "attachment"},
+		{"?asatt=inline", ""},
+		{"?asatt=no&filename=photo.png", `inline; filename=photo.png`},
+		{"?filename=photo.png", `inline; filename=photo.png`},
+		{"?asatt=true&filename=../../etc/passwd", `attachment; filename=....etcpasswd`},
+		{"?filename=" + url.QueryEscape("фото \"1\".png"),
+			`inline; filename="____ _1_.png"; filename*=UTF-8''%D1%84%D0%BE%D1%82%D0%BE%20%221%22.png`},
+		{"?asatt=1&filename=" + url.QueryEscape("a.txt\r\nSet-Cookie: x=1"), `attachment; filename="a.txtSet-Cookie: x=1"`},
+	} {
+		u, _ := url.Parse(serveURL + tc.query)
+		hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		loc, _ := url.Parse(hdr["Location"][0])
+		q := loc.Query()
+		if got := q.Get("response-content-disposition"); got != tc.disposition {
+			t.Errorf("Query '%s': expected disposition '%s', got '%s'", tc.query, tc.disposition, got)
+		}
+		if q.Get("response-content-type") != fdef.MimeType || q.Get("response-cache-control") != ah.conf.CacheControl {
+			t.Errorf("Query '%s': response headers must be set by the server: %v", tc.query, q)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{"photo.png", `attachment; filename=photo.png`},
+		{"", `attachment`},
+		{"\r\n", `attachment`},
+		{"party 🎉.png", `attachment; filename="party _.png"; filename*=UTF-8''party%20%F0%9F%8E%89.png`},
+		{"报告.pdf", `attachment; filename=__.pdf; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf`},
+		{`say "hi".txt`, `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"evil\r\nSet-Cookie: a=b.txt", `attachment; filename="evilSet-Cookie: a=b.txt"`},
+		{"invoice\u202egpj.exe", `attachment; filename=invoicegpj.exe`},
+		{"100%.txt", `attachment; filename=100_.txt; filename*=UTF-8''100%25.txt`},
+		{"..\\..\\boot.ini", `attachment; filename=....boot.ini`},
+	} {
+		if got := contentDisposition("attachment", tc.name); got != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestStartUploadRetry(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"store_retries": 2, "store_retry_backoff": 1`)
+
+	// Transient failure is retried.
+	gomock.InOrder(
+		files.EXPECT().StartUpload(gomock.Any()).Return(errors.New("connection reset")),
+		files.EXPECT().StartUpload(gomock.Any()).Return(nil),
+	)
+	if _, _, err := ah.Upload(newTestFileDef(), bytes.NewReader([]byte("data"))); err != nil {
+		t.Error("Transient failure must be retried:", err)
+	}
+
+	// Record created by a failed attempt.
+	gomock.InOrder(
+		files.EXPECT().StartUpload(gomock.Any()).Return(errors.New("timeout")),
+		files.EXPECT().StartUpload(gomock.Any()).Return(types.ErrDuplicate),
+	)
+	if _, _, err := ah.Upload(newTestFileDef(), bytes.NewReader([]byte("data"))); err != nil {
+		t.Error("Duplicate record must be treated as success:", err)
+	}
+
+	// Out of attempts.
+	files.EXPECT().StartUpload(gomock.Any()).Return(errors.New("db down")).Times(3)
+	if _, _, err := ah.Upload(newTestFileDef(), bytes.NewReader([]byte("data"))); err == nil {
+		t.Error("Expected failure after all retries")
+	}
+
+	// Permanent errors are not retried.
+	files.EXPECT().StartUpload(gomock.Any()).Return(types.ErrPermissionDenied).Times(1)
+	if _, _, err := ah.Upload(newTestFileDef(), bytes.NewReader([]byte("data"))); err != types.ErrPermissionDenied {
+		t.Error("Expected permission error, got", err)
+	}
+}
+
+func TestDuplicateUploadExisting(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"duplicate_upload": "existing"`)
+	existing := newTestFileDef()
+	existing.User = "usr1"
+	existing.Status = types.UploadCompleted
+	existing.Location = ah.objectKey(existing.Uid())
+	existing.ETag = "put-etag"
+	fake.mu.Lock()
+	fake.objects[existing.Location] = &fakeObject{data: []byte("stored"), header: http.Header{"ETag": {`"put-etag"`}}}
+	fake.mu.Unlock()
+	files.EXPECT().StartUpload(gomock.Any()).Return(types.ErrDuplicate).Times(3)
+	files.EXPECT().Get(existing.Id).Return(existing, nil).Times(4)
+
+	// The retry returns the stored object without uploading it again.
+	fdef := newTestFileDef()
+	fdef.User = "usr1"
+	uploadURL, size, err := ah.Upload(fdef, bytes.NewReader([]byte("retry")))
+	if err != nil || size != int64(len("stored")) || uploadURL != defaultServeURL+fdef.Id+".png" {
+		t.Fatal("Expected the stored object, got", uploadURL, size, err)
+	}
+	if fdef.Location != existing.Location || fdef.ETag != "put-etag" || fake.hasOp("PutObject") {
+		t.Error("Object uploaded again", fdef, fake.hasOp("PutObject"))
+	}
+
+	// Records of other users are neither reused nor overwritten.
+	fdef = newTestFileDef()
+	fdef.User = "usr2"
+	if _, _, err = ah.Upload(fdef, bytes.NewReader([]byte("other"))); !errors.Is(err, types.ErrPermissionDenied) {
+		t.Error("Expected upload of another user denied, got", err)
+	}
+	if obj := fake.object(existing.Location); obj == nil || string(obj.data) != "stored" {
+		t.Error("Object of another user overwritten")
+	}
+
+	// The object of the earlier attempt is missing, it's uploaded.
+	fake.mu.Lock()
+	delete(fake.objects, existing.Location)
+	fake.mu.Unlock()
+	fdef = newTestFileDef()
+	fdef.User = "usr1"
+	if _, size, err = ah.Upload(fdef, bytes.NewReader([]byte("again"))); err != nil || size != int64(len("again")) {
+		t.Error("Expected upload of the missing object, got", size, err)
+	}
+	if obj := fake.object(existing.Location); obj == nil || string(obj.data) != "again" {
+		t.Error("Missing object not uploaded")
+	}
+
+	// A form upload with an existing record gets the form again.
+	files.EXPECT().StartUpload(gomock.Any()).Return(types.ErrDuplicate)
+	fdef = newTestFileDef()
+	fdef.User = "usr1"
+	if _, err = ah.FormUploadPolicy(context.Background(), fdef, 1024); err != nil {
+		t.Error("Form upload of duplicate failed:", err)
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "duplicate_upload": "fail"}`); err == nil || !strings.Contains(err.Error(), "duplicate_upload") {
+		t.Error("Invalid duplicate_upload must be rejected, got", err)
+	}
+}
+
+func TestFailedRetryKeepsExisting(t *testing.T) {
+	for _, mode := range []string{duplicateUploadOverwrite, duplicateUploadExisting} {
+		ah, fake, files := newTestHandler(t, `"part_size": 5242880, "duplicate_upload": "`+mode+`"`)
+		fdef := newTestFileDef()
+		fdef.User = "usr1"
+		key := ah.uploadObjectKey(context.Background(), fdef.Uid())
+		fake.mu.Lock()
+		fake.objects[key] = &fakeObject{data: []byte("stored"), header: http.Header{"ETag": {`"put-etag"`}}}
+		fake.mu.Unlock()
+		// The earlier attempt stored the object but not its location, so it's uploaded again in either mode.
+		// No FinishUpload is expected: the record of the earlier upload must not be marked failed.
+		existing := *fdef
+		existing.Status = types.UploadStarted
+		files.EXPECT().StartUpload(gomock.Any()).Return(types.ErrDuplicate).Times(2)
+		files.EXPECT().Get(fdef.Id).Return(&existing, nil).AnyTimes()
+
+		saved := *fdef
+		_, _, err := ah.Upload(fdef, &failingReader{n: 6 << 20})
+		var existingErr *media.ExistingFileError
+		var readErr *media.SourceReadError
+		if !errors.As(err, &existingErr) || !errors.As(err, &readErr) {
+			t.Fatal(mode, "expected source read error of existing file, got", err)
+		}
+		if obj := fake.object(key); obj == nil || string(obj.data) != "stored" {
+			t.Error(mode, "object of the earlier upload not kept")
+		}
+		if fdef.Id != saved.Id || fdef.User != saved.User || fdef.Location != "" {
+			t.Error(mode, "file record changed by the failed retry", fdef)
+		}
+
+		// The record of another user is never overwritten.
+		existing.User = "usr2"
+		_, _, err = ah.Upload(&saved, bytes.NewReader([]byte("other")))
+		if !errors.As(err, &existingErr) || !errors.Is(err, types.ErrPermissionDenied) {
+			t.Error(mode, "expected upload over the record of another user denied, got", err)
+		}
+		if obj := fake.object(key); obj == nil || string(obj.data) != "stored" {
+			t.Error(mode, "object of another user overwritten")
+		}
+	}
+}
+
+func TestContentLanguage(t *testing.T) {
+	ah, fake, files := newTestHandler(t, "")
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+
+	fdef := newTestFileDef()
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{Language: "pt-br"})
+	if _, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if lang := fake.object(fdef.Location).header.Get("Content-Language"); lang != "pt-BR" {
+		t.Error("Wrong stored language", lang)
+	}
+
+	// Malformed tag is rejected before creating the file record.
+	ctx = media.NewContext(context.Background(), &media.RequestInfo{Language: "not a language!"})
+	if _, _, err := ah.UploadWithContext(ctx, newTestFileDef(), bytes.NewReader([]byte("data"))); err != types.ErrMalformed {
+		t.Error("Expected ErrMalformed, got", err)
+	}
+}
+
+func TestUploadBufferPool(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"upload_buffer_size": 1024`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(2)
+
+	// Small stream of unknown length: single PUT from the pooled buffer.
+	small := bytes.Repeat([]byte("a"), 100)
+	fdef := newTestFileDef()
+	if _, size, err := ah.Upload(fdef, &unsizedReader{bytes.NewReader(small)}); err != nil || size != int64(len(small)) {
+		t.Fatal("Small upload failed:", size, err)
+	}
+	if fake.hasOp("CreateMultipartUpload") || !fake.hasOp("PutObject") {
+		t.Error("Small upload must be sent with a single PUT")
+	}
+	if obj := fake.object(fdef.Location); obj == nil || !bytes.Equal(obj.data, small) {
+		t.Error("Small object not stored correctly")
+	}
+	if fdef.ETag == "" {
+		t.Error("ETag not set")
+	}
+
+	// Stream larger than the buffer: the buffered part must not be lost.
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	fdef = newTestFileDef()
+	fdef.Id = types.Uid(23456).String()
+	if _, size, err := ah.Upload(fdef, &unsizedReader{bytes.NewReader(large)}); err != nil || size != int64(len(large)) {
+		t.Fatal("Large upload failed:", size, err)
+	}
+	if !fake.hasOp("CreateMultipartUpload") {
+		t.Error("Large stream must be uploaded with multipart upload")
+	}
+	if obj := fake.object(fdef.Location); obj == nil || !bytes.Equal(obj.data, large) {
+		t.Error("Large object not stored correctly")
+	}
+}
+
+// Concurrent small uploads of unknown length, with and without pooled buffers.
+func BenchmarkSmallUploads(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		conf string
+	}{
+		{"unpooled", ""},
+		{"pooled", `"upload_buffer_size": 65536`},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ah, _, files := newTestHandler(b, bc.conf)
+			files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+			data := bytes.Repeat([]byte("x"), 4096)
+			var id atomic.Uint64
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					fdef := newTestFileDef()
+					// Distinct IDs, otherwise the uploads are deduplicated.
+					fdef.Id = types.Uid(id.Add(1)).String()
+					if _, _, err := ah.Upload(fdef, &unsizedReader{bytes.NewReader(data)}); err != nil {
+						b.Error("Upload failed:", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	ah, _, _ := newTestHandler(t, `"min_tls_version": "1.3"`)
+	client, ok := ah.svc.Options().HTTPClient.(*awshttp.BuildableClient)
+	if !ok {
+		t.Fatal("Unexpected HTTP client", ah.svc.Options().HTTPClient)
+	}
+	if got := client.GetTransport().TLSClientConfig.MinVersion; got != tls.VersionTLS13 {
+		t.Error("Wrong minimum TLS version", got)
+	}
+
+	bad := &awshandler{}
+	if err := bad.Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "min_tls_version": "1.4"}`); err == nil {
+		t.Error("Invalid min_tls_version must be rejected")
+	}
+}
+
+func TestReadReplicas(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"read_replicas": [
+		{"region": "eu-central-1", "bucket": "replica-eu", "endpoint": "http://eu.example.com", "hints": ["DE", "fr"]}]`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+
+	for _, tc := range []struct {
+		hint   string
+		host   string
+		bucket string
+	}{
+		{"", "", testBucket},
+		{"US", "", testBucket},
+		{"de", "eu.example.com", "replica-eu"},
+		{"FR", "eu.example.com", "replica-eu"},
+		{"eu-central-1", "eu.example.com", "replica-eu"},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			hdr, status, err := ah.Headers(method, u, http.Header{"Cloudfront-Viewer-Country": {tc.hint}}, true)
+			if err != nil || status != http.StatusPermanentRedirect {
+				t.Fatal("Expected redirect, got", status, err)
+			}
+			loc, _ := url.Parse(hdr["Location"][0])
+			if tc.host != "" && loc.Host != tc.host {
+				t.Errorf("Hint '%s' %s: expected host '%s', got '%s'", tc.hint, method, tc.host, loc.Host)
+			}
+			if !strings.HasPrefix(loc.Path, "/"+tc.bucket+"/") {
+				t.Errorf("Hint '%s' %s: expected bucket '%s', got '%s'", tc.hint, method, tc.bucket, loc.Path)
+			}
+			if !slices.Contains(hdr["Vary"], defaultRegionHintHeader) {
+				t.Error("Redirect must vary by the region hint", hdr["Vary"])
+			}
+		}
+	}
+}
+
+func TestRespectObjectCacheControl(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"respect_object_cache_control": true, "file_download_limit": true`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	location := func(method string) string {
+		u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+		hdr, _, err := ah.Headers(method, u, http.Header{}, true)
+		if err != nil {
+			t.Fatal("Headers failed:", err)
+		}
+		return hdr.Get("Location")
+	}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if got := location(method); got == "" || strings.Contains(got, "response-cache-control") {
+			t.Error(method, "expected the Cache-Control of the object, got", got)
+		}
+	}
+
+	// Limited files must not be cached whatever the object says.
+	fdef.DownloadLimit = 2
+	files.EXPECT().CountDownload(fdef.Id).Return(1, nil)
+	if got := location(http.MethodGet); !strings.Contains(got, "response-cache-control=private%2C%20no-store") {
+		t.Error("Expected no-store override of limited file, got", got)
+	}
+}
+
+func TestSignatureV2(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"signature_version": "v2"`)
+	fdef := newTestFileDef()
+	fdef.Id = types.Uid(34567).String()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	hdr, _, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil {
+		t.Fatal("Headers failed:", err)
+	}
+	presigned, err := url.Parse(hdr.Get("Location"))
+	if err != nil {
+		t.Fatal("Invalid presigned URL:", err)
+	}
+	query := presigned.Query()
+	for _, param := range []string{"X-Amz-Signature", "X-Amz-Algorithm", "X-Amz-Expires", "x-id"} {
+		if query.Has(param) {
+			t.Error("Presigned URL has V4 parameter", param)
+		}
+	}
+	if strings.Contains(presigned.RawQuery, "+") {
+		t.Error("Spaces must be encoded as %20:", presigned.RawQuery)
+	}
+	if query.Get("AWSAccessKeyId") != "key" {
+		t.Error("Wrong AWSAccessKeyId", query.Get("AWSAccessKeyId"))
+	}
+	expires, _ := strconv.ParseInt(query.Get("Expires"), 10, 64)
+	if ttl := time.Until(time.Unix(expires, 0)); ttl <= 0 || ttl > time.Duration(ah.conf.PresignTTL+1)*time.Second {
+		t.Error("Wrong Expires", query.Get("Expires"))
+	}
+	toSign := "GET\n\n\n" + query.Get("Expires") + "\n" + presigned.EscapedPath() +
+		"?response-cache-control=" + ah.conf.CacheControl + "&response-content-type=image/png"
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(toSign))
+	if sig := query.Get("Signature"); sig != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Error("Wrong signature", sig)
+	}
+
+	// Never on AWS.
+	for _, endpoint := range []string{"", `"endpoint": "s3.us-east-1.amazonaws.com",`} {
+		if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1", ` +
+			endpoint + `"bucket": "` + testBucket + `", "signature_version": "v2"}`); err == nil {
+			t.Error("signature_version v2 accepted without a custom endpoint:", endpoint)
+		}
+	}
+}
+
+func TestFileCacheControl(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"file_cache_control": true`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(2)
+
+	ephemeral := newTestFileDef()
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{CacheControl: "No-Store, max-age=0"})
+	if _, _, err := ah.UploadWithContext(ctx, ephemeral, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if cc := fake.object(ephemeral.Location).header.Get("Cache-Control"); cc != "no-store, max-age=0" {
+		t.Error("Wrong stored Cache-Control", cc)
+	}
+
+	regular := newTestFileDef()
+	regular.Id = types.Uid(23456).String()
+	if _, _, err := ah.Upload(regular, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+
+	// Malformed directives are rejected before creating the file record.
+	for _, cc := range []string{"max-age=abc", "no-store, evil", "max-age", "no-cache=1", "no-store\r\nX-Injected: 1"} {
+		ctx = media.NewContext(context.Background(), &media.RequestInfo{CacheControl: cc})
+		if _, _, err := ah.UploadWithContext(ctx, newTestFileDef(), bytes.NewReader([]byte("data"))); err != types.ErrMalformed {
+			t.Errorf("'%s': expected ErrMalformed, got %v", cc, err)
+		}
+	}
+
+	// Forget the uploads: the directives are read from S3.
+	ah.cacheControls = newObjectCache[string]()
+	for _, fdef := range []*types.FileDef{ephemeral, regular} {
+		fdef.Status = types.UploadCompleted
+		files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	}
+	for _, tc := range []struct {
+		fdef     *types.FileDef
+		expected string
+		redirect string
+	}{
+		{ephemeral, "no-store, max-age=0", "no-store, max-age=0"},
+		// The redirect is cached for 80% of the default presign_ttl of 120s.
+		{regular, ah.conf.CacheControl, ah.conf.CacheControl + ", max-age=96"},
+	} {
+		u, _ := url.Parse(defaultServeURL + tc.fdef.Id + ".png")
+		hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		if hdr["Cache-Control"][0] != tc.redirect {
+			t.Errorf("Expected redirect Cache-Control '%s', got '%s'", tc.redirect, hdr["Cache-Control"][0])
+		}
+		loc, _ := url.Parse(hdr["Location"][0])
+		if got := loc.Query().Get("response-cache-control"); got != tc.expected {
+			t.Errorf("Expected response-cache-control '%s', got '%s'", tc.expected, got)
+		}
+	}
+}
+
+func TestETagCheck(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"etag_check_rate": 1`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	fdef.ETag = "stale"
+	fdef.Size = 4
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	// The object was replaced out of band.
+	fake.mu.Lock()
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("replaced"), header: http.Header{"Etag": {`"live"`}}}
+	fake.mu.Unlock()
+
+	var repaired *types.FileDef
+	files.EXPECT().FinishUpload(gomock.Any(), true, int64(8)).DoAndReturn(
+		func(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+			repaired = fd
+			return fd, nil
+		})
+
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	// Stale ETag must not produce 304.
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{"If-None-Match": {`"stale"`}}, true)
+	if err != nil || status != http.StatusPermanentRedirect {
+		t.Fatal("Expected redirect, got", status, err)
+	}
+	if hdr["ETag"][0] != `"live"` {
+		t.Error("Expected live ETag, got", hdr["ETag"])
+	}
+	if repaired == nil || repaired.ETag != "live" || repaired.Id != fdef.Id {
+		t.Error("File record not repaired", repaired)
+	}
+
+	// Matching records are left alone.
+	fdef.ETag = "live"
+	if _, status, err = ah.Headers(http.MethodGet, u, http.Header{"If-None-Match": {`"live"`}}, true); err != nil || status != http.StatusNotModified {
+		t.Error("Expected 304, got", status, err)
+	}
+
+	bad := &awshandler{}
+	if err := bad.Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "etag_check_rate": 1.5}`); err == nil {
+		t.Error("Invalid etag_check_rate must be rejected")
+	}
+}
+
+func TestContentHashETag(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"etag_source": "content_hash", "etag_check_rate": 1`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(2)
+
+	data := []byte("same content")
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+	// The ETag does not depend on how the object was uploaded.
+	fdef := newTestFileDef()
+	if _, _, err := ah.Upload(fdef, bytes.NewReader(data)); err != nil || fdef.ETag != want {
+		t.Fatal("Expected content hash ETag of single PUT, got", fdef.ETag, err)
+	}
+	multi := newTestFileDef()
+	multi.Id = types.Uid(23456).String()
+	if _, _, err := ah.Upload(multi, &unsizedReader{bytes.NewReader(data)}); err != nil || multi.ETag != want {
+		t.Fatal("Expected content hash ETag of multipart upload, got", multi.ETag, err)
+	}
+	if obj := fake.object(multi.Location); obj == nil || obj.header.Get("ETag") == `"`+want+`"` {
+		t.Fatal("Expected S3 ETag of the object to differ")
+	}
+
+	// The record is not repaired with the ETag of S3.
+	fdef.Status = types.UploadCompleted
+	fdef.Size = int64(len(data))
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{"If-None-Match": {`"` + want + `"`}}, true)
+	if err != nil || status != http.StatusNotModified || hdr["ETag"][0] != `"`+want+`"` {
+		t.Error("Expected 304 with content hash ETag, got", status, err, hdr)
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "etag_source": "md5"}`); err == nil || !strings.Contains(err.Error(), "etag_source") {
+		t.Error("Invalid etag_source must be rejected, got", err)
+	}
+}
+
+func TestMissingObject(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"missing_object_status": 410`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		hdr, status, err := ah.Headers(method, u, http.Header{}, true)
+		if err != nil || status != http.StatusGone {
+			t.Errorf("%s: expected 410, got %d %v", method, status, err)
+		}
+		if hdr[missingObjectHeader][0] != "1" {
+			t.Errorf("%s: missing %s header", method, missingObjectHeader)
+		}
+	}
+
+	fake.mu.Lock()
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("data"), header: http.Header{}}
+	fake.mu.Unlock()
+	if _, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusPermanentRedirect {
+		t.Error("Expected redirect, got", status, err)
+	}
+
+	bad := &awshandler{}
+	if err := bad.Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "missing_object_status": 500}`); err == nil {
+		t.Error("Invalid missing_object_status must be rejected")
+	}
+}
+
+func TestImmutableUpload(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"immutable": {"retention_days": 30, "token_secret": "secret"}`)
+	if !fake.hasOp("GetObjectLockConfiguration") {
+		t.Error("Object lock of the bucket not checked")
+	}
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+
+	fdef := newTestFileDef()
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{Immutable: true})
+	fileURL, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader([]byte("data")))
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if fdef.Location != defaultImmutablePrefix+ah.objectKey(fdef.Uid()) || !ah.isImmutable(fdef) {
+		t.Error("Not stored as immutable", fdef.Location)
+	}
+	obj := fake.object(fdef.Location)
+	if obj.header.Get("X-Amz-Object-Lock-Mode") != "COMPLIANCE" {
+		t.Error("Object not locked", obj.header)
+	}
+	until, err := time.Parse(time.RFC3339, obj.header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	if err != nil || until.Before(time.Now().AddDate(0, 0, 29)) {
+		t.Error("Wrong retention", obj.header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	}
+
+	// Served by version with a valid token only.
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(fileURL)
+	if u.Query().Get(immutableVersionParam) != "v1" {
+		t.Fatal("Serve URL is not tied to the version", fileURL)
+	}
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil || status != http.StatusPermanentRedirect {
+		t.Fatal("Expected redirect, got", status, err)
+	}
+	if loc, _ := url.Parse(hdr["Location"][0]); loc.Query().Get("versionId") != "v1" {
+		t.Error("Redirect is not tied to the version", hdr["Location"][0])
+	}
+	for _, tamper := range []func(url.Values){
+		func(q url.Values) { q.Set(immutableVersionParam, "v2") },
+		func(q url.Values) { q.Set(immutableExpiresParam, "9999999999") },
+		func(q url.Values) { q.Del(immutableSignatureParam) },
+	} {
+		query := u.Query()
+		tamper(query)
+		bad := *u
+		bad.RawQuery = query.Encode()
+		if _, _, err := ah.Headers(http.MethodGet, &bad, http.Header{}, true); err != types.ErrPermissionDenied {
+			t.Error("Expected ErrPermissionDenied for", bad.RawQuery, "got", err)
+		}
+	}
+
+	// Refused to delete until the retention expires.
+	var progress [2]int
+	err = ah.DeleteWithProgress(context.Background(), []string{fdef.Location}, func(deleted, failed int) {
+		progress = [2]int{deleted, failed}
+	})
+	if err != nil || progress != [2]int{0, 1} || fake.object(fdef.Location) == nil {
+		t.Error("Retained object must not be deleted", err, progress)
+	}
+	fake.mu.Lock()
+	obj.header.Set("X-Amz-Object-Lock-Retain-Until-Date", time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	fake.mu.Unlock()
+	if err = ah.Delete([]string{fdef.Location}); err != nil || fake.object(fdef.Location) != nil {
+		t.Error("Expired object must be deleted", err)
+	}
+
+	// Not configured.
+	plain, _, _ := newTestHandler(t, "")
+	if _, _, err = plain.UploadWithContext(ctx, newTestFileDef(), bytes.NewReader([]byte("data"))); err != types.ErrUnsupported {
+		t.Error("Expected ErrUnsupported, got", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	ah, _, files := newTestHandler(t, `"audit_log": "`+auditFile+`"`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{
+		Uid:        types.Uid(777),
+		SessionId:  "sess",
+		RemoteAddr: "10.0.0.1",
+	})
+	// HEAD is not an access to the content.
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		if _, status, err := ah.HeadersWithContext(ctx, method, u, http.Header{}, true); err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+	}
+
+	var data []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, _ = os.ReadFile(auditFile); len(data) > 0 {
+			break
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var rec auditRecord
+	if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &rec) != nil {
+		t.Fatal("Expected one audit record, got", string(data))
+	}
+	if rec.Id != fdef.Id || rec.User != types.Uid(777).UserId() || rec.SessionId != "sess" ||
+		rec.RemoteAddr != "10.0.0.1" || rec.Time.IsZero() || rec.Proxy {
+		t.Error("Wrong audit record", rec)
+	}
+
+	// Overflow drops records without blocking.
+	full := &auditLogger{queue: make(chan []byte, 1)}
+	dropped := auditDropped.Value()
+	full.log(ctx, fdef, false)
+	full.log(ctx, fdef, false)
+	if auditDropped.Value() != dropped+1 {
+		t.Error("Dropped record not counted")
+	}
+}
+
+func TestKeyLayoutByTopic(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"key_layout": "by_topic"`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(3)
+
+	for _, tc := range []struct {
+		topic    string
+		expected string
+	}{
+		{"grpAbC-12_x", "topics/grpAbC-12_x/"},
+		{"", ""},
+		{"../etc", ""},
+	} {
+		fdef := newTestFileDef()
+		ctx := media.NewContext(context.Background(), &media.RequestInfo{Topic: tc.topic})
+		if _, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader([]byte("data"))); err != nil {
+			t.Fatal("Upload failed:", err)
+		}
+		if fdef.Location != tc.expected+ah.objectKey(fdef.Uid()) || fake.object(fdef.Location) == nil {
+			t.Errorf("'%s': wrong location %s", tc.topic, fdef.Location)
+		}
+	}
+
+	// Objects are served and deleted by the stored location.
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = "topics/grpAbC-12_x/" + ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil || status != http.StatusPermanentRedirect {
+		t.Fatal("Expected redirect, got", status, err)
+	}
+	if loc, _ := url.Parse(hdr["Location"][0]); !strings.HasSuffix(loc.Path, "/"+fdef.Location) {
+		t.Error("Redirect to wrong object", loc.Path)
+	}
+	if err = ah.Delete([]string{fdef.Location}); err != nil || fake.object(fdef.Location) != nil {
+		t.Error("Object not deleted", err)
+	}
+
+	bad := &awshandler{}
+	if err := bad.Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "key_layout": "nested"}`); err == nil {
+		t.Error("Unknown key_layout must be rejected")
+	}
+}
+
+func TestVideoCacheControl(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"video_cache_control": "Public, max-age=86400"`)
+	video := newTestFileDef()
+	video.MimeType = "video/mp4"
+	image := newTestFileDef()
+	image.Id = types.Uid(23456).String()
+	for _, fdef := range []*types.FileDef{video, image} {
+		fdef.Status = types.UploadCompleted
+		fdef.Location = ah.objectKey(fdef.Uid())
+		files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+	}
+
+	for _, tc := range []struct {
+		fdef         *types.FileDef
+		cacheControl string
+		redirect     string
+		ranges       bool
+	}{
+		{video, "public, max-age=86400", "public, max-age=96", true},
+		{image, ah.conf.CacheControl, ah.conf.CacheControl + ", max-age=96", false},
+	} {
+		u, _ := url.Parse(defaultServeURL + tc.fdef.Id)
+		hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		if hdr["Cache-Control"][0] != tc.redirect {
+			t.Errorf("%s: expected Cache-Control '%s', got '%s'", tc.fdef.MimeType, tc.redirect, hdr["Cache-Control"][0])
+		}
+		if loc, _ := url.Parse(hdr["Location"][0]); loc.Query().Get("response-cache-control") != tc.cacheControl {
+			t.Errorf("%s: wrong response-cache-control of the redirect", tc.fdef.MimeType)
+		}
+		if _, ok := hdr["Accept-Ranges"]; ok != tc.ranges {
+			t.Errorf("%s: unexpected Accept-Ranges %v", tc.fdef.MimeType, hdr["Accept-Ranges"])
+		}
+	}
+
+	bad := &awshandler{}
+	if err := bad.Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "video_cache_control": "max-age=forever"}`); err == nil {
+		t.Error("Invalid video_cache_control must be rejected")
+	}
+}
+
+func TestReconcileRecords(t *testing.T) {
+	ah, fake, files := newTestHandler(t, "")
+	var fdefs []types.FileDef
+	for i := range 3 {
+		fdef := newTestFileDef()
+		fdef.Id = types.Uid(1000 + i).String()
+		fdef.Status = types.UploadCompleted
+		fdef.Location = ah.objectKey(fdef.Uid())
+		fdefs = append(fdefs, *fdef)
+	}
+	// Only the first object exists.
+	fake.mu.Lock()
+	fake.objects[fdefs[0].Location] = &fakeObject{data: []byte("data"), header: http.Header{}}
+	fake.mu.Unlock()
+
+	files.EXPECT().List("", reconcileBatchSize).Return(fdefs, nil).Times(2)
+	files.EXPECT().List(fdefs[2].Id, reconcileBatchSize).Return(nil, nil).Times(2)
+
+	stats, err := ah.ReconcileRecords(context.Background(), true, 0)
+	if err != nil || *stats != (media.ReconcileStats{Checked: 3, Missing: 2}) {
+		t.Fatal("Wrong dry run result", stats, err)
+	}
+
+	var deleted []string
+	files.EXPECT().FinishUpload(gomock.Any(), false, int64(0)).DoAndReturn(
+		func(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+			deleted = append(deleted, fd.Id)
+			return fd, nil
+		}).Times(2)
+	stats, err = ah.ReconcileRecords(context.Background(), false, 1000)
+	if err != nil || *stats != (media.ReconcileStats{Checked: 3, Missing: 2, Deleted: 2}) {
+		t.Fatal("Wrong result", stats, err)
+	}
+	if !slices.Equal(deleted, []string{fdefs[1].Id, fdefs[2].Id}) {
+		t.Error("Wrong records deleted", deleted)
+	}
+}
+
+func TestDownloadTokens(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"download_token_ttl": 60`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	fileURL := defaultServeURL + fdef.Id + ".png"
+
+	owner := media.NewContext(context.Background(), &media.RequestInfo{Uid: types.Uid(777), SessionId: "sess"})
+	other := media.NewContext(context.Background(), &media.RequestInfo{Uid: types.Uid(777), SessionId: "other"})
+	get := func(ctx context.Context, token string) error {
+		u, _ := url.Parse(fileURL + "?" + downloadTokenParam + "=" + token)
+		_, status, err := ah.HeadersWithContext(ctx, http.MethodGet, u, http.Header{}, true)
+		if err == nil && status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status)
+		}
+		return err
+	}
+
+	token, err := ah.DownloadToken(owner, fileURL)
+	if err != nil || token.Token == "" || token.Expires.Before(time.Now()) {
+		t.Fatal("DownloadToken failed", token, err)
+	}
+	if err = get(owner, token.Token); err != nil {
+		t.Error("Valid token rejected:", err)
+	}
+	// Single use.
+	if err = get(owner, token.Token); err != types.ErrPermissionDenied {
+		t.Error("Used token accepted:", err)
+	}
+	// Tied to the session.
+	token, _ = ah.DownloadToken(owner, fileURL)
+	if err = get(other, token.Token); err != types.ErrPermissionDenied {
+		t.Error("Token of another session accepted:", err)
+	}
+	if err = get(owner, ""); err != types.ErrPermissionDenied {
+		t.Error("Missing token accepted:", err)
+	}
+	// HEAD reveals no content and needs no token.
+	u, _ := url.Parse(fileURL)
+	if _, _, err = ah.HeadersWithContext(owner, http.MethodHead, u, http.Header{}, true); err != nil {
+		t.Error("HEAD without token rejected:", err)
+	}
+
+	// Expired.
+	ah.downloadTokens.ttl = -time.Second
+	token, _ = ah.DownloadToken(owner, fileURL)
+	if err = get(owner, token.Token); err != types.ErrPermissionDenied {
+		t.Error("Expired token accepted:", err)
+	}
+
+	if _, err = ah.DownloadToken(context.Background(), fileURL); err != types.ErrPermissionDenied {
+		t.Error("Token issued to anonymous requester:", err)
+	}
+	plain, _, _ := newTestHandler(t, "")
+	if _, err = plain.DownloadToken(owner, fileURL); err != types.ErrUnsupported {
+		t.Error("Expected ErrUnsupported, got", err)
+	}
+}
+
+func TestRequesterPays(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"requester_pays": true, "upload_buffer_size": 1024`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(2)
+
+	fdef := newTestFileDef()
+	if _, _, err := ah.Upload(fdef, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	// Multipart upload.
+	large := newTestFileDef()
+	large.Id = types.Uid(23456).String()
+	if _, _, err := ah.Upload(large, &unsizedReader{bytes.NewReader(make([]byte, 2048))}); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		hdr, status, err := ah.Headers(method, u, http.Header{}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		if loc, _ := url.Parse(hdr["Location"][0]); loc.Query().Get("x-amz-request-payer") != "requester" {
+			t.Errorf("%s: presigned URL without request payer %s", method, loc)
+		}
+	}
+	_, reader, err := ah.Download(u.String())
+	if err != nil {
+		t.Fatal("Download failed:", err)
+	}
+	io.ReadAll(reader)
+	reader.Close()
+	if err = ah.Delete([]string{fdef.Location, large.Location}); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+
+	fake.mu.Lock()
+	if fake.unpaid != 0 {
+		t.Error("Requests without request payer:", fake.unpaid)
+	}
+	fake.mu.Unlock()
+
+	if _, err = ah.FormUploadPolicy(context.Background(), newTestFileDef(), 0); err != types.ErrUnsupported {
+		t.Error("Form uploads to Requester Pays bucket must be rejected, got", err)
+	}
+}
+
+func TestFileExpiry(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"file_expiry": true, "presign_ttl": 3600`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+
+	fdef := newTestFileDef()
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{TTL: "60"})
+	if _, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if fake.object(fdef.Location).header.Get("X-Amz-Meta-Expires-At") == "" {
+		t.Fatal("Expiration not stored")
+	}
+	for _, ttl := range []string{"0", "-5", "soon"} {
+		ctx = media.NewContext(context.Background(), &media.RequestInfo{TTL: ttl})
+		if _, _, err := ah.UploadWithContext(ctx, newTestFileDef(), bytes.NewReader([]byte("data"))); err != types.ErrMalformed {
+			t.Errorf("'%s': expected ErrMalformed, got %v", ttl, err)
+		}
+	}
+
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	// Read the expiration from S3.
+	ah.expiries = newObjectCache[time.Time]()
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil || status != http.StatusPermanentRedirect {
+		t.Fatal("Expected redirect, got", status, err)
+	}
+	loc, _ := url.Parse(hdr["Location"][0])
+	if expires, _ := strconv.Atoi(loc.Query().Get("X-Amz-Expires")); expires <= 0 || expires > 60 {
+		t.Error("Presigned URL outlives the file:", expires)
+	}
+
+	// Expired.
+	fake.mu.Lock()
+	fake.objects[fdef.Location].header.Set("X-Amz-Meta-Expires-At", strconv.FormatInt(time.Now().Unix()-1, 10))
+	fake.mu.Unlock()
+	ah.expiries = newObjectCache[time.Time]()
+	if hdr, status, err = ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusGone {
+		t.Error("Expected 410, got", status, err)
+	}
+	if hdr[missingObjectHeader][0] != "1" {
+		t.Error("Missing", missingObjectHeader)
+	}
+}
+
+func TestFileMetadata(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"meta_keys": ["X-Amz-Meta-Label"]`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	fdef.ETag = "abc"
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	fake.mu.Lock()
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("data"), header: http.Header{
+		"X-Amz-Meta-Label": {"holiday"},
+		"X-Amz-Meta-Audit": {"internal"},
+	}}
+	fake.mu.Unlock()
+	fileURL := defaultServeURL + fdef.Id + ".png"
+
+	meta, err := ah.FileMetadata(context.Background(), fileURL, false)
+	if err != nil || meta.Id != fdef.Id || meta.ETag != "abc" || meta.Meta != nil {
+		t.Fatal("Unexpected description", meta, err)
+	}
+	meta, err = ah.FileMetadata(context.Background(), fileURL, true)
+	if err != nil {
+		t.Fatal("FileMetadata failed:", err)
+	}
+	if len(meta.Meta) != 1 || meta.Meta["label"] != "holiday" {
+		t.Error("Expected only allowed metadata, got", meta.Meta)
+	}
+
+	if _, err = ah.FileMetadata(context.Background(), defaultServeURL+"none", true); err != types.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+	if err = (&awshandler{}).Init(`{"access_key_id": "a", "secret_access_key": "b", "bucket": "b",
+		"meta_keys": ["bad key"]}`); err == nil {
+		t.Error("Invalid meta_keys accepted")
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	uploaded := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	replaced := time.Date(2024, 3, 2, 12, 30, 0, 0, time.UTC)
+	newFile := func(ah *awshandler, fake *fakeS3, files *mock_store.MockFilePersistenceInterface) *types.FileDef {
+		fdef := newTestFileDef()
+		fdef.Status = types.UploadCompleted
+		fdef.Location = ah.objectKey(fdef.Uid())
+		fdef.Size = 4
+		fdef.CreatedAt = uploaded.Add(-time.Minute)
+		fdef.UpdatedAt = uploaded
+		files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+		fake.mu.Lock()
+		fake.objects[fdef.Location] = &fakeObject{data: []byte("data"), header: http.Header{
+			"Last-Modified": {replaced.Format(http.TimeFormat)},
+		}}
+		fake.mu.Unlock()
+		return fdef
+	}
+
+	// From the file record by default.
+	ah, fake, files := newTestHandler(t, `"proxy": "always"`)
+	fdef := newFile(ah, fake, files)
+	fileURL := defaultServeURL + fdef.Id + ".png"
+	meta, err := ah.FileMetadata(context.Background(), fileURL, false)
+	if err != nil || !meta.CreatedAt.Equal(fdef.CreatedAt) || !meta.UpdatedAt.Equal(uploaded) {
+		t.Fatal("Unexpected times", meta, err)
+	}
+	u, _ := url.Parse(fileURL)
+	hdr, _, err := ah.Headers(http.MethodHead, u, http.Header{}, true)
+	if err != nil || hdr.Get("Last-Modified") != uploaded.Format(http.TimeFormat) {
+		t.Error("Expected Last-Modified of the record, got", hdr, err)
+	}
+	if fake.hasOp("HeadObject") {
+		t.Error("The object must not be checked")
+	}
+
+	// From the object if configured.
+	ah, fake, files = newTestHandler(t, `"proxy": "always", "last_modified_source": "object"`)
+	fdef = newFile(ah, fake, files)
+	if meta, err = ah.FileMetadata(context.Background(), fileURL, false); err != nil || !meta.UpdatedAt.Equal(replaced) {
+		t.Error("Expected the time of the object", meta, err)
+	}
+	hdr, _, err = ah.Headers(http.MethodHead, u, http.Header{}, true)
+	if err != nil || hdr.Get("Last-Modified") != replaced.Format(http.TimeFormat) {
+		t.Error("Expected Last-Modified of the object, got", hdr, err)
+	}
+	got, rsc, err := ah.Download(fileURL)
+	if err != nil {
+		t.Fatal("Download failed:", err)
+	}
+	rsc.Close()
+	if !got.UpdatedAt.Equal(replaced) || !fdef.UpdatedAt.Equal(uploaded) {
+		t.Error("Download must report the time of the object", got.UpdatedAt)
+	}
+
+	if err = (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "last_modified_source": "s3"}`); err == nil {
+		t.Error("Invalid last_modified_source accepted")
+	}
+}
+
+func TestInitRetry(t *testing.T) {
+	saved := initRetryDelay
+	initRetryDelay = 50 * time.Millisecond
+	t.Cleanup(func() { initRetryDelay = saved })
+
+	// S3 is not ready on the first checks of the bucket.
+	fake, _ := newFakeS3(t)
+	var unavailable atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && unavailable.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	conf := func(key, retry string) string {
+		return `{"access_key_id": "` + key + `", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + testBucket + `", "endpoint": "` + srv.URL + `", "force_path_style": true,
+			"init_retry_seconds": ` + retry + `}`
+	}
+	// One failure of the bucket check after all attempts of the SDK.
+	unavailable.Store(3)
+	if err := (&awshandler{}).Init(conf("key", "30")); err != nil {
+		t.Fatal("Init did not wait for S3:", err)
+	}
+	if !fake.hasOp("HeadBucket") {
+		t.Error("Bucket not checked")
+	}
+
+	// Denied access is not retried.
+	start := time.Now()
+	if err := (&awshandler{}).Init(conf("invalid", "30")); err == nil {
+		t.Error("Invalid credentials accepted")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Auth error retried")
+	}
+	if err := (&awshandler{}).Init(conf("key", "-1")); err == nil {
+		t.Error("Negative init_retry_seconds accepted")
+	}
+}
+
+func TestAsyncVariantsRetry(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"compress": ["br"], "async_variants": {"workers": 1, "retries": 2, "retry_backoff": 1}`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(2)
+	wait := func(fdef *types.FileDef) {
+		for deadline := time.Now().Add(5 * time.Second); ah.variantsMissing(fdef); {
+			if time.Now().After(deadline) {
+				t.Fatal("Variants still pending")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	upload := func(fdef *types.FileDef, failGets int) {
+		fdef.MimeType = "text/plain"
+		fake.mu.Lock()
+		fake.failGets = failGets
+		fake.mu.Unlock()
+		if _, _, err := ah.Upload(fdef, bytes.NewReader(bytes.Repeat([]byte("retry me "), 200))); err != nil {
+			t.Fatal("Upload failed:", err)
+		}
+		wait(fdef)
+	}
+
+	// A transient failure is retried.
+	retries, failures := variantRetries.Value(), variantFailures.Value()
+	fdef := newTestFileDef()
+	upload(fdef, 1)
+	if fake.object(ah.variantKey(fdef.Location, "br")) == nil {
+		t.Error("Variant not stored after retry")
+	}
+	if got := variantRetries.Value() - retries; got != 1 {
+		t.Error("Expected 1 retry, got", got)
+	}
+	if variantFailures.Value() != failures {
+		t.Error("Retried job counted as failed")
+	}
+
+	// Out of retries, the file is marked.
+	fdef = newTestFileDef()
+	fdef.Id = types.Uid(23456).String()
+	files.EXPECT().MarkVariantsFailed(fdef.Id).Return(nil)
+	upload(fdef, 3)
+	if fake.object(ah.variantKey(fdef.Location, "br")) != nil {
+		t.Error("Variant stored despite failures")
+	}
+	if got := variantFailures.Value() - failures; got != 1 {
+		t.Error("Expected 1 failure, got", got)
+	}
+
+	// Variants of marked files are not looked up.
+	fdef.VariantsFailed = true
+	if key, _ := ah.negotiateVariant(context.Background(), fdef, "br"); key != "" {
+		t.Error("Variant negotiated for a file with failed variants:", key)
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "async_variants": {"retries": -1}}`); err == nil {
+		t.Error("Negative retries accepted")
+	}
+}
+
+func TestAsyncVariants(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"compress": ["br"], "async_variants": {"workers": 1}`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+
+	data := bytes.Repeat([]byte("compress me later "), 200)
+	fdef := newTestFileDef()
+	fdef.MimeType = "text/plain; charset=utf-8"
+	if _, _, err := ah.Upload(fdef, bytes.NewReader(data)); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	key := ah.variantKey(fdef.Location, "br")
+	for deadline := time.Now().Add(5 * time.Second); ah.variantsMissing(fdef); {
+		if time.Now().After(deadline) {
+			t.Fatal("Variants not generated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	br := fake.object(key)
+	if br == nil {
+		t.Fatal("Brotli variant not stored")
+	}
+	if decoded, err := io.ReadAll(brotli.NewReader(bytes.NewReader(br.data))); err != nil || !bytes.Equal(decoded, data) {
+		t.Error("Brotli variant does not match the original", err)
+	}
+
+	// The object itself is served while the variants are pending.
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".txt")
+	serve := func() string {
+		hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{"Accept-Encoding": {"br"}}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		loc, _ := url.Parse(hdr["Location"][0])
+		return loc.Path
+	}
+	ah.variantWorkers.mu.Lock()
+	ah.variantWorkers.pending[fdef.Location] = true
+	ah.variantWorkers.mu.Unlock()
+	if got := serve(); !strings.HasSuffix(got, "/"+fdef.Location) {
+		t.Error("Expected the object while variants are pending, got", got)
+	}
+	ah.variantWorkers.done(fdef.Location)
+	if got := serve(); !strings.HasSuffix(got, "/"+key) {
+		t.Error("Expected the variant once generated, got", got)
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "async_variants": {"workers": -1}}`); err == nil {
+		t.Error("Invalid async_variants must be rejected")
+	}
+}
+
+func TestAsyncVariantsOtherNode(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"compress": ["br"], "thumbnails": {}, "async_variants": {"workers": 1}`)
+
+	// Uploaded by another node which is still generating the variants.
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("png data"), header: http.Header{"ETag": {`"etag"`}}}
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	thumbKey := ah.variantKey(fdef.Location, thumbnailKind)
+	brKey := ah.variantKey(fdef.Location, "br")
+
+	serve := func(query string, headers http.Header) string {
+		u, _ := url.Parse(defaultServeURL + fdef.Id + ".png" + query)
+		hdr, status, err := ah.Headers(http.MethodGet, u, headers, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		loc, _ := url.Parse(hdr.Get("Location"))
+		return loc.Path
+	}
+	// The image is served instead of the missing thumbnail.
+	if got := serve("?thumb=1", http.Header{}); !strings.HasSuffix(got, "/"+fdef.Location) {
+		t.Error("Expected the image while the thumbnail is pending, got", got)
+	}
+	if got := ah.variantExists(context.Background(), brKey); got {
+		t.Error("Variant not stored yet must not exist")
+	}
+
+	// The variants are stored. Their absence is cached briefly only.
+	fake.objects[thumbKey] = &fakeObject{data: []byte("thumb"), header: http.Header{"Content-Type": {"image/png"}}}
+	fake.objects[brKey] = &fakeObject{data: []byte("br"), header: http.Header{}}
+	thumbEntry := ah.thumbnails.known[thumbKey]
+	if thumbEntry.expires.IsZero() || time.Until(thumbEntry.expires) > missingVariantCacheTTL {
+		t.Fatal("Missing thumbnail cached for good", thumbEntry)
+	}
+	thumbEntry.expires = time.Now().Add(-time.Second)
+	ah.thumbnails.known[thumbKey] = thumbEntry
+	brEntry := ah.variants.known[brKey]
+	if brEntry.expires.IsZero() {
+		t.Fatal("Missing variant cached for good", brEntry)
+	}
+	brEntry.expires = time.Now().Add(-time.Second)
+	ah.variants.known[brKey] = brEntry
+
+	if got := serve("?thumb=1", http.Header{}); !strings.HasSuffix(got, "/"+thumbKey) {
+		t.Error("Expected the thumbnail once stored, got", got)
+	}
+	if !ah.variantExists(context.Background(), brKey) {
+		t.Error("Expected the variant once stored")
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"placeholders": true`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+
+	img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 6), G: 80, B: uint8(y * 8), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	fdef := newTestFileDef()
+	if _, _, err := ah.Upload(fdef, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	stored := fake.object(ah.variantKey(fdef.Location, placeholderKind))
+	if stored == nil || len(stored.data) != 28 {
+		t.Fatal("Placeholder not stored", stored)
+	}
+
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	// Read the placeholder from S3.
+	ah.placeholders = newObjectCache[string]()
+	meta, err := ah.FileMetadata(context.Background(), defaultServeURL+fdef.Id+".png", false)
+	if err != nil || meta.Placeholder != string(stored.data) {
+		t.Error("Placeholder not returned", meta, err)
+	}
+
+	// Not an image.
+	doc := newTestFileDef()
+	doc.Id = types.Uid(23456).String()
+	doc.MimeType = "text/plain"
+	if _, _, err = ah.Upload(doc, bytes.NewReader([]byte("text"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if fake.object(ah.variantKey(doc.Location, placeholderKind)) != nil {
+		t.Error("Placeholder of a text file stored")
+	}
+
+	// Too large.
+	ah.conf.PlaceholderMaxSize = 100
+	large := newTestFileDef()
+	large.Id = types.Uid(34567).String()
+	if _, _, err = ah.Upload(large, &unsizedReader{bytes.NewReader(buf.Bytes())}); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if fake.object(ah.variantKey(large.Location, placeholderKind)) != nil {
+		t.Error("Placeholder of a large image stored")
+	}
+}
+
+func TestVariantKinds(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)))
+	text := strings.Repeat("compressible text ", 100)
+
+	upload := func(ah *awshandler, id types.Uid, mimeType, data string) *types.FileDef {
+		fdef := newTestFileDef()
+		fdef.Id = id.String()
+		fdef.MimeType = mimeType
+		if _, _, err := ah.Upload(fdef, strings.NewReader(data)); err != nil {
+			t.Fatal("Upload failed:", err)
+		}
+		return fdef
+	}
+	variantsOf := func(ah *awshandler, fake *fakeS3, fdef *types.FileDef) []string {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		var kinds []string
+		for key := range fake.objects {
+			if kind, ok := strings.CutPrefix(key, ah.variantPrefix(fdef.Location)); ok {
+				kinds = append(kinds, kind)
+			}
+		}
+		sort.Strings(kinds)
+		return kinds
+	}
+
+	// All variants are created and deleted.
+	ah, fake, files := newTestHandler(t, `"compress": ["br", "gzip"], "placeholders": true`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+	doc := upload(ah, 23456, "text/plain", text)
+	img := upload(ah, 34567, "image/png", buf.String())
+	if kinds := variantsOf(ah, fake, doc); !slices.Equal(kinds, []string{"br", "gz"}) {
+		t.Error("Wrong variants of the text", kinds)
+	}
+	if kinds := variantsOf(ah, fake, img); !slices.Equal(kinds, []string{placeholderKind}) {
+		t.Error("Wrong variants of the image", kinds)
+	}
+	if err := ah.Delete([]string{doc.Location, img.Location}); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+	fake.mu.Lock()
+	if len(fake.objects) != 0 {
+		t.Error("Objects left after delete", fake.objects)
+	}
+	fake.mu.Unlock()
+
+	// Only the allowed kinds are created.
+	ah, fake, files = newTestHandler(t, `"compress": ["br", "gzip"], "placeholders": true, "variant_kinds": ["gz"]`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+	doc = upload(ah, 23456, "text/plain", text)
+	img = upload(ah, 34567, "image/png", buf.String())
+	if kinds := variantsOf(ah, fake, doc); !slices.Equal(kinds, []string{"gz"}) {
+		t.Error("Wrong allowed variants of the text", kinds)
+	}
+	if kinds := variantsOf(ah, fake, img); len(kinds) != 0 {
+		t.Error("Placeholder must not be created", kinds)
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "variant_kinds": ["webp"]}`); err == nil || !strings.Contains(err.Error(), "variant kind") {
+		t.Error("Unknown variant kind accepted", err)
+	}
+}
+
+func TestEndpointRegion(t *testing.T) {
+	// The region is optional with a custom endpoint.
+	ah, _, _ := newTestHandler(t, `"region": ""`)
+	if ah.conf.Region != defaultEndpointRegion {
+		t.Error("Expected default region, got", ah.conf.Region)
+	}
+
+	// and required by AWS.
+	err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "bucket": "` + testBucket + `"}`)
+	if err == nil || err.Error() != "missing Region" {
+		t.Error("Missing region accepted", err)
+	}
+}
+
+func TestVersionedURLs(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"versioned_urls": true`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+
+	fdef := newTestFileDef()
+	url1, _, err := ah.Upload(fdef, strings.NewReader("old avatar"))
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if url1 != defaultServeURL+fdef.Id+".png?cv="+contentVersion("put-etag") {
+		t.Error("Wrong versioned URL", url1)
+	}
+	if ah.GetIdFromUrl(url1) != fdef.Uid() {
+		t.Error("Version token not ignored", url1)
+	}
+
+	// New content gets a new URL. Multipart uploads are stored with a different ETag by the fake.
+	url2, _, err := ah.Upload(newTestFileDef(), &unsizedReader{strings.NewReader("new avatar")})
+	if err != nil || url2 == url1 {
+		t.Error("URL of new content must differ", url2, err)
+	}
+
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+	u, _ := url.Parse(url1)
+	if _, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusPermanentRedirect {
+		t.Error("Versioned URL not served", status, err)
+	}
+}
+
+func TestBlurhashSolidColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, color.RGBA{R: 255, G: 128, B: 0, A: 255})
+		}
+	}
+	hash := blurhash(img)
+	// Size flag, maximum AC value, the average color and 11 AC components.
+	if len(hash) != 28 || hash[:1] != encode83(3+2*9, 1) || hash[2:6] != encode83(0xff8000, 4) {
+		t.Error("Unexpected hash", hash)
+	}
+}
+
+func TestLegacyServeURLs(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"legacy_serve_urls": ["/v0/file/s/(?P<id>[-_A-Za-z0-9]+)/[^/]+"]`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+
+	u, _ := url.Parse(defaultServeURL + fdef.Id + "/photo.png")
+	if _, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusPermanentRedirect {
+		t.Error("Legacy URL not served", status, err)
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "a", "secret_access_key": "b", "bucket": "b",
+		"legacy_serve_urls": ["/v0/media/.*"]}`); err == nil {
+		t.Error("Pattern without the id group accepted")
+	}
+}
+
+func TestURLCache(t *testing.T) {
+	// Two nodes with different credentials share the cache.
+	node1, _, _ := newTestHandler(t, `"url_cache": {"name": "memory", "ttl": 30}`)
+	node2, _, files := newTestHandler(t, `"url_cache": {"name": "memory"}, "access_key_id": "other"`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = node1.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	location := func(ah *awshandler, method, query string) string {
+		u, _ := url.Parse(defaultServeURL + fdef.Id + ".png" + query)
+		hdr, status, err := ah.Headers(method, u, http.Header{}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		return hdr.Get("Location")
+	}
+	signed := location(node1, http.MethodGet, "")
+	if !strings.Contains(signed, "Credential=key") {
+		t.Fatal("Unexpected URL", signed)
+	}
+	if got := location(node2, http.MethodGet, ""); got != signed {
+		t.Error("Cached URL not used", got)
+	}
+	// Different parameters are signed separately.
+	if got := location(node2, http.MethodGet, "?asatt=1"); got == signed || !strings.Contains(got, "Credential=other") {
+		t.Error("Cached URL of other parameters used", got)
+	}
+	if got := location(node2, http.MethodHead, ""); got == signed {
+		t.Error("Cached URL of GET used for HEAD", got)
+	}
+
+	for _, conf := range []string{`{"name": "none"}`, `{"name": "memory", "ttl": 120}`} {
+		if err := (&awshandler{}).Init(`{"access_key_id": "a", "secret_access_key": "b", "bucket": "b",
+			"url_cache": ` + conf + `}`); err == nil {
+			t.Error("Invalid url_cache accepted", conf)
+		}
+	}
+}
+
+func TestURLCacheRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte("old-key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ah, _, files := newTestHandler(t, `"url_cache": {"name": "memory"}, "access_key_id": "", "access_key_id_file": "`+path+`"`)
+	fdef := newTestFileDef()
+	// The memory cache is shared by the tests.
+	fdef.Id = types.Uid(23456).String()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	location := func() string {
+		u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+		hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		return hdr.Get("Location")
+	}
+	signed := location()
+	if !strings.Contains(signed, "Credential=old-key") {
+		t.Fatal("Unexpected URL", signed)
+	}
+
+	// The key is rotated and the credentials are refreshed.
+	if err := os.WriteFile(path, []byte("new-key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ah.downloadCredentials.Invalidate()
+	if got := location(); got == signed || !strings.Contains(got, "Credential=new-key") {
+		t.Error("URL signed with the old key served after rotation", got)
+	}
+	if generation, err := ah.downloadCredentials.generation(context.Background()); err != nil || generation != 1 {
+		t.Error("Expected generation 1, got", generation, err)
+	}
+}
+
+func TestPublicObjects(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"public_url": "https://cdn.example.com", "download_token_ttl": 60`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	fake.mu.Lock()
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("data"), header: http.Header{
+		"X-Amz-Tagging": {"visibility=public"},
+	}}
+	fake.mu.Unlock()
+
+	serve := func(query string) (http.Header, int, error) {
+		u, _ := url.Parse(defaultServeURL + fdef.Id + ".png" + query)
+		return ah.Headers(http.MethodGet, u, http.Header{}, true)
+	}
+	// No download token needed.
+	hdr, status, err := serve("")
+	if err != nil || status != http.StatusPermanentRedirect {
+		t.Fatal("Expected redirect, got", status, err)
+	}
+	if got := hdr.Get("Location"); got != "https://cdn.example.com/"+fdef.Location {
+		t.Error("Expected public URL, got", got)
+	}
+	// The tag is cached.
+	fake.mu.Lock()
+	fake.ops = nil
+	fake.mu.Unlock()
+	serve("")
+	if fake.hasOp("GetObjectTagging") {
+		t.Error("Tags read again")
+	}
+	// Attachments need the presigned response override, which requires a token.
+	if _, _, err = serve("?asatt=1"); err != types.ErrPermissionDenied {
+		t.Error("Expected token check for attachment, got", err)
+	}
+
+	// Private.
+	fake.mu.Lock()
+	fake.objects[fdef.Location].header.Set("X-Amz-Tagging", "visibility=private")
+	fake.mu.Unlock()
+	ah.visibilities = newObjectCache[visibility]()
+	if _, _, err = serve(""); err != types.ErrPermissionDenied {
+		t.Error("Private object served without token", err)
+	}
+
+	if err = (&awshandler{}).Init(`{"access_key_id": "a", "secret_access_key": "b", "bucket": "b",
+		"public_url": "cdn.example.com"}`); err == nil {
+		t.Error("Invalid public_url accepted")
+	}
+}
+
+func TestNeverCreateBucket(t *testing.T) {
+	fake, _ := newFakeS3(t)
+	var puts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			puts.Add(1)
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	conf := func(bucket string) string {
+		return `{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + bucket + `", "endpoint": "` + srv.URL + `", "force_path_style": true,
+			"never_create_bucket": true}`
+	}
+	err := (&awshandler{}).Init(conf("missing"))
+	if err == nil || !strings.Contains(err.Error(), "never_create_bucket") {
+		t.Error("Expected failure for missing bucket, got", err)
+	}
+	if puts.Load() != 0 {
+		t.Error("Bucket creation attempted")
+	}
+	if err = (&awshandler{}).Init(conf(testBucket)); err != nil {
+		t.Error("Existing bucket rejected:", err)
+	}
+}
+
+func TestManageCors(t *testing.T) {
+	fake, _ := newFakeS3(t)
+	var creates, corsPuts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/new-bucket" && r.Method == http.MethodPut {
+			if r.URL.Query().Has("cors") {
+				corsPuts.Add(1)
+			} else {
+				creates.Add(1)
+			}
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	conf := func(extra string) string {
+		return `{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "new-bucket", "endpoint": "` + srv.URL + `", "force_path_style": true` + extra + `}`
+	}
+	if err := (&awshandler{}).Init(conf("")); err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	if creates.Load() != 1 || corsPuts.Load() != 1 {
+		t.Error("Expected bucket created with CORS rules", creates.Load(), corsPuts.Load())
+	}
+
+	if err := (&awshandler{}).Init(conf(`, "manage_cors": false`)); err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	if creates.Load() != 2 || corsPuts.Load() != 1 {
+		t.Error("Expected bucket created without CORS rules", creates.Load(), corsPuts.Load())
+	}
+
+	err := (&awshandler{}).Init(conf(`, "manage_cors": false, "cors_rules": [{"methods": ["GET"]}]`))
+	if err == nil || !strings.Contains(err.Error(), "manage_cors") {
+		t.Error("Expected cors_rules rejected, got", err)
+	}
+}
+
+func TestUploadEx(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"placeholders": true`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)))
+
+	fdef := newTestFileDef()
+	res, err := ah.UploadEx(context.Background(), fdef, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal("UploadEx failed:", err)
+	}
+	if res.URL != defaultServeURL+fdef.Id+".png" || res.Size != int64(buf.Len()) || res.Location != fdef.Location ||
+		res.ETag == "" || res.ETag != fdef.ETag || res.MimeType != "image/png" {
+		t.Error("Unexpected result", res)
+	}
+	if res.Width != 40 || res.Height != 30 || len(res.Placeholder) != 28 {
+		t.Error("Image not described", res.Width, res.Height, res.Placeholder)
+	}
+
+	// Not an image: no dimensions.
+	doc := newTestFileDef()
+	doc.Id = types.Uid(23456).String()
+	doc.MimeType = "text/plain"
+	if res, err = media.UploadEx(context.Background(), ah, doc, bytes.NewReader([]byte("text"))); err != nil {
+		t.Fatal("UploadEx failed:", err)
+	}
+	if res.Size != 4 || res.Width != 0 || res.Placeholder != "" {
+		t.Error("Unexpected result of a text file", res)
+	}
+}
+
+func TestPinPresignToIP(t *testing.T) {
+	var mu sync.Mutex
+	var policies []string
+	failSTS := false
+	stsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+		if failSTS || r.Form.Get("Action") != "AssumeRole" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<ErrorResponse><Error><Code>AccessDenied</Code></Error></ErrorResponse>`)
+			return
+		}
+		policies = append(policies, r.Form.Get("Policy"))
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult>
+<Credentials><AccessKeyId>ASIAPINNED</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>
+<SessionToken>token</SessionToken><Expiration>`+time.Now().Add(75*time.Minute).UTC().Format(time.RFC3339)+
+			`</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+	}))
+	t.Cleanup(stsSrv.Close)
+
+	ah, _, files := newTestHandler(t, `"pin_presign_to_ip": true, "pin_presign_ipv4_prefix": 24,
+		"pin_presign_role_arn": "arn:aws:iam::123456789012:role/presign", "sts_endpoint": "`+stsSrv.URL+`"`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+
+	location := func(remoteAddr string) (*url.URL, error) {
+		ctx := context.Background()
+		if remoteAddr != "" {
+			ctx = media.NewContext(ctx, &media.RequestInfo{RemoteAddr: remoteAddr})
+		}
+		hdr, _, err := ah.HeadersWithContext(ctx, http.MethodGet, u, http.Header{}, true)
+		if err != nil {
+			return nil, err
+		}
+		return url.Parse(hdr["Location"][0])
+	}
+
+	loc, err := location("203.0.113.7:5555")
+	if err != nil {
+		t.Fatal("Pinned presign failed:", err)
+	}
+	if q := loc.Query(); !strings.HasPrefix(q.Get("X-Amz-Credential"), "ASIAPINNED/") || q.Get("X-Amz-Security-Token") != "token" {
+		t.Error("URL not signed with pinned credentials", loc)
+	}
+	if len(policies) != 1 || !strings.Contains(policies[0], `"aws:SourceIp":"203.0.113.0/24"`) {
+		t.Fatal("Session policy not limited to the network", policies)
+	}
+
+	// Same network reuses the credentials, another network gets its own.
+	if _, err = location("203.0.113.99"); err != nil || len(policies) != 1 {
+		t.Error("Credentials of the network not reused", len(policies), err)
+	}
+	if _, err = location("[2001:db8::1]:443"); err != nil || len(policies) != 2 ||
+		!strings.Contains(policies[1], `"2001:db8::/64"`) {
+		t.Error("IPv6 network not pinned", policies, err)
+	}
+
+	// Unknown address is not pinned.
+	if loc, err = location(""); err != nil || !strings.HasPrefix(loc.Query().Get("X-Amz-Credential"), "key/") {
+		t.Error("URL without client address must not be pinned", loc, err)
+	}
+
+	// Failure to get the credentials fails the request.
+	mu.Lock()
+	failSTS = true
+	mu.Unlock()
+	if _, err = location("198.51.100.1"); err != types.ErrUnavailable {
+		t.Error("Expected ErrUnavailable, got", err)
+	}
+
+	if err = (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "pin_presign_to_ip": true}`); err == nil ||
+		!strings.Contains(err.Error(), "pin_presign_role_arn") {
+		t.Error("Pinning without a role accepted", err)
+	}
+}
+
+func TestHeadContentType(t *testing.T) {
+	ah, fake, files := newTestHandler(t, "")
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	// Uploaded by an older version without the content type.
+	fake.mu.Lock()
+	fake.objects[ah.objectLocation(fdef)] = &fakeObject{data: []byte("png"),
+		header: http.Header{"Content-Type": {"application/octet-stream"}}}
+	fake.mu.Unlock()
+
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	contentType := func(method string) string {
+		hdr, status, err := ah.Headers(method, u, http.Header{}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal(method, "expected redirect, got", status, err)
+		}
+		req, _ := http.NewRequest(method, hdr["Location"][0], nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(method, "failed:", err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Content-Type")
+	}
+	head, get := contentType(http.MethodHead), contentType(http.MethodGet)
+	if head != fdef.MimeType || get != fdef.MimeType {
+		t.Errorf("Expected '%s' for HEAD and GET, got '%s' and '%s'", fdef.MimeType, head, get)
+	}
+}
+
+func TestBatchPresign(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"batch_presign": {"max_files": 3, "rate": 4},
+		"immutable": {"retention_days": 30, "token_secret": "secret"}`)
+	ready := newTestFileDef()
+	ready.Status = types.UploadCompleted
+	ready.Location = ah.objectKey(ready.Uid())
+	pending := newTestFileDef()
+	pending.Id = types.Uid(23456).String()
+	immutable := newTestFileDef()
+	immutable.Id = types.Uid(34567).String()
+	immutable.Status = types.UploadCompleted
+	immutable.Location = defaultImmutablePrefix + ah.objectKey(immutable.Uid())
+	ids := []string{ready.Id, pending.Id, immutable.Id}
+	files.EXPECT().GetAll(ids).Return([]types.FileDef{*ready, *pending, *immutable}, nil)
+
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{Uid: types.Uid(777)})
+	// Duplicates are signed once.
+	urls, err := ah.PresignURLs(ctx, append(ids, ready.Id))
+	if err != nil {
+		t.Fatal("PresignURLs failed:", err)
+	}
+	if len(urls) != 1 || !strings.Contains(urls[ready.Id], "X-Amz-Signature") {
+		t.Error("Expected the URL of the uploaded file only, got", urls)
+	}
+
+	if _, err = ah.PresignURLs(ctx, append(ids, types.Uid(45678).String())); err != types.ErrTooLarge {
+		t.Error("Expected ErrTooLarge, got", err)
+	}
+	if _, err = ah.PresignURLs(ctx, []string{"not an id!"}); err != types.ErrMalformed {
+		t.Error("Expected ErrMalformed, got", err)
+	}
+	// Three of four files per minute are used up.
+	if _, err = ah.PresignURLs(ctx, ids[:2]); err != types.ErrPolicy {
+		t.Error("Expected ErrPolicy, got", err)
+	}
+	// Other users have their own allowance.
+	other := media.NewContext(context.Background(), &media.RequestInfo{Uid: types.Uid(888)})
+	files.EXPECT().GetAll(ids[:1]).Return([]types.FileDef{*ready}, nil)
+	if urls, err = ah.PresignURLs(other, ids[:1]); err != nil || len(urls) != 1 {
+		t.Error("Allowance of another user used up", urls, err)
+	}
+
+	plain, _, _ := newTestHandler(t, "")
+	if _, err = plain.PresignURLs(ctx, ids); err != types.ErrUnsupported {
+		t.Error("Expected ErrUnsupported, got", err)
+	}
+	if err = (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "batch_presign": {}, "download_token_ttl": 60}`); err == nil ||
+		!strings.Contains(err.Error(), "download_token_ttl") {
+		t.Error("Batch presigning with download tokens accepted", err)
+	}
+}
+
+func TestHeadMetadata(t *testing.T) {
+	newFile := func(ah *awshandler, fake *fakeS3) *types.FileDef {
+		fdef := newTestFileDef()
+		fdef.Status = types.UploadCompleted
+		fdef.Location = ah.objectKey(fdef.Uid())
+		fdef.ETag = "stale"
+		fdef.Size = 4
+		// The object was replaced out of band.
+		fake.mu.Lock()
+		fake.objects[fdef.Location] = &fakeObject{data: []byte("replaced"), header: http.Header{"Etag": {`"live"`}}}
+		fake.mu.Unlock()
+		return fdef
+	}
+	u, _ := url.Parse(defaultServeURL + types.Uid(12345).String() + ".png")
+
+	// The record is trusted by default.
+	ah, fake, files := newTestHandler(t, `"proxy": "always"`)
+	fdef := newFile(ah, fake)
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+	hdr, _, err := ah.Headers(http.MethodHead, u, http.Header{}, true)
+	if err != nil || hdr.Get("Content-Length") != "4" || hdr["ETag"][0] != `"stale"` {
+		t.Error("Expected metadata of the record", hdr, err)
+	}
+
+	ah, fake, files = newTestHandler(t, `"proxy": "always", "head_metadata": "verify"`)
+	fdef = newFile(ah, fake)
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+	var repaired *types.FileDef
+	files.EXPECT().FinishUpload(gomock.Any(), true, int64(8)).DoAndReturn(
+		func(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+			repaired = fd
+			fd.Size = size
+			return fd, nil
+		})
+	hdr, _, err = ah.Headers(http.MethodHead, u, http.Header{}, true)
+	if err != nil || hdr.Get("Content-Length") != "8" || hdr["ETag"][0] != `"live"` ||
+		hdr.Get("Content-Type") != fdef.MimeType {
+		t.Error("Expected metadata of the object", hdr, err)
+	}
+	if repaired == nil || repaired.ETag != "live" || repaired.Id != fdef.Id {
+		t.Error("File record not repaired", repaired)
+	}
+
+	for _, conf := range []string{`"head_metadata": "s3"`, `"head_verify_rate": 2`} {
+		if err = (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + testBucket + `", ` + conf + `}`); err == nil || !strings.Contains(err.Error(), "head_") {
+			t.Error("Invalid config accepted", conf, err)
+		}
+	}
+}
+
+func TestIdempotentRetry(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"idempotency_ttl": 60`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).Times(2)
+
+	data := []byte("uploaded once")
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{
+		Header: http.Header{idempotencyKeyHeader: {"retry-1"}},
+	})
+	upload := func(id uint64, user string) (*types.FileDef, string) {
+		fdef := newTestFileDef()
+		fdef.Id = types.Uid(id).String()
+		fdef.User = user
+		url, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal("Upload failed:", err)
+		}
+		return fdef, url
+	}
+
+	first, firstURL := upload(12345, "usr1")
+	// Sequential retry after the first upload completed.
+	retry, retryURL := upload(12346, "usr1")
+	if retryURL != firstURL || retry.Id != first.Id || retry.Location != first.Location {
+		t.Error("Retry must return the first result", firstURL, retryURL, retry.Id)
+	}
+
+	// Concurrent retries.
+	var wg sync.WaitGroup
+	urls := make([]string, 5)
+	for i := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fdef := newTestFileDef()
+			fdef.Id = types.Uid(20000 + i).String()
+			fdef.User = "usr1"
+			url, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader(data))
+			if err != nil || fdef.Id != first.Id {
+				t.Error("Concurrent retry failed", fdef.Id, err)
+			}
+			urls[i] = url
+		}()
+	}
+	wg.Wait()
+	for _, url := range urls {
+		if url != firstURL {
+			t.Error("Concurrent retry must return the first result", url)
+		}
+	}
+	fake.mu.Lock()
+	stored := len(fake.objects)
+	fake.mu.Unlock()
+	if stored != 1 {
+		t.Error("Expected one stored object, got", stored)
+	}
+
+	// Keys are scoped to the user.
+	if other, _ := upload(12347, "usr2"); other.Id == first.Id {
+		t.Error("Result of another user returned")
+	}
+	// Expired results are forgotten.
+	done, _ := ah.completed.get("usr1/retry-1")
+	done.expires = time.Now().Add(-time.Second)
+	ah.completed.set("usr1/retry-1", done)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	if again, _ := upload(12348, "usr1"); again.Id == first.Id {
+		t.Error("Expired result returned")
+	}
+}
+
+func TestLogFileIds(t *testing.T) {
+	var buf bytes.Buffer
+	logs.Warn.SetOutput(&buf)
+	t.Cleanup(func() { logs.Warn.SetOutput(os.Stderr) })
+
+	ah, _, files := newTestHandler(t, `"log_file_ids": "hash", "log_id_secret": "secret", "missing_object_status": 410`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	if _, status, _ := ah.Headers(http.MethodGet, u, http.Header{}, true); status != http.StatusGone {
+		t.Fatal("Expected 410, got", status)
+	}
+	logged := buf.String()
+	if strings.Contains(logged, fdef.Id) || !strings.Contains(logged, ah.redact.ref(fdef.Id)) {
+		t.Error("File ID not hashed in logs:", logged)
+	}
+
+	// Hashes with the same secret match across handlers.
+	other, _, _ := newTestHandler(t, `"log_file_ids": "hash", "log_id_secret": "secret"`)
+	if ref := other.redact.ref(fdef.Id); ref != ah.redact.ref(fdef.Id) || ref == fdef.Id {
+		t.Error("Unexpected hash", ref)
+	}
+	plain, _, _ := newTestHandler(t, "")
+	if ref := plain.redact.ref(fdef.Id); ref != fdef.Id {
+		t.Error("File ID must be logged as is by default, got", ref)
+	}
+
+	if err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+		"bucket": "` + testBucket + `", "log_file_ids": "short"}`); err == nil || !strings.Contains(err.Error(), "log_file_ids") {
+		t.Error("Invalid log_file_ids accepted", err)
+	}
+}
+
+// exifJPEG encodes a 16x8 image, red on the left and blue on the right, with the EXIF orientation tag.
+func exifJPEG(t *testing.T, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := range 8 {
+		for x := range 16 {
+			if x < 8 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Big-endian TIFF with one IFD entry: the orientation, SHORT.
+	tiff := []byte{'M', 'M', 0, 0x2a, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1,
+		byte(orientation >> 8), byte(orientation), 0, 0, 0, 0, 0, 0}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app1...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestNormalizeOrientation(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"normalize_orientation": true, "placeholders": true`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+
+	data := exifJPEG(t, 6)
+	if jpegOrientation(data) != 6 {
+		t.Fatal("Orientation not parsed")
+	}
+	fdef := newTestFileDef()
+	fdef.MimeType = "image/jpeg"
+	res, err := ah.UploadEx(context.Background(), fdef, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	stored := fake.object(fdef.Location).data
+	if res.Size != int64(len(stored)) || bytes.Equal(stored, data) {
+		t.Error("Rotated image not stored", res.Size, len(stored))
+	}
+	if jpegOrientation(stored) != 0 {
+		t.Error("Orientation tag not stripped")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal("Stored image not decoded:", err)
+	}
+	// Rotated clockwise: the left half is on top.
+	if b := img.Bounds(); b.Dx() != 8 || b.Dy() != 16 || res.Width != 8 || res.Height != 16 {
+		t.Error("Dimensions not swapped", b, res.Width, res.Height)
+	}
+	if r, _, bl, _ := img.At(4, 2).RGBA(); r < bl {
+		t.Error("Expected red on top")
+	}
+	if r, _, bl, _ := img.At(4, 13).RGBA(); r > bl {
+		t.Error("Expected blue at the bottom")
+	}
+
+	// Images without the tag are stored as is.
+	plain := exifJPEG(t, 1)
+	fdef = newTestFileDef()
+	fdef.Id = types.Uid(12346).String()
+	fdef.MimeType = "image/jpeg"
+	if _, err = ah.UploadEx(context.Background(), fdef, bytes.NewReader(plain)); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if !bytes.Equal(fake.object(fdef.Location).data, plain) {
+		t.Error("Image without rotation changed")
+	}
+}
+
+func TestServeURLBase(t *testing.T) {
+	for _, tc := range []struct {
+		conf, prefix string
+	}{
+		// Root mount.
+		{"", defaultServeURL},
+		// Subpath mount.
+		{`"serve_url_base": "/chat/"`, "/chat" + defaultServeURL},
+	} {
+		ah, _, files := newTestHandler(t, tc.conf)
+		files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+
+		fdef := newTestFileDef()
+		url, _, err := ah.Upload(fdef, bytes.NewReader([]byte("data")))
+		if err != nil {
+			t.Fatal("Upload failed:", err)
+		}
+		if !strings.HasPrefix(url, tc.prefix+fdef.Id) {
+			t.Error("Unexpected URL", url, "expected prefix", tc.prefix)
+		}
+		for _, ref := range []string{url, defaultServeURL + fdef.Id + ".png"} {
+			if fid := ah.GetIdFromUrl(ref); fid.String() != fdef.Id {
+				t.Error("File ID not resolved from", ref, fid)
+			}
+		}
+	}
+
+	err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1", "bucket": "` +
+		testBucket + `", "serve_url_base": "chat"}`)
+	if err == nil || !strings.Contains(err.Error(), "serve_url_base") {
+		t.Error("Invalid serve_url_base accepted", err)
+	}
+}
+
+// failingThumbnailer is a thumbnailer which is always down.
+type failingThumbnailer struct{}
+
+func (failingThumbnailer) Init(jsconf string) error {
+	return nil
+}
+
+func (failingThumbnailer) Thumbnail(ctx context.Context, mimeType string, img []byte, size int) ([]byte, string, error) {
+	return nil, "", errors.New("thumbnailer is down")
+}
+
+func TestThumbnails(t *testing.T) {
+	media.RegisterThumbnailer("test-failing", failingThumbnailer{})
+
+	ah, fake, files := newTestHandler(t, `"thumbnails": {"size": 20}`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+
+	img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 6), G: 80, B: uint8(y * 8), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	fdef := newTestFileDef()
+	res, err := ah.UploadEx(context.Background(), fdef, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	thumbURL := defaultServeURL + fdef.Id + ".png?thumb=1"
+	if res.Thumbnail != thumbURL {
+		t.Error("Unexpected thumbnail URL", res.Thumbnail)
+	}
+	key := ah.variantKey(fdef.Location, thumbnailKind)
+	stored := fake.object(key)
+	if stored == nil || stored.header.Get("Content-Type") != "image/png" {
+		t.Fatal("Thumbnail not stored", stored)
+	}
+	if thumb, err := png.DecodeConfig(bytes.NewReader(stored.data)); err != nil || thumb.Width != 20 || thumb.Height != 15 {
+		t.Error("Wrong thumbnail", thumb, err)
+	}
+
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	// Read the content type of the thumbnail from S3.
+	ah.thumbnails = newObjectCache[string]()
+	meta, err := ah.FileMetadata(context.Background(), defaultServeURL+fdef.Id+".png", false)
+	if err != nil || meta.Thumbnail != thumbURL {
+		t.Error("Thumbnail not described", meta, err)
+	}
+	u, _ := url.Parse(thumbURL)
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+	if err != nil || status != http.StatusPermanentRedirect || !strings.Contains(hdr.Get("Location"), key) ||
+		!strings.Contains(hdr.Get("Location"), "response-content-type=image%2Fpng") {
+		t.Error("Thumbnail not redirected to", hdr, status, err)
+	}
+
+	// Not an image.
+	doc := newTestFileDef()
+	doc.Id = types.Uid(23456).String()
+	doc.MimeType = "text/plain"
+	doc.Status = types.UploadCompleted
+	if res, err = ah.UploadEx(context.Background(), doc, bytes.NewReader([]byte("text"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if res.Thumbnail != "" || fake.object(ah.variantKey(doc.Location, thumbnailKind)) != nil {
+		t.Error("Thumbnail of a text file stored")
+	}
+	files.EXPECT().Get(doc.Id).Return(doc, nil).AnyTimes()
+	u, _ = url.Parse(defaultServeURL + doc.Id + ".txt?thumb=1")
+	if _, _, err = ah.Headers(http.MethodGet, u, http.Header{}, true); err != types.ErrNotFound {
+		t.Error("Expected ErrNotFound for a missing thumbnail, got", err)
+	}
+
+	// The upload succeeds when the thumbnailer fails.
+	ah, fake, files = newTestHandler(t, `"thumbnails": {"name": "test-failing"}`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil)
+	fdef = newTestFileDef()
+	if res, err = ah.UploadEx(context.Background(), fdef, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal("Upload failed with a failing thumbnailer:", err)
+	}
+	if res.Thumbnail != "" || fake.object(ah.variantKey(fdef.Location, thumbnailKind)) != nil {
+		t.Error("Thumbnail stored by a failing thumbnailer")
+	}
+	if obj := fake.object(fdef.Location); obj == nil || !bytes.Equal(obj.data, buf.Bytes()) {
+		t.Error("Image not stored")
+	}
+
+	for _, conf := range []string{
+		`"thumbnails": {"name": "none"}`,
+		`"thumbnails": {"size": -1}`,
+		`"thumbnails": {"name": "http", "config": {"url": "none"}}`,
+		`"thumbnails": {}, "proxy": "always"`,
+	} {
+		err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1", "bucket": "` +
+			testBucket + `", ` + conf + `}`)
+		if err == nil {
+			t.Error("Invalid config accepted", conf)
+		}
+	}
+}
+
+func TestUnsatisfiableRange(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"bytes=16-", true},
+		{"bytes=100-200", true},
+		{"bytes=16-20, 30-", true},
+		{"bytes=-0", true},
+		{"bytes=15-", false},
+		{"bytes=0-100", false},
+		{"bytes=-5", false},
+		{"bytes=30-40, 0-1", false},
+		// Invalid headers are ignored.
+		{"bytes=20-10", false},
+		{"bytes=x-", false},
+		{"items=20-", false},
+		{"bytes=", false},
+	} {
+		if got := rangesUnsatisfiable(tc.header, 16); got != tc.want {
+			t.Errorf("%s: expected %t, got %t", tc.header, tc.want, got)
+		}
+	}
+
+	ah, fake, files := newTestHandler(t, "")
+	data := []byte("0123456789abcdef")
+	fdef := newTestFileDef()
+	fdef.Location = fdef.Uid().String32()
+	fdef.Size = int64(len(data))
+	fdef.ETag = "put-etag"
+	fdef.Status = types.UploadCompleted
+	fake.objects[fdef.Location] = &fakeObject{data: data, header: http.Header{"ETag": {`"put-etag"`}}}
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{"Range": {"bytes=20-"}}, true)
+	if err != nil || status != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatal("Expected 416, got", status, err)
+	}
+	if hdr.Get("Content-Range") != "bytes */16" || hdr.Get("Location") != "" {
+		t.Error("Unexpected headers of 416", hdr)
+	}
+
+	for _, headers := range []http.Header{
+		{"Range": {"bytes=10-"}},
+		// The range is of another version, the whole file is served.
+		{"Range": {"bytes=20-"}, "If-Range": {`"old-etag"`}},
+	} {
+		_, status, err = ah.Headers(http.MethodGet, u, headers, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Error("Expected redirect, got", headers, status, err)
+		}
+	}
+}
+
+func TestDangerousExtensions(t *testing.T) {
+	ah, fake, files := newTestHandler(t, "")
+	fdef := newTestFileDef()
+	fdef.Location = fdef.Uid().String32()
+	fdef.Size = 4
+	fdef.ETag = "put-etag"
+	fdef.Status = types.UploadCompleted
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("data"), header: http.Header{"ETag": {`"put-etag"`}}}
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	redirect := func(ah *awshandler, serveURL string) string {
+		u, _ := url.Parse(serveURL)
+		hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		return hdr.Get("Location")
+	}
+	forced := func(location string) bool {
+		return strings.Contains(location, "response-content-disposition=attachment") &&
+			strings.Contains(location, "response-content-type=application%2Foctet-stream")
+	}
+
+	base := defaultServeURL + fdef.Id
+	for _, serveURL := range []string{base + ".exe", base + ".HTML", base + ".png?filename=photo.png.exe",
+		base + ".png?filename=run.bat.%20."} {
+		if !forced(redirect(ah, serveURL)) {
+			t.Error("Dangerous download not forced", serveURL)
+		}
+	}
+	if location := redirect(ah, base+".png?filename=photo.png"); forced(location) ||
+		!strings.Contains(location, "response-content-type=image%2Fpng") {
+		t.Error("Safe download forced", location)
+	}
+
+	// Proxied downloads are typed safely too, the record is unchanged.
+	got, reader, err := ah.Download(base + ".svg")
+	if err != nil {
+		t.Fatal("Download failed:", err)
+	}
+	reader.Close()
+	if got.MimeType != safeContentType || fdef.MimeType != "image/png" {
+		t.Error("Unexpected content type of proxied download", got.MimeType, fdef.MimeType)
+	}
+
+	// Disabled and custom lists.
+	ah.conf.DangerousExtensions = []string{}
+	ah.initDangerousExtensions()
+	if forced(redirect(ah, base+".exe")) {
+		t.Error("Download forced with the policy disabled")
+	}
+	ah.conf.DangerousExtensions = []string{"PNG"}
+	ah.initDangerousExtensions()
+	if !forced(redirect(ah, base+".png")) || forced(redirect(ah, base+".exe")) {
+		t.Error("Custom extensions not applied")
+	}
+
+	err = (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1", "bucket": "` +
+		testBucket + `", "dangerous_extensions": ["a/b"]}`)
+	if err == nil || !strings.Contains(err.Error(), "dangerous_extensions") {
+		t.Error("Invalid extension accepted", err)
+	}
+}
+
+func TestInlineTypes(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"inline_types": ["image/*", "Application/PDF"]`)
+	fdef := newTestFileDef()
+	fdef.Location = fdef.Uid().String32()
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	attachment := func(mimeType string) bool {
+		fdef.MimeType = mimeType
+		u, _ := url.Parse(defaultServeURL + fdef.Id)
+		hdr, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true)
+		if err != nil || status != http.StatusPermanentRedirect {
+			t.Fatal("Expected redirect, got", status, err)
+		}
+		return strings.Contains(hdr.Get("Location"), "response-content-disposition=attachment")
+	}
+	for _, mimeType := range []string{"image/png", "image/jpeg", "application/pdf; charset=binary"} {
+		if attachment(mimeType) {
+			t.Error("Allowlisted type downloaded as attachment", mimeType)
+		}
+	}
+	for _, mimeType := range []string{"text/html", "application/octet-stream", "video/mp4"} {
+		if !attachment(mimeType) {
+			t.Error("Type outside of the allowlist rendered inline", mimeType)
+		}
+	}
+
+	// The denylist forces only the listed types.
+	ah.conf.InlineTypes = nil
+	ah.conf.ForceDownloadTypes = []string{"text/*"}
+	if !attachment("text/html") || attachment("video/mp4") {
+		t.Error("force_download_types not applied")
+	}
+
+	conf := `{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1", "bucket": "` + testBucket + `"`
+	for _, extra := range []string{`"inline_types": ["image/*"], "force_download_types": ["text/*"]`,
+		`"inline_types": ["image"]`, `"force_download_types": ["text/["]`} {
+		if err := (&awshandler{}).Init(conf + `, ` + extra + `}`); err == nil {
+			t.Error("Expected", extra, "rejected")
+		}
+	}
+}
+
+func TestVerifyProxiedDownloads(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"proxy": "request", "verify_proxied_downloads": true`)
+
+	data := []byte("0123456789abcdef")
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+	fdef := newTestFileDef()
+	fdef.Location = fdef.Uid().String32()
+	fdef.Size = int64(len(data))
+	fdef.ETag = etag
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	download := func(offset int64) {
+		_, reader, err := ah.Download(defaultServeURL + fdef.Id + ".png")
+		if err != nil {
+			t.Fatal("Download failed:", err)
+		}
+		defer reader.Close()
+		reader.Seek(offset, io.SeekStart)
+		if _, err = io.ReadAll(reader); err != nil {
+			t.Fatal("Read failed:", err)
+		}
+	}
+
+	before := corruptDownloads.Value()
+	fake.objects[fdef.Location] = &fakeObject{data: data, header: http.Header{"ETag": {`"` + etag + `"`}}}
+	download(0)
+	if corruptDownloads.Value() != before {
+		t.Error("Intact download reported corrupt")
+	}
+
+	// Same ETag, different content.
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("0123456789abcdeX"), header: http.Header{"ETag": {`"` + etag + `"`}}}
+	download(0)
+	if corruptDownloads.Value() != before+1 {
+		t.Error("Corrupt download not reported")
+	}
+	// Ranges are not verified.
+	download(4)
+	if corruptDownloads.Value() != before+1 {
+		t.Error("Partial download verified")
+	}
+
+	// ETags of multipart uploads are not MD5 of the content.
+	fdef.ETag = "mpu-etag"
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("0123456789abcdeX"), header: http.Header{"ETag": {`"mpu-etag"`}}}
+	download(0)
+	if corruptDownloads.Value() != before+1 {
+		t.Error("Download verified against a multipart ETag")
+	}
+}
+
+// pngWithDimensions returns a PNG image whose header declares the dimensions regardless of its pixels.
+func pngWithDimensions(width, height uint32) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	data := buf.Bytes()
+	// The IHDR chunk follows the signature and is covered by its CRC.
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestImageLimits(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"image_limits": {"min_width": 10, "min_height": 10, "max_width": 1000,
+		"max_height": 1000, "max_pixels": 500000}`)
+	files.EXPECT().StartUpload(gomock.Any()).Return(nil).AnyTimes()
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)))
+	fdef := newTestFileDef()
+	res, err := ah.UploadEx(context.Background(), fdef, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if res.Size != int64(buf.Len()) || !bytes.Equal(fake.object(fdef.Location).data, buf.Bytes()) {
+		t.Error("Image not stored as is", res.Size)
+	}
+
+	for i, tc := range []struct {
+		width, height int
+	}{
+		// Pixel bomb.
+		{100000, 100000},
+		{2000, 20},
+		{20, 2000},
+		{900, 900},
+		{5, 20},
+		{20, 5},
+	} {
+		fdef := newTestFileDef()
+		fdef.Id = types.Uid(50000 + i).String()
+		files.EXPECT().FinishUpload(fdef, false, int64(0)).Return(nil, nil)
+		_, _, err := ah.Upload(fdef, bytes.NewReader(pngWithDimensions(uint32(tc.width), uint32(tc.height))))
+		var dimsErr *media.ImageDimensionsError
+		if !errors.As(err, &dimsErr) || !errors.Is(err, types.ErrPolicy) ||
+			dimsErr.Width != tc.width || dimsErr.Height != tc.height {
+			t.Error(tc.width, "x", tc.height, "expected dimensions error, got", err)
+		}
+		if fake.object(ah.uploadObjectKey(context.Background(), fdef.Uid())) != nil {
+			t.Error(tc.width, "x", tc.height, "rejected image stored")
+		}
+	}
+
+	// Not an image after all.
+	bad := newTestFileDef()
+	bad.Id = types.Uid(60000).String()
+	files.EXPECT().FinishUpload(bad, false, int64(0)).Return(nil, nil)
+	if _, _, err = ah.Upload(bad, bytes.NewReader([]byte("\x89PNG\r\n\x1a\nbroken"))); err != types.ErrMalformed {
+		t.Error("Expected invalid header rejected, got", err)
+	}
+
+	// Other files are not checked.
+	doc := newTestFileDef()
+	doc.Id = types.Uid(60001).String()
+	doc.MimeType = "text/plain"
+	if _, _, err = ah.Upload(doc, bytes.NewReader([]byte("text"))); err != nil {
+		t.Error("Text upload failed:", err)
+	}
+
+	for _, limits := range []string{`{"max_width": -1}`, `{"min_height": 200, "max_height": 100}`,
+		`{"min_width": 100, "min_height": 100, "max_pixels": 1000}`} {
+		err := (&awshandler{}).Init(`{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1",
+			"bucket": "` + testBucket + `", "image_limits": ` + limits + `}`)
+		if err == nil || !strings.Contains(err.Error(), "image_limits") {
+			t.Error("Expected", limits, "rejected, got", err)
+		}
+	}
+}
+
+func TestConfigUnknownOption(t *testing.T) {
+	conf := `{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1", "bucket": "` + testBucket + `"`
+	// A typo in the name of an option.
+	err := (&awshandler{}).Init(conf + `, "presign_tll": 100}`)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "presign_tll"`) {
+		t.Error("Expected unknown option rejected, got", err)
+	}
+	err = (&awshandler{}).Init(conf + `, "thumbnails": {"sise": 100}}`)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "sise"`) {
+		t.Error("Expected unknown nested option rejected, got", err)
+	}
+
+	data, err := (&awshandler{}).ConfigSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Extra      bool `json:"additionalProperties"`
+		Properties map[string]struct {
+			Type string   `json:"type"`
+			Enum []string `json:"enum"`
+		} `json:"properties"`
+	}
+	if err = json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema.Extra || schema.Properties["presign_ttl"].Type != "integer" || schema.Properties["thumbnails"].Type != "object" ||
+		!slices.Contains(schema.Properties["proxy"].Enum, proxyAlways) || schema.Properties["presign_tll"].Type != "" {
+		t.Error("Unexpected schema", string(data))
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"file_download_limit": true, "delete_exhausted": true,
+		"thumbnails": {}`)
+	var stored types.FileDef
+	files.EXPECT().StartUpload(gomock.Any()).DoAndReturn(func(fd *types.FileDef) error {
+		stored = *fd
+		return nil
+	})
+
+	fdef := newTestFileDef()
+	ctx := media.NewContext(context.Background(), &media.RequestInfo{MaxDownloads: "2"})
+	if _, _, err := ah.UploadWithContext(ctx, fdef, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	if stored.DownloadLimit != 2 {
+		t.Fatal("Download limit not stored", stored.DownloadLimit)
+	}
+	for _, limit := range []string{"0", "-1", "once", "4294967296"} {
+		ctx = media.NewContext(context.Background(), &media.RequestInfo{MaxDownloads: limit})
+		if _, _, err := ah.UploadWithContext(ctx, newTestFileDef(), bytes.NewReader([]byte("data"))); err != types.ErrMalformed {
+			t.Errorf("'%s': expected ErrMalformed, got %v", limit, err)
+		}
+	}
+
+	fdef.Status = types.UploadCompleted
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+
+	// HEAD requests are not counted.
+	hdr, status, err := ah.Headers(http.MethodHead, u, http.Header{}, true)
+	if err != nil || status != http.StatusTemporaryRedirect {
+		t.Fatal("Expected temporary redirect of HEAD, got", status, err)
+	}
+
+	gomock.InOrder(
+		files.EXPECT().CountDownload(fdef.Id).Return(1, nil),
+		files.EXPECT().CountDownload(fdef.Id).Return(2, nil),
+		files.EXPECT().CountDownload(fdef.Id).Return(0, nil),
+	)
+	for i := 0; i < 2; i++ {
+		hdr, status, err = ah.Headers(http.MethodGet, u, http.Header{}, true)
+		if err != nil || status != http.StatusTemporaryRedirect {
+			t.Fatal("Expected temporary redirect, got", status, err)
+		}
+		if hdr.Get("Cache-Control") != limitedCacheControl {
+			t.Error("Redirect may be cached:", hdr.Get("Cache-Control"))
+		}
+		loc, _ := url.Parse(hdr.Get("Location"))
+		if expires, _ := strconv.Atoi(loc.Query().Get("X-Amz-Expires")); expires <= 0 || expires > 60 {
+			t.Error("Presigned URL is long-lived:", expires)
+		}
+	}
+	if fake.object(fdef.Location) == nil {
+		t.Fatal("Object deleted before the presigned URL expired")
+	}
+
+	// The limit is reached: the object is deleted right away.
+	if hdr, status, err = ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusGone {
+		t.Fatal("Expected 410, got", status, err)
+	}
+	if hdr.Get(missingObjectHeader) != "1" {
+		t.Error("Missing", missingObjectHeader)
+	}
+	for i := 0; fake.object(fdef.Location) != nil; i++ {
+		if i == 100 {
+			t.Fatal("Exhausted object not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Exhausted according to the record: not counted again.
+	fdef.Downloads = 2
+	if _, status, err = ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusGone {
+		t.Error("Expected 410 of exhausted record, got", status, err)
+	}
+
+	// Thumbnails would bypass the limit.
+	fdef.Downloads = 0
+	thumb, _ := url.Parse(ah.thumbnailURL(fdef))
+	if _, _, err = ah.Headers(http.MethodGet, thumb, http.Header{}, true); err != types.ErrNotFound {
+		t.Error("Expected thumbnail of limited file not found, got", err)
+	}
+}
+
+func TestDeleteExhaustedOnRestart(t *testing.T) {
+	ah, fake, files := newTestHandler(t, `"file_download_limit": true, "delete_exhausted": true`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	fdef.DownloadLimit = 1
+	fdef.Downloads = 1
+	fake.objects[fdef.Location] = &fakeObject{data: []byte("data"), header: http.Header{"ETag": {`"etag"`}}}
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil)
+
+	// The object of the file exhausted before the restart is deleted by the next request.
+	u, _ := url.Parse(defaultServeURL + fdef.Id + ".png")
+	if _, status, err := ah.Headers(http.MethodGet, u, http.Header{}, true); err != nil || status != http.StatusGone {
+		t.Fatal("Expected 410, got", status, err)
+	}
+	for i := 0; fake.object(fdef.Location) != nil; i++ {
+		if i == 100 {
+			t.Fatal("Exhausted object not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCDNCookies(t *testing.T) {
+	ah, _, files := newTestHandler(t, `"cdn_cookie_url": "https://media.example.com", "file_download_limit": true`)
+	fdef := newTestFileDef()
+	fdef.Status = types.UploadCompleted
+	fdef.Location = ah.objectKey(fdef.Uid())
+	fdef.ETag = "abc"
+	files.EXPECT().Get(fdef.Id).Return(fdef, nil).AnyTimes()
+
+	serve := func(method, query string) (http.Header, int, error) {
+		u, _ := url.Parse(defaultServeURL + fdef.Id + ".png" + query)
+		return ah.Headers(method, u, http.Header{}, true)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		hdr, status, err := serve(method, "")
+		if err != nil || status != http.StatusFound {
+			t.Fatal(method, "expected redirect to the CDN, got", status, err)
+		}
+		if got := hdr.Get("Location"); got != "https://media.example.com/"+fdef.Location {
+			t.Error(method, "expected unsigned CDN URL, got", got)
+		}
+	}
+
+	// The response is altered by the presigned URL.
+	hdr, status, err := serve(http.MethodGet, "?asatt=1")
+	if err != nil || status != http.StatusPermanentRedirect || !strings.Contains(hdr.Get("Location"), "X-Amz-Signature") {
+		t.Error("Expected presigned attachment, got", status, err, hdr.Get("Location"))
+	}
+
+	// Downloads of limited files are counted.
+	fdef.DownloadLimit = 1
+	files.EXPECT().CountDownload(fdef.Id).Return(1, nil)
+	if hdr, status, err = serve(http.MethodGet, ""); err != nil || status != http.StatusTemporaryRedirect ||
+		!strings.Contains(hdr.Get("Location"), "X-Amz-Signature") {
+		t.Error("Expected presigned limited file, got", status, err, hdr.Get("Location"))
+	}
+
+	conf := `{"access_key_id": "key", "secret_access_key": "secret", "region": "us-east-1", "bucket": "` + testBucket + `"`
+	for _, extra := range []string{`"cdn_cookie_url": "media.example.com"`, `"cdn_cookie_url": "https://cdn/?auth=1"`,
+		`"cdn_cookie_url": "https://cdn/", "pin_presign_to_ip": true`} {
+		if err := (&awshandler{}).Init(conf + `, ` + extra + `}`); err == nil || !strings.Contains(err.Error(), "cdn_cookie_url") {
+			t.Error("Expected", extra, "rejected, got", err)
+		}
+	}
+}
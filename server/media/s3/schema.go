@@ -0,0 +1,37 @@
+package s3
+
+import (
+	"slices"
+
+	"github.com/tinode/chat/server/media"
+)
+
+// ConfigSchema returns the JSON Schema of the configuration of the handler for validating configs
+// with external tooling. The handler rejects configs with unknown options just as the schema does.
+func (ah *awshandler) ConfigSchema() ([]byte, error) {
+	var tlsNames []string
+	for name := range tlsVersions {
+		tlsNames = append(tlsNames, name)
+	}
+	slices.Sort(tlsNames)
+
+	// Empty values select the defaults.
+	return media.ConfigSchema("Tinode S3 media handler", awsconfig{}, map[string][]string{
+		"min_tls_version":  append([]string{""}, tlsNames...),
+		"proxy":            {"", proxyOff, proxyRequest, proxyAlways},
+		"head_metadata":    {"", headMetadataDB, headMetadataVerify},
+		"etag_source":      {"", etagSourceS3, etagSourceContentHash},
+		"duplicate_upload": {"", duplicateUploadOverwrite, duplicateUploadExisting},
+		"key_encoding":     {"", keyEncodingBase32, keyEncodingHex, keyEncodingHMAC},
+		"key_layout":       {"", keyLayoutFlat, keyLayoutByTopic},
+		"mime_detection":   {"", mimeClient, mimeSniff, mimeSniffFallback},
+		"mime_correction":  {mimeFromExtension, mimeFromContent},
+		"log_file_ids":     {"", logIDsFull, logIDsHash},
+		"compress":         {encodingBrotli, encodingGzip},
+		"variant_kinds": {placeholderKind, thumbnailKind, compressedKind[encodingBrotli],
+			compressedKind[encodingGzip]},
+		"signature_version":    {"", signatureV4, signatureV2},
+		"last_modified_source": {"", lastModifiedRecord, lastModifiedObject},
+		"multipart":            {"", multipartAuto, multipartOff},
+	})
+}
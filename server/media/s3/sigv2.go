@@ -0,0 +1,162 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Some older S3-compatible appliances accept only URLs presigned with Signature Version 2, which the SDK
+// does not support. With signature_version "v2" download URLs are presigned by sigV2Presigner instead.
+// Requests of the handler itself are still signed with Signature Version 4. AWS does not accept new
+// Signature Version 2 URLs, so "v2" is allowed only with a custom endpoint.
+const (
+	// Values of the "signature_version" config option.
+	signatureV4 = "v4"
+	signatureV2 = "v2"
+)
+
+// Query parameters included in the string to sign of Signature Version 2 URLs.
+var sigV2SubResources = []string{
+	"response-cache-control",
+	"response-content-disposition",
+	"response-content-encoding",
+	"response-content-language",
+	"response-content-type",
+	"response-expires",
+	"versionId",
+}
+
+// initSignatureVersion validates the signature version of presigned URLs.
+func (ah *awshandler) initSignatureVersion() error {
+	switch ah.conf.SignatureVersion {
+	case "":
+		ah.conf.SignatureVersion = signatureV4
+	case signatureV4:
+	case signatureV2:
+		if ah.conf.Endpoint == "" || isAWSEndpoint(ah.conf.Endpoint) {
+			return errors.New("signature_version 'v2' requires a custom endpoint")
+		}
+		for _, rep := range ah.conf.ReadReplicas {
+			if isAWSEndpoint(rep.Endpoint) {
+				return errors.New("signature_version 'v2' can't be used with read replicas on AWS")
+			}
+		}
+		if ah.conf.RequesterPays {
+			// Clients can't send the signed request payer header.
+			return errors.New("signature_version 'v2' can't be used with requester_pays")
+		}
+	default:
+		return errors.New("invalid signature_version '" + ah.conf.SignatureVersion + "'")
+	}
+	return nil
+}
+
+// isAWSEndpoint checks if the endpoint is a host of AWS.
+func isAWSEndpoint(endpoint string) bool {
+	if _, rest, ok := strings.Cut(endpoint, "://"); ok {
+		endpoint = rest
+	}
+	host, _, _ := strings.Cut(endpoint, "/")
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.HasSuffix(host, ".amazonaws.com") || strings.HasSuffix(host, ".amazonaws.com.cn")
+}
+
+// newPresignClient returns the client which presigns requests of the S3 client with the configured
+// signature version, corrected for the clock skew if configured.
+func (ah *awshandler) newPresignClient(svc *s3.Client) *s3.PresignClient {
+	var presigner s3.HTTPPresignerV4
+	if ah.conf.SignatureVersion == signatureV2 {
+		presigner = sigV2Presigner{pathStyle: ah.conf.ForcePathStyle}
+	}
+	if ah.conf.CorrectClockSkew {
+		if presigner == nil {
+			presigner = newV4Presigner(svc)
+		}
+		presigner = skewedPresigner{next: presigner, ah: ah}
+	}
+	if presigner == nil {
+		return s3.NewPresignClient(svc)
+	}
+	return s3.NewPresignClient(svc, func(o *s3.PresignOptions) {
+		o.Presigner = presigner
+	})
+}
+
+// sigV2Presigner presigns requests with Signature Version 2 query parameters.
+type sigV2Presigner struct {
+	// The bucket is in the path of URLs instead of the host name.
+	pathStyle bool
+}
+
+// PresignHTTP implements s3.HTTPPresignerV4. The lifetime of the URL is taken from the X-Amz-Expires
+// parameter set by the presign client.
+func (p sigV2Presigner) PresignHTTP(ctx context.Context, credentials aws.Credentials, r *http.Request,
+	payloadHash string, service string, region string, signingTime time.Time,
+	optFns ...func(*v4.SignerOptions)) (string, http.Header, error) {
+	query := r.URL.Query()
+	ttl, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil {
+		return "", nil, errors.New("sigv2: missing expiration of the presigned URL")
+	}
+	query.Del("X-Amz-Expires")
+	// Operation hint of the SDK, meaningless to the server.
+	query.Del("x-id")
+	expires := strconv.FormatInt(signingTime.Unix()+ttl, 10)
+
+	var amzHeaders string
+	if credentials.SessionToken != "" {
+		amzHeaders = "x-amz-security-token:" + credentials.SessionToken + "\n"
+		query.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	toSign := r.Method + "\n\n\n" + expires + "\n" + amzHeaders + p.canonicalResource(r.URL, query)
+
+	mac := hmac.New(sha1.New, []byte(credentials.SecretAccessKey))
+	mac.Write([]byte(toSign))
+	query.Set("AWSAccessKeyId", credentials.AccessKeyID)
+	query.Set("Expires", expires)
+	query.Set("Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	presigned := *r.URL
+	// Spaces are encoded as %20, the same as in Signature Version 4 URLs.
+	presigned.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	return presigned.String(), http.Header{}, nil
+}
+
+// canonicalResource is the bucket and key of the request followed by the sub-resources in the query.
+func (p sigV2Presigner) canonicalResource(u *url.URL, query url.Values) string {
+	resource := u.EscapedPath()
+	if !p.pathStyle {
+		bucket, _, _ := strings.Cut(u.Hostname(), ".")
+		resource = "/" + bucket + resource
+	}
+	var params []string
+	for name := range query {
+		if slices.Contains(sigV2SubResources, name) {
+			params = append(params, name)
+		}
+	}
+	slices.Sort(params)
+	for i, name := range params {
+		params[i] = name + "=" + query.Get(name)
+	}
+	if len(params) > 0 {
+		resource += "?" + strings.Join(params, "&")
+	}
+	return resource
+}
@@ -0,0 +1,181 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	"github.com/aws/smithy-go"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+)
+
+// Some minimal S3-compatible servers don't implement multipart uploads. With multipart "auto", the first
+// upload rejected by CreateMultipartUpload as not implemented switches the handler to single PutObject
+// requests, and the rejected upload is retried that way from the part already read by the uploader.
+// With multipart "off", uploads are always sent with PutObject. SigV4 requires a seekable body of known
+// length, so uploads are buffered in memory if small, in a temporary file otherwise, up to
+// single_put_max_size.
+const (
+	// Values of the "multipart" config option.
+	multipartAuto = "auto"
+	multipartOff  = "off"
+
+	// Default maximum size of uploads sent with a single PutObject, the limit of S3.
+	defaultSinglePutMaxSize = 5 << 30
+	// Uploads of known size up to this are buffered in memory rather than in a temporary file.
+	singlePutMemorySize = 1 << 20
+
+	// Defaults of the uploader. It reads up to the larger of them before starting a multipart upload.
+	uploaderPartSize  = 8 << 20
+	uploaderThreshold = 16 << 20
+)
+
+// initMultipart validates the mode of multipart uploads.
+func (ah *awshandler) initMultipart() error {
+	switch ah.conf.Multipart {
+	case "":
+		ah.conf.Multipart = multipartAuto
+	case multipartAuto, multipartOff:
+	default:
+		return errors.New("invalid multipart '" + ah.conf.Multipart + "'")
+	}
+	if ah.conf.SinglePutMaxSize < 0 {
+		return errors.New("invalid single_put_max_size")
+	}
+	if ah.conf.SinglePutMaxSize == 0 {
+		ah.conf.SinglePutMaxSize = defaultSinglePutMaxSize
+	}
+	return nil
+}
+
+// uploadObject uploads the object with the uploader, or with a single PutObject if multipart uploads
+// are not supported.
+func (ah *awshandler) uploadObject(ctx context.Context, input *transfermanager.UploadObjectInput,
+	opts []func(*transfermanager.Options)) (*transfermanager.UploadObjectOutput, error) {
+	if ah.conf.Multipart == multipartOff || ah.multipartUnsupported.Load() {
+		return ah.putSingle(ctx, input)
+	}
+	if ah.multipartSupported.Load() {
+		return ah.uploader.UploadObject(ctx, input, opts...)
+	}
+
+	// Support of multipart uploads is not known yet: keep what the uploader reads before starting
+	// the multipart upload, so the upload can be retried.
+	body := input.Body
+	partSize, threshold := ah.conf.PartSize, ah.conf.MultipartThreshold
+	if partSize == 0 {
+		partSize = uploaderPartSize
+	}
+	if threshold == 0 {
+		threshold = uploaderThreshold
+	}
+	replay := &replayReader{reader: body, limit: max(partSize, threshold)}
+	input.Body = replay
+	out, err := ah.uploader.UploadObject(ctx, input, opts...)
+	input.Body = body
+	if err == nil {
+		if replay.full || input.ContentLength == nil {
+			// Stored with a multipart upload.
+			ah.multipartSupported.Store(true)
+		}
+		return out, nil
+	}
+	if !isMultipartUnsupported(err) {
+		return nil, err
+	}
+	if !ah.multipartUnsupported.Swap(true) {
+		logs.Warn.Println("s3: multipart uploads are not supported by the storage, using single PUT uploads", err)
+	}
+	if replay.overflow {
+		return nil, err
+	}
+	input.Body = io.MultiReader(bytes.NewReader(replay.buf), body)
+	return ah.putSingle(ctx, input)
+}
+
+// isMultipartUnsupported checks if S3 rejected the start of a multipart upload as not implemented.
+func isMultipartUnsupported(err error) bool {
+	var opErr *smithy.OperationError
+	if !errors.As(err, &opErr) || opErr.Operation() != "CreateMultipartUpload" {
+		return false
+	}
+	if isAPIError(err, "NotImplemented", "XNotImplemented", "MethodNotAllowed") {
+		return true
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status == http.StatusNotImplemented || status == http.StatusMethodNotAllowed
+	}
+	return false
+}
+
+// putSingle buffers the upload and stores it with a single PutObject.
+func (ah *awshandler) putSingle(ctx context.Context, input *transfermanager.UploadObjectInput) (*transfermanager.UploadObjectOutput, error) {
+	limit := ah.conf.SinglePutMaxSize
+	size := aws.ToInt64(input.ContentLength)
+	if size > limit {
+		return nil, &media.SizeLimitError{Limit: limit}
+	}
+
+	if input.ContentLength != nil && size <= singlePutMemorySize {
+		data, err := io.ReadAll(io.LimitReader(input.Body, singlePutMemorySize+1))
+		if err != nil {
+			return nil, err
+		}
+		return ah.putObject(ctx, input, bytes.NewReader(data), int64(len(data)))
+	}
+
+	tmp, err := os.CreateTemp("", "tinode-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	n, err := io.Copy(tmp, io.LimitReader(input.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, &media.SizeLimitError{Limit: limit}
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ah.putObject(ctx, input, tmp, n)
+}
+
+// replayReader keeps up to limit bytes read from the reader.
+type replayReader struct {
+	reader io.Reader
+	limit  int64
+	buf    []byte
+	// The limit is reached.
+	full bool
+	// More than the limit was read.
+	overflow bool
+}
+
+// Read implements io.Reader.
+func (rr *replayReader) Read(p []byte) (int, error) {
+	n, err := rr.reader.Read(p)
+	room := rr.limit - int64(len(rr.buf))
+	if int64(n) > room {
+		rr.overflow = true
+	}
+	if keep := min(int64(n), room); keep > 0 {
+		rr.buf = append(rr.buf, p[:keep]...)
+	}
+	rr.full = int64(len(rr.buf)) >= rr.limit
+	return n, err
+}
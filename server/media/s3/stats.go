@@ -0,0 +1,83 @@
+package s3
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+)
+
+// Minimum interval between bucket scans in seconds: scanning a large bucket is slow and costs requests.
+const minBucketStatsPeriod = 60
+
+// bucketStats is the size of the bucket reported through expvar as "S3Bucket".
+type bucketStats struct {
+	mu sync.RWMutex
+	// Total number of objects in the bucket.
+	Objects int64
+	// Total size of objects in bytes.
+	Bytes int64
+	// Time of the last completed scan.
+	Updated time.Time
+}
+
+var publishStats sync.Once
+
+// publish exposes the stats through expvar. Only the first handler is published.
+func (bs *bucketStats) publish() {
+	publishStats.Do(func() {
+		expvar.Publish("S3Bucket", expvar.Func(func() any {
+			bs.mu.RLock()
+			defer bs.mu.RUnlock()
+			return map[string]any{"objects": bs.Objects, "bytes": bs.Bytes, "updated": bs.Updated}
+		}))
+	})
+}
+
+// startBucketStats periodically updates the stats of the bucket in background.
+func (ah *awshandler) startBucketStats(period time.Duration) {
+	ah.bucketStats = &bucketStats{}
+	ah.bucketStats.publish()
+
+	go func() {
+		for {
+			start := time.Now()
+			objects, bytes, err := ah.scanBucket(context.Background())
+			if err != nil {
+				logs.Warn.Println("s3: failed to collect bucket stats", err)
+			} else {
+				ah.bucketStats.mu.Lock()
+				ah.bucketStats.Objects, ah.bucketStats.Bytes, ah.bucketStats.Updated = objects, bytes, time.Now()
+				ah.bucketStats.mu.Unlock()
+				logs.Info.Println("s3: bucket stats collected in", time.Since(start), "objects:", objects, "bytes:", bytes)
+			}
+			time.Sleep(period)
+		}
+	}()
+}
+
+// scanBucket counts objects in the bucket and sums their sizes. It works with any S3-compatible backend.
+func (ah *awshandler) scanBucket(ctx context.Context) (int64, int64, error) {
+	var objects, bytes int64
+	paginator := s3.NewListObjectsV2Paginator(ah.svc, &s3.ListObjectsV2Input{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, obj := range page.Contents {
+			objects++
+			if obj.Size != nil {
+				bytes += *obj.Size
+			}
+		}
+	}
+	return objects, bytes, nil
+}
@@ -0,0 +1,117 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+)
+
+// Several tenants may share one bucket. Objects of each tenant are stored under its own key prefix, so
+// they can be isolated with bucket policies, and the total size of files of the tenant is limited by its
+// quota. The tenant of an upload is the first tenant with a topic pattern matching the topic of the upload.
+// It's never taken from the request, so clients can't store files of other tenants. Uploads of no tenant
+// are stored as usual.
+type tenantConfig struct {
+	// Name of the tenant, reported to clients over quota.
+	Name string `json:"name"`
+	// Prefix of keys of objects of the tenant, like "acme/". Must not be changed once files are stored.
+	Prefix string `json:"prefix"`
+	// Maximum total size of files of the tenant in bytes, 0 if unlimited.
+	Quota int64 `json:"quota"`
+	// Patterns of names of topics of the tenant, like "grpAcme*".
+	Topics []string `json:"topics"`
+}
+
+// initTenants validates the tenants. Their prefixes must not overlap with each other or with other
+// prefixes of keys, so files of one tenant are not counted against the quota of another.
+func (ah *awshandler) initTenants() error {
+	reserved := []string{topicKeyPrefix, ah.conf.VariantPrefix}
+	if ah.conf.Immutable != nil {
+		reserved = append(reserved, ah.conf.Immutable.Prefix)
+	}
+	names := make(map[string]bool)
+	for i := range ah.conf.Tenants {
+		tenant := &ah.conf.Tenants[i]
+		if tenant.Name == "" || names[tenant.Name] {
+			return errors.New("missing or duplicate tenant name '" + tenant.Name + "'")
+		}
+		names[tenant.Name] = true
+		if !strings.HasSuffix(tenant.Prefix, "/") || strings.HasPrefix(tenant.Prefix, "/") {
+			return errors.New("prefix of tenant '" + tenant.Name + "' must end with '/' and must not start with '/'")
+		}
+		for _, other := range reserved {
+			if other != "" && (strings.HasPrefix(tenant.Prefix, other) || strings.HasPrefix(other, tenant.Prefix)) {
+				return errors.New("prefix of tenant '" + tenant.Name + "' overlaps with '" + other + "'")
+			}
+		}
+		reserved = append(reserved, tenant.Prefix)
+		if tenant.Quota < 0 {
+			return errors.New("invalid quota of tenant '" + tenant.Name + "'")
+		}
+		for _, pattern := range tenant.Topics {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.New("invalid topic pattern '" + pattern + "' of tenant '" + tenant.Name + "'")
+			}
+		}
+	}
+	return nil
+}
+
+// uploadTenant returns the tenant of the upload with the request of the context, nil if none.
+func (ah *awshandler) uploadTenant(ctx context.Context) *tenantConfig {
+	info := media.RequestInfoFromContext(ctx)
+	if len(ah.conf.Tenants) == 0 || info == nil || info.Topic == "" {
+		return nil
+	}
+	for i := range ah.conf.Tenants {
+		for _, pattern := range ah.conf.Tenants[i].Topics {
+			if ok, _ := path.Match(pattern, info.Topic); ok {
+				return &ah.conf.Tenants[i]
+			}
+		}
+	}
+	return nil
+}
+
+// keyPrefix is the prefix of keys of objects of the tenant, empty for no tenant.
+func (tenant *tenantConfig) keyPrefix() string {
+	if tenant == nil {
+		return ""
+	}
+	return tenant.Prefix
+}
+
+// checkTenantQuota rejects an upload of the given size, unknown if not positive, which would exceed
+// the quota of the tenant. Concurrent uploads are not accounted for, so the quota may be exceeded
+// by their size.
+func (ah *awshandler) checkTenantQuota(tenant *tenantConfig, size int64) error {
+	if tenant == nil || tenant.Quota == 0 {
+		return nil
+	}
+	prefixes := []string{tenant.Prefix}
+	if ah.conf.Immutable != nil {
+		// Immutable objects of the tenant.
+		prefixes = append(prefixes, ah.conf.Immutable.Prefix+tenant.Prefix)
+	}
+	var used int64
+	for _, prefix := range prefixes {
+		err := ah.storeBreaker.call(func() error {
+			n, err := store.Files.UsedBytesByPrefix(prefix)
+			used += n
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if used >= tenant.Quota || used+max(size, 0) > tenant.Quota {
+		logs.Info.Println("s3: quota of tenant", tenant.Name, "exceeded, used", used, "upload", size)
+		return &media.QuotaExceededError{Tenant: tenant.Name, Quota: tenant.Quota}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package s3
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+)
+
+// S3 throttles requests under heavy load with SlowDown errors. The SDK retries them, and once it runs out
+// of retries, clients are told to come back after a Retry-After delay instead of getting a generic error.
+// The delay starts at throttle_retry_after seconds and doubles while throttling continues, so clients back
+// off together. Throttled requests are counted as "S3Throttled".
+const (
+	// Default Retry-After of throttled requests in seconds.
+	defaultThrottleRetryAfter = 1
+	// Default maximum Retry-After of throttled requests in seconds.
+	defaultThrottleMaxRetryAfter = 60
+)
+
+var throttledRequests = expvar.NewInt("S3Throttled")
+
+// throttleBackoff computes the Retry-After of throttled requests.
+type throttleBackoff struct {
+	mu sync.Mutex
+	// Current delay, 0 if not throttled.
+	delay time.Duration
+	// When the delay was last doubled.
+	raised time.Time
+	// When the last request was throttled.
+	last time.Time
+}
+
+// initThrottling validates the limits of Retry-After of throttled requests.
+func (ah *awshandler) initThrottling() error {
+	if ah.conf.ThrottleRetryAfter < 0 || ah.conf.ThrottleMaxRetryAfter < 0 {
+		return errors.New("invalid throttle_retry_after")
+	}
+	if ah.conf.ThrottleRetryAfter == 0 {
+		ah.conf.ThrottleRetryAfter = defaultThrottleRetryAfter
+	}
+	if ah.conf.ThrottleMaxRetryAfter == 0 {
+		ah.conf.ThrottleMaxRetryAfter = max(defaultThrottleMaxRetryAfter, ah.conf.ThrottleRetryAfter)
+	}
+	if ah.conf.ThrottleMaxRetryAfter < ah.conf.ThrottleRetryAfter {
+		return errors.New("throttle_max_retry_after is less than throttle_retry_after")
+	}
+	return nil
+}
+
+// isThrottlingError checks if S3 refused the request because of the request rate.
+func isThrottlingError(err error) bool {
+	if isAPIError(err, "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded",
+		"TooManyRequests", "TooManyRequestsException", "RequestThrottled") {
+		return true
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status == http.StatusServiceUnavailable || status == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// next returns the Retry-After of a throttled request. The delay doubles when requests are still throttled
+// after the previous delay, and starts over once nothing was throttled for twice the delay.
+func (tb *throttleBackoff) next(initial, limit time.Duration) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	if tb.delay == 0 || now.Sub(tb.last) > 2*tb.delay {
+		tb.delay = initial
+		tb.raised = now
+	} else if now.Sub(tb.raised) >= tb.delay {
+		tb.delay = min(2*tb.delay, limit)
+		tb.raised = now
+	}
+	tb.last = now
+	return tb.delay
+}
+
+// throttled converts a throttling error of S3 into media.ThrottledError for the client. Other errors
+// are returned unchanged.
+func (ah *awshandler) throttled(err error) error {
+	if err == nil || !isThrottlingError(err) {
+		return err
+	}
+	throttledRequests.Add(1)
+	retryAfter := ah.throttle.next(time.Second*time.Duration(ah.conf.ThrottleRetryAfter),
+		time.Second*time.Duration(ah.conf.ThrottleMaxRetryAfter))
+	logs.Warn.Println("s3: throttled, retry after", retryAfter, err)
+	return &media.ThrottledError{RetryAfter: retryAfter, Err: err}
+}
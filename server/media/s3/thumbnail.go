@@ -0,0 +1,229 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Thumbnails of images are created by the configured media.Thumbnailer while the image is uploaded
+// and stored as a variant of the object. They are served with the query parameter "thumb".
+const (
+	thumbnailKind  = "thumb"
+	thumbnailParam = "thumb"
+
+	// Default name of the thumbnailer.
+	defaultThumbnailer = "builtin"
+	// Default maximum width and height of thumbnails in pixels.
+	defaultThumbnailSize = 256
+	// Default maximum size of an image in bytes to create the thumbnail of.
+	defaultThumbnailMaxSize = 10 * 1024 * 1024
+	// Default time in seconds to wait for the thumbnail.
+	defaultThumbnailTimeout = 10
+)
+
+type thumbnailConfig struct {
+	// Name of the registered thumbnailer: "builtin" (default) or "http".
+	Name string `json:"name"`
+	// Maximum width and height of thumbnails in pixels, 256 if 0.
+	Size int `json:"size"`
+	// Thumbnails are not created for images larger than this, 10MB if 0.
+	MaxSize int64 `json:"max_size"`
+	// Time in seconds to wait for the thumbnail, 10 if 0.
+	Timeout int `json:"timeout"`
+	// Configuration of the thumbnailer.
+	Config json.RawMessage `json:"config"`
+}
+
+// initThumbnails finds and initializes the thumbnailer.
+func (ah *awshandler) initThumbnails() error {
+	conf := ah.conf.Thumbnails
+	if conf == nil {
+		return nil
+	}
+	if ah.conf.DownloadTokenTTL > 0 {
+		return errors.New("thumbnails can't be used with download_token_ttl")
+	}
+	if ah.conf.Proxy == proxyAlways {
+		return errors.New("thumbnails can't be used when proxy is 'always'")
+	}
+	if conf.Name == "" {
+		conf.Name = defaultThumbnailer
+	}
+	tn := media.GetThumbnailer(conf.Name)
+	if tn == nil {
+		return errors.New("unknown thumbnailer '" + conf.Name + "'")
+	}
+	if conf.Size < 0 {
+		return errors.New("invalid thumbnails size")
+	}
+	if conf.Size == 0 {
+		conf.Size = defaultThumbnailSize
+	}
+	if conf.MaxSize < 0 {
+		return errors.New("invalid thumbnails max_size")
+	}
+	if conf.MaxSize == 0 {
+		conf.MaxSize = defaultThumbnailMaxSize
+	}
+	if conf.Timeout < 0 {
+		return errors.New("invalid thumbnails timeout")
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultThumbnailTimeout
+	}
+	if err := tn.Init(string(conf.Config)); err != nil {
+		return err
+	}
+	ah.thumbnailer = tn
+	ah.thumbnails = newObjectCache[string]()
+	return nil
+}
+
+// newThumbnailBuffer creates the buffer for the upload or returns nil if the thumbnail should not be created.
+func (ah *awshandler) newThumbnailBuffer(fdef *types.FileDef, size int64) *placeholderBuffer {
+	if ah.thumbnailer == nil || !ah.variantAllowed(thumbnailKind) || !strings.HasPrefix(fdef.MimeType, "image/") ||
+		size > ah.conf.Thumbnails.MaxSize {
+		return nil
+	}
+	return &placeholderBuffer{limit: ah.conf.Thumbnails.MaxSize}
+}
+
+// storeThumbnail creates the thumbnail of the uploaded image and stores it. The URL of the thumbnail
+// is added to the result. Failures are logged but otherwise ignored: the thumbnail is optional.
+func (ah *awshandler) storeThumbnail(ctx context.Context, fdef *types.FileDef, tb *placeholderBuffer,
+	cacheControl string, res *media.UploadResult) {
+	if tb == nil || tb.failed {
+		return
+	}
+	tctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(ah.conf.Thumbnails.Timeout))
+	data, contentType, err := ah.thumbnailer.Thumbnail(tctx, fdef.MimeType, tb.buf.Bytes(), ah.conf.Thumbnails.Size)
+	cancel()
+	if err != nil {
+		// Unsupported format, not an image after all or the thumbnailer is failing.
+		logs.Info.Println("s3: no thumbnail for", ah.redact.ref(fdef.Id), err)
+		return
+	}
+	key := ah.variantKey(fdef.Location, thumbnailKind)
+	_, err = ah.svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(ah.conf.BucketName),
+		RequestPayer:  ah.requestPayer(),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String(contentType),
+		CacheControl:  aws.String(cacheControl),
+	})
+	if err != nil {
+		logs.Warn.Println("s3: failed to store thumbnail", ah.redact.ref(key), err)
+		return
+	}
+	ah.thumbnails.set(key, contentType)
+	res.Thumbnail = ah.thumbnailURL(fdef)
+}
+
+// thumbnailURL is the URL to serve the thumbnail of the file.
+func (ah *awshandler) thumbnailURL(fdef *types.FileDef) string {
+	return ah.serveURL + fdef.Id + media.FileExtension(fdef.MimeType, ah.extensions) + "?" + thumbnailParam + "=1"
+}
+
+// thumbnailType returns the content type of the thumbnail of the file or an empty string if there is none.
+func (ah *awshandler) thumbnailType(ctx context.Context, fdef *types.FileDef) string {
+	if ah.thumbnailer == nil || !ah.variantAllowed(thumbnailKind) || ah.isImmutable(fdef) ||
+		!strings.HasPrefix(fdef.MimeType, "image/") || ah.variantsMissing(fdef) {
+		return ""
+	}
+	key := ah.variantKey(ah.objectLocation(fdef), thumbnailKind)
+	if contentType, ok := ah.thumbnails.get(key); ok {
+		return contentType
+	}
+	head, err := ah.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(key),
+	})
+	if err != nil {
+		if isAPIError(err, "NotFound", "NoSuchKey") {
+			// Uploaded before thumbnails were enabled or the thumbnail could not be created.
+			ah.thumbnails.setExpiring(key, "", ah.missingVariantTTL())
+		}
+		return ""
+	}
+	contentType := aws.ToString(head.ContentType)
+	ah.thumbnails.set(key, contentType)
+	return contentType
+}
+
+// serveThumbnail redirects to the thumbnail of the file. Files without thumbnails are not found.
+func (ah *awshandler) serveThumbnail(ctx context.Context, method string, fdef *types.FileDef, headers http.Header,
+	ttl time.Duration) (http.Header, int, error) {
+	contentType := ah.thumbnailType(ctx, fdef)
+	if contentType == "" {
+		return nil, 0, types.ErrNotFound
+	}
+	key := ah.variantKey(ah.objectLocation(fdef), thumbnailKind)
+	cacheControl := ah.cacheControl(ctx, fdef)
+
+	presign, bucket := ah.presignClient(headers)
+	pin := func(*s3.PresignOptions) {}
+	network := ah.clientNetwork(ctx)
+	if network != "" {
+		var err error
+		if pin, err = ah.pinPresign(ctx, network, ttl); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var redirURL string
+	if method == http.MethodHead {
+		release, err := ah.presignLimit.acquire(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer release()
+		presigned, err := presign.PresignHeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(bucket),
+			RequestPayer:         ah.requestPayer(),
+			Key:                  aws.String(key),
+			ResponseCacheControl: ah.responseCacheControl(fdef, cacheControl),
+			ResponseContentType:  aws.String(contentType),
+		}, func(opts *s3.PresignOptions) {
+			opts.Expires = ttl
+		}, pin)
+		if err != nil {
+			return nil, 0, err
+		}
+		redirURL = presigned.URL
+	} else {
+		// The thumbnail is served with its own content type.
+		thumb := *fdef
+		thumb.MimeType = contentType
+		var err error
+		redirURL, err = ah.presignGet(ctx, &thumb, presign, bucket, key, nil, cacheControl, nil, nil, ttl, pin, network)
+		if err != nil {
+			return nil, 0, err
+		}
+		ah.audit.log(ctx, fdef, false)
+	}
+
+	resp := http.Header{
+		"Location":      {redirURL},
+		"Content-Type":  {"application/json; charset=utf-8"},
+		"Cache-Control": {ah.redirectCacheControl(cacheControl, ttl)},
+	}
+	if ah.replicas != nil {
+		// The redirect depends on the region hint.
+		resp["Vary"] = []string{ah.conf.RegionHintHeader}
+	}
+	return resp, http.StatusPermanentRedirect, nil
+}
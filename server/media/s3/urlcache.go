@@ -0,0 +1,82 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+)
+
+type urlCacheConfig struct {
+	// Name of the registered cache, e.g. "memory".
+	Name string `json:"name"`
+	// Lifetime of cached URLs in seconds, must be shorter than presign_ttl. Half of presign_ttl if 0.
+	TTL int `json:"ttl"`
+	// Configuration of the cache.
+	Config json.RawMessage `json:"config"`
+}
+
+// initURLCache finds and initializes the cache of presigned URLs.
+func (ah *awshandler) initURLCache() error {
+	conf := ah.conf.URLCache
+	if conf == nil {
+		return nil
+	}
+	cache := media.GetURLCache(conf.Name)
+	if cache == nil {
+		return errors.New("unknown url_cache '" + conf.Name + "'")
+	}
+	if conf.TTL < 0 || conf.TTL >= ah.conf.PresignTTL {
+		return errors.New("url_cache ttl must be shorter than presign_ttl")
+	}
+	if conf.TTL == 0 {
+		conf.TTL = ah.conf.PresignTTL / 2
+	}
+	if err := cache.Init(string(conf.Config)); err != nil {
+		return err
+	}
+	ah.urlCache = cache
+	ah.urlCacheTTL = time.Second * time.Duration(conf.TTL)
+	return nil
+}
+
+// cachedPresign returns the URL from the cache of presigned URLs or signs it with sign and caches it.
+// The key of the URL is derived from all parameters which affect it. URLs which expire sooner than
+// the cached ones, like of self-destructing files, are not cached.
+// The key includes the generation of the credentials which sign the URLs, so rotating the access key
+// invalidates the whole cache and URLs signed with the old key are not served anymore.
+func (ah *awshandler) cachedPresign(ctx context.Context, fid string, ttl time.Duration, sign func() (string, error),
+	params ...string) (string, error) {
+	if ah.urlCache == nil || ttl <= ah.urlCacheTTL {
+		return ah.limitedPresign(ctx, sign)
+	}
+	generation, err := ah.downloadCredentials.generation(ctx)
+	if err != nil {
+		return ah.limitedPresign(ctx, sign)
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(params, "\n")))
+	key := "s3:" + fid + ":" + strconv.Itoa(generation) + ":" + base64.RawURLEncoding.EncodeToString(hash[:])
+	cached, err := ah.urlCache.Get(ctx, key)
+	if err != nil {
+		logs.Warn.Println("s3: failed to read cached URL", ah.redact.ref(fid), err)
+	} else if cached != "" {
+		return cached, nil
+	}
+
+	url, err := ah.limitedPresign(ctx, sign)
+	if err != nil {
+		return "", err
+	}
+	if err = ah.urlCache.Set(ctx, key, url, ah.urlCacheTTL); err != nil {
+		logs.Warn.Println("s3: failed to cache URL", ah.redact.ref(fid), err)
+	}
+	return url, nil
+}
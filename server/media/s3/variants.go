@@ -0,0 +1,119 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tinode/chat/server/logs"
+)
+
+// Objects derived from the uploaded file, like compressed copies, are stored under
+// <variant prefix><object key>/<kind> so they don't clutter the main namespace and
+// all variants of a file can be found by prefix.
+const defaultVariantPrefix = "variants/"
+
+func (ah *awshandler) initVariants() error {
+	if ah.conf.VariantPrefix == "" {
+		ah.conf.VariantPrefix = defaultVariantPrefix
+	}
+	if !strings.HasSuffix(ah.conf.VariantPrefix, "/") || strings.HasPrefix(ah.conf.VariantPrefix, "/") {
+		return errors.New("variant_prefix must end with '/' and must not start with '/'")
+	}
+	if ah.conf.VariantKinds != nil {
+		ah.variantKinds = make(map[string]bool)
+		for _, kind := range ah.conf.VariantKinds {
+			if kind != placeholderKind && kind != thumbnailKind && kind != compressedKind[encodingBrotli] && kind != compressedKind[encodingGzip] {
+				return errors.New("unknown variant kind '" + kind + "'")
+			}
+			ah.variantKinds[kind] = true
+		}
+	}
+	return nil
+}
+
+// variantAllowed checks if variants of the kind may be created and served.
+func (ah *awshandler) variantAllowed(kind string) bool {
+	return ah.variantKinds == nil || ah.variantKinds[kind]
+}
+
+// variantPrefix is the prefix of keys of all variants of the object.
+func (ah *awshandler) variantPrefix(location string) string {
+	return ah.conf.VariantPrefix + location + "/"
+}
+
+// variantKey is the key of the variant of the given kind.
+func (ah *awshandler) variantKey(location, kind string) string {
+	return ah.variantPrefix(location) + kind
+}
+
+// hasVariants checks if the handler is configured to create any variants.
+func (ah *awshandler) hasVariants() bool {
+	for _, enc := range ah.conf.Compress {
+		if ah.variantAllowed(compressedKind[enc]) {
+			return true
+		}
+	}
+	return (ah.conf.Placeholders && ah.variantAllowed(placeholderKind)) ||
+		(ah.thumbnailer != nil && ah.variantAllowed(thumbnailKind))
+}
+
+// variantWriters returns the writers which produce variants of the object from its content.
+func variantWriters(comps []*compressor, lqip, thumb *placeholderBuffer) []io.Writer {
+	var writers []io.Writer
+	for _, c := range comps {
+		writers = append(writers, c)
+	}
+	if lqip != nil {
+		writers = append(writers, lqip)
+	}
+	if thumb != nil {
+		writers = append(writers, thumb)
+	}
+	return writers
+}
+
+// deleteVariants deletes all variants of the objects. Variants are found by listing the prefix,
+// so exactly the variants which were created are deleted. Failures are logged only: orphaned
+// variants are not served. It costs a listing request per object so it's skipped if no variants
+// are configured.
+func (ah *awshandler) deleteVariants(ctx context.Context, locations []string) {
+	if !ah.hasVariants() {
+		return
+	}
+	for _, loc := range locations {
+		prefix := ah.variantPrefix(loc)
+		paginator := s3.NewListObjectsV2Paginator(ah.svc, &s3.ListObjectsV2Input{
+			Bucket:       aws.String(ah.conf.BucketName),
+			RequestPayer: ah.requestPayer(),
+			Prefix:       aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				logs.Warn.Println("s3: failed to list variants", ah.redact.ref(prefix), err)
+				break
+			}
+			if len(page.Contents) == 0 {
+				break
+			}
+			objects := make([]s3types.ObjectIdentifier, len(page.Contents))
+			for i, obj := range page.Contents {
+				objects[i] = s3types.ObjectIdentifier{Key: obj.Key}
+				ah.variants.set(aws.ToString(obj.Key), false)
+			}
+			if _, err = ah.svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket:       aws.String(ah.conf.BucketName),
+				RequestPayer: ah.requestPayer(),
+				Delete:       &s3types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			}); err != nil {
+				logs.Warn.Println("s3: failed to delete variants", ah.redact.ref(prefix), err)
+				break
+			}
+		}
+	}
+}
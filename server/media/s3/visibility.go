@@ -0,0 +1,88 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Objects tagged visibility=public, e.g. by external tooling, are served from the public URL without
+// presigning. The bucket policy must allow anonymous reads of such objects, like with the condition
+// on s3:ExistingObjectTag/visibility. All other objects are private.
+const (
+	visibilityTag    = "visibility"
+	visibilityPublic = "public"
+
+	// Default time in seconds to remember the visibility of an object.
+	defaultVisibilityCacheTTL = 300
+)
+
+// visibility of an object as of the time it was checked.
+type visibility struct {
+	public  bool
+	expires time.Time
+}
+
+// initVisibility validates the configuration of public objects.
+func (ah *awshandler) initVisibility() error {
+	if ah.conf.PublicURL == "" {
+		return nil
+	}
+	base, err := url.Parse(ah.conf.PublicURL)
+	if err != nil || (base.Scheme != "https" && base.Scheme != "http") || base.Host == "" {
+		return errors.New("invalid public_url")
+	}
+	if !strings.HasSuffix(ah.conf.PublicURL, "/") {
+		ah.conf.PublicURL += "/"
+	}
+	if ah.conf.VisibilityCacheTTL < 0 {
+		return errors.New("invalid visibility_cache_ttl")
+	}
+	if ah.conf.VisibilityCacheTTL == 0 {
+		ah.conf.VisibilityCacheTTL = defaultVisibilityCacheTTL
+	}
+	ah.visibilities = newObjectCache[visibility]()
+	return nil
+}
+
+// isPublic checks if the file may be served from the public URL. Immutable files are served by version
+// and self-destructing files must expire, so they are always presigned. Lookup failures are treated as private.
+func (ah *awshandler) isPublic(ctx context.Context, fdef *types.FileDef, expires time.Time) bool {
+	if ah.conf.PublicURL == "" || ah.isImmutable(fdef) || !expires.IsZero() {
+		return false
+	}
+
+	key := ah.objectLocation(fdef)
+	if vis, ok := ah.visibilities.get(key); ok && time.Now().Before(vis.expires) {
+		return vis.public
+	}
+	out, err := ah.svc.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:       aws.String(ah.conf.BucketName),
+		RequestPayer: ah.requestPayer(),
+		Key:          aws.String(key),
+	})
+	if err != nil {
+		logs.Warn.Println("s3: failed to read object tags", ah.redact.ref(key), err)
+		return false
+	}
+	vis := visibility{expires: time.Now().Add(time.Second * time.Duration(ah.conf.VisibilityCacheTTL))}
+	for _, tag := range out.TagSet {
+		if aws.ToString(tag.Key) == visibilityTag {
+			vis.public = aws.ToString(tag.Value) == visibilityPublic
+		}
+	}
+	ah.visibilities.set(key, vis)
+	return vis.public
+}
+
+// publicURL returns the direct URL of the object.
+func (ah *awshandler) publicURL(fdef *types.FileDef) string {
+	return ah.conf.PublicURL + (&url.URL{Path: ah.objectLocation(fdef)}).EscapedPath()
+}
@@ -0,0 +1,153 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of notifications waiting to be sent. Notifications are dropped when the queue is full.
+	webhookQueueSize = 1024
+	// Number of notifications sent concurrently.
+	webhookWorkers = 4
+	// Number of attempts to deliver a notification.
+	webhookAttempts = 5
+	// Delay before the first retry, doubled with every attempt.
+	webhookBackoff = time.Second
+	webhookTimeout = 10 * time.Second
+
+	// Header with the signature of the request body: hex-encoded HMAC-SHA256.
+	webhookSignatureHeader = "X-Tinode-Signature"
+)
+
+// uploadEvent is the payload of the upload notification.
+type uploadEvent struct {
+	Id       string    `json:"id"`
+	User     string    `json:"user,omitempty"`
+	Topic    string    `json:"topic,omitempty"`
+	MimeType string    `json:"mime"`
+	Size     int64     `json:"size"`
+	Location string    `json:"location"`
+	URL      string    `json:"url"`
+	Created  time.Time `json:"created"`
+}
+
+// webhookNotifier POSTs notifications of completed uploads to an external URL in background.
+type webhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+	queue  chan []byte
+	redact *logRedactor
+}
+
+// newWebhookNotifier creates and starts the notifier. Returns nil if the URL is not configured.
+func newWebhookNotifier(hookURL, secret string, redact *logRedactor) (*webhookNotifier, error) {
+	if hookURL == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(hookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("invalid upload_webhook_url")
+	}
+
+	wn := &webhookNotifier{
+		url:    hookURL,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan []byte, webhookQueueSize),
+		redact: redact,
+	}
+	for range webhookWorkers {
+		go wn.run()
+	}
+	return wn, nil
+}
+
+// notify queues notification of a completed upload. It never blocks.
+func (wn *webhookNotifier) notify(ctx context.Context, fdef *types.FileDef, url string, size int64) {
+	if wn == nil {
+		return
+	}
+
+	event := uploadEvent{
+		Id:       fdef.Id,
+		User:     fdef.User,
+		MimeType: fdef.MimeType,
+		Size:     size,
+		Location: fdef.Location,
+		URL:      url,
+		Created:  fdef.CreatedAt,
+	}
+	if info := media.RequestInfoFromContext(ctx); info != nil {
+		event.Topic = info.Topic
+	}
+	body, err := json.Marshal(&event)
+	if err != nil {
+		logs.Warn.Println("s3: failed to serialize upload notification", wn.redact.ref(fdef.Id), err)
+		return
+	}
+
+	select {
+	case wn.queue <- body:
+	default:
+		logs.Warn.Println("s3: upload notification queue full, dropped", wn.redact.ref(fdef.Id))
+	}
+}
+
+func (wn *webhookNotifier) run() {
+	for body := range wn.queue {
+		backoff := webhookBackoff
+		for attempt := 1; ; attempt++ {
+			retry, err := wn.send(body)
+			if err == nil {
+				break
+			}
+			if !retry || attempt >= webhookAttempts {
+				logs.Warn.Println("s3: upload notification failed:", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// send delivers one notification. Returns true if the failed request should be retried.
+func (wn *webhookNotifier) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, wn.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if len(wn.secret) > 0 {
+		mac := hmac.New(sha256.New, wn.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		// Network error.
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.New("webhook responded with " + resp.Status)
+	// Retry server errors and throttling, client errors won't go away.
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
@@ -0,0 +1,98 @@
+package media
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Dialect of the generated schemas.
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// ConfigSchema returns the JSON Schema of the configuration of a media handler, so configs can be validated
+// by external tooling. The schema is derived from the type of conf, a struct decoded from the config
+// with encoding/json. Objects don't allow unknown properties. Enums are the allowed values of string
+// properties or of items of arrays of strings by the dotted path of the property, like "proxy" or
+// "thumbnails.name".
+func ConfigSchema(title string, conf any, enums map[string][]string) ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(conf), "", enums)
+	schema["$schema"] = schemaDialect
+	schema["title"] = title
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// typeSchema returns the schema of values of the type at the path.
+func typeSchema(t reflect.Type, path string, enums map[string][]string) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == rawMessageType {
+		// Any JSON value, e.g. the config of a plugin.
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		schema := map[string]any{"type": "string"}
+		if values, ok := enums[path]; ok {
+			schema["enum"] = values
+		}
+		return schema
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Base64-encoded bytes.
+			return map[string]any{"type": "string"}
+		}
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), path, enums)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem(), path, enums)}
+	case reflect.Struct:
+		props := map[string]any{}
+		structProperties(t, path, enums, props)
+		return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	return map[string]any{}
+}
+
+// structProperties adds the schemas of the fields of the struct decoded by encoding/json to props.
+func structProperties(t reflect.Type, path string, enums map[string][]string, props map[string]any) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			// Fields of embedded structs are decoded as fields of the outer struct.
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				structProperties(ft, path, enums, props)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		propPath := name
+		if path != "" {
+			propPath = path + "." + name
+		}
+		props[name] = typeSchema(field.Type, propPath, enums)
+	}
+}
@@ -0,0 +1,225 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	// Formats of images with built-in thumbnails.
+	_ "image/gif"
+)
+
+// Thumbnailer creates thumbnails of images. Thumbnails may be created in process or by an external service,
+// e.g. to keep decoding of untrusted images out of the server.
+type Thumbnailer interface {
+	// Init initializes the thumbnailer. It's called by every media handler which uses it.
+	Init(jsconf string) error
+	// Thumbnail scales the image down to fit into size by size pixels. Returns the thumbnail and its content type.
+	Thumbnail(ctx context.Context, mimeType string, img []byte, size int) ([]byte, string, error)
+}
+
+// Registered thumbnailers.
+var thumbnailers map[string]Thumbnailer
+
+// RegisterThumbnailer saves reference to a thumbnailer.
+func RegisterThumbnailer(name string, tn Thumbnailer) {
+	if thumbnailers == nil {
+		thumbnailers = make(map[string]Thumbnailer)
+	}
+
+	if tn == nil {
+		panic("RegisterThumbnailer: thumbnailer is nil")
+	}
+	if _, dup := thumbnailers[name]; dup {
+		panic("RegisterThumbnailer: called twice for thumbnailer " + name)
+	}
+	thumbnailers[name] = tn
+}
+
+// GetThumbnailer returns the registered thumbnailer or nil if not found.
+func GetThumbnailer(name string) Thumbnailer {
+	return thumbnailers[name]
+}
+
+const (
+	// Images with more pixels are not decoded by the built-in thumbnailer.
+	maxThumbnailPixels = 50 * 1000 * 1000
+	// Quality of JPEG thumbnails.
+	thumbnailQuality = 85
+
+	// Default maximum size of thumbnails returned by the external service.
+	defaultHTTPThumbnailMaxSize = 1024 * 1024
+)
+
+// imageThumbnailer creates thumbnails of JPEG, PNG and GIF images in process. Thumbnails of JPEG images
+// are JPEG, of others PNG to keep the transparency.
+type imageThumbnailer struct{}
+
+func (imageThumbnailer) Init(jsconf string) error {
+	return nil
+}
+
+func (imageThumbnailer) Thumbnail(ctx context.Context, mimeType string, img []byte, size int) ([]byte, string, error) {
+	if size <= 0 {
+		return nil, "", errors.New("invalid thumbnail size")
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxThumbnailPixels {
+		return nil, "", errors.New("image too large to decode")
+	}
+	src, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, scaleDown(src, size), &jpeg.Options{Quality: thumbnailQuality})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, scaleDown(src, size))
+	return buf.Bytes(), "image/png", err
+}
+
+// scaleDown scales the image to fit into size by size pixels averaging the pixels of the source.
+// Smaller images are copied as is.
+func scaleDown(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if w > size || h > size {
+		if w >= h {
+			dw, dh = size, max(1, h*size/w)
+		} else {
+			dw, dh = max(1, w*size/h), size
+		}
+	}
+
+	dst := image.NewNRGBA64(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		y0, y1 := y*h/dh, max((y+1)*h/dh, y*h/dh+1)
+		for x := range dw {
+			x0, x1 := x*w/dw, max((x+1)*w/dw, x*w/dw+1)
+			// Premultiplied sums of the source pixels.
+			var r, g, b, a uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+				}
+			}
+			if a == 0 {
+				continue
+			}
+			// Un-premultiply the averages.
+			n := uint64((y1 - y0) * (x1 - x0))
+			dst.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(min(r*0xffff/a, 0xffff)),
+				G: uint16(min(g*0xffff/a, 0xffff)),
+				B: uint16(min(b*0xffff/a, 0xffff)),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// httpThumbnailer delegates creation of thumbnails to an external service, e.g. a sandboxed one. The image
+// is POSTed to the URL with its content type and the size in the query parameter "size". The service
+// responds with the thumbnail image.
+type httpThumbnailer struct {
+	url     string
+	maxSize int64
+	client  *http.Client
+}
+
+type httpThumbnailerConfig struct {
+	// URL of the service.
+	URL string `json:"url"`
+	// Maximum size of the thumbnail in bytes, 1MB if 0.
+	MaxSize int64 `json:"max_size"`
+}
+
+func (ht *httpThumbnailer) Init(jsconf string) error {
+	var conf httpThumbnailerConfig
+	if jsconf != "" && jsconf != "null" {
+		if err := json.Unmarshal([]byte(jsconf), &conf); err != nil {
+			return errors.New("failed to parse http thumbnailer config: " + err.Error())
+		}
+	}
+	if u, err := url.Parse(conf.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid http thumbnailer url")
+	}
+	if conf.MaxSize < 0 {
+		return errors.New("invalid http thumbnailer max_size")
+	}
+	if conf.MaxSize == 0 {
+		conf.MaxSize = defaultHTTPThumbnailMaxSize
+	}
+	ht.url = conf.URL
+	ht.maxSize = conf.MaxSize
+	// Timeouts are set by the context of the caller.
+	ht.client = &http.Client{}
+	return nil
+}
+
+func (ht *httpThumbnailer) Thumbnail(ctx context.Context, mimeType string, img []byte, size int) ([]byte, string, error) {
+	u, err := url.Parse(ht.url)
+	if err != nil {
+		return nil, "", err
+	}
+	query := u.Query()
+	query.Set("size", strconv.Itoa(size))
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(img))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", mimeType)
+	req.Header.Set("Accept", "image/*")
+	req.Header.Set("User-Agent", "Tinode/"+ServerVersion)
+	resp, err := ht.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New("thumbnailer responded with " + resp.Status)
+	}
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(contentType, "image/") {
+		return nil, "", errors.New("thumbnailer responded with a non-image")
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, ht.maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > ht.maxSize {
+		return nil, "", errors.New("thumbnail too large")
+	}
+	if len(data) == 0 {
+		return nil, "", errors.New("empty thumbnail")
+	}
+	return data, contentType, nil
+}
+
+func init() {
+	RegisterThumbnailer("builtin", imageThumbnailer{})
+	RegisterThumbnailer("http", &httpThumbnailer{})
+}
@@ -0,0 +1,123 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// URLCache is a cache of signed URLs of files, like S3 presigned URLs. An external cache shares the signing
+// work among the nodes of a cluster.
+type URLCache interface {
+	// Init initializes the cache. It's called by every media handler which uses the cache.
+	Init(jsconf string) error
+	// Get returns the cached URL or an empty string if it's not cached.
+	Get(ctx context.Context, key string) (string, error)
+	// Set caches the URL for the given time.
+	Set(ctx context.Context, key, url string, ttl time.Duration) error
+}
+
+// Registered caches of signed URLs.
+var urlCaches map[string]URLCache
+
+// RegisterURLCache saves reference to a cache of signed URLs.
+func RegisterURLCache(name string, cache URLCache) {
+	if urlCaches == nil {
+		urlCaches = make(map[string]URLCache)
+	}
+
+	if cache == nil {
+		panic("RegisterURLCache: cache is nil")
+	}
+	if _, dup := urlCaches[name]; dup {
+		panic("RegisterURLCache: called twice for cache " + name)
+	}
+	urlCaches[name] = cache
+}
+
+// GetURLCache returns the registered cache of signed URLs or nil if not found.
+func GetURLCache(name string) URLCache {
+	return urlCaches[name]
+}
+
+// Default maximum number of URLs in the in-memory cache.
+const defaultMemoryURLCacheSize = 10000
+
+// memoryURLCache is the cache of signed URLs local to the node.
+type memoryURLCache struct {
+	mu      sync.Mutex
+	maxSize int
+	urls    map[string]cachedURL
+}
+
+type cachedURL struct {
+	url     string
+	expires time.Time
+}
+
+type memoryURLCacheConfig struct {
+	// Maximum number of cached URLs.
+	Size int `json:"size"`
+}
+
+func (mc *memoryURLCache) Init(jsconf string) error {
+	var conf memoryURLCacheConfig
+	if jsconf != "" && jsconf != "null" {
+		if err := json.Unmarshal([]byte(jsconf), &conf); err != nil {
+			return errors.New("failed to parse memory URL cache config: " + err.Error())
+		}
+	}
+	if conf.Size < 0 {
+		return errors.New("invalid memory URL cache size")
+	}
+	if conf.Size == 0 {
+		conf.Size = defaultMemoryURLCacheSize
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.maxSize = conf.Size
+	if mc.urls == nil {
+		mc.urls = make(map[string]cachedURL)
+	}
+	return nil
+}
+
+func (mc *memoryURLCache) Get(ctx context.Context, key string) (string, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	cached, ok := mc.urls[key]
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(cached.expires) {
+		delete(mc.urls, key)
+		return "", nil
+	}
+	return cached.url, nil
+}
+
+func (mc *memoryURLCache) Set(ctx context.Context, key, url string, ttl time.Duration) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if len(mc.urls) >= mc.maxSize {
+		// Drop expired URLs, start over if all are still valid.
+		now := time.Now()
+		for k, cached := range mc.urls {
+			if now.After(cached.expires) {
+				delete(mc.urls, k)
+			}
+		}
+		if len(mc.urls) >= mc.maxSize {
+			mc.urls = make(map[string]cachedURL)
+		}
+	}
+	mc.urls[key] = cachedURL{url: url, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func init() {
+	RegisterURLCache("memory", &memoryURLCache{})
+}
@@ -1197,6 +1197,21 @@ func (m *MockFilePersistenceInterface) EXPECT() *MockFilePersistenceInterfaceMoc
 	return m.recorder
 }
 
+// CountDownload mocks base method.
+func (m *MockFilePersistenceInterface) CountDownload(fid string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountDownload", fid)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountDownload indicates an expected call of CountDownload.
+func (mr *MockFilePersistenceInterfaceMockRecorder) CountDownload(fid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountDownload", reflect.TypeOf((*MockFilePersistenceInterface)(nil).CountDownload), fid)
+}
+
 // DeleteUnused mocks base method.
 func (m *MockFilePersistenceInterface) DeleteUnused(olderThan time.Time, limit int) error {
 	m.ctrl.T.Helper()
@@ -1241,6 +1256,21 @@ func (mr *MockFilePersistenceInterfaceMockRecorder) Get(fid interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockFilePersistenceInterface)(nil).Get), fid)
 }
 
+// GetAll mocks base method.
+func (m *MockFilePersistenceInterface) GetAll(fids []string) ([]types.FileDef, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", fids)
+	ret0, _ := ret[0].([]types.FileDef)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockFilePersistenceInterfaceMockRecorder) GetAll(fids interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockFilePersistenceInterface)(nil).GetAll), fids)
+}
+
 // LinkAttachments mocks base method.
 func (m *MockFilePersistenceInterface) LinkAttachments(topic string, msgId types.Uid, attachments []string) error {
 	m.ctrl.T.Helper()
@@ -1255,6 +1285,35 @@ func (mr *MockFilePersistenceInterfaceMockRecorder) LinkAttachments(topic, msgId
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LinkAttachments", reflect.TypeOf((*MockFilePersistenceInterface)(nil).LinkAttachments), topic, msgId, attachments)
 }
 
+// List mocks base method.
+func (m *MockFilePersistenceInterface) List(after string, limit int) ([]types.FileDef, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", after, limit)
+	ret0, _ := ret[0].([]types.FileDef)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockFilePersistenceInterfaceMockRecorder) List(after, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockFilePersistenceInterface)(nil).List), after, limit)
+}
+
+// MarkVariantsFailed mocks base method.
+func (m *MockFilePersistenceInterface) MarkVariantsFailed(fid string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkVariantsFailed", fid)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkVariantsFailed indicates an expected call of MarkVariantsFailed.
+func (mr *MockFilePersistenceInterfaceMockRecorder) MarkVariantsFailed(fid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkVariantsFailed", reflect.TypeOf((*MockFilePersistenceInterface)(nil).MarkVariantsFailed), fid)
+}
+
 // StartUpload mocks base method.
 func (m *MockFilePersistenceInterface) StartUpload(fd *types.FileDef) error {
 	m.ctrl.T.Helper()
@@ -1269,6 +1328,21 @@ func (mr *MockFilePersistenceInterfaceMockRecorder) StartUpload(fd interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartUpload", reflect.TypeOf((*MockFilePersistenceInterface)(nil).StartUpload), fd)
 }
 
+// UsedBytesByPrefix mocks base method.
+func (m *MockFilePersistenceInterface) UsedBytesByPrefix(prefix string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UsedBytesByPrefix", prefix)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UsedBytesByPrefix indicates an expected call of UsedBytesByPrefix.
+func (mr *MockFilePersistenceInterfaceMockRecorder) UsedBytesByPrefix(prefix interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UsedBytesByPrefix", reflect.TypeOf((*MockFilePersistenceInterface)(nil).UsedBytesByPrefix), prefix)
+}
+
 // MockPersistentCacheInterface is a mock of PersistentCacheInterface interface.
 type MockPersistentCacheInterface struct {
 	ctrl     *gomock.Controller
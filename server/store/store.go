@@ -991,6 +991,11 @@ func RegisterMediaHandler(name string, mh media.Handler) {
 	fileHandlers[name] = mh
 }
 
+// GetRegisteredMediaHandler returns the registered media handler or nil if not found.
+func GetRegisteredMediaHandler(name string) media.Handler {
+	return fileHandlers[name]
+}
+
 // GetMediaHandler returns default media handler.
 func (storeObj) GetMediaHandler() media.Handler {
 	return mediaHandler
@@ -1013,6 +1018,17 @@ type FilePersistenceInterface interface {
 	FinishUpload(fd *types.FileDef, success bool, size int64) (*types.FileDef, error)
 	// Get fetches a file record for a unique file id.
 	Get(fid string) (*types.FileDef, error)
+	// GetAll fetches records of the files with the given ids. Missing files are skipped.
+	GetAll(fids []string) ([]types.FileDef, error)
+	// List fetches records of completed uploads with IDs greater than 'after' ordered by ID.
+	List(after string, limit int) ([]types.FileDef, error)
+	// CountDownload increments the number of downloads of the file unless it has reached the download limit.
+	// Returns the number of downloads including this one, or 0 if the limit is reached.
+	CountDownload(fid string) (int, error)
+	// MarkVariantsFailed records that generating the variants of the file failed permanently.
+	MarkVariantsFailed(fid string) error
+	// UsedBytesByPrefix returns the total size of completed uploads with locations starting with the prefix.
+	UsedBytesByPrefix(prefix string) (int64, error)
 	// DeleteUnused removes unused attachments.
 	DeleteUnused(olderThan time.Time, limit int) error
 	// LinkAttachments connects earlier uploaded attachments to a message or topic to prevent it
@@ -1042,6 +1058,33 @@ func (fileMapper) Get(fid string) (*types.FileDef, error) {
 	return adp.FileGet(fid)
 }
 
+// GetAll fetches records of the files with the given ids in one request. Missing files are skipped.
+func (fileMapper) GetAll(fids []string) ([]types.FileDef, error) {
+	return adp.FileGetAll(fids)
+}
+
+// List fetches records of completed uploads with IDs greater than 'after' ordered by ID.
+// Use empty 'after' to start from the beginning.
+func (fileMapper) List(after string, limit int) ([]types.FileDef, error) {
+	return adp.FileList(after, limit)
+}
+
+// CountDownload increments the number of downloads of the file unless it has reached the download limit.
+// Returns the number of downloads including this one, or 0 if the limit is reached.
+func (fileMapper) CountDownload(fid string) (int, error) {
+	return adp.FileCountDownload(fid)
+}
+
+// MarkVariantsFailed records that generating the variants of the file failed permanently.
+func (fileMapper) MarkVariantsFailed(fid string) error {
+	return adp.FileMarkVariantsFailed(fid)
+}
+
+// UsedBytesByPrefix returns the total size of completed uploads with locations starting with the prefix.
+func (fileMapper) UsedBytesByPrefix(prefix string) (int64, error) {
+	return adp.FileUsedBytesByPrefix(prefix)
+}
+
 // DeleteUnused removes unused attachments and avatars.
 func (fileMapper) DeleteUnused(olderThan time.Time, limit int) error {
 	toDel, err := adp.FileDeleteUnused(olderThan, limit)
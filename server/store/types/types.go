@@ -52,6 +52,10 @@ const (
 	ErrInvalidResponse = StoreError("invalid response")
 	// ErrRedirected means the subscription request was redirected to another topic.
 	ErrRedirected = StoreError("redirected")
+	// ErrTooLarge means the object exceeds the maximum allowed size.
+	ErrTooLarge = StoreError("too large")
+	// ErrUnavailable means the service is temporarily unavailable, the client should retry later.
+	ErrUnavailable = StoreError("unavailable")
 )
 
 // Uid is a database-specific record id, suitable to be used as a primary key.
@@ -1437,6 +1441,14 @@ type FileDef struct {
 	Location string
 	// ETag generated by the file server.
 	ETag string
+	// Maximum number of downloads of the file, 0 if unlimited.
+	DownloadLimit int
+	// Number of downloads of the file counted against the limit.
+	Downloads int
+	// Generation of variants of the file failed permanently.
+	VariantsFailed bool
+	// Location of the unprocessed original of the file if kept, i.e. before EXIF orientation was applied.
+	OriginalLocation string
 }
 
 // FlattenDoubleSlice turns 2d slice into a 1d slice.
@@ -212,6 +212,10 @@ func decodeStoreErrorExplicitTs(err error, id, topic string, serverTs, incomingR
 			errmsg = ErrInvalidResponse(id, topic, serverTs, incomingReqTs)
 		case types.ErrRedirected:
 			errmsg = InfoUseOther(id, topic, params["topic"].(string), serverTs, incomingReqTs)
+		case types.ErrTooLarge:
+			errmsg = ErrTooLarge(id, topic, serverTs)
+		case types.ErrUnavailable:
+			errmsg = ErrServiceUnavailableExplicitTs(id, topic, serverTs, incomingReqTs)
 		default:
 			errmsg = ErrUnknownExplicitTs(id, topic, serverTs, incomingReqTs)
 		}
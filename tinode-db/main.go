@@ -25,6 +25,7 @@ import (
 type configType struct {
 	P2PDeleteEnabled bool            `json:"p2p_delete_enabled"`
 	StoreConfig      json.RawMessage `json:"store_config"`
+	Media            *mediaConfig    `json:"media"`
 }
 
 type theCard struct {
@@ -199,6 +200,14 @@ func main() {
 	makeRoot := flag.String("make_root", "", "promote ordinary user to ROOT, auth scheme 'basic'")
 	datafile := flag.String("data", "", "name of file with sample data to load")
 	conffile := flag.String("config", "./tinode.conf", "config of the database connection")
+	migrate := flag.String("migrate_media", "", "copy uploaded files between media handlers, 'SRC:DST', e.g. 'fs:s3'")
+	migrateState := flag.String("migrate_state", "", "file to save media migration progress to for resuming")
+	migrateRate := flag.Int("migrate_rate", 0, "maximum number of files to migrate per second, 0 for no limit")
+	migrateWorkers := flag.Int("migrate_workers", 1, "number of files to migrate concurrently")
+	migrateRetries := flag.Int("migrate_retries", 2, "number of times to retry a file which failed to migrate")
+	reconcile := flag.String("reconcile_media", "", "delete file records whose files are missing in the named media handler, e.g. 's3'")
+	reconcileDryRun := flag.Bool("reconcile_dry_run", false, "only report file records with missing files, don't delete them")
+	reconcileRate := flag.Int("reconcile_rate", 0, "maximum number of files to check per second, 0 for no limit")
 
 	flag.Parse()
 
@@ -353,6 +362,14 @@ func main() {
 		log.Printf("ROOT user created: '%s:%s'", uname, password)
 	}
 
+	if *migrate != "" {
+		migrateMedia(config.Media, *migrate, *migrateState, *migrateRate, *migrateWorkers, *migrateRetries)
+	}
+
+	if *reconcile != "" {
+		reconcileMedia(config.Media, *reconcile, *reconcileDryRun, *reconcileRate)
+	}
+
 	log.Println("All done.")
 
 	os.Exit(0)
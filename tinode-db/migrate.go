@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	_ "github.com/tinode/chat/server/media/fs"
+	_ "github.com/tinode/chat/server/media/s3"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Number of file records to fetch from the DB at once.
+	migrateBatchSize = 100
+	// Report progress after this many files.
+	migrateReportEvery = 100
+	// Number of files queued for migration per worker.
+	migrateQueuePerWorker = 2
+	// Delay before the first retry of a failed file, doubled for each next one.
+	migrateRetryDelay = time.Second
+)
+
+// Media handler configuration, same as the 'media' section of the server config.
+type mediaConfig struct {
+	Handlers map[string]json.RawMessage `json:"handlers"`
+}
+
+// mediaMigration copies uploaded files from one media handler to another.
+type mediaMigration struct {
+	src media.Handler
+	dst media.Handler
+	// File to save ID of the last processed file to so an interrupted migration can be resumed.
+	stateFile string
+	// Maximum number of files to migrate per second, 0 for no limit.
+	rate int
+	// Number of files migrated concurrently.
+	workers int
+	// Number of times to retry a failed file.
+	retries int
+	// Delay before the first retry of a failed file.
+	retryDelay time.Duration
+
+	// Number of files to migrate, for the estimate of the remaining time.
+	total    int
+	migrated int
+	skipped  int
+	failed   int
+	bytes    int64
+}
+
+// migrateJob is a file queued for migration. Jobs are numbered in the order of file IDs.
+type migrateJob struct {
+	seq  int
+	fdef types.FileDef
+}
+
+// migrateResult is the outcome of migrating one file.
+type migrateResult struct {
+	seq  int
+	id   string
+	size int64
+	err  error
+}
+
+// migrateMedia moves all completed uploads from one handler to another. The spec is "SRC:DST", e.g. "fs:s3".
+func migrateMedia(conf *mediaConfig, spec, stateFile string, rate, workers, retries int) {
+	srcName, dstName, ok := strings.Cut(spec, ":")
+	if !ok || srcName == "" || dstName == "" || srcName == dstName {
+		log.Fatalf("Invalid media migration '%s', must be 'SRC:DST', e.g. 'fs:s3'", spec)
+	}
+	if conf == nil {
+		log.Fatalln("Media migration: missing 'media' section in config")
+	}
+	if workers < 1 {
+		log.Fatalln("Media migration: number of workers must be at least 1")
+	}
+	if retries < 0 {
+		log.Fatalln("Media migration: number of retries must not be negative")
+	}
+
+	// Media handlers write to the server logs.
+	logs.Init(os.Stderr, "stdFlags")
+
+	mm := &mediaMigration{
+		src:        initMediaHandler(conf, srcName),
+		dst:        initMediaHandler(conf, dstName),
+		stateFile:  stateFile,
+		rate:       rate,
+		workers:    workers,
+		retries:    retries,
+		retryDelay: migrateRetryDelay,
+	}
+	if err := mm.run(); err != nil {
+		log.Fatalln("Media migration:", err)
+	}
+	log.Println("Media migration: completed")
+}
+
+// initMediaHandler initializes the named handler. The handler also becomes the current handler of the store.
+func initMediaHandler(conf *mediaConfig, name string) media.Handler {
+	params := conf.Handlers[name]
+	if params == nil {
+		log.Fatalf("Media handler '%s' is not configured", name)
+	}
+	if err := store.Store.UseMediaHandler(name, string(params)); err != nil {
+		log.Fatalf("Failed to init media handler '%s': %s", name, err)
+	}
+	return store.Store.GetMediaHandler()
+}
+
+// reconcileMedia deletes records of completed uploads whose files are missing in the named handler.
+func reconcileMedia(conf *mediaConfig, name string, dryRun bool, rate int) {
+	if conf == nil {
+		log.Fatalln("Media reconciliation: missing 'media' section in config")
+	}
+	logs.Init(os.Stderr, "stdFlags")
+
+	reconciler, ok := initMediaHandler(conf, name).(media.RecordReconciler)
+	if !ok {
+		log.Fatalf("Media handler '%s' does not support reconciliation", name)
+	}
+	start := time.Now()
+	stats, err := reconciler.ReconcileRecords(context.Background(), dryRun, rate)
+	if stats != nil {
+		log.Printf("Media reconciliation: %d checked, %d missing, %d deleted, %d failed in %s (dry run: %t)",
+			stats.Checked, stats.Missing, stats.Deleted, stats.Failed, time.Since(start).Round(time.Second), dryRun)
+	}
+	if err != nil {
+		log.Fatalln("Media reconciliation failed:", err)
+	}
+}
+
+// run migrates the files after the saved state. Fails if any file failed to migrate.
+func (mm *mediaMigration) run() error {
+	after := mm.loadState()
+	if after != "" {
+		log.Println("Media migration: resuming after", after)
+	}
+	mm.total = countFiles(after)
+	log.Printf("Media migration: %d files to migrate with %d workers", mm.total, mm.workers)
+
+	// The queue is bounded so the file records are read only as fast as the files are migrated.
+	jobs := make(chan migrateJob, mm.workers*migrateQueuePerWorker)
+	results := make(chan migrateResult, mm.workers)
+	var wg sync.WaitGroup
+	for range mm.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				size, err := mm.migrateWithRetry(&job.fdef)
+				results <- migrateResult{seq: job.seq, id: job.fdef.Id, size: size, err: err}
+			}
+		}()
+	}
+	go func() {
+		mm.queue(after, jobs)
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	// Files complete out of order. The state is the last file such that all files before it are done,
+	// and it's saved only until the first failure so the failed files are retried on resume.
+	saveState := true
+	done := make(map[int]migrateResult)
+	next := 0
+	for res := range results {
+		switch res.err {
+		case nil:
+			mm.migrated++
+			mm.bytes += res.size
+		case types.ErrNotFound:
+			// Missing in the source. If the migration is repeated, the file is already moved.
+			log.Println("Media migration: not found in source, skipped", res.id)
+			mm.skipped++
+		default:
+			log.Println("Media migration: failed", res.id, res.err)
+			mm.failed++
+		}
+
+		done[res.seq] = res
+		checkpoint := ""
+		for {
+			prev, ok := done[next]
+			if !ok {
+				break
+			}
+			delete(done, next)
+			next++
+			if prev.err != nil && prev.err != types.ErrNotFound {
+				saveState = false
+			}
+			if saveState {
+				checkpoint = prev.id
+			}
+		}
+		if checkpoint != "" {
+			mm.saveState(checkpoint)
+		}
+
+		if total := mm.migrated + mm.skipped + mm.failed; total%migrateReportEvery == 0 {
+			mm.report(start)
+		}
+	}
+
+	mm.report(start)
+	if mm.failed > 0 {
+		return errors.New("some files failed to migrate; fix the problem and run again to retry")
+	}
+	return nil
+}
+
+// queue reads the file records after the given ID and queues them for migration at the configured rate.
+func (mm *mediaMigration) queue(after string, jobs chan<- migrateJob) {
+	var throttle <-chan time.Time
+	if mm.rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(mm.rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	seq := 0
+	for {
+		fdefs, err := store.Files.List(after, migrateBatchSize)
+		if err != nil {
+			log.Fatalln("Media migration: failed to read file records:", err)
+		}
+		if len(fdefs) == 0 {
+			return
+		}
+		for i := range fdefs {
+			if throttle != nil {
+				<-throttle
+			}
+			jobs <- migrateJob{seq: seq, fdef: fdefs[i]}
+			seq++
+		}
+		after = fdefs[len(fdefs)-1].Id
+	}
+}
+
+// countFiles returns the number of completed uploads with IDs greater than 'after'.
+func countFiles(after string) int {
+	count := 0
+	for {
+		fdefs, err := store.Files.List(after, migrateBatchSize)
+		if err != nil {
+			log.Fatalln("Media migration: failed to read file records:", err)
+		}
+		if len(fdefs) == 0 {
+			return count
+		}
+		count += len(fdefs)
+		after = fdefs[len(fdefs)-1].Id
+	}
+}
+
+// migrateWithRetry migrates the file retrying failures with increasing delays. Files missing
+// in the source are not retried.
+func (mm *mediaMigration) migrateWithRetry(fdef *types.FileDef) (int64, error) {
+	delay := mm.retryDelay
+	for attempt := 0; ; attempt++ {
+		size, err := mm.migrate(fdef)
+		if err == nil || err == types.ErrNotFound || attempt >= mm.retries {
+			return size, err
+		}
+		log.Println("Media migration: failed, retrying", fdef.Id, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// migrate copies one file to the destination, updates the file record and verifies the copy.
+// Returns the number of copied bytes.
+func (mm *mediaMigration) migrate(fdef *types.FileDef) (int64, error) {
+	_, reader, err := mm.src.Download(fdef.Id)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	// Same file ID and metadata, new location.
+	moved := *fdef
+	moved.Location = ""
+	moved.ETag = ""
+	if _, _, err = mm.dst.Upload(&moved, reader); err != nil {
+		return 0, err
+	}
+
+	// Hash the source now that the upload has finished reading it.
+	if _, err = reader.Seek(0, io.SeekStart); err != nil {
+		mm.dst.Delete([]string{moved.Location})
+		return 0, err
+	}
+	srcSum, srcSize, err := digest(reader)
+	if err != nil {
+		mm.dst.Delete([]string{moved.Location})
+		return 0, err
+	}
+	if fdef.Size > 0 && srcSize != fdef.Size {
+		mm.dst.Delete([]string{moved.Location})
+		return 0, errors.New("source size does not match the file record")
+	}
+
+	if _, err = store.Files.FinishUpload(&moved, true, srcSize); err != nil {
+		mm.dst.Delete([]string{moved.Location})
+		return 0, err
+	}
+
+	if err = mm.verify(&moved, srcSum, srcSize); err != nil {
+		// Point the record back to the source copy.
+		orig := *fdef
+		if _, rerr := store.Files.FinishUpload(&orig, true, fdef.Size); rerr != nil {
+			log.Println("Media migration: failed to restore file record", fdef.Id, rerr)
+		}
+		mm.dst.Delete([]string{moved.Location})
+		return 0, err
+	}
+
+	return srcSize, nil
+}
+
+// verify reads the file back through the destination handler: the size, content and ETag must match.
+func (mm *mediaMigration) verify(moved *types.FileDef, sum []byte, size int64) error {
+	got, reader, err := mm.dst.Download(moved.Id)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if got.Location != moved.Location || got.ETag != moved.ETag {
+		return errors.New("file record not updated")
+	}
+	dstSum, dstSize, err := digest(reader)
+	if err != nil {
+		return err
+	}
+	if dstSize != size {
+		return errors.New("size mismatch after copying")
+	}
+	if !bytes.Equal(dstSum, sum) {
+		return errors.New("content mismatch after copying")
+	}
+	return nil
+}
+
+// report logs the progress of the migration, the throughput and the estimate of the remaining time.
+func (mm *mediaMigration) report(start time.Time) {
+	elapsed := time.Since(start)
+	processed := mm.migrated + mm.skipped + mm.failed
+	var filesPerSec, bytesPerSec float64
+	if secs := elapsed.Seconds(); secs > 0 {
+		filesPerSec = float64(processed) / secs
+		bytesPerSec = float64(mm.bytes) / secs
+	}
+	eta := migrateETA(mm.total, processed, elapsed)
+	log.Printf("Media migration: %d of %d processed, %d migrated (%d bytes), %d skipped, %d failed in %s; "+
+		"%.1f files/s, %.0f bytes/s, ETA %s", processed, mm.total, mm.migrated, mm.bytes, mm.skipped, mm.failed,
+		elapsed.Round(time.Second), filesPerSec, bytesPerSec, eta)
+}
+
+// migrateETA estimates the time to process the rest of the files at the throughput so far.
+func migrateETA(total, processed int, elapsed time.Duration) string {
+	if processed <= 0 || elapsed <= 0 {
+		return "unknown"
+	}
+	// Files uploaded since the migration started are not counted.
+	remaining := max(total-processed, 0)
+	return time.Duration(float64(remaining) * float64(elapsed) / float64(processed)).Round(time.Second).String()
+}
+
+func (mm *mediaMigration) loadState() string {
+	if mm.stateFile == "" {
+		return ""
+	}
+	data, err := os.ReadFile(mm.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ""
+		}
+		log.Fatalln("Media migration: failed to read state file:", err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (mm *mediaMigration) saveState(after string) {
+	if mm.stateFile == "" {
+		return
+	}
+	if err := os.WriteFile(mm.stateFile, []byte(after), 0644); err != nil {
+		log.Fatalln("Media migration: failed to save state file:", err)
+	}
+}
+
+// digest returns SHA-256 of the stream and its length.
+func digest(r io.Reader) ([]byte, int64, error) {
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hasher.Sum(nil), size, nil
+}
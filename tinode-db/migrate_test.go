@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// memHandler is a media handler which keeps files in memory by file ID.
+type memHandler struct {
+	prefix string
+
+	mu      sync.Mutex
+	files   map[string][]byte
+	records map[string]types.FileDef
+	// Number of following downloads of the file to fail.
+	failures map[string]int
+	// Downloads of the file wait until the channel is closed.
+	block map[string]chan struct{}
+	// Number of downloads by file ID.
+	downloads map[string]int
+	// Number of downloads in progress and the most seen at once.
+	active, maxActive int
+	// Delay of downloads.
+	delay time.Duration
+	// Called after the file is uploaded.
+	uploaded func(id string)
+}
+
+func newMemHandler(prefix string) *memHandler {
+	return &memHandler{
+		prefix:    prefix,
+		files:     map[string][]byte{},
+		records:   map[string]types.FileDef{},
+		failures:  map[string]int{},
+		block:     map[string]chan struct{}{},
+		downloads: map[string]int{},
+	}
+}
+
+func (mh *memHandler) Init(jsconf string) error {
+	return nil
+}
+
+func (mh *memHandler) Headers(method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
+	return nil, 0, nil
+}
+
+func (mh *memHandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", 0, err
+	}
+	fdef.Location = mh.prefix + fdef.Id
+	fdef.ETag = "etag-" + fdef.Id
+	mh.mu.Lock()
+	mh.files[fdef.Id] = data
+	mh.records[fdef.Id] = *fdef
+	uploaded := mh.uploaded
+	mh.mu.Unlock()
+	if uploaded != nil {
+		uploaded(fdef.Id)
+	}
+	return "/v0/file/s/" + fdef.Id, int64(len(data)), nil
+}
+
+func (mh *memHandler) Download(id string) (*types.FileDef, media.ReadSeekCloser, error) {
+	mh.mu.Lock()
+	mh.downloads[id]++
+	mh.active++
+	mh.maxActive = max(mh.maxActive, mh.active)
+	block := mh.block[id]
+	mh.mu.Unlock()
+	defer func() {
+		mh.mu.Lock()
+		mh.active--
+		mh.mu.Unlock()
+	}()
+
+	if block != nil {
+		<-block
+	}
+	time.Sleep(mh.delay)
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	if mh.failures[id] != 0 {
+		mh.failures[id]--
+		return nil, nil, errors.New("connection reset")
+	}
+	data, ok := mh.files[id]
+	if !ok {
+		return nil, nil, types.ErrNotFound
+	}
+	fdef := mh.records[id]
+	return &fdef, memReader{bytes.NewReader(data)}, nil
+}
+
+func (mh *memHandler) Delete(locations []string) error {
+	return nil
+}
+
+func (mh *memHandler) GetIdFromUrl(url string) types.Uid {
+	return types.ZeroUid
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error {
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	logs.Init(io.Discard, "stdFlags")
+	os.Exit(m.Run())
+}
+
+// newTestMigration returns the migration of n files from the source to the destination. The records
+// of the files are served by the mock store.
+func newTestMigration(t *testing.T, n, workers, retries int) (*mediaMigration, *memHandler, *memHandler, []string) {
+	ctrl := gomock.NewController(t)
+	files := mock_store.NewMockFilePersistenceInterface(ctrl)
+	saved := store.Files
+	store.Files = files
+	t.Cleanup(func() { store.Files = saved })
+
+	src, dst := newMemHandler("src/"), newMemHandler("dst/")
+	var records []types.FileDef
+	var ids []string
+	for i := range n {
+		fdef := types.FileDef{ObjHeader: types.ObjHeader{Id: types.Uid(1000 + i).String()}, Size: 4}
+		fdef.Location = "src/" + fdef.Id
+		src.files[fdef.Id] = []byte("data")
+		src.records[fdef.Id] = fdef
+		records = append(records, fdef)
+		ids = append(ids, fdef.Id)
+	}
+	files.EXPECT().List(gomock.Any(), migrateBatchSize).DoAndReturn(func(after string, limit int) ([]types.FileDef, error) {
+		start := slices.IndexFunc(records, func(fdef types.FileDef) bool { return fdef.Id == after }) + 1
+		return records[start:min(start+limit, len(records))], nil
+	}).AnyTimes()
+	files.EXPECT().FinishUpload(gomock.Any(), true, gomock.Any()).DoAndReturn(
+		func(fdef *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+			return fdef, nil
+		}).AnyTimes()
+
+	mm := &mediaMigration{
+		src:        src,
+		dst:        dst,
+		stateFile:  filepath.Join(t.TempDir(), "state"),
+		workers:    workers,
+		retries:    retries,
+		retryDelay: time.Millisecond,
+	}
+	return mm, src, dst, ids
+}
+
+func TestMigrateCheckpoint(t *testing.T) {
+	mm, src, dst, ids := newTestMigration(t, 5, 3, 0)
+
+	// The second file fails after all later files succeeded.
+	release := make(chan struct{})
+	src.block[ids[1]] = release
+	src.failures[ids[1]] = 1
+	dst.uploaded = func(id string) {
+		if id == ids[len(ids)-1] {
+			close(release)
+		}
+	}
+
+	if err := mm.run(); err == nil {
+		t.Fatal("Expected failure of the migration")
+	}
+	if mm.migrated != 4 || mm.failed != 1 {
+		t.Error("Unexpected totals", mm.migrated, mm.failed)
+	}
+	// The checkpoint stays before the failed file.
+	if state := mm.loadState(); state != ids[0] {
+		t.Errorf("Expected checkpoint %s, got %s", ids[0], state)
+	}
+
+	// Resumed from the checkpoint, the failed file is migrated.
+	mm.migrated, mm.failed = 0, 0
+	dst.uploaded = nil
+	if err := mm.run(); err != nil {
+		t.Fatal("Resumed migration failed:", err)
+	}
+	if mm.migrated != len(ids)-1 || src.downloads[ids[0]] != 1 {
+		t.Error("Expected migration of the files after the checkpoint", mm.migrated, src.downloads[ids[0]])
+	}
+	if state := mm.loadState(); state != ids[len(ids)-1] {
+		t.Errorf("Expected checkpoint %s, got %s", ids[len(ids)-1], state)
+	}
+}
+
+func TestMigrateRetry(t *testing.T) {
+	mm, src, dst, ids := newTestMigration(t, 3, 1, 2)
+
+	// Transient failures are retried with backoff.
+	src.failures[ids[0]] = 2
+	// Files missing in the source are skipped without retries.
+	delete(src.files, ids[1])
+	// Out of attempts.
+	src.failures[ids[2]] = 3
+
+	if err := mm.run(); err == nil {
+		t.Fatal("Expected failure of the migration")
+	}
+	if mm.migrated != 1 || mm.skipped != 1 || mm.failed != 1 {
+		t.Error("Unexpected totals", mm.migrated, mm.skipped, mm.failed)
+	}
+	// Two retries of the failed files.
+	if src.downloads[ids[0]] != 3 || src.downloads[ids[1]] != 1 || src.downloads[ids[2]] != 3 {
+		t.Error("Unexpected attempts", src.downloads)
+	}
+	if _, ok := dst.files[ids[0]]; !ok {
+		t.Error("Retried file not migrated")
+	}
+	if state := mm.loadState(); state != ids[1] {
+		t.Errorf("Expected checkpoint %s, got %s", ids[1], state)
+	}
+}
+
+func TestMigrateWorkers(t *testing.T) {
+	mm, src, dst, ids := newTestMigration(t, 8, 4, 0)
+	src.delay = 20 * time.Millisecond
+
+	var uploads atomic.Int32
+	dst.uploaded = func(string) { uploads.Add(1) }
+	if err := mm.run(); err != nil {
+		t.Fatal("Migration failed:", err)
+	}
+	if int(uploads.Load()) != len(ids) || mm.migrated != len(ids) || mm.bytes != int64(4*len(ids)) {
+		t.Error("Not all files migrated", uploads.Load(), mm.migrated, mm.bytes)
+	}
+	if src.maxActive < 2 || src.maxActive > 4 {
+		t.Error("Expected files migrated concurrently by up to 4 workers, got", src.maxActive)
+	}
+	for _, id := range ids {
+		if rec := dst.records[id]; rec.Location != "dst/"+id {
+			t.Error("File record not moved", id, rec.Location)
+		}
+	}
+}
+
+func TestMigrateETA(t *testing.T) {
+	for _, tc := range []struct {
+		total, processed int
+		elapsed          time.Duration
+		expected         string
+	}{
+		{100, 25, 10 * time.Second, "30s"},
+		{100, 0, 10 * time.Second, "unknown"},
+		{100, 10, 0, "unknown"},
+		// Files uploaded since the migration started.
+		{10, 20, 5 * time.Second, "0s"},
+	} {
+		if eta := migrateETA(tc.total, tc.processed, tc.elapsed); eta != tc.expected {
+			t.Errorf("migrateETA(%d, %d, %s): expected %s, got %s", tc.total, tc.processed, tc.elapsed, tc.expected, eta)
+		}
+	}
+}